@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"os"
 	"time"
 
+	"github.com/levilutz/basiccoin/internal/blockfile"
 	"github.com/levilutz/basiccoin/internal/bus"
 	"github.com/levilutz/basiccoin/internal/chain"
 	"github.com/levilutz/basiccoin/internal/inv"
@@ -44,10 +47,45 @@ func main() {
 
 	// Make the event bus and shared inventory
 	msgBus := bus.NewBus()
-	inv := inv.NewInv(coreParams, flags.SaveDir)
+	inv := inv.NewInv(coreParams, flags.SaveDir, flags.StoreParams)
+
+	if flags.Command == "verify-db" {
+		verifyDb(inv, *flags.SaveDir, flags.Repair)
+		closeInv(inv)
+		return
+	}
 
 	// Create app components
-	chain := chain.NewChain(msgBus, inv, flags.Miners > 0, flags.SaveDir)
+	chain := chain.NewChain(
+		msgBus, inv, flags.Miners > 0, flags.SaveDir, flags.PruneDepth, flags.Indexes,
+		flags.MempoolParams,
+	)
+	if flags.LoadSnapshot != "" {
+		if err := chain.LoadSnapshot(flags.LoadSnapshot); err != nil {
+			panic(fmt.Sprintf("failed to load snapshot: %s", err))
+		}
+	}
+
+	// Run a command instead, if given
+	switch flags.Command {
+	case "export-blocks":
+		numBlocks, err := blockfile.Export(inv, chain.SavedHead(), flags.CommandPath)
+		if err != nil {
+			panic(fmt.Sprintf("failed to export blocks: %s", err))
+		}
+		fmt.Printf("exported %d blocks to %s\n", numBlocks, flags.CommandPath)
+		closeInv(inv)
+		return
+	case "import-blocks":
+		go chain.Loop()
+		numBlocks, err := blockfile.Import(msgBus, inv, flags.CommandPath)
+		if err != nil {
+			panic(fmt.Sprintf("failed to import blocks: %s", err))
+		}
+		fmt.Printf("imported %d blocks from %s\n", numBlocks, flags.CommandPath)
+		closeInv(inv)
+		return
+	}
 	peerFactory := peerfactory.NewPeerFactory(peerFactoryParams, msgBus, inv)
 	miners := make([]*miner.Miner, flags.Miners)
 	for i := 0; i < flags.Miners; i++ {
@@ -89,7 +127,46 @@ func main() {
 			})
 
 		case <-terminateSubCh.C:
+			closeInv(inv)
 			panic("terminated")
 		}
 	}
 }
+
+// Sync the inventory and mark it cleanly shut down, so it isn't checked for corruption when next
+// opened.
+func closeInv(inv *inv.Inv) {
+	if err := inv.Close(); err != nil {
+		fmt.Printf("failed to close inventory: %s\n", err)
+	}
+}
+
+// Verify the save dir's records and saved chain, and print any inconsistencies found.
+// If repairing, first quarantines corrupt records and clears interrupted writes, as on the first
+// start after a crash.
+func verifyDb(inv *inv.Inv, saveDir string, repair bool) {
+	if repair {
+		if quarantined, err := inv.Recover(); err != nil {
+			panic(fmt.Sprintf("failed to recover inventory: %s", err))
+		} else if quarantined > 0 {
+			fmt.Printf("quarantined %d corrupt inventory records\n", quarantined)
+		}
+	}
+	report, err := inv.VerifyRecords(repair)
+	if err == nil {
+		err = chain.VerifySaved(inv, saveDir, report, repair)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("failed to verify save dir: %s", err))
+	}
+	for _, problem := range report.Problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf(
+		"checked %d records, found %d problems, repaired %d\n",
+		report.Checked, len(report.Problems), report.Repaired,
+	)
+	if len(report.Problems) > report.Repaired {
+		os.Exit(1)
+	}
+}
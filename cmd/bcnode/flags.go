@@ -4,9 +4,14 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/levilutz/basiccoin/internal/chain"
+	"github.com/levilutz/basiccoin/internal/inv"
 	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/util"
 )
 
 type Flags struct {
@@ -21,6 +26,34 @@ type Flags struct {
 	HttpWalletEnabled bool
 	HttpAdminPw       string
 	SaveDir           *string
+	StoreParams       inv.StoreParams
+	PruneDepth        uint64
+	Indexes           chain.Indexes
+	MempoolParams     chain.MempoolParams
+	LoadSnapshot      string
+	Command           string
+	CommandPath       string
+	Repair            bool
+}
+
+// A command that runs against the save dir then exits, instead of running a node.
+type command struct {
+	HelpText  string
+	TakesPath bool
+}
+
+var commands = map[string]command{
+	"export-blocks": {
+		HelpText:  "Write the saved chain to a portable block file at the given path",
+		TakesPath: true,
+	},
+	"import-blocks": {
+		HelpText:  "Validate and save the chain from the block file at the given path",
+		TakesPath: true,
+	},
+	"verify-db": {
+		HelpText: "Check every saved record and replay the saved chain, reporting inconsistencies (see --repair)",
+	},
 }
 
 func ParseFlags() Flags {
@@ -37,8 +70,34 @@ func ParseFlags() Flags {
 	httpWallet := flag.Bool("http-wallet", false, "Whether to enable the wallet http server")
 	httpAdminPw := flag.String("admin-pw", "", "Password for the admin http endpoints")
 	saveDir := flag.String("save-dir", "", "Directory to save the chain")
+	storeBackend := flag.String("store", "files", "How to store the chain in the save dir (files, segments or kv)")
+	cacheMB := flag.Int64("cache-mb", 512, "Memory budget for caching the saved chain, in MB (0 for unlimited)")
+	mempoolMB := flag.Uint64("mempool-mb", 64, "Most memory for txs in the mempool, in MB of vSize (0 for unlimited)")
+	mempoolMaxChain := flag.Uint64("mempool-max-chain", 25, "Most txs in a chain of unconfirmed txs the mempool accepts (0 for unlimited)")
+	mempoolExpiry := flag.Duration("mempool-expiry", 14*24*time.Hour, "How long txs may wait in the mempool before being dropped (0 to keep them)")
+	loadSnapshot := flag.String("load-snapshot", "", "Utxo snapshot file to bootstrap a new save dir from, if trusted by the network")
+	repair := flag.Bool("repair", false, "Whether verify-db should repair the inconsistencies it finds")
+	indexPkhTxs := flag.Bool("index-pkh-txs", false, "Whether to index the tx history of each public key hash, for the wallet history endpoint")
+	indexUtxoSpenders := flag.Bool("index-utxo-spenders", false, "Whether to index the tx spending each utxo, for the wallet utxo spender endpoint")
+	prune := flag.Uint64("prune", 0, fmt.Sprintf("Delete block contents buried this deep, at least %d (0 to keep everything)", chain.MinPruneDepth))
 
-	flag.Parse()
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: bcnode [command] [flags] [path]\n\nCommands:\n")
+		names := util.MapKeys(commands)
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(out, "  %s\n    \t%s\n", name, commands[name].HelpText)
+		}
+		fmt.Fprintf(out, "\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	// An optional command comes before the flags
+	commandName, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		commandName, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args)
 
 	// Validate, convert types, fill in other defaults
 	var payoutPkhHash core.HashT
@@ -74,6 +133,41 @@ func ParseFlags() Flags {
 		saveDirReal = nil
 	}
 
+	if *loadSnapshot != "" && saveDirReal == nil {
+		panic("Must set save dir when loading a snapshot")
+	}
+	if *prune > 0 && saveDirReal == nil {
+		panic("Must set save dir when pruning")
+	} else if *prune > 0 && *prune < chain.MinPruneDepth {
+		panic(fmt.Sprintf("Prune depth must be at least %d", chain.MinPruneDepth))
+	}
+
+	storeBackendParsed, err := inv.ParseStoreBackend(*storeBackend)
+	if err != nil {
+		panic(err)
+	} else if *prune > 0 && storeBackendParsed == inv.StoreBackendSegments {
+		// Segments only tombstone deleted records, so pruning would never reclaim any space
+		panic("Can't prune with the segments store")
+	}
+
+	var commandPath string
+	if commandName != "" {
+		cmd, ok := commands[commandName]
+		if !ok {
+			panic(fmt.Sprintf("Unknown command: %s", commandName))
+		} else if saveDirReal == nil {
+			panic(fmt.Sprintf("Must set save dir to %s", commandName))
+		} else if cmd.TakesPath && flag.NArg() != 1 {
+			panic(fmt.Sprintf("Must give %s a single path after the flags", commandName))
+		} else if !cmd.TakesPath && flag.NArg() != 0 {
+			panic(fmt.Sprintf("Unexpected args to %s: %v", commandName, flag.Args()))
+		}
+		commandPath = flag.Arg(0)
+	}
+	if *repair && commandName != "verify-db" {
+		panic("Can only repair with verify-db")
+	}
+
 	return Flags{
 		Dev:               *dev,
 		Listen:            *listen,
@@ -86,5 +180,23 @@ func ParseFlags() Flags {
 		HttpWalletEnabled: *httpWallet,
 		HttpAdminPw:       *httpAdminPw,
 		SaveDir:           saveDirReal,
+		StoreParams: inv.StoreParams{
+			Backend:    storeBackendParsed,
+			CacheBytes: *cacheMB * 1024 * 1024,
+		},
+		PruneDepth: *prune,
+		Indexes: chain.Indexes{
+			PkhTxs:       *indexPkhTxs,
+			UtxoSpenders: *indexUtxoSpenders,
+		},
+		MempoolParams: chain.MempoolParams{
+			MaxVSize:       *mempoolMB * 1024 * 1024,
+			MaxAge:         *mempoolExpiry,
+			MaxChainLength: *mempoolMaxChain,
+		},
+		LoadSnapshot: *loadSnapshot,
+		Command:      commandName,
+		CommandPath:  commandPath,
+		Repair:       *repair,
 	}
 }
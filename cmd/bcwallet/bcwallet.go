@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -71,35 +72,20 @@ var commands = []Command{
 		ArgsUsage:      "(prefix)",
 		RequiresClient: false,
 		Handler: func(ctx *HandlerContext) error {
-			var kc KeyConfig
-			if len(ctx.Args) > 0 {
-				if len(ctx.Args[0]) >= 6 {
-					fmt.Println(yellowStr("longer prefixes take exponentially longer time to find"))
-				} // nb. we don't check that the given prefix only contains hex chars
-				for {
-					priv, err := core.NewEcdsa()
-					if err != nil {
-						return err
-					}
-					tryKc := NewKeyConfig(priv)
-					raw := tryKc.PublicKeyHash.Data()
-					pkhHex := make([]byte, 64)
-					hex.Encode(pkhHex, raw[:])
-					if bytes.HasPrefix(pkhHex, []byte(ctx.Args[0])) {
-						kc = tryKc
-						break
-					}
-				}
-			} else {
-				priv, err := core.NewEcdsa()
-				if err != nil {
-					return err
-				}
-				kc = NewKeyConfig(priv)
-			}
-			ctx.Config.AddKeys(kc)
-			fmt.Println(kc.PublicKeyHash)
-			return ctx.Config.Save()
+			return generateKey(ctx, func() (crypto.Signer, error) {
+				return core.NewEcdsa()
+			})
+		},
+	},
+	{
+		Name:           "generate-ed25519",
+		HelpText:       "Generate a new address to receive coin, using a smaller ed25519 key.",
+		ArgsUsage:      "(prefix)",
+		RequiresClient: false,
+		Handler: func(ctx *HandlerContext) error {
+			return generateKey(ctx, func() (crypto.Signer, error) {
+				return core.NewEd25519()
+			})
 		},
 	},
 	{
@@ -178,6 +164,55 @@ var commands = []Command{
 			return nil
 		},
 	},
+	{
+		Name:           "history",
+		HelpText:       "Get the most recent txs crediting or debiting our public key hashes, or given public key hashes.",
+		ArgsUsage:      "(publicKeyHash...)",
+		RequiredArgs:   0,
+		RequiresClient: true,
+		Handler: func(ctx *HandlerContext) error {
+			var pkhs []core.HashT
+			if len(ctx.Args) > 0 {
+				var err error
+				pkhs, err = core.UnmarshalHashTSlice(ctx.Args)
+				if err != nil {
+					return err
+				}
+			} else {
+				pkhs = ctx.Config.GetPublicKeyHashes()
+			}
+			if len(pkhs) == 0 {
+				return fmt.Errorf("no publicKeyHashes in wallet - run 'bcwallet generate'")
+			}
+			for _, pkh := range pkhs {
+				// Get the total first, to fetch the newest page
+				_, total, err := ctx.Client.GetPkhTxs(pkh, 0, 0)
+				if err != nil {
+					return err
+				}
+				offset := uint64(0)
+				if total > historyLength {
+					offset = total - historyLength
+				}
+				txIds, total, err := ctx.Client.GetPkhTxs(pkh, offset, historyLength)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s:\t%d txs\n", greenStr(fmt.Sprint(pkh)), total)
+				if len(txIds) == 0 {
+					continue
+				}
+				confirms, err := ctx.Client.GetTxConfirms(txIds)
+				if err != nil {
+					return err
+				}
+				for _, txId := range util.Reverse(txIds) {
+					fmt.Printf("\t%s\t%d\n", txId, confirms[txId])
+				}
+			}
+			return nil
+		},
+	},
 	{
 		Name:           "send",
 		HelpText:       "Send coin to given public key hashes, given as 'pkh:amount' pairs.",
@@ -298,9 +333,129 @@ var commands = []Command{
 			return nil
 		},
 	},
+	{
+		Name:           "bump-fee",
+		HelpText:       "Replace an unconfirmed tx with one paying a higher fee rate from its change.",
+		ArgsUsage:      "[txId] (feeRate)",
+		RequiredArgs:   1,
+		RequiresClient: true,
+		Handler: func(ctx *HandlerContext) error {
+			// Parse input
+			txId, err := core.NewHashTFromString(ctx.Args[0])
+			if err != nil {
+				return err
+			}
+
+			// Get the tx, and check it's unconfirmed
+			txs, err := ctx.Client.GetTx([]core.HashT{txId})
+			if err != nil {
+				return err
+			}
+			tx, ok := txs[txId]
+			if !ok {
+				return fmt.Errorf("tx not known")
+			}
+			id := tx.Id(ctx.Config.CoreParams())
+			confirms, err := ctx.Client.GetTxConfirms([]core.HashT{id})
+			if err != nil {
+				return err
+			} else if confirms[id] > 0 {
+				return fmt.Errorf("tx already confirmed")
+			}
+
+			// Default to the least fee rate nodes accept as a replacement
+			feeRate := tx.Rate() + core.IncrementalRelayRate
+			if len(ctx.Args) > 1 {
+				feeRate, err = strconv.ParseFloat(ctx.Args[1], 64)
+				if err != nil {
+					return err
+				}
+			}
+
+			// Make tx
+			bumped, err := core.MakeBumpFeeTx(ctx.Config.GetPrivateKeys(), tx, feeRate)
+			if err != nil {
+				return err
+			}
+
+			// Ask user for confirmation on the fee
+			oldFee := tx.InputsValue() - tx.OutputsValue()
+			fee := bumped.InputsValue() - bumped.OutputsValue()
+			fmt.Printf("fees: %d -> %d\n", oldFee, fee)
+			fmt.Printf("fee rate: %.3f -> %.3f\n", tx.Rate(), bumped.Rate())
+			if inp := ReadInput("confirm? (y/n): "); inp != "y" && inp != "Y" {
+				return fmt.Errorf("tx cancelled")
+			}
+
+			// Send tx
+			resp, err := ctx.Client.PostTx(*bumped)
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(greenStr(resp.String()))
+			return nil
+		},
+	},
+	{
+		Name:           "anchor",
+		HelpText:       "Anchor the given hex-encoded data in an unspendable data output.",
+		ArgsUsage:      "[hex]",
+		RequiredArgs:   1,
+		RequiresClient: true,
+		Handler: func(ctx *HandlerContext) error {
+			// Parse input
+			data, err := hex.DecodeString(ctx.Args[0])
+			if err != nil {
+				return err
+			}
+
+			// Get current head height / min block
+			minBlock, err := ctx.Client.GetHeadHeight()
+			if err != nil {
+				return err
+			}
+
+			// Get utxo balances
+			utxos, err := ctx.Client.GetManyUtxos(ctx.Config.GetPublicKeyHashes(), true)
+			if err != nil {
+				return err
+			}
+
+			// Make tx
+			tx, err := core.MakeAnchorTx(
+				ctx.Config.CoreParams(),
+				ctx.Config.GetPrivateKeys(),
+				utxos,
+				data,
+				float64(1.0),
+				minBlock,
+			)
+			if err != nil {
+				return err
+			}
+
+			// Ask user for confirmation on the fee
+			fee := tx.InputsValue() - tx.OutputsValue()
+			fmt.Printf("data: %d bytes\n", len(data))
+			fmt.Printf("fees: %d\n", fee)
+			if inp := ReadInput("confirm? (y/n): "); inp != "y" && inp != "Y" {
+				return fmt.Errorf("tx cancelled")
+			}
+
+			// Send tx
+			resp, err := ctx.Client.PostTx(*tx)
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(greenStr(resp.String()))
+			return nil
+		},
+	},
 	{
 		Name:           "tx-confirms",
-		HelpText:       "Get the number of confirmations for given tx ids.",
+		HelpText:       "Get the number of confirmations for given tx ids, or why they were dropped from the mempool.",
 		ArgsUsage:      "(txId...)",
 		RequiredArgs:   1,
 		RequiresClient: true,
@@ -313,6 +468,10 @@ var commands = []Command{
 			if err != nil {
 				return err
 			}
+			dropped, err := ctx.Client.GetTxDropped(txIds)
+			if err != nil {
+				return err
+			}
 			knownTxIds := util.MapKeys(confirms)
 			sort.Slice(knownTxIds, func(i, j int) bool {
 				// descending
@@ -320,7 +479,9 @@ var commands = []Command{
 			})
 			for _, txId := range knownTxIds {
 				numStr := ""
-				if confirms[txId] == 0 {
+				if reason, ok := dropped[txId]; ok && confirms[txId] == 0 {
+					numStr = redStr("dropped: " + reason)
+				} else if confirms[txId] == 0 {
 					numStr = yellowStr("0")
 				} else {
 					numStr = greenStr(fmt.Sprintf("%d", confirms[txId]))
@@ -395,6 +556,38 @@ var commands = []Command{
 			return nil
 		},
 	},
+	{
+		Name:           "get-tx-data",
+		HelpText:       "Get the anchored data outputs of the given txs.",
+		ArgsUsage:      "(txId...)",
+		RequiredArgs:   1,
+		RequiresClient: true,
+		Handler: func(ctx *HandlerContext) error {
+			txIds, err := core.UnmarshalHashTSlice(ctx.Args)
+			if err != nil {
+				return err
+			}
+			txData, err := ctx.Client.GetTxData(txIds)
+			if err != nil {
+				return err
+			}
+			for txId, outputs := range txData {
+				fmt.Printf("%s:\n", greenStr(fmt.Sprint(txId)))
+				inds := util.MapKeys(outputs)
+				sort.Slice(inds, func(i, j int) bool { return inds[i] < inds[j] })
+				for _, ind := range inds {
+					fmt.Printf("\t[%d]\t%x\n", ind, outputs[ind])
+				}
+			}
+			for _, txId := range txIds {
+				if _, ok := txData[txId]; !ok {
+					uhOh := redStr("not known")
+					fmt.Printf("%s\t%s\n", txId, uhOh)
+				}
+			}
+			return nil
+		},
+	},
 	{
 		Name:           "get-merkle",
 		HelpText:       "Get the data for the given merkles.",
@@ -491,10 +684,46 @@ var commands = []Command{
 	},
 }
 
+// How many of the most recent txs of each pkh the history command shows.
+const historyLength = 20
+
 func main() {
 	Execute(commands)
 }
 
+// Generate a new key with the given generator, optionally with a pkh prefix, and save it.
+func generateKey(ctx *HandlerContext, newKey func() (crypto.Signer, error)) error {
+	var kc KeyConfig
+	if len(ctx.Args) > 0 {
+		if len(ctx.Args[0]) >= 6 {
+			fmt.Println(yellowStr("longer prefixes take exponentially longer time to find"))
+		} // nb. we don't check that the given prefix only contains hex chars
+		for {
+			priv, err := newKey()
+			if err != nil {
+				return err
+			}
+			tryKc := NewKeyConfig(priv)
+			raw := tryKc.PublicKeyHash.Data()
+			pkhHex := make([]byte, 64)
+			hex.Encode(pkhHex, raw[:])
+			if bytes.HasPrefix(pkhHex, []byte(ctx.Args[0])) {
+				kc = tryKc
+				break
+			}
+		}
+	} else {
+		priv, err := newKey()
+		if err != nil {
+			return err
+		}
+		kc = NewKeyConfig(priv)
+	}
+	ctx.Config.AddKeys(kc)
+	fmt.Println(kc.PublicKeyHash)
+	return ctx.Config.Save()
+}
+
 // Read a line from stdin, given prompt.
 func ReadInput(prompt string) string {
 	reader := bufio.NewReader(os.Stdin)
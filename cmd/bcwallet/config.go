@@ -1,7 +1,7 @@
 package main
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -12,17 +12,18 @@ import (
 )
 
 type KeyConfigJSON struct {
-	PublicKeyHash core.HashT `json:"publicKeyHash"`
-	PrivateKey    []byte     `json:"privateKey"`
+	PublicKeyHash core.HashT   `json:"publicKeyHash"`
+	PrivateKey    []byte       `json:"privateKey"`
+	KeyType       core.KeyType `json:"keyType,omitempty"`
 }
 
 type KeyConfig struct {
 	PublicKeyHash core.HashT
-	PrivateKey    *ecdsa.PrivateKey
+	PrivateKey    crypto.Signer
 }
 
-func NewKeyConfig(priv *ecdsa.PrivateKey) KeyConfig {
-	pubBytes, err := core.MarshalEcdsaPublic(priv)
+func NewKeyConfig(priv crypto.Signer) KeyConfig {
+	pubBytes, err := core.MarshalPublic(priv)
 	if err != nil {
 		panic(err)
 	}
@@ -33,13 +34,18 @@ func NewKeyConfig(priv *ecdsa.PrivateKey) KeyConfig {
 }
 
 func (kc KeyConfig) MarshalJSON() ([]byte, error) {
-	privateBytes, err := core.MarshalEcdsaPrivate(kc.PrivateKey)
+	keyType, err := core.KeyTypeOf(kc.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	privateBytes, err := core.MarshalPrivate(kc.PrivateKey)
 	if err != nil {
 		return nil, err
 	}
 	return json.MarshalIndent(KeyConfigJSON{
 		PublicKeyHash: kc.PublicKeyHash,
 		PrivateKey:    privateBytes,
+		KeyType:       keyType,
 	}, "", "    ")
 }
 
@@ -48,7 +54,7 @@ func (kc *KeyConfig) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &v); err != nil {
 		return err
 	}
-	priv, err := core.ParseECDSAPrivate(v.PrivateKey)
+	priv, err := core.ParsePrivate(v.KeyType, v.PrivateKey)
 	if err != nil {
 		return err
 	}
@@ -58,7 +64,7 @@ func (kc *KeyConfig) UnmarshalJSON(data []byte) error {
 }
 
 func (kc *KeyConfig) Verify() error {
-	pub, err := core.MarshalEcdsaPublic(kc.PrivateKey)
+	pub, err := core.MarshalPublic(kc.PrivateKey)
 	if err != nil {
 		return err
 	}
@@ -123,15 +129,15 @@ func (c *Config) GetPublicKeyHashes() []core.HashT {
 	return out
 }
 
-func (c *Config) GetPrivateKeys() []*ecdsa.PrivateKey {
-	out := make([]*ecdsa.PrivateKey, len(c.Keys))
+func (c *Config) GetPrivateKeys() []crypto.Signer {
+	out := make([]crypto.Signer, len(c.Keys))
 	for i, kc := range c.Keys {
 		out[i] = kc.PrivateKey
 	}
 	return out
 }
 
-func (c *Config) GetPrivateKey(publicKeyHash core.HashT) (*ecdsa.PrivateKey, error) {
+func (c *Config) GetPrivateKey(publicKeyHash core.HashT) (crypto.Signer, error) {
 	for _, kc := range c.Keys {
 		if kc.PublicKeyHash == publicKeyHash {
 			return kc.PrivateKey, nil
@@ -0,0 +1,182 @@
+package blockfile
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/levilutz/basiccoin/internal/bus"
+	"github.com/levilutz/basiccoin/internal/inv"
+	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/prot"
+	"github.com/levilutz/basiccoin/pkg/queue"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+// Identifies a block file, and the version of its format.
+const (
+	fileMagic   = "levilutz/basiccoin-blocks"
+	fileVersion = "v1"
+)
+
+// How many blocks to send the chain at once when importing.
+const importBatchSize = 64
+
+// Write our chain from height 1 to the given head into a block file, in the peer wire
+// encoding. Each block is preceded by its txs then its merkle nodes (children first), so
+// they can be stored in order on import. Returns the number of blocks written.
+func Export(inv inv.InvReader, head core.HashT, path string) (uint64, error) {
+	if head.EqZero() {
+		return 0, fmt.Errorf("no chain to export")
+	} else if inv.GetPrunedHeight() > 0 {
+		return 0, fmt.Errorf("cannot export chain pruned to height %d", inv.GetPrunedHeight())
+	}
+	// Write to a temp file first, so a failed export doesn't look like a short chain
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	conn := prot.NewStreamConn(nil, w)
+	conn.WriteString(fileMagic)
+	conn.WriteString(fileVersion)
+	blockIds := append(util.Reverse(inv.GetBlockAncestorsUntil(head, core.HashT{})), head)
+	for _, blockId := range blockIds {
+		merkleIds, txIds := getBlockContents(inv, blockId)
+		conn.WriteBool(true)
+		conn.WriteUint64(uint64(len(txIds)))
+		for _, txId := range txIds {
+			conn.WriteHashT(txId)
+			conn.WriteTx(inv.GetTx(txId))
+		}
+		conn.WriteUint64(uint64(len(merkleIds)))
+		for i := len(merkleIds) - 1; i >= 0; i-- {
+			conn.WriteHashT(merkleIds[i])
+			conn.WriteMerkle(inv.GetMerkle(merkleIds[i]))
+		}
+		conn.WriteHashT(blockId)
+		conn.WriteBlock(inv.GetBlock(blockId))
+		if conn.HasErr() {
+			return 0, conn.Err()
+		}
+	}
+	conn.WriteBool(false)
+	if conn.HasErr() {
+		return 0, conn.Err()
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	} else if err := f.Sync(); err != nil {
+		return 0, err
+	} else if err := os.Rename(tmpPath, path); err != nil {
+		return 0, err
+	}
+	return uint64(len(blockIds)), nil
+}
+
+// Import a block file through the chain, which must be running. Blocks are sent to the chain
+// in batches, each with only its own txs and merkle nodes, waiting for each batch to be
+// validated before reading the next. Blocks we already know are skipped.
+// Returns the number of blocks imported.
+func Import(msgBus *bus.Bus, inv inv.InvReader, path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	conn := prot.NewStreamConn(bufio.NewReader(f), nil)
+	conn.ReadStringExpected(fileMagic)
+	conn.ReadStringExpected(fileVersion)
+	if conn.HasErr() {
+		return 0, fmt.Errorf("not a block file: %s", conn.Err())
+	}
+	imported := uint64(0)
+	blocks := make([]core.Block, 0, importBatchSize)
+	merkles := make([]core.MerkleNode, 0)
+	txs := make([]core.Tx, 0)
+	for conn.ReadBool() {
+		blockTxs := make([]core.Tx, 0)
+		for i, numTxs := uint64(0), conn.ReadUint64(); i < numTxs && !conn.HasErr(); i++ {
+			blockTxs = append(blockTxs, conn.ReadTx(conn.ReadHashT()))
+		}
+		blockMerkles := make([]core.MerkleNode, 0)
+		for i, numMerkles := uint64(0), conn.ReadUint64(); i < numMerkles && !conn.HasErr(); i++ {
+			blockMerkles = append(blockMerkles, conn.ReadMerkle(conn.ReadHashT()))
+		}
+		block := conn.ReadBlock(conn.ReadHashT())
+		if conn.HasErr() {
+			return imported, fmt.Errorf("failed to read block file: %s", conn.Err())
+		} else if inv.HasBlock(block.Hash()) {
+			continue
+		}
+		blocks = append(blocks, block)
+		merkles = append(merkles, blockMerkles...)
+		txs = append(txs, blockTxs...)
+		if len(blocks) < importBatchSize {
+			continue
+		}
+		if err := submitBatch(msgBus, blocks, merkles, txs); err != nil {
+			return imported, err
+		}
+		imported += uint64(len(blocks))
+		fmt.Printf("imported to height %d\n", inv.GetBlockHeight(block.Hash()))
+		blocks = make([]core.Block, 0, importBatchSize)
+		merkles = make([]core.MerkleNode, 0)
+		txs = make([]core.Tx, 0)
+	}
+	if conn.HasErr() {
+		return imported, fmt.Errorf("failed to read block file: %s", conn.Err())
+	}
+	if len(blocks) > 0 {
+		if err := submitBatch(msgBus, blocks, merkles, txs); err != nil {
+			return imported, err
+		}
+		imported += uint64(len(blocks))
+	}
+	return imported, nil
+}
+
+// Send a batch of blocks, oldest first, and their contents to the chain, and wait until it's
+// validated the last as our new head.
+func submitBatch(
+	msgBus *bus.Bus, blocks []core.Block, merkles []core.MerkleNode, txs []core.Tx,
+) error {
+	ret := make(chan error)
+	head := blocks[len(blocks)-1].Hash()
+	msgBus.CandidateHead.Pub(bus.CandidateHeadEvent{
+		Ret:                    ret,
+		Head:                   head,
+		Blocks:                 blocks,
+		Merkles:                merkles,
+		Txs:                    txs,
+		AutoAddMempoolInsecure: false,
+	})
+	if err := <-ret; err != nil {
+		return fmt.Errorf("chain rejected blocks up to %s: %s", head, err)
+	}
+	return nil
+}
+
+// Get the ids of the merkle nodes (parents first) and txs under a block.
+func getBlockContents(inv inv.InvReader, blockId core.HashT) ([]core.HashT, []core.HashT) {
+	merkleIds := make([]core.HashT, 0)
+	txIds := make([]core.HashT, 0)
+	idQueue := queue.NewQueue(inv.GetBlock(blockId).MerkleRoot)
+	for idQueue.Size() > 0 {
+		nextId, _ := idQueue.Pop()
+		if inv.HasTx(nextId) {
+			txIds = append(txIds, nextId)
+		} else {
+			merkleIds = append(merkleIds, nextId)
+			merkle := inv.GetMerkle(nextId)
+			idQueue.Push(merkle.LChild)
+			if merkle.RChild != merkle.LChild {
+				idQueue.Push(merkle.RChild)
+			}
+		}
+	}
+	return merkleIds, txIds
+}
@@ -5,54 +5,74 @@ import "github.com/levilutz/basiccoin/pkg/topic"
 // The set of pub sub topics any component needs.
 type Bus struct {
 	// Events
-	CandidateHead      *topic.Topic[CandidateHeadEvent]
-	CandidateTx        *topic.Topic[CandidateTxEvent]
-	MinerTarget        *topic.Topic[MinerTargetEvent]
-	PeerAnnouncedAddr  *topic.Topic[PeerAnnouncedAddrEvent]
-	PeerClosing        *topic.Topic[PeerClosingEvent]
-	PeersReceived      *topic.Topic[PeersReceivedEvent]
-	PeersRequested     *topic.Topic[PeersRequestedEvent]
-	PrintUpdate        *topic.Topic[PrintUpdateEvent]
-	SendPeers          *topic.Topic[SendPeersEvent]
-	ShouldAnnounceAddr *topic.Topic[ShouldAnnounceAddrEvent]
-	ShouldRequestPeers *topic.Topic[ShouldRequestPeersEvent]
-	ValidatedHead      *topic.Topic[ValidatedHeadEvent]
-	ValidatedTx        *topic.Topic[ValidatedTxEvent]
+	BlockContents              *topic.Topic[BlockContentsEvent]
+	CandidateHead              *topic.Topic[CandidateHeadEvent]
+	CandidatePackage           *topic.Topic[CandidatePackageEvent]
+	CandidateTx                *topic.Topic[CandidateTxEvent]
+	DroppedTxs                 *topic.Topic[DroppedTxsEvent]
+	MinerTarget                *topic.Topic[MinerTargetEvent]
+	PeerAnnouncedAddr          *topic.Topic[PeerAnnouncedAddrEvent]
+	PeerClosing                *topic.Topic[PeerClosingEvent]
+	PeersReceived              *topic.Topic[PeersReceivedEvent]
+	PeersRequested             *topic.Topic[PeersRequestedEvent]
+	PrintUpdate                *topic.Topic[PrintUpdateEvent]
+	SendPeers                  *topic.Topic[SendPeersEvent]
+	ShouldAnnounceAddr         *topic.Topic[ShouldAnnounceAddrEvent]
+	ShouldRequestBlockContents *topic.Topic[ShouldRequestBlockContentsEvent]
+	ShouldRequestPeers         *topic.Topic[ShouldRequestPeersEvent]
+	ValidatedHead              *topic.Topic[ValidatedHeadEvent]
+	ValidatedTx                *topic.Topic[ValidatedTxEvent]
 	// Commands
 	Terminate *topic.Topic[TerminateCommand]
 	// Queries
-	HeadHeight      *topic.Topic[HeadHeightQuery]
-	PkhBalance      *topic.Topic[PkhBalanceQuery]
-	PkhUtxos        *topic.Topic[PkhUtxosQuery]
-	RichList        *topic.Topic[RichListQuery]
-	TxConfirms      *topic.Topic[TxConfirmsQuery]
-	TxIncludedBlock *topic.Topic[TxIncludedBlockQuery]
+	BlockIdsByHeight *topic.Topic[BlockIdsByHeightQuery]
+	BlockUtxoHash    *topic.Topic[BlockUtxoHashQuery]
+	HeadHeight       *topic.Topic[HeadHeightQuery]
+	MainChainRange   *topic.Topic[MainChainRangeQuery]
+	PkhBalance       *topic.Topic[PkhBalanceQuery]
+	PkhTxs           *topic.Topic[PkhTxsQuery]
+	PkhUtxos         *topic.Topic[PkhUtxosQuery]
+	RichList         *topic.Topic[RichListQuery]
+	TxConfirms       *topic.Topic[TxConfirmsQuery]
+	TxIncludedBlock  *topic.Topic[TxIncludedBlockQuery]
+	UtxoSnapshot     *topic.Topic[UtxoSnapshotQuery]
+	UtxoSpender      *topic.Topic[UtxoSpenderQuery]
 }
 
 func NewBus() *Bus {
 	return &Bus{
 		// Events
-		CandidateHead:      topic.NewTopic[CandidateHeadEvent](),
-		CandidateTx:        topic.NewTopic[CandidateTxEvent](),
-		MinerTarget:        topic.NewTopic[MinerTargetEvent](),
-		PeerAnnouncedAddr:  topic.NewTopic[PeerAnnouncedAddrEvent](),
-		PeerClosing:        topic.NewTopic[PeerClosingEvent](),
-		PeersReceived:      topic.NewTopic[PeersReceivedEvent](),
-		PeersRequested:     topic.NewTopic[PeersRequestedEvent](),
-		PrintUpdate:        topic.NewTopic[PrintUpdateEvent](),
-		SendPeers:          topic.NewTopic[SendPeersEvent](),
-		ShouldAnnounceAddr: topic.NewTopic[ShouldAnnounceAddrEvent](),
-		ShouldRequestPeers: topic.NewTopic[ShouldRequestPeersEvent](),
-		ValidatedHead:      topic.NewTopic[ValidatedHeadEvent](),
-		ValidatedTx:        topic.NewTopic[ValidatedTxEvent](),
+		BlockContents:              topic.NewTopic[BlockContentsEvent](),
+		CandidateHead:              topic.NewTopic[CandidateHeadEvent](),
+		CandidatePackage:           topic.NewTopic[CandidatePackageEvent](),
+		CandidateTx:                topic.NewTopic[CandidateTxEvent](),
+		DroppedTxs:                 topic.NewTopic[DroppedTxsEvent](),
+		MinerTarget:                topic.NewTopic[MinerTargetEvent](),
+		PeerAnnouncedAddr:          topic.NewTopic[PeerAnnouncedAddrEvent](),
+		PeerClosing:                topic.NewTopic[PeerClosingEvent](),
+		PeersReceived:              topic.NewTopic[PeersReceivedEvent](),
+		PeersRequested:             topic.NewTopic[PeersRequestedEvent](),
+		PrintUpdate:                topic.NewTopic[PrintUpdateEvent](),
+		SendPeers:                  topic.NewTopic[SendPeersEvent](),
+		ShouldAnnounceAddr:         topic.NewTopic[ShouldAnnounceAddrEvent](),
+		ShouldRequestBlockContents: topic.NewTopic[ShouldRequestBlockContentsEvent](),
+		ShouldRequestPeers:         topic.NewTopic[ShouldRequestPeersEvent](),
+		ValidatedHead:              topic.NewTopic[ValidatedHeadEvent](),
+		ValidatedTx:                topic.NewTopic[ValidatedTxEvent](),
 		// Commands
 		Terminate: topic.NewTopic[TerminateCommand](),
 		// Queries
-		HeadHeight:      topic.NewTopic[HeadHeightQuery](),
-		PkhBalance:      topic.NewTopic[PkhBalanceQuery](),
-		PkhUtxos:        topic.NewTopic[PkhUtxosQuery](),
-		RichList:        topic.NewTopic[RichListQuery](),
-		TxConfirms:      topic.NewTopic[TxConfirmsQuery](),
-		TxIncludedBlock: topic.NewTopic[TxIncludedBlockQuery](),
+		BlockIdsByHeight: topic.NewTopic[BlockIdsByHeightQuery](),
+		BlockUtxoHash:    topic.NewTopic[BlockUtxoHashQuery](),
+		HeadHeight:       topic.NewTopic[HeadHeightQuery](),
+		MainChainRange:   topic.NewTopic[MainChainRangeQuery](),
+		PkhBalance:       topic.NewTopic[PkhBalanceQuery](),
+		PkhTxs:           topic.NewTopic[PkhTxsQuery](),
+		PkhUtxos:         topic.NewTopic[PkhUtxosQuery](),
+		RichList:         topic.NewTopic[RichListQuery](),
+		TxConfirms:       topic.NewTopic[TxConfirmsQuery](),
+		TxIncludedBlock:  topic.NewTopic[TxIncludedBlockQuery](),
+		UtxoSnapshot:     topic.NewTopic[UtxoSnapshotQuery](),
+		UtxoSpender:      topic.NewTopic[UtxoSpenderQuery](),
 	}
 }
@@ -2,8 +2,18 @@ package bus
 
 import "github.com/levilutz/basiccoin/pkg/core"
 
+// A peer has sent us the contents of blocks we already have the headers of.
+// Published empty by the chain itself to continue working through history.
+type BlockContentsEvent struct {
+	PeerRuntimeId string
+	BlockIds      []core.HashT
+	Merkles       []core.MerkleNode
+	Txs           []core.Tx
+}
+
 // When we have a new potential head for the chain to validate.
 type CandidateHeadEvent struct {
+	Ret     chan error // May be nil if emitter doesn't care about success
 	Head    core.HashT
 	Blocks  []core.Block
 	Merkles []core.MerkleNode
@@ -14,12 +24,41 @@ type CandidateHeadEvent struct {
 	AutoAddMempoolInsecure bool
 }
 
+// When we have a package of related potential txs for the chain to validate together, so
+// children can pay for parents below the mempool's min fee rate. Each tx must come after the
+// txs whose outputs it spends.
+type CandidatePackageEvent struct {
+	Ret chan error // May be nil if emitter doesn't care about success
+	Txs []core.Tx
+}
+
 // When we have a new potential tx for the chain to validate.
 type CandidateTxEvent struct {
 	Ret chan error // May be nil if emitter doesn't care about success
 	Tx  core.Tx
 }
 
+// Why txs were dropped from the mempool.
+type DropReason string
+
+const (
+	// The mempool was full, and the txs paid the lowest fee rates
+	DropReasonEvicted DropReason = "evicted"
+	// The txs waited in the mempool too long without being mined
+	DropReasonExpired DropReason = "expired"
+	// The txs' inputs were spent by other txs, so they can never be mined
+	DropReasonUnspendable DropReason = "unspendable"
+	// A tx paying a higher fee spent the same inputs as the txs, or as their ancestors
+	DropReasonReplaced DropReason = "replaced"
+)
+
+// Txs have been dropped from the mempool without being included in our chain.
+// They stay stored, so can be resubmitted.
+type DroppedTxsEvent struct {
+	TxIds  []core.HashT
+	Reason DropReason
+}
+
 // Emitted alongside ValidatedHeatEvent, if miners are running.
 // Informs the miners of what set of Txs is most profitable to include now.
 type MinerTargetEvent struct {
@@ -67,6 +106,13 @@ type ShouldAnnounceAddrEvent struct {
 	Addr            string
 }
 
+// We should request the contents of the given blocks from the given peer id, or any peer
+// that has them if empty.
+type ShouldRequestBlockContentsEvent struct {
+	TargetRuntimeId string
+	BlockIds        []core.HashT
+}
+
 // We should request the given peer id for their peers.
 type ShouldRequestPeersEvent struct {
 	TargetRuntimeId string
@@ -2,6 +2,28 @@ package bus
 
 import "github.com/levilutz/basiccoin/pkg/core"
 
+// A query for the block of our chain at each given height.
+// Heights above our head aren't returned in the output map.
+type BlockIdsByHeightQuery struct {
+	Ret     chan map[uint64]core.HashT
+	Heights []uint64
+}
+
+// A query for the blocks of our chain from the given height upward, up to Limit of them.
+type MainChainRangeQuery struct {
+	Ret   chan []core.HashT
+	Start uint64
+	Limit uint64
+}
+
+// A query for the utxo set hash after each given block.
+// If any of the given blocks aren't on our chain, or their hash is unknown, they're not
+// returned in the output map.
+type BlockUtxoHashQuery struct {
+	Ret      chan map[core.HashT]core.HashT
+	BlockIds []core.HashT
+}
+
 // A query for the current height of the chain head.
 type HeadHeightQuery struct {
 	Ret chan uint64
@@ -13,6 +35,21 @@ type PkhBalanceQuery struct {
 	PublicKeyHashes []core.HashT
 }
 
+// A query for a page of the txs crediting or debiting a PublicKeyHash, in chain order.
+type PkhTxsQuery struct {
+	Ret           chan PkhTxsResult
+	PublicKeyHash core.HashT
+	Offset        uint64
+	Limit         uint64
+}
+
+// A page of tx ids (see core.Tx.Id) and the total number of txs, or why they couldn't be got.
+type PkhTxsResult struct {
+	TxIds []core.HashT
+	Total uint64
+	Err   error
+}
+
 // A query for the current utxos controlled by a PublicKeyHash.
 // Optionally, exclude utxos that are spent by any txs in the mempool.
 type PkhUtxosQuery struct {
@@ -39,3 +76,33 @@ type TxIncludedBlockQuery struct {
 	Ret   chan map[core.HashT]core.HashT
 	TxIds []core.HashT
 }
+
+// A query for the tx spending a utxo on our chain, and the mempool txs spending it.
+type UtxoSpenderQuery struct {
+	Ret  chan UtxoSpenderResult
+	Utxo core.Utxo
+}
+
+// The tx id (see core.Tx.Id) and block spending a utxo on our chain if Spent, and the ids of
+// the mempool txs spending it, or why they couldn't be got.
+type UtxoSpenderResult struct {
+	Spent        bool
+	TxId         core.HashT
+	BlockId      core.HashT
+	MempoolTxIds []core.HashT
+	Err          error
+}
+
+// A query for a snapshot of the utxo set and chain at the given block on our chain.
+// The zero block means our head.
+type UtxoSnapshotQuery struct {
+	Ret     chan UtxoSnapshotResult
+	BlockId core.HashT
+}
+
+// A serialized utxo snapshot and its hash, or why it couldn't be made.
+type UtxoSnapshotResult struct {
+	Snapshot []byte
+	Hash     core.HashT
+	Err      error
+}
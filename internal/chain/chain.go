@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/levilutz/basiccoin/internal/bus"
 	"github.com/levilutz/basiccoin/internal/inv"
 	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/queue"
+	"github.com/levilutz/basiccoin/pkg/set"
 	"github.com/levilutz/basiccoin/pkg/topic"
 	"github.com/levilutz/basiccoin/pkg/util"
 )
@@ -16,16 +19,24 @@ import (
 // Ensure each of these is initialized in NewChain.
 type subscriptions struct {
 	// Events
-	CandidateHead *topic.SubCh[bus.CandidateHeadEvent]
-	CandidateTx   *topic.SubCh[bus.CandidateTxEvent]
-	PrintUpdate   *topic.SubCh[bus.PrintUpdateEvent]
+	BlockContents    *topic.SubCh[bus.BlockContentsEvent]
+	CandidateHead    *topic.SubCh[bus.CandidateHeadEvent]
+	CandidatePackage *topic.SubCh[bus.CandidatePackageEvent]
+	CandidateTx      *topic.SubCh[bus.CandidateTxEvent]
+	PrintUpdate      *topic.SubCh[bus.PrintUpdateEvent]
 	// Queries
-	HeadHeight      *topic.SubCh[bus.HeadHeightQuery]
-	PkhBalance      *topic.SubCh[bus.PkhBalanceQuery]
-	PkhUtxos        *topic.SubCh[bus.PkhUtxosQuery]
-	RichList        *topic.SubCh[bus.RichListQuery]
-	TxConfirms      *topic.SubCh[bus.TxConfirmsQuery]
-	TxIncludedBlock *topic.SubCh[bus.TxIncludedBlockQuery]
+	BlockIdsByHeight *topic.SubCh[bus.BlockIdsByHeightQuery]
+	BlockUtxoHash    *topic.SubCh[bus.BlockUtxoHashQuery]
+	HeadHeight       *topic.SubCh[bus.HeadHeightQuery]
+	MainChainRange   *topic.SubCh[bus.MainChainRangeQuery]
+	PkhBalance       *topic.SubCh[bus.PkhBalanceQuery]
+	PkhTxs           *topic.SubCh[bus.PkhTxsQuery]
+	PkhUtxos         *topic.SubCh[bus.PkhUtxosQuery]
+	RichList         *topic.SubCh[bus.RichListQuery]
+	TxConfirms       *topic.SubCh[bus.TxConfirmsQuery]
+	TxIncludedBlock  *topic.SubCh[bus.TxIncludedBlockQuery]
+	UtxoSnapshot     *topic.SubCh[bus.UtxoSnapshotQuery]
+	UtxoSpender      *topic.SubCh[bus.UtxoSpenderQuery]
 }
 
 // A routine to manage our blockchain state and updates to it.
@@ -36,64 +47,398 @@ type Chain struct {
 	state         *State
 	supportMiners bool
 	saveDir       *string
+	// Most recently saved heads, newest first, to roll back to if the newest is corrupt
+	recentHeads []core.HashT
+	// Persisted utxo set and indexes, if saving
+	stateStore *stateStore
+	// How many blocks deep a block must be before its contents are pruned, 0 to not prune
+	pruneDepth uint64
+	// Height up to which block contents have been pruned
+	prunedHeight uint64
+	// Which optional indexes to maintain
+	indexes Indexes
+	// Limits on the mempool
+	mempoolParams MempoolParams
+	// Replay of the history below a loaded snapshot, while it's being validated
+	history *historyValidator
 }
 
-// Create a new chain.
+// How many recent heads to keep in the head file.
+const savedRecentHeads = 32
+
+// The shallowest depth blocks can be pruned at, so reorgs and head rollbacks stay possible.
+const MinPruneDepth = 100
+
+// Optional indexes of the chain's history. Each is built from the zero block, so enabling one
+// on a saved chain replays it, and none can be built from a snapshot.
+type Indexes struct {
+	// The txs crediting or debiting each pkh
+	PkhTxs bool
+	// The tx and block spending each spent utxo
+	UtxoSpenders bool
+}
+
+// Whether any index is enabled.
+func (i Indexes) Any() bool {
+	return i.PkhTxs || i.UtxoSpenders
+}
+
+// Create a new chain. If pruneDepth is non-zero, the contents of blocks buried that deep
+// are deleted from the inventory once they're reflected in the persisted state.
+// The given indexes are maintained, replaying the chain if the saved state lacks any.
 func NewChain(
-	msgBus *bus.Bus, inv *inv.Inv, supportMiners bool, saveDir *string,
+	msgBus *bus.Bus,
+	inv *inv.Inv,
+	supportMiners bool,
+	saveDir *string,
+	pruneDepth uint64,
+	indexes Indexes,
+	mempoolParams MempoolParams,
 ) *Chain {
+	if pruneDepth > 0 && saveDir == nil {
+		panic("pruning requires a save dir")
+	} else if pruneDepth > 0 && pruneDepth < MinPruneDepth {
+		panic(fmt.Sprintf("prune depth must be at least %d", MinPruneDepth))
+	}
 	if saveDir != nil {
 		if err := os.MkdirAll(*saveDir, 0750); err != nil {
 			panic(fmt.Sprintf("failed to make chain save dir: %s", err))
 		}
 	}
 	subs := &subscriptions{
-		CandidateHead:   msgBus.CandidateHead.SubCh(),
-		CandidateTx:     msgBus.CandidateTx.SubCh(),
-		PrintUpdate:     msgBus.PrintUpdate.SubCh(),
-		HeadHeight:      msgBus.HeadHeight.SubCh(),
-		PkhBalance:      msgBus.PkhBalance.SubCh(),
-		PkhUtxos:        msgBus.PkhUtxos.SubCh(),
-		RichList:        msgBus.RichList.SubCh(),
-		TxConfirms:      msgBus.TxConfirms.SubCh(),
-		TxIncludedBlock: msgBus.TxIncludedBlock.SubCh(),
+		BlockContents:    msgBus.BlockContents.SubCh(),
+		CandidateHead:    msgBus.CandidateHead.SubCh(),
+		CandidatePackage: msgBus.CandidatePackage.SubCh(),
+		CandidateTx:      msgBus.CandidateTx.SubCh(),
+		PrintUpdate:      msgBus.PrintUpdate.SubCh(),
+		BlockIdsByHeight: msgBus.BlockIdsByHeight.SubCh(),
+		BlockUtxoHash:    msgBus.BlockUtxoHash.SubCh(),
+		HeadHeight:       msgBus.HeadHeight.SubCh(),
+		MainChainRange:   msgBus.MainChainRange.SubCh(),
+		PkhBalance:       msgBus.PkhBalance.SubCh(),
+		PkhTxs:           msgBus.PkhTxs.SubCh(),
+		PkhUtxos:         msgBus.PkhUtxos.SubCh(),
+		RichList:         msgBus.RichList.SubCh(),
+		TxConfirms:       msgBus.TxConfirms.SubCh(),
+		TxIncludedBlock:  msgBus.TxIncludedBlock.SubCh(),
+		UtxoSnapshot:     msgBus.UtxoSnapshot.SubCh(),
+		UtxoSpender:      msgBus.UtxoSpender.SubCh(),
 	}
-	if saveDir != nil {
-		head, err := loadHeadFromFile(saveDir)
-		if err != nil {
-			fmt.Printf("failed to load previous head from file: %s\n", err)
-		} else {
-			msgBus.CandidateHead.Pub(bus.CandidateHeadEvent{
-				Head:    *head,
-				Blocks:  []core.Block{},
-				Merkles: []core.MerkleNode{},
-				Txs:     []core.Tx{},
-				// This is necessary, as mempool is empty on first startup
-				AutoAddMempoolInsecure: true,
-			})
-		}
-	}
-	return &Chain{
+	c := &Chain{
 		bus:           msgBus,
 		inv:           inv,
 		subs:          subs,
 		state:         NewState(inv),
 		supportMiners: supportMiners,
 		saveDir:       saveDir,
+		recentHeads:   make([]core.HashT, 0),
+		pruneDepth:    pruneDepth,
+		indexes:       indexes,
+		mempoolParams: mempoolParams,
+	}
+	c.state.EnableIndexes(indexes)
+	if saveDir != nil {
+		c.loadSaved()
+	}
+	return c
+}
+
+// Resume from the saved head, loading the stored state if it's consistent with it, else
+// replaying the chain from the zero block.
+func (c *Chain) loadSaved() {
+	stateStore, err := openStateStore(*c.saveDir + "/state")
+	if err != nil {
+		fmt.Printf("failed to open state store, state won't be persisted: %s\n", err)
+	} else {
+		c.stateStore = stateStore
+		c.state.EnableJournal()
+		prunedHeight, err := stateStore.PrunedHeight()
+		if err != nil {
+			panic(fmt.Sprintf("failed to load pruned height: %s", err))
+		}
+		c.prunedHeight = prunedHeight
+		c.inv.SetPrunedHeight(prunedHeight)
+		if err := stateStore.DropIndexes(c.indexes); err != nil {
+			panic(fmt.Sprintf("failed to drop disabled indexes: %s", err))
+		}
+	}
+	if c.pruneDepth > 0 && c.stateStore == nil {
+		panic("pruning requires the state store")
+	}
+	heads, err := loadHeadsFromFile(c.saveDir)
+	if err != nil {
+		fmt.Printf("failed to load previous head from file: %s\n", err)
+		c.clearStateStore()
+		return
+	}
+	head, ok := recoverHead(c.inv, heads)
+	if !ok {
+		fmt.Println("no previous head is fully stored, syncing from scratch")
+		c.clearStateStore()
+		return
+	}
+	if head != heads[0] {
+		fmt.Printf("rolled back head from %s to %s\n", heads[0], head)
+	}
+	c.recentHeads = heads
+
+	// Resume from the stored state, if it's on the way to the saved head
+	if c.stateStore != nil {
+		state, err := c.stateStore.Load(c.inv, c.indexes)
+		if err == nil {
+			state.EnableJournal()
+			head, err = c.reconcileStoredState(state, head)
+		}
+		if err != nil {
+			fmt.Printf("failed to load stored state, replaying chain: %s\n", err)
+			c.clearStateStore()
+		} else {
+			c.state = state
+			c.resumeHistory()
+			if head == state.head {
+				return
+			}
+		}
+	}
+	c.bus.CandidateHead.Pub(bus.CandidateHeadEvent{
+		Head:    head,
+		Blocks:  []core.Block{},
+		Merkles: []core.MerkleNode{},
+		Txs:     []core.Tx{},
+		// This is necessary, as mempool is empty on first startup
+		AutoAddMempoolInsecure: true,
+	})
+}
+
+// Reconcile a loaded state with the saved head, returning the head to resume towards.
+// The state is saved before the head, so a crash between them leaves the state ahead of the
+// saved head, which is resumed from if it's fully stored. Otherwise (or if the saved head was
+// rolled back) the state is rewound onto the saved chain using its undo records.
+func (c *Chain) reconcileStoredState(state *State, head core.HashT) (core.HashT, error) {
+	if _, ok := c.inv.GetBlockAncestorDepth(head, state.head); ok {
+		return head, nil
+	}
+	if _, ok := c.inv.GetBlockAncestorDepth(state.head, head); ok {
+		if recovered, ok := recoverHead(c.inv, []core.HashT{state.head}); ok && recovered == state.head {
+			fmt.Printf("stored state ahead of saved head, resuming from %s\n", state.head)
+			if err := c.saveHeadToFile(state.head); err != nil {
+				fmt.Printf("failed to save head to file: %s\n", err)
+			}
+			return state.head, nil
+		}
+	}
+	lcaId := c.inv.GetBlockLCA(head, state.head)
+	fmt.Printf("stored state not on saved chain, rewinding it to %s\n", lcaId)
+	for state.head != lcaId {
+		undo, err := c.stateStore.GetUndo(state.head)
+		if err != nil {
+			return core.HashT{}, err
+		}
+		if err := state.RewindUndo(undo); err != nil {
+			return core.HashT{}, err
+		}
+	}
+	return head, c.stateStore.Apply(state.TakeJournal(), state)
+}
+
+// Get the newest fully stored head loaded from the save dir, or the zero block if none.
+func (c *Chain) SavedHead() core.HashT {
+	if head, ok := recoverHead(c.inv, c.recentHeads); ok {
+		return head
+	}
+	return core.HashT{}
+}
+
+// Resume validating the history below a loaded snapshot, if it was interrupted.
+func (c *Chain) resumeHistory() {
+	hash, snapshotHead, ok, err := c.stateStore.Snapshot()
+	if err != nil {
+		panic(fmt.Sprintf("failed to load snapshot hash: %s", err))
+	} else if ok {
+		c.startHistory(hash, snapshotHead)
+	}
+}
+
+// Empty the state store so it's rebuilt as the state advances from the zero block.
+// If that fails, stop persisting state.
+// Panics if the chain has been pruned, as it can't be replayed.
+func (c *Chain) clearStateStore() {
+	if c.stateStore == nil {
+		return
+	} else if c.prunedHeight > 0 {
+		panic(fmt.Sprintf(
+			"chain pruned to height %d can't be replayed, delete the save dir to resync",
+			c.prunedHeight,
+		))
+	}
+	if err := c.stateStore.Clear(); err != nil {
+		fmt.Printf("failed to clear state store, state won't be persisted: %s\n", err)
+		c.stateStore = nil
+		c.state.DisableJournal()
+	}
+}
+
+// Persist the changes journaled by the state since it was last saved.
+// If that fails, stop persisting state, so the store is replayed from scratch next startup.
+func (c *Chain) saveState() {
+	if c.stateStore == nil {
+		return
+	}
+	if err := c.stateStore.Apply(c.state.TakeJournal(), c.state); err != nil {
+		fmt.Printf("failed to persist state, won't persist further: %s\n", err)
+		if err := c.stateStore.Clear(); err != nil {
+			fmt.Printf("failed to clear state store: %s\n", err)
+		}
+		c.stateStore = nil
+		c.state.DisableJournal()
+	}
+}
+
+// Delete the contents of blocks on our chain buried at least pruneDepth deep, other than
+// txs with outputs still unspent (or spent by a block that could still be rewound).
+// The persisted state must already be saved, so pruned blocks never need replaying.
+func (c *Chain) pruneBuried() {
+	if c.pruneDepth == 0 || c.stateStore == nil {
+		return
+	}
+	headHeight := c.inv.GetBlockHeight(c.state.head)
+	if headHeight <= c.prunedHeight+c.pruneDepth {
+		return
+	}
+	targetHeight := headHeight - c.pruneDepth
+	targetId := c.inv.GetBlockSpecificAncestor(c.state.head, int(c.pruneDepth))
+	prunedId := c.inv.GetBlockSpecificAncestor(targetId, int(targetHeight-c.prunedHeight))
+	pruneIds := util.Prepend(c.inv.GetBlockAncestorsUntil(targetId, prunedId), targetId)
+	c.pruneContents(pruneIds, targetHeight)
+}
+
+// Delete the contents of the given blocks on our chain, at or below the given new pruned
+// height, other than txs with outputs unspent at that height.
+func (c *Chain) pruneContents(pruneIds []core.HashT, prunedHeight uint64) {
+	// Utxos spent above the pruned height could be returned by a rewind, so keep their txs
+	headHeight := c.inv.GetBlockHeight(c.state.head)
+	prunedId := c.inv.GetBlockSpecificAncestor(c.state.head, int(headHeight-prunedHeight))
+	windowSpent := set.NewSet[core.Utxo]()
+	windowIds := util.Prepend(c.inv.GetBlockAncestorsUntil(c.state.head, prunedId), c.state.head)
+	if c.state.head == prunedId {
+		windowIds = []core.HashT{}
+	}
+	for _, blockId := range windowIds {
+		for _, tx := range c.inv.GetMerkleTxs(c.inv.GetBlock(blockId).MerkleRoot) {
+			windowSpent.Add(tx.GetConsumedUtxos()...)
+		}
+	}
+	// Each tx becomes prunable in the block spending its last output, or its own block
+	merkleIds := make([]core.HashT, 0)
+	candidateTxIds := set.NewSet[core.HashT]()
+	for _, blockId := range pruneIds {
+		blockMerkleIds, blockTxIds := c.getStoredBlockContents(blockId)
+		merkleIds = append(merkleIds, blockMerkleIds...)
+		for _, txId := range blockTxIds {
+			candidateTxIds.Add(txId)
+			for _, utxo := range c.inv.GetTx(txId).GetConsumedUtxos() {
+				if c.inv.HasTxById(utxo.TxId) {
+					candidateTxIds.Add(c.inv.GetTxHashById(utxo.TxId))
+				}
+			}
+		}
+	}
+	candidateTxIds.Filter(func(txId core.HashT) bool {
+		tx := c.inv.GetTx(txId)
+		id := tx.Id(c.inv.GetCoreParams())
+		for i, txo := range tx.Outputs {
+			if txo.IsData() {
+				continue
+			}
+			utxo := core.Utxo{TxId: id, Ind: uint64(i), Value: txo.Value}
+			if c.state.utxos.Includes(utxo) || windowSpent.Includes(utxo) {
+				return false
+			}
+		}
+		return true
+	})
+	// Record the new pruned height first, so a crash can't leave it behind the inv
+	if err := c.stateStore.Prune(prunedHeight, pruneIds); err != nil {
+		fmt.Printf("failed to persist pruned height, not pruning: %s\n", err)
+		return
+	}
+	c.prunedHeight = prunedHeight
+	c.inv.SetPrunedHeight(prunedHeight)
+	c.inv.BeginBatch()
+	for _, merkleId := range merkleIds {
+		c.inv.DeleteMerkle(merkleId)
+	}
+	for _, txId := range candidateTxIds.ToList() {
+		c.inv.DeleteTx(txId)
+	}
+	if err := c.inv.CommitBatch(); err != nil {
+		fmt.Printf("failed to prune blocks: %s\n", err)
 	}
 }
 
+// Point the ids of txs included in our chain at the included versions, rather than at other
+// malleated versions stored first.
+func (c *Chain) setIncludedTxs(txIds []core.HashT) {
+	c.inv.BeginBatch()
+	for _, txId := range txIds {
+		c.inv.SetIncludedTx(txId)
+	}
+	if err := c.inv.CommitBatch(); err != nil {
+		fmt.Printf("failed to store included txs: %s\n", err)
+	}
+}
+
+// Get the ids of the merkle nodes and txs under a block that are still stored.
+func (c *Chain) getStoredBlockContents(blockId core.HashT) ([]core.HashT, []core.HashT) {
+	merkleIds := make([]core.HashT, 0)
+	txIds := make([]core.HashT, 0)
+	idQueue := queue.NewQueue(c.inv.GetBlock(blockId).MerkleRoot)
+	for idQueue.Size() > 0 {
+		nextId, _ := idQueue.Pop()
+		if c.inv.HasTx(nextId) {
+			txIds = append(txIds, nextId)
+		} else if c.inv.HasMerkle(nextId) {
+			merkleIds = append(merkleIds, nextId)
+			merkle := c.inv.GetMerkle(nextId)
+			idQueue.Push(merkle.LChild)
+			if merkle.RChild != merkle.LChild {
+				idQueue.Push(merkle.RChild)
+			}
+		}
+	}
+	return merkleIds, txIds
+}
+
 // Start the chain's loop.
 func (c *Chain) Loop() {
 	if c.supportMiners {
 		c.CreateMiningTarget()
 	}
+	sweepMempoolTicker := time.NewTicker(mempoolSweepFreq)
 	for {
 		select {
 		case event := <-c.subs.CandidateHead.C:
-			if err := c.handleCandidateHead(event); err != nil {
+			err := c.handleCandidateHead(event)
+			if err != nil {
 				fmt.Printf("failed to verify new chain: %s\n", err.Error())
 			}
+			if event.Ret != nil {
+				util.WriteChIfPossible(event.Ret, err)
+			}
+
+		case event := <-c.subs.BlockContents.C:
+			if err := c.handleBlockContents(event); err != nil {
+				fmt.Printf("failed to store block contents: %s\n", err.Error())
+			}
+
+		case event := <-c.subs.CandidatePackage.C:
+			err := c.handleCandidatePackage(event)
+			if err != nil {
+				fmt.Printf("failed to verify new tx package: %s\n", err.Error())
+			}
+			if event.Ret != nil {
+				util.WriteChIfPossible(event.Ret, err)
+			}
 
 		case event := <-c.subs.CandidateTx.C:
 			err := c.handleCandidateTx(event)
@@ -104,8 +449,19 @@ func (c *Chain) Loop() {
 				util.WriteChIfPossible(event.Ret, err)
 			}
 
+		case <-sweepMempoolTicker.C:
+			c.sweepMempool()
+
 		case <-c.subs.PrintUpdate.C:
 			fmt.Printf("chain height: %d\n", c.inv.GetBlockHeight(c.state.head))
+			mempoolTxs, mempoolVSize := c.state.GetMempoolSize()
+			fmt.Printf(
+				"mempool: %d txs, %d vBytes, min fee rate %.3f\n",
+				mempoolTxs, mempoolVSize, c.state.GetMinRelayRate(),
+			)
+			for name, stats := range c.inv.GetCacheStats() {
+				fmt.Printf("%s cache: %s\n", name, stats)
+			}
 
 		case query := <-c.subs.HeadHeight.C:
 			util.WriteChIfPossible(query.Ret, c.inv.GetBlockHeight(c.state.head))
@@ -113,6 +469,23 @@ func (c *Chain) Loop() {
 		case query := <-c.subs.PkhBalance.C:
 			util.WriteChIfPossible(query.Ret, c.state.GetManyPkhBalances(query.PublicKeyHashes))
 
+		case query := <-c.subs.BlockIdsByHeight.C:
+			util.WriteChIfPossible(query.Ret, c.state.GetMainChainBlockIds(query.Heights))
+
+		case query := <-c.subs.MainChainRange.C:
+			util.WriteChIfPossible(query.Ret, c.state.GetMainChainRange(query.Start, query.Limit))
+
+		case query := <-c.subs.BlockUtxoHash.C:
+			util.WriteChIfPossible(query.Ret, c.state.GetBlockUtxoHashes(query.BlockIds))
+
+		case query := <-c.subs.PkhTxs.C:
+			txIds, total, err := c.state.GetPkhTxs(query.PublicKeyHash, query.Offset, query.Limit)
+			util.WriteChIfPossible(query.Ret, bus.PkhTxsResult{
+				TxIds: txIds,
+				Total: total,
+				Err:   err,
+			})
+
 		case query := <-c.subs.PkhUtxos.C:
 			util.WriteChIfPossible(
 				query.Ret, c.state.GetManyPkhUtxos(query.PublicKeyHashes, query.ExcludeMempool),
@@ -126,40 +499,50 @@ func (c *Chain) Loop() {
 
 		case query := <-c.subs.TxIncludedBlock.C:
 			util.WriteChIfPossible(query.Ret, c.state.GetTxIncludedBlock(query.TxIds))
+
+		case query := <-c.subs.UtxoSnapshot.C:
+			snapshot, hash, err := c.exportSnapshotAt(query.BlockId)
+			util.WriteChIfPossible(query.Ret, bus.UtxoSnapshotResult{
+				Snapshot: snapshot,
+				Hash:     hash,
+				Err:      err,
+			})
+
+		case query := <-c.subs.UtxoSpender.C:
+			txId, blockId, spent, err := c.state.GetUtxoSpender(query.Utxo)
+			util.WriteChIfPossible(query.Ret, bus.UtxoSpenderResult{
+				Spent:        spent,
+				TxId:         txId,
+				BlockId:      blockId,
+				MempoolTxIds: c.state.GetMempoolUtxoSpenders(query.Utxo),
+				Err:          err,
+			})
 		}
 	}
 }
 
 // Upgrades our chain to the given new head, if it proves to be correct and better.
-func (c *Chain) handleCandidateHead(event bus.CandidateHeadEvent) error {
+func (c *Chain) handleCandidateHead(event bus.CandidateHeadEvent) (err error) {
 	curHead := c.state.head
-	// Insert each entity into the inventory, in order.
+	// Verify new tx signatures in parallel up front, so storing them hits the sig cache
+	newTxs := make([]core.Tx, 0, len(event.Txs))
 	for _, tx := range event.Txs {
-		txId := tx.Hash()
-		if !c.inv.HasTx(txId) {
-			err := c.inv.StoreTx(tx)
-			if err != nil {
-				return err
-			}
-			c.state.AddMempoolTx(txId)
-			// Don't re-broadcast tx directly, it's implicitly rebroadcasted with block
+		if !c.inv.HasTx(tx.Hash()) {
+			newTxs = append(newTxs, tx)
 		}
 	}
-	for _, merkle := range event.Merkles {
-		if !c.inv.HasMerkle(merkle.Hash()) {
-			err := c.inv.StoreMerkle(merkle)
-			if err != nil {
-				return err
-			}
-		}
+	if err := c.inv.VerifyTxsSigs(newTxs); err != nil {
+		return err
 	}
-	for _, block := range event.Blocks {
-		if !c.inv.HasBlock(block.Hash()) {
-			err := c.inv.StoreBlock(block)
-			if err != nil {
-				return err
-			}
+	// Txs of a head we don't switch to may still be mined on our chain
+	defer func() {
+		if err != nil {
+			c.offerMempoolTxs(newTxs)
 		}
+	}()
+	// Insert each entity into the inventory, in order, committing them together
+	if err := c.storeEntities(newTxs, event.Merkles, event.Blocks); err != nil {
+		return err
 	}
 	// Verify new total work is higher
 	if !c.inv.HasBlock(event.Head) {
@@ -172,10 +555,21 @@ func (c *Chain) handleCandidateHead(event bus.CandidateHeadEvent) error {
 	}
 	// Find common ancestor of our chain heads
 	lcaId := c.inv.GetBlockLCA(curHead, event.Head)
+	if c.inv.GetBlockHeight(lcaId) < c.prunedHeight {
+		return fmt.Errorf("new chain forks below pruned height %d", c.prunedHeight)
+	}
+	newBlocks := c.inv.GetBlockAncestorsUntil(event.Head, lcaId)
 	// Copy state, rewind to lca, and advance to head
 	newState := c.state.Copy()
 	newState.RewindUntil(lcaId)
-	newBlocks := c.inv.GetBlockAncestorsUntil(event.Head, lcaId)
+	// The blocks' txs aren't in our mempool if new, or if dropped from it while still stored
+	// Only the copy gets them, as the blocks must include them all for it to be kept
+	includedTxIds := make([]core.HashT, 0)
+	for _, blockId := range append(newBlocks, event.Head) {
+		_, txIds := c.getStoredBlockContents(blockId)
+		newState.RestoreMempoolTxs(txIds)
+		includedTxIds = append(includedTxIds, txIds...)
+	}
 	// Advance through intermediate blocks, then the new head
 	for i := len(newBlocks) - 1; i >= 0; i-- {
 		if err := newState.Advance(
@@ -189,12 +583,22 @@ func (c *Chain) handleCandidateHead(event bus.CandidateHeadEvent) error {
 	}
 	// Shift to new head - don't return error after here or state will get corrupted
 	c.state = newState
+	c.setIncludedTxs(includedTxIds)
+	// Rewound txs may have overfilled the mempool, or mined ones relieved it
+	c.state.DecayMinRelayRate(c.mempoolParams.MaxVSize)
+	c.publishDroppedTxs(c.state.TrimMempool(c.mempoolParams.MaxVSize), bus.DropReasonEvicted)
 	// Save to file
 	if c.saveDir != nil {
+		c.saveState()
 		err := c.saveHeadToFile(c.state.head)
 		if err != nil {
 			fmt.Printf("failed to save head to file: %s\n", err)
 		}
+		c.pruneBuried()
+	}
+	// Peers may have connected or caught up since history was last requested
+	if c.history != nil && c.history.pending.Size() > 0 {
+		c.requestHistory()
 	}
 	// Publish events
 	c.bus.ValidatedHead.Pub(bus.ValidatedHeadEvent{
@@ -206,30 +610,193 @@ func (c *Chain) handleCandidateHead(event bus.CandidateHeadEvent) error {
 	return nil
 }
 
+// Store the given new entities into the inventory as one batch.
+func (c *Chain) storeEntities(
+	txs []core.Tx, merkles []core.MerkleNode, blocks []core.Block,
+) (err error) {
+	c.inv.BeginBatch()
+	defer func() {
+		if err != nil {
+			c.inv.DiscardBatch()
+		} else {
+			err = c.inv.CommitBatch()
+		}
+	}()
+	for _, tx := range txs {
+		if !c.inv.HasTx(tx.Hash()) {
+			if err := c.inv.StoreTx(tx); err != nil {
+				return err
+			}
+		}
+	}
+	for _, merkle := range merkles {
+		if !c.inv.HasMerkle(merkle.Hash()) {
+			if err := c.inv.StoreMerkle(merkle); err != nil {
+				return err
+			}
+		}
+	}
+	for _, block := range blocks {
+		if !c.inv.HasBlock(block.Hash()) {
+			if err := c.inv.StoreBlock(block); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (c *Chain) handleCandidateTx(event bus.CandidateTxEvent) error {
-	txId := event.Tx.Hash()
-	if c.inv.HasTx(txId) {
+	if c.state.IsTxKnown(event.Tx) {
 		return nil
 	}
-	if err := c.inv.StoreTx(event.Tx); err != nil {
+	if err := c.state.VerifyTxRelayRate(event.Tx); err != nil {
 		return err
 	}
-	c.state.AddMempoolTx(txId)
-	c.bus.ValidatedTx.Pub(bus.ValidatedTxEvent{
-		TxId: txId,
-	})
+	return c.addMempoolTxs([]core.Tx{event.Tx})
+}
+
+func (c *Chain) handleCandidatePackage(event bus.CandidatePackageEvent) error {
+	if err := verifyPackageShape(c.inv.GetCoreParams(), event.Txs); err != nil {
+		return err
+	}
+	newTxs := make([]core.Tx, 0, len(event.Txs))
+	for _, tx := range event.Txs {
+		if !c.state.IsTxKnown(tx) {
+			newTxs = append(newTxs, tx)
+		}
+	}
+	if len(newTxs) == 0 {
+		return nil
+	}
+	if err := c.state.VerifyPackageRelayRate(newTxs); err != nil {
+		return err
+	}
+	// Try the whole package first, so its txs are stored and added all or nothing
+	if err := c.tryMempoolTxs(newTxs); err != nil {
+		return err
+	}
+	return c.addMempoolTxs(newTxs)
+}
+
+// Add each tx of a candidate head we didn't switch to to the mempool, if it would be accepted
+// on its own, as it may still be mined on our chain.
+func (c *Chain) offerMempoolTxs(txs []core.Tx) {
+	for _, tx := range txs {
+		if tx.IsCoinbase || c.state.IsTxKnown(tx) {
+			continue
+		}
+		if err := c.state.VerifyTxRelayRate(tx); err != nil {
+			continue
+		}
+		c.addMempoolTxs([]core.Tx{tx})
+	}
+}
+
+// Check that new txs would all be accepted to the mempool in order, and none then evicted,
+// without storing or adding any of them.
+func (c *Chain) tryMempoolTxs(txs []core.Tx) error {
+	pending := newPendingTxsInv(c.inv)
+	staged := c.state.copyMempool(pending)
+	for _, tx := range txs {
+		if err := c.inv.VerifyTxWith(pending, tx); err != nil {
+			return err
+		}
+		if err := staged.VerifyMempoolTx(tx, c.mempoolParams.MaxChainLength); err != nil {
+			return err
+		}
+		pending.add(tx)
+		if _, err := staged.AddMempoolReplacement(tx.Hash()); err != nil {
+			return err
+		}
+	}
+	evicted := staged.TrimMempool(c.mempoolParams.MaxVSize)
+	for _, tx := range txs {
+		if evicted.Includes(tx.Hash()) {
+			return fmt.Errorf("mempool is full, and the package's fee rate is too low to stay in it")
+		}
+	}
+	return nil
+}
+
+// Store new txs and add them to the mempool in order, replacing the txs they conflict with,
+// then announce them. Errors on the first tx rejected or evicted, keeping the txs before it.
+func (c *Chain) addMempoolTxs(txs []core.Tx) error {
+	var err error
+	added := make([]core.Tx, 0, len(txs))
+	for _, tx := range txs {
+		txId := tx.Hash()
+		if err = c.state.VerifyMempoolTx(tx, c.mempoolParams.MaxChainLength); err != nil {
+			break
+		}
+		// An evicted tx is still stored, and may be accepted again
+		if !c.inv.HasTx(txId) {
+			if err = c.inv.StoreTx(tx); err != nil {
+				break
+			}
+		}
+		var replaced *set.Set[core.HashT]
+		if replaced, err = c.state.AddMempoolReplacement(txId); err != nil {
+			break
+		}
+		c.publishDroppedTxs(replaced, bus.DropReasonReplaced)
+		added = append(added, tx)
+	}
+	// Trim once all are added, so children's fees count towards keeping their parents
+	evicted := c.state.TrimMempool(c.mempoolParams.MaxVSize)
+	c.publishDroppedTxs(evicted, bus.DropReasonEvicted)
+	for _, tx := range added {
+		if !evicted.Includes(tx.Hash()) {
+			c.bus.ValidatedTx.Pub(bus.ValidatedTxEvent{
+				TxId: tx.Hash(),
+			})
+		} else if err == nil {
+			err = fmt.Errorf(
+				"mempool is full, and tx fee rate %.3f is too low to stay in it", tx.Rate(),
+			)
+		}
+	}
 	// Retargeting the miners after every tx would probably be too much in a very active network
-	if c.supportMiners {
+	if c.supportMiners && len(added)+evicted.Size() > 0 {
 		c.CreateMiningTarget()
 	}
-	return nil
+	return err
 }
 
+// Drop expired and unspendable txs from the mempool.
+func (c *Chain) sweepMempool() {
+	expired, unspendable := c.state.SweepMempool(time.Now(), c.mempoolParams.MaxAge)
+	c.publishDroppedTxs(expired, bus.DropReasonExpired)
+	c.publishDroppedTxs(unspendable, bus.DropReasonUnspendable)
+	if c.supportMiners && expired.Size()+unspendable.Size() > 0 {
+		c.CreateMiningTarget()
+	}
+}
+
+// Announce txs dropped from the mempool, if any.
+func (c *Chain) publishDroppedTxs(txIds *set.Set[core.HashT], reason bus.DropReason) {
+	if txIds.Size() == 0 {
+		return
+	}
+	fmt.Printf("dropped %d txs from mempool: %s\n", txIds.Size(), reason)
+	c.bus.DroppedTxs.Pub(bus.DroppedTxsEvent{
+		TxIds:  txIds.ToList(),
+		Reason: reason,
+	})
+}
+
+// Atomically save the given head to file, along with the previously saved heads.
 func (c *Chain) saveHeadToFile(head core.HashT) error {
-	return os.WriteFile(*c.saveDir+"/head", []byte(head.String()), 0666)
+	c.recentHeads = util.Prepend(c.recentHeads, head)
+	if len(c.recentHeads) > savedRecentHeads {
+		c.recentHeads = c.recentHeads[:savedRecentHeads]
+	}
+	raw := strings.Join(core.MarshalHashTSlice(c.recentHeads), "\n")
+	return util.WriteFileAtomic(*c.saveDir+"/head", []byte(raw), 0666)
 }
 
-func loadHeadFromFile(saveDir *string) (head *core.HashT, err error) {
+// Load the saved heads from file, newest first.
+func loadHeadsFromFile(saveDir *string) (heads []core.HashT, err error) {
 	if saveDir == nil {
 		return nil, fmt.Errorf("was not configured with a save dir")
 	}
@@ -242,9 +809,53 @@ func loadHeadFromFile(saveDir *string) (head *core.HashT, err error) {
 		return nil, err
 	}
 	rawS := strings.Trim(string(raw), "\n")
-	headD, err := core.NewHashTFromString(rawS)
+	heads, err = core.UnmarshalHashTSlice(strings.Split(rawS, "\n"))
 	if err != nil {
 		return nil, err
 	}
-	return &headD, nil
+	if len(heads) == 0 {
+		return nil, fmt.Errorf("head file is empty")
+	}
+	return heads, nil
+}
+
+// Find the newest block among the given heads (and their ancestors) whose whole chain is
+// fully stored, in case records were lost or quarantined. Returns false if there is none.
+func recoverHead(inv *inv.Inv, heads []core.HashT) (core.HashT, bool) {
+	for _, head := range heads {
+		// Walk back to the origin, skipping this head if any block is missing entirely
+		chainIds := make([]core.HashT, 0)
+		complete := true
+		for cur := head; !cur.EqZero(); cur = inv.GetBlockParentId(cur) {
+			if !inv.HasBlock(cur) {
+				complete = false
+				break
+			}
+			chainIds = append(chainIds, cur)
+		}
+		if !complete {
+			continue
+		}
+		// The usable head is the parent of the earliest block with missing contents
+		// Pruned blocks are expected to be missing theirs
+		recovered := head
+		prunedHeight := inv.GetPrunedHeight()
+		for i := len(chainIds) - 1; i >= 0; i-- {
+			if inv.GetBlockHeight(chainIds[i]) <= prunedHeight {
+				continue
+			}
+			if !inv.HasBlockContents(chainIds[i]) {
+				if i == len(chainIds)-1 {
+					recovered = core.HashT{}
+				} else {
+					recovered = chainIds[i+1]
+				}
+				break
+			}
+		}
+		if !recovered.EqZero() {
+			return recovered, true
+		}
+	}
+	return core.HashT{}, false
 }
@@ -0,0 +1,171 @@
+package chain
+
+import (
+	"fmt"
+
+	"github.com/levilutz/basiccoin/internal/bus"
+	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/set"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+// How many blocks of history to request at once, and to replay per loop iteration.
+const historyBatchSize = 16
+
+// Replays the chain below a loaded snapshot, fetching block contents from peers, to verify
+// the snapshot matches the chain's actual history.
+type historyValidator struct {
+	snapshotHash core.HashT
+	// Block ids from height 1 to the snapshot head, oldest first
+	blockIds []core.HashT
+	// The replayed state, with its journal holding undo records not yet stored
+	state *State
+	// Blocks whose contents we've requested and are waiting on
+	pending *set.Set[core.HashT]
+	// The peer that last served us contents, to keep requesting from
+	peerRuntimeId string
+}
+
+// Start replaying history up to the given snapshot head.
+func (c *Chain) startHistory(snapshotHash core.HashT, snapshotHead core.HashT) {
+	blockIds := util.Reverse(c.inv.GetBlockAncestorsUntil(snapshotHead, core.HashT{}))
+	state := NewState(c.inv)
+	state.EnableJournal()
+	c.history = &historyValidator{
+		snapshotHash: snapshotHash,
+		blockIds:     append(blockIds, snapshotHead),
+		state:        state,
+		pending:      set.NewSet[core.HashT](),
+	}
+	// Kick off replay from our own loop
+	c.bus.BlockContents.Pub(bus.BlockContentsEvent{})
+}
+
+// Store block contents received for history replay, then continue replaying.
+func (c *Chain) handleBlockContents(event bus.BlockContentsEvent) error {
+	if c.history == nil {
+		return nil
+	}
+	h := c.history
+	if len(event.BlockIds) > 0 {
+		// Ignore duplicate responses, from other peers or to earlier requests
+		if !h.pending.HasIntersection(set.NewSetFromList(event.BlockIds)) {
+			return nil
+		}
+		h.pending = set.NewSet[core.HashT]()
+		h.peerRuntimeId = event.PeerRuntimeId
+		newTxs := make([]core.Tx, 0, len(event.Txs))
+		for _, tx := range event.Txs {
+			if !c.inv.HasTx(tx.Hash()) {
+				newTxs = append(newTxs, tx)
+			}
+		}
+		err := c.inv.VerifyTxsSigs(newTxs)
+		if err == nil {
+			err = c.storeEntities(newTxs, event.Merkles, []core.Block{})
+		}
+		if err != nil {
+			// Try any other peer next time
+			h.peerRuntimeId = ""
+			c.requestHistory()
+			return err
+		}
+	} else if h.pending.Size() > 0 {
+		return nil
+	}
+	c.advanceHistory()
+	return nil
+}
+
+// Replay the next batch of history blocks whose contents are stored, then either continue
+// from our own loop, request the next missing contents, or finish.
+func (c *Chain) advanceHistory() {
+	h := c.history
+	for i := 0; i < historyBatchSize; i++ {
+		height := c.inv.GetBlockHeight(h.state.head)
+		if height == uint64(len(h.blockIds)) {
+			c.finishHistory()
+			return
+		}
+		nextId := h.blockIds[height]
+		if !c.inv.HasBlockContents(nextId) {
+			c.requestHistory()
+			return
+		}
+		// A snapshot with invalid history was trusted, no state built on it can be trusted
+		if err := c.inv.VerifyStoredBlock(nextId); err != nil {
+			panic(fmt.Sprintf("snapshot history has invalid block %s: %s", nextId, err))
+		}
+		if err := h.state.Advance(nextId, true); err != nil {
+			panic(fmt.Sprintf("snapshot history has invalid block %s: %s", nextId, err))
+		}
+		_, txIds := c.getStoredBlockContents(nextId)
+		c.setIncludedTxs(txIds)
+		// The snapshot head's utxo hash is already known, from the snapshot itself
+		utxoHash := h.state.blockUtxoHashes[nextId]
+		if known, ok := c.state.blockUtxoHashes[nextId]; ok && known != utxoHash {
+			panic(fmt.Sprintf(
+				"snapshot utxo hash %s does not match history, which gives %s", known, utxoHash,
+			))
+		}
+		c.state.blockUtxoHashes[nextId] = utxoHash
+		if err := c.stateStore.StoreUndos(h.state.TakeJournal()); err != nil {
+			fmt.Printf("failed to store history undo records: %s\n", err)
+		}
+	}
+	// Yield to other events between batches
+	c.bus.BlockContents.Pub(bus.BlockContentsEvent{})
+}
+
+// Request the contents of the next history blocks that we're missing, or re-request those
+// still pending from any peer.
+func (c *Chain) requestHistory() {
+	h := c.history
+	if h.pending.Size() > 0 {
+		c.bus.ShouldRequestBlockContents.Pub(bus.ShouldRequestBlockContentsEvent{
+			BlockIds: h.pending.ToList(),
+		})
+		return
+	}
+	for height := c.inv.GetBlockHeight(h.state.head); height < uint64(len(h.blockIds)) &&
+		h.pending.Size() < historyBatchSize; height++ {
+		if !c.inv.HasBlockContents(h.blockIds[height]) {
+			h.pending.Add(h.blockIds[height])
+		}
+	}
+	c.bus.ShouldRequestBlockContents.Pub(bus.ShouldRequestBlockContentsEvent{
+		TargetRuntimeId: h.peerRuntimeId,
+		BlockIds:        h.pending.ToList(),
+	})
+}
+
+// Verify the replayed history reproduces the snapshot exactly, and stop treating the
+// blocks below it as pruned. Panics if it doesn't.
+func (c *Chain) finishHistory() {
+	h := c.history
+	_, hash, err := exportSnapshot(h.state)
+	if err != nil {
+		panic(fmt.Sprintf("failed to export replayed history: %s", err))
+	} else if hash != h.snapshotHash {
+		panic(fmt.Sprintf(
+			"snapshot %s does not match the chain's history, which gives %s",
+			h.snapshotHash, hash,
+		))
+	}
+	c.history = nil
+	// A pruning node keeps its pruned height, but drops the replayed contents
+	prunedHeight := uint64(0)
+	if c.pruneDepth > 0 {
+		prunedHeight = c.prunedHeight
+	}
+	if err := c.stateStore.FinishSnapshot(prunedHeight); err != nil {
+		fmt.Printf("failed to record validated snapshot: %s\n", err)
+		return
+	}
+	c.prunedHeight = prunedHeight
+	c.inv.SetPrunedHeight(prunedHeight)
+	fmt.Printf("validated history of snapshot %s\n", h.snapshotHash)
+	if c.pruneDepth > 0 {
+		c.pruneContents(h.blockIds, c.prunedHeight)
+	}
+}
@@ -0,0 +1,535 @@
+package chain
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/levilutz/basiccoin/internal/inv"
+	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/set"
+)
+
+// Limits on the mempool.
+type MempoolParams struct {
+	// The most total vSize of txs to keep, 0 for unlimited
+	MaxVSize uint64
+	// The most txs a chain of unconfirmed txs may have, counting a tx with either its
+	// unconfirmed ancestors or its unconfirmed descendants, 0 for unlimited
+	MaxChainLength uint64
+	// How long a tx may wait in the mempool before it's dropped, 0 to keep txs indefinitely
+	MaxAge time.Duration
+}
+
+// How often the mempool is swept of expired txs and txs that can no longer be mined.
+const mempoolSweepFreq = time.Minute
+
+// The most mempool txs a single tx may replace, counting the descendants of those it conflicts
+// with, so a replacement can't make us rescore and drop an unbounded number of txs.
+const maxMempoolReplaced = 100
+
+// Get the fee rate below which txs aren't accepted to the mempool.
+func (s *State) GetMinRelayRate() float64 {
+	return s.minRelayRate
+}
+
+// Get the number of txs in the mempool, and their total vSize.
+func (s *State) GetMempoolSize() (int, uint64) {
+	return s.mempool.Size(), s.mempoolVSize
+}
+
+// Get a mempool tx and the mempool txs spending its outputs, recursively.
+func (s *State) getMempoolDescendants(txId core.HashT) *set.Set[core.HashT] {
+	out := set.NewSetFromList([]core.HashT{txId})
+	pending := []core.HashT{txId}
+	for len(pending) > 0 {
+		tx := s.inv.GetTx(pending[0])
+		pending = pending[1:]
+		id := tx.Id(s.inv.GetCoreParams())
+		for i, txo := range tx.Outputs {
+			spenders, ok := s.mempoolUtxoSpends[core.Utxo{TxId: id, Ind: uint64(i), Value: txo.Value}]
+			if !ok {
+				continue
+			}
+			for _, spenderId := range spenders.ToList() {
+				if !out.Includes(spenderId) {
+					out.Add(spenderId)
+					pending = append(pending, spenderId)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// Get the fee a tx pays, or 0 if it has no surplus.
+func txFee(tx core.Tx) uint64 {
+	if !tx.HasSurplus() {
+		return 0
+	}
+	return tx.InputsValue() - tx.OutputsValue()
+}
+
+// Add a stored tx to the mempool, replacing the mempool txs spending any of the same utxos, and
+// their descendants. The tx must pay a higher fee rate than each tx it conflicts with directly,
+// and the fee of all the txs it replaces together plus core.IncrementalRelayRate for its own
+// vSize, so a replacement pays to relay itself. At most maxMempoolReplaced txs may be replaced.
+// Returns the replaced txs.
+func (s *State) AddMempoolReplacement(txId core.HashT) (*set.Set[core.HashT], error) {
+	tx := s.inv.GetTx(txId)
+	replaced := set.NewSet[core.HashT]()
+	for _, utxo := range tx.GetConsumedUtxos() {
+		spenders, ok := s.mempoolUtxoSpends[utxo]
+		if !ok {
+			continue
+		}
+		for _, spenderId := range spenders.ToList() {
+			if rate := s.mempoolRates[spenderId]; tx.Rate() <= rate {
+				return nil, fmt.Errorf(
+					"tx fee rate %.3f must exceed the rate %.3f of the mempool tx %s it replaces",
+					tx.Rate(), rate, spenderId,
+				)
+			}
+			replaced.Add(s.getMempoolDescendants(spenderId).ToList()...)
+			if replaced.Size() > maxMempoolReplaced {
+				return nil, fmt.Errorf(
+					"tx would replace more than the max %d mempool txs", maxMempoolReplaced,
+				)
+			}
+		}
+	}
+	replacedFees := uint64(0)
+	replacedIds := set.NewSet[core.HashT]()
+	for _, replacedId := range replaced.ToList() {
+		replacedTx := s.inv.GetTx(replacedId)
+		replacedFees += txFee(replacedTx)
+		replacedIds.Add(replacedTx.Id(s.inv.GetCoreParams()))
+	}
+	minFee := float64(replacedFees) + core.IncrementalRelayRate*float64(tx.VSize())
+	if fee := txFee(tx); replaced.Size() > 0 && float64(fee) < minFee {
+		return nil, fmt.Errorf(
+			"tx fee %d must be at least %.3f, the total fee %d of the %d mempool txs it "+
+				"replaces plus %.3f per vByte",
+			fee, minFee, replacedFees, replaced.Size(), core.IncrementalRelayRate,
+		)
+	}
+	for _, utxo := range tx.GetConsumedUtxos() {
+		if replacedIds.Includes(utxo.TxId) {
+			return nil, fmt.Errorf("tx spends an output of a mempool tx it replaces")
+		}
+	}
+	for _, replacedId := range replaced.ToList() {
+		if err := s.removeMempoolTx(replacedId); err != nil {
+			panic(err)
+		}
+	}
+	s.AddMempoolTx(txId)
+	return replaced, nil
+}
+
+// Get the fee rate a mempool tx is worth keeping at: its own, or that of it and its descendants
+// together if higher, as a high fee child pays for its parent to be mined.
+func (s *State) getMempoolDescendantRate(txId core.HashT) float64 {
+	fee, vSize := uint64(0), uint64(0)
+	for _, descendantId := range s.getMempoolDescendants(txId).ToList() {
+		tx := s.inv.GetTx(descendantId)
+		fee += txFee(tx)
+		vSize += tx.VSize()
+	}
+	if rate := float64(fee) / float64(vSize); rate > s.mempoolRates[txId] {
+		return rate
+	}
+	return s.mempoolRates[txId]
+}
+
+// Evict the txs with the lowest descendant fee rate, and the txs spending their outputs, until
+// the mempool's total vSize is within maxVSize. Raises the min relay rate above each evicted
+// rate, so txs that would just be evicted again aren't accepted. Returns the evicted txs.
+func (s *State) TrimMempool(maxVSize uint64) *set.Set[core.HashT] {
+	evicted := set.NewSet[core.HashT]()
+	if maxVSize == 0 || s.mempoolVSize <= maxVSize {
+		return evicted
+	}
+	// Score every tx once, then rescore only the ancestors of what each eviction removes
+	rates := make(map[core.HashT]float64, s.mempool.Size())
+	for _, txId := range s.mempool.ToList() {
+		rates[txId] = s.getMempoolDescendantRate(txId)
+	}
+	for s.mempoolVSize > maxVSize {
+		var lowestId core.HashT
+		var lowestRate float64
+		first := true
+		for txId, rate := range rates {
+			if first || rate < lowestRate || (rate == lowestRate && txId.Lt(lowestId)) {
+				lowestId, lowestRate = txId, rate
+				first = false
+			}
+		}
+		if minRate := lowestRate + core.IncrementalRelayRate; minRate > s.minRelayRate {
+			s.minRelayRate = minRate
+		}
+		removed := s.getMempoolDescendants(lowestId).ToList()
+		for _, txId := range removed {
+			if err := s.removeMempoolTx(txId); err != nil {
+				panic(err)
+			}
+			delete(rates, txId)
+			evicted.Add(txId)
+		}
+		rescore := set.NewSet[core.HashT]()
+		for _, txId := range removed {
+			rescore.Add(s.getMempoolAncestors(s.inv.GetTx(txId)).ToList()...)
+		}
+		for _, txId := range rescore.ToList() {
+			rates[txId] = s.getMempoolDescendantRate(txId)
+		}
+	}
+	return evicted
+}
+
+// Drop the mempool txs that entered it longer than maxAge before now (unless maxAge is 0), and
+// those whose inputs are neither unspent in our chain nor created by another mempool tx, as
+// when a reorg spent them. The txs spending their outputs are dropped with them. Txs only
+// waiting on their MinBlock are kept. Returns the expired and the unspendable txs.
+func (s *State) SweepMempool(
+	now time.Time, maxAge time.Duration,
+) (*set.Set[core.HashT], *set.Set[core.HashT]) {
+	expired := set.NewSet[core.HashT]()
+	unspendable := set.NewSet[core.HashT]()
+	drop := func(txId core.HashT, reason *set.Set[core.HashT]) {
+		for _, dropId := range s.getMempoolDescendants(txId).ToList() {
+			if err := s.removeMempoolTx(dropId); err != nil {
+				panic(err)
+			}
+			reason.Add(dropId)
+		}
+	}
+	if maxAge > 0 {
+		for _, txId := range s.mempool.ToList() {
+			if s.mempool.Includes(txId) && now.Sub(s.mempoolTimes[txId]) > maxAge {
+				drop(txId, expired)
+			}
+		}
+	}
+	// Outputs of mempool txs may be spent once they're mined
+	for _, txId := range s.mempool.ToList() {
+		if !s.mempool.Includes(txId) {
+			continue
+		}
+		for _, utxo := range s.inv.GetTx(txId).GetConsumedUtxos() {
+			if !s.utxos.Includes(utxo) && !s.isMempoolTxOut(utxo) {
+				drop(txId, unspendable)
+				break
+			}
+		}
+	}
+	return expired, unspendable
+}
+
+// Whether a utxo is an output of a tx in the mempool.
+func (s *State) isMempoolTxOut(utxo core.Utxo) bool {
+	return s.mempoolUtxos.Includes(utxo)
+}
+
+// Halve the min relay rate while the mempool is under half full, so it falls back to zero once
+// the pressure that raised it has passed. Called as each new head is reached.
+func (s *State) DecayMinRelayRate(maxVSize uint64) {
+	if maxVSize > 0 && s.mempoolVSize >= maxVSize/2 {
+		return
+	}
+	s.minRelayRate /= 2
+	if s.minRelayRate < core.IncrementalRelayRate/2 {
+		s.minRelayRate = 0
+	}
+}
+
+// Whether a tx is in the mempool or included in our chain.
+func (s *State) IsTxKnown(tx core.Tx) bool {
+	if s.mempool.Includes(tx.Hash()) {
+		return true
+	}
+	_, ok := s.includedTxBlocks[tx.Id(s.inv.GetCoreParams())]
+	return ok
+}
+
+// Check whether a tx's fee rate is enough for it to be accepted to the mempool.
+func (s *State) VerifyTxRelayRate(tx core.Tx) error {
+	if rate := tx.Rate(); rate < s.minRelayRate {
+		return fmt.Errorf(
+			"tx fee rate %.3f is below the mempool's min fee rate %.3f", rate, s.minRelayRate,
+		)
+	}
+	return nil
+}
+
+// Check whether a package of txs pays enough fee rate together to be accepted to the mempool,
+// even if some of them don't alone.
+func (s *State) VerifyPackageRelayRate(txs []core.Tx) error {
+	fee, vSize := uint64(0), uint64(0)
+	for _, tx := range txs {
+		fee += txFee(tx)
+		vSize += tx.VSize()
+	}
+	if rate := float64(fee) / float64(vSize); rate < s.minRelayRate {
+		return fmt.Errorf(
+			"package fee rate %.3f is below the mempool's min fee rate %.3f", rate, s.minRelayRate,
+		)
+	}
+	return nil
+}
+
+// A mempool tx along with its unconfirmed ancestors, which must be mined before or with it.
+type mempoolPackage struct {
+	// The txs, each after its ancestors, ending with the tx itself
+	TxIds []core.HashT
+	Fee   uint64
+	VSize uint64
+}
+
+// The fee rate of the package's txs together.
+func (p mempoolPackage) Rate() float64 {
+	return float64(p.Fee) / float64(p.VSize)
+}
+
+// Get the mempool txs whose outputs a tx spends.
+func (s *State) getMempoolParents(tx core.Tx) []core.HashT {
+	out := make([]core.HashT, 0)
+	for _, utxo := range tx.GetConsumedUtxos() {
+		if s.isMempoolTxOut(utxo) {
+			out = append(out, s.mempoolIds[utxo.TxId])
+		}
+	}
+	return out
+}
+
+// Get the mempool txs a tx spends the outputs of, recursively.
+func (s *State) getMempoolAncestors(tx core.Tx) *set.Set[core.HashT] {
+	out := set.NewSet[core.HashT]()
+	pending := s.getMempoolParents(tx)
+	for len(pending) > 0 {
+		txId := pending[0]
+		pending = pending[1:]
+		if out.Includes(txId) {
+			continue
+		}
+		out.Add(txId)
+		pending = append(pending, s.getMempoolParents(s.inv.GetTx(txId))...)
+	}
+	return out
+}
+
+// Check whether a new tx can join the mempool: each of its inputs must be unspent in our chain
+// or an output of a mempool tx, and it mustn't make any chain of unconfirmed txs too long.
+func (s *State) VerifyMempoolTx(tx core.Tx, maxChainLength uint64) error {
+	for _, utxo := range tx.GetConsumedUtxos() {
+		if !s.utxos.Includes(utxo) && !s.isMempoolTxOut(utxo) {
+			return fmt.Errorf("tx input not available %s[%d]", utxo.TxId, utxo.Ind)
+		}
+	}
+	if maxChainLength == 0 {
+		return nil
+	}
+	ancestors := s.getMempoolAncestors(tx)
+	if uint64(ancestors.Size())+1 > maxChainLength {
+		return fmt.Errorf(
+			"tx has %d unconfirmed ancestors, over the limit of %d",
+			ancestors.Size(), maxChainLength-1,
+		)
+	}
+	for _, ancestorId := range ancestors.ToList() {
+		// Descendants include the ancestor itself
+		descendants := s.getMempoolDescendants(ancestorId)
+		if uint64(descendants.Size())+1 > maxChainLength {
+			return fmt.Errorf(
+				"tx ancestor %s already has %d unconfirmed descendants, the limit",
+				ancestorId, descendants.Size()-1,
+			)
+		}
+	}
+	return nil
+}
+
+// Get the package of each includable mempool tx, sorted by package fee rate, descending.
+// A tx is includable if its MinBlock allows, it pays a fee, and each of its inputs is either
+// unspent in our chain or an output of an includable mempool tx. Ranking txs by the rate of
+// their package lets a high fee child pay for its low fee parents to be mined.
+func (s *State) GetSortedMempoolPackages() []mempoolPackage {
+	height := s.inv.GetBlockHeight(s.head)
+	// How many generations of unconfirmed ancestors each tx has, or -1 if it isn't includable
+	depths := make(map[core.HashT]int, s.mempool.Size())
+	var getDepth func(txId core.HashT) int
+	getDepth = func(txId core.HashT) int {
+		if depth, ok := depths[txId]; ok {
+			return depth
+		}
+		depths[txId] = -1
+		tx := s.inv.GetTx(txId)
+		if height+1 < tx.MinBlock || !tx.HasSurplus() {
+			return -1
+		}
+		depth := 0
+		for _, utxo := range tx.GetConsumedUtxos() {
+			if s.utxos.Includes(utxo) {
+				continue
+			} else if !s.isMempoolTxOut(utxo) {
+				return -1
+			}
+			parentDepth := getDepth(s.mempoolIds[utxo.TxId])
+			if parentDepth == -1 {
+				return -1
+			}
+			if parentDepth+1 > depth {
+				depth = parentDepth + 1
+			}
+		}
+		depths[txId] = depth
+		return depth
+	}
+	packages := make([]mempoolPackage, 0, s.mempool.Size())
+	for _, txId := range s.mempool.ToList() {
+		if getDepth(txId) == -1 {
+			continue
+		}
+		// Order the tx and its ancestors by depth, so parents come first
+		pkg := mempoolPackage{TxIds: append(s.getMempoolAncestors(s.inv.GetTx(txId)).ToList(), txId)}
+		sort.Slice(pkg.TxIds, func(i, j int) bool {
+			return depths[pkg.TxIds[i]] < depths[pkg.TxIds[j]]
+		})
+		for _, ancestorId := range pkg.TxIds {
+			tx := s.inv.GetTx(ancestorId)
+			pkg.Fee += txFee(tx)
+			pkg.VSize += tx.VSize()
+		}
+		packages = append(packages, pkg)
+	}
+	sort.Slice(packages, func(i, j int) bool {
+		// descending
+		return packages[i].Rate() > packages[j].Rate()
+	})
+	return packages
+}
+
+// Return stored txs to the mempool if they're in neither it nor our chain, as after being
+// evicted, so blocks including them can still be advanced to. This skips the mempool's checks,
+// so should only be done to a copy of the state that is discarded unless it includes them.
+func (s *State) RestoreMempoolTxs(txIds []core.HashT) {
+	for _, txId := range txIds {
+		if s.mempool.Includes(txId) || !s.inv.HasTx(txId) {
+			continue
+		}
+		tx := s.inv.GetTx(txId)
+		if _, ok := s.includedTxBlocks[tx.Id(s.inv.GetCoreParams())]; !ok {
+			s.AddMempoolTx(txId)
+		}
+	}
+}
+
+// Check that txs form a package: a child, last, and its unconfirmed ancestors, each after the
+// package txs it spends. So every tx but the child must be spent by a later one, otherwise a
+// single high fee tx could carry unrelated low fee txs past the min relay rate.
+func verifyPackageShape(params core.Params, txs []core.Tx) error {
+	if len(txs) == 0 {
+		return fmt.Errorf("package has no txs")
+	}
+	inds := make(map[core.HashT]int, len(txs))
+	for i, tx := range txs {
+		id := tx.Id(params)
+		if _, ok := inds[id]; ok {
+			return fmt.Errorf("package has tx %s more than once", id)
+		}
+		inds[id] = i
+	}
+	spent := make([]bool, len(txs))
+	for i, tx := range txs {
+		for _, utxo := range tx.GetConsumedUtxos() {
+			parentInd, ok := inds[utxo.TxId]
+			if !ok {
+				continue
+			} else if parentInd >= i {
+				return fmt.Errorf("package tx %d must come after tx %d it spends", parentInd, i)
+			}
+			spent[parentInd] = true
+		}
+	}
+	for i := range txs[:len(txs)-1] {
+		if !spent[i] {
+			return fmt.Errorf("package tx %d isn't spent by a later tx", i)
+		}
+	}
+	return nil
+}
+
+// An inventory that also knows some txs that aren't stored yet, so a package of txs spending
+// each other's outputs can be verified before any are stored.
+type pendingTxsInv struct {
+	inv.InvReader
+	// The pending txs by hash, and their hashes by id (see core.Tx.Id)
+	txs map[core.HashT]core.Tx
+	ids map[core.HashT]core.HashT
+}
+
+// Create an inventory reading through to the given one, with no pending txs yet.
+func newPendingTxsInv(base inv.InvReader) *pendingTxsInv {
+	return &pendingTxsInv{
+		InvReader: base,
+		txs:       make(map[core.HashT]core.Tx),
+		ids:       make(map[core.HashT]core.HashT),
+	}
+}
+
+// Add a pending tx.
+func (p *pendingTxsInv) add(tx core.Tx) {
+	p.txs[tx.Hash()] = tx
+	p.ids[tx.Id(p.GetCoreParams())] = tx.Hash()
+}
+
+func (p *pendingTxsInv) HasTx(txId core.HashT) bool {
+	_, ok := p.txs[txId]
+	return ok || p.InvReader.HasTx(txId)
+}
+
+func (p *pendingTxsInv) GetTx(txId core.HashT) core.Tx {
+	if tx, ok := p.txs[txId]; ok {
+		return tx
+	}
+	return p.InvReader.GetTx(txId)
+}
+
+func (p *pendingTxsInv) GetTxVSize(txId core.HashT) uint64 {
+	return p.GetTx(txId).VSize()
+}
+
+func (p *pendingTxsInv) HasTxById(txId core.HashT) bool {
+	_, ok := p.ids[txId]
+	return ok || p.InvReader.HasTxById(txId)
+}
+
+func (p *pendingTxsInv) GetTxHashById(txId core.HashT) core.HashT {
+	if txHash, ok := p.ids[txId]; ok {
+		return txHash
+	}
+	return p.InvReader.GetTxHashById(txId)
+}
+
+func (p *pendingTxsInv) GetTxById(txId core.HashT) core.Tx {
+	return p.GetTx(p.GetTxHashById(txId))
+}
+
+func (p *pendingTxsInv) HasTxOut(txId core.HashT, ind uint64) bool {
+	return p.HasTxById(txId) && ind < uint64(len(p.GetTxById(txId).Outputs))
+}
+
+func (p *pendingTxsInv) GetTxOut(txId core.HashT, ind uint64) core.TxOut {
+	return p.GetTxById(txId).Outputs[ind]
+}
+
+func (p *pendingTxsInv) HasEntity(entityId core.HashT) bool {
+	return p.HasMerkle(entityId) || p.HasTx(entityId)
+}
+
+func (p *pendingTxsInv) GetEntityVSize(entityId core.HashT) uint64 {
+	if p.HasMerkle(entityId) {
+		return p.GetMerkleVSize(entityId)
+	}
+	return p.GetTxVSize(entityId)
+}
@@ -0,0 +1,479 @@
+package chain
+
+import (
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/levilutz/basiccoin/internal/bus"
+	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+// Test that a full mempool evicts its lowest fee rate txs with their descendants, and raises
+// then decays the min relay rate.
+func TestTrimMempool(t *testing.T) {
+	params := core.DevNetParams()
+	state, _, memInv, _ := newIndexedState(t, Indexes{})
+	addTx := func(utxo core.Utxo, fee uint64) core.Tx {
+		tx := core.Tx{
+			MinBlock: 1,
+			Inputs:   []core.TxIn{{Utxo: utxo}},
+			Outputs:  []core.TxOut{{Value: utxo.Value - fee, PublicKeyHash: core.NewHashTRand()}},
+		}
+		memInv.StoreTrustedTx(tx)
+		state.AddMempoolTx(tx.Hash())
+		return tx
+	}
+	randUtxo := func() core.Utxo {
+		return core.Utxo{TxId: core.NewHashTRand(), Ind: 0, Value: 10000}
+	}
+
+	// A low rate parent with a lower rate child, and a medium rate tx
+	parent := addTx(randUtxo(), 100)
+	child := addTx(core.Utxo{TxId: parent.Id(params), Ind: 0, Value: parent.Outputs[0].Value}, 50)
+	medium := addTx(randUtxo(), 1000)
+	numTxs, vSize := state.GetMempoolSize()
+	util.Assert(t, numTxs == 3, "wrong mempool size: %d", numTxs)
+	util.Assert(t, state.TrimMempool(vSize).Size() == 0, "evicted from mempool within limit")
+
+	// The child goes first, then the parent, raising the min relay rate above the parent's
+	evicted := state.TrimMempool(vSize - child.VSize() - 1)
+	util.Assert(t, evicted.Size() == 2, "wrong number evicted: %d", evicted.Size())
+	util.Assert(t, evicted.Includes(parent.Hash()) && evicted.Includes(child.Hash()), "wrong txs evicted")
+	numTxs, vSize = state.GetMempoolSize()
+	util.Assert(t, numTxs == 1 && vSize == medium.VSize(), "wrong mempool after eviction")
+	util.Assert(t, len(state.GetMempoolUtxoSpenders(child.Inputs[0].Utxo)) == 0, "evicted spend kept")
+	minRate := parent.Rate() + core.IncrementalRelayRate
+	util.Assert(t, state.GetMinRelayRate() == minRate, "wrong min rate: %f", state.GetMinRelayRate())
+	util.Assert(t, state.VerifyTxRelayRate(parent) != nil, "accepted evicted rate")
+	util.AssertNoErr(t, state.VerifyTxRelayRate(medium))
+
+	// Evicted txs are still stored, so can be restored
+	util.Assert(t, !state.IsTxKnown(parent), "evicted tx still known")
+	state.RestoreMempoolTxs([]core.HashT{parent.Hash(), medium.Hash()})
+	numTxs, _ = state.GetMempoolSize()
+	util.Assert(t, numTxs == 2 && state.IsTxKnown(parent), "evicted tx not restored")
+
+	// The min relay rate only decays while the mempool is under half full
+	state.DecayMinRelayRate(vSize)
+	util.Assert(t, state.GetMinRelayRate() == minRate, "min rate decayed while full")
+	state.DecayMinRelayRate(vSize * 10)
+	util.Assert(t, state.GetMinRelayRate() == minRate/2, "min rate didn't decay")
+	for i := 0; i < 64; i++ {
+		state.DecayMinRelayRate(0)
+	}
+	util.Assert(t, state.GetMinRelayRate() == 0, "min rate didn't reach zero")
+}
+
+// Test that evicting a tx's descendant rescores it without the descendant's fee.
+func TestTrimMempoolRescores(t *testing.T) {
+	params := core.DevNetParams()
+	state, _, memInv, _ := newIndexedState(t, Indexes{})
+	addTx := func(utxos []core.Utxo, fee uint64, numOuts int) core.Tx {
+		tx := core.Tx{MinBlock: 1, Inputs: []core.TxIn{}, Outputs: []core.TxOut{}}
+		value := uint64(0)
+		for _, utxo := range utxos {
+			tx.Inputs = append(tx.Inputs, core.TxIn{Utxo: utxo})
+			value += utxo.Value
+		}
+		for i := 0; i < numOuts; i++ {
+			outValue := (value - fee) / uint64(numOuts)
+			tx.Outputs = append(tx.Outputs, core.TxOut{Value: outValue, PublicKeyHash: core.NewHashTRand()})
+		}
+		memInv.StoreTrustedTx(tx)
+		state.AddMempoolTx(tx.Hash())
+		return tx
+	}
+	randUtxo := func() core.Utxo {
+		return core.Utxo{TxId: core.NewHashTRand(), Ind: 0, Value: 100000}
+	}
+	outOf := func(tx core.Tx, ind uint64) core.Utxo {
+		return core.Utxo{TxId: tx.Id(params), Ind: ind, Value: tx.Outputs[ind].Value}
+	}
+
+	// A low rate parent with a high rate child and a tiny rate child, and a medium rate tx
+	parent := addTx([]core.Utxo{randUtxo()}, 100, 2)
+	child := addTx([]core.Utxo{outOf(parent, 0)}, 6000, 1)
+	tiny := addTx([]core.Utxo{outOf(parent, 1)}, 10, 1)
+	medium := addTx([]core.Utxo{randUtxo()}, 2500, 1)
+
+	// Counting the tiny child, the parent scores below the medium tx, but not without it
+	evicted := state.TrimMempool(parent.VSize() + child.VSize())
+	util.Assert(t, evicted.Size() == 2, "wrong number evicted: %d", evicted.Size())
+	util.Assert(t, evicted.Includes(tiny.Hash()) && evicted.Includes(medium.Hash()), "parent not rescored")
+	util.Assert(t, state.mempool.Includes(parent.Hash()), "parent evicted")
+}
+
+// Test that sweeping the mempool drops expired txs, and txs whose inputs were spent in our
+// chain, along with their descendants.
+func TestSweepMempool(t *testing.T) {
+	params := core.DevNetParams()
+	state, _, memInv, advance := newIndexedState(t, Indexes{})
+	coinbase := core.Tx{
+		IsCoinbase: true,
+		MinBlock:   1,
+		Outputs:    []core.TxOut{{Value: 10000, PublicKeyHash: core.NewHashTRand()}},
+	}
+	advance(coinbase)
+	addTx := func(utxo core.Utxo) core.Tx {
+		tx := core.Tx{
+			MinBlock: 2,
+			Inputs:   []core.TxIn{{Utxo: utxo}},
+			Outputs:  []core.TxOut{{Value: utxo.Value - 100, PublicKeyHash: core.NewHashTRand()}},
+		}
+		memInv.StoreTrustedTx(tx)
+		state.AddMempoolTx(tx.Hash())
+		return tx
+	}
+	outOf := func(tx core.Tx) core.Utxo {
+		return core.Utxo{TxId: tx.Id(params), Ind: 0, Value: tx.Outputs[0].Value}
+	}
+
+	// A spend of the coinbase with a child, and a tx spending a utxo that doesn't exist
+	utxo := outOf(coinbase)
+	spend := addTx(utxo)
+	child := addTx(outOf(spend))
+	missing := addTx(core.Utxo{TxId: core.NewHashTRand(), Ind: 0, Value: 10000})
+	expired, unspendable := state.SweepMempool(time.Now(), time.Hour)
+	util.Assert(t, expired.Size() == 0, "dropped fresh txs as expired")
+	util.Assert(t, unspendable.Size() == 1 && unspendable.Includes(missing.Hash()), "wrong unspendable txs")
+	numTxs, _ := state.GetMempoolSize()
+	util.Assert(t, numTxs == 2, "dropped spendable txs")
+
+	// A conflicting spend mined in our chain makes the spend and its child unspendable
+	conflict := core.Tx{
+		MinBlock: 2,
+		Inputs:   []core.TxIn{{Utxo: utxo}},
+		Outputs:  []core.TxOut{{Value: 9000, PublicKeyHash: core.NewHashTRand()}},
+	}
+	memInv.StoreTrustedTx(conflict)
+	state.AddMempoolTx(conflict.Hash())
+	advance(core.Tx{
+		IsCoinbase: true,
+		MinBlock:   2,
+		Outputs:    []core.TxOut{{Value: 10000, PublicKeyHash: core.NewHashTRand()}},
+	}, conflict)
+	_, unspendable = state.SweepMempool(time.Now(), time.Hour)
+	util.Assert(t, unspendable.Size() == 2, "wrong number unspendable: %d", unspendable.Size())
+	util.Assert(t, unspendable.Includes(spend.Hash()) && unspendable.Includes(child.Hash()), "wrong unspendable txs")
+
+	// Txs expire after the max age, unless it's 0
+	pending := addTx(outOf(conflict))
+	expired, _ = state.SweepMempool(time.Now().Add(2*time.Hour), 0)
+	util.Assert(t, expired.Size() == 0, "expired txs without max age")
+	expired, unspendable = state.SweepMempool(time.Now().Add(2*time.Hour), time.Hour)
+	util.Assert(t, expired.Size() == 1 && expired.Includes(pending.Hash()), "wrong expired txs")
+	util.Assert(t, unspendable.Size() == 0, "expired tx also unspendable")
+	numTxs, vSize := state.GetMempoolSize()
+	util.Assert(t, numTxs == 0 && vSize == 0, "mempool not empty: %d txs", numTxs)
+}
+
+// Test that a conflicting tx only replaces mempool txs when it pays a higher fee and fee rate.
+func TestMempoolReplacement(t *testing.T) {
+	params := core.DevNetParams()
+	state, _, memInv, _ := newIndexedState(t, Indexes{})
+	storeTx := func(utxo core.Utxo, fee uint64, numOutputs int) core.Tx {
+		tx := core.Tx{MinBlock: 1, Inputs: []core.TxIn{{Utxo: utxo}}}
+		for i := 0; i < numOutputs; i++ {
+			value := (utxo.Value - fee) / uint64(numOutputs)
+			tx.Outputs = append(tx.Outputs, core.TxOut{Value: value, PublicKeyHash: core.NewHashTRand()})
+		}
+		tx.Outputs[0].Value += utxo.Value - fee - tx.OutputsValue()
+		memInv.StoreTrustedTx(tx)
+		return tx
+	}
+	utxo := core.Utxo{TxId: core.NewHashTRand(), Ind: 0, Value: 100000}
+
+	// A tx with a child
+	original := storeTx(utxo, 1000, 1)
+	replaced, err := state.AddMempoolReplacement(original.Hash())
+	util.AssertNoErr(t, err)
+	util.Assert(t, replaced.Size() == 0, "replaced without conflicts")
+	originalOut := core.Utxo{TxId: original.Id(params), Ind: 0, Value: original.Outputs[0].Value}
+	child := storeTx(originalOut, 1000, 1)
+	_, err = state.AddMempoolReplacement(child.Hash())
+	util.AssertNoErr(t, err)
+
+	// A higher rate but lower total fee than the original and child together is rejected
+	_, err = state.AddMempoolReplacement(storeTx(utxo, 1500, 1).Hash())
+	util.Assert(t, err != nil, "replaced with lower total fee")
+	// A higher total fee but lower rate than the original is rejected
+	_, err = state.AddMempoolReplacement(storeTx(utxo, 2500, 100).Hash())
+	util.Assert(t, err != nil, "replaced with lower fee rate")
+	// Only just beating the total fee doesn't pay to relay the replacement
+	_, err = state.AddMempoolReplacement(storeTx(utxo, 2001, 1).Hash())
+	util.Assert(t, err != nil, "replaced without paying the incremental rate")
+	numTxs, _ := state.GetMempoolSize()
+	util.Assert(t, numTxs == 2, "rejected replacement changed mempool")
+
+	// A higher fee and rate replaces both
+	replacement := storeTx(utxo, 3000, 1)
+	replaced, err = state.AddMempoolReplacement(replacement.Hash())
+	util.AssertNoErr(t, err)
+	util.Assert(t, replaced.Size() == 2, "wrong number replaced: %d", replaced.Size())
+	util.Assert(t, replaced.Includes(original.Hash()) && replaced.Includes(child.Hash()), "wrong txs replaced")
+	util.Assert(t, state.IsTxKnown(replacement) && !state.IsTxKnown(original), "replacement not in mempool")
+	spenders := state.GetMempoolUtxoSpenders(utxo)
+	util.Assert(t, len(spenders) == 1 && spenders[0] == replacement.Id(params), "wrong utxo spenders")
+
+	// Replacing too many txs is rejected, however much it pays
+	wide := storeTx(core.Utxo{TxId: core.NewHashTRand(), Ind: 0, Value: 100000}, 1000, maxMempoolReplaced)
+	_, err = state.AddMempoolReplacement(wide.Hash())
+	util.AssertNoErr(t, err)
+	for i := range wide.Outputs {
+		wideOut := core.Utxo{TxId: wide.Id(params), Ind: uint64(i), Value: wide.Outputs[i].Value}
+		_, err = state.AddMempoolReplacement(storeTx(wideOut, 10, 1).Hash())
+		util.AssertNoErr(t, err)
+	}
+	_, err = state.AddMempoolReplacement(storeTx(wide.Inputs[0].Utxo, 50000, 1).Hash())
+	util.Assert(t, err != nil, "replaced more than the max txs")
+}
+
+// Test that a high fee child is ranked with its low fee parent, both for mining and eviction.
+func TestMempoolPackages(t *testing.T) {
+	params := core.DevNetParams()
+	state, _, memInv, advance := newIndexedState(t, Indexes{})
+	coinbase := core.Tx{
+		IsCoinbase: true,
+		MinBlock:   1,
+		Outputs: []core.TxOut{
+			{Value: 100000, PublicKeyHash: core.NewHashTRand()},
+		},
+	}
+	advance(coinbase)
+	addTx := func(utxo core.Utxo, fee uint64) core.Tx {
+		tx := core.Tx{
+			MinBlock: 2,
+			Inputs:   []core.TxIn{{Utxo: utxo}},
+			Outputs:  []core.TxOut{{Value: utxo.Value - fee, PublicKeyHash: core.NewHashTRand()}},
+		}
+		memInv.StoreTrustedTx(tx)
+		state.AddMempoolTx(tx.Hash())
+		return tx
+	}
+	outOf := func(tx core.Tx) core.Utxo {
+		return core.Utxo{TxId: tx.Id(params), Ind: 0, Value: tx.Outputs[0].Value}
+	}
+
+	// A low rate parent with a high rate child, a medium rate tx, and an unspendable tx
+	parent := addTx(outOf(coinbase), 100)
+	child := addTx(outOf(parent), 5000)
+	medium := addTx(core.Utxo{TxId: core.NewHashTRand(), Ind: 0, Value: 10000}, 1000)
+	state.utxos.Add(medium.Inputs[0].Utxo)
+	addTx(core.Utxo{TxId: core.NewHashTRand(), Ind: 0, Value: 10000}, 2000)
+	packages := state.GetSortedMempoolPackages()
+	util.Assert(t, len(packages) == 3, "wrong number of packages: %d", len(packages))
+	top := packages[0]
+	util.Assert(t, len(top.TxIds) == 2 && top.TxIds[0] == parent.Hash() && top.TxIds[1] == child.Hash(),
+		"child not ranked first with its parent: %v", top.TxIds)
+	util.Assert(t, top.Fee == 5100 && top.VSize == parent.VSize()+child.VSize(), "wrong package totals")
+	util.Assert(t, packages[1].TxIds[0] == medium.Hash(), "medium tx not ranked second")
+	util.Assert(t, packages[2].TxIds[0] == parent.Hash() && len(packages[2].TxIds) == 1, "parent not last")
+
+	// The package rate admits a parent below the min relay rate
+	state.minRelayRate = parent.Rate() + 1
+	util.Assert(t, state.VerifyTxRelayRate(parent) != nil, "accepted parent alone")
+	util.AssertNoErr(t, state.VerifyPackageRelayRate([]core.Tx{parent, child}))
+
+	// The child keeps its parent from eviction, but their eviction takes both
+	evicted := state.TrimMempool(parent.VSize() + child.VSize() + 1)
+	util.Assert(t, evicted.Size() == 2 && evicted.Includes(medium.Hash()), "parent not kept by child")
+	evicted = state.TrimMempool(1)
+	util.Assert(t, evicted.Includes(parent.Hash()) && evicted.Includes(child.Hash()), "child kept without parent")
+}
+
+// Test that a package must be a child last with its parents, and is accepted all or nothing.
+func TestCandidatePackage(t *testing.T) {
+	params := core.DevNetParams()
+	state, _, memInv, advance := newIndexedState(t, Indexes{})
+	priv, err := core.NewEcdsa()
+	util.AssertNoErr(t, err)
+	pub, err := core.MarshalEcdsaPublic(priv)
+	util.AssertNoErr(t, err)
+	pkh := core.DHashBytes(pub)
+	coinbase := core.Tx{
+		IsCoinbase: true,
+		MinBlock:   1,
+		Outputs: []core.TxOut{
+			{Value: 100000, PublicKeyHash: pkh},
+			{Value: 100000, PublicKeyHash: pkh},
+		},
+	}
+	advance(coinbase)
+	c := &Chain{
+		bus:           bus.NewBus(),
+		inv:           memInv,
+		state:         state,
+		mempoolParams: MempoolParams{MaxChainLength: 25},
+	}
+	spend := func(tx core.Tx, ind uint64, rate float64) core.Tx {
+		utxo := core.Utxo{TxId: tx.Id(params), Ind: ind, Value: tx.Outputs[ind].Value}
+		out, err := core.MakeOutboundTx(
+			params,
+			[]crypto.Signer{priv},
+			map[core.Utxo]core.HashT{utxo: pkh},
+			map[core.HashT]uint64{pkh: utxo.Value / 2},
+			rate,
+			2,
+		)
+		util.AssertNoErr(t, err)
+		return *out
+	}
+	parentOut := func(parent core.Tx) uint64 {
+		for i, txo := range parent.Outputs {
+			if txo.Value == parent.Inputs[0].Utxo.Value/2 {
+				return uint64(i)
+			}
+		}
+		t.Fatal("parent has no output to spend")
+		return 0
+	}
+	addPackage := func(txs ...core.Tx) error {
+		return c.handleCandidatePackage(bus.CandidatePackageEvent{Txs: txs})
+	}
+	parent := spend(coinbase, 0, 1)
+	child := spend(parent, parentOut(parent), 50)
+	other := spend(coinbase, 1, 50)
+	state.minRelayRate = 5
+
+	// Unrelated txs and children before their parents aren't packages
+	util.Assert(t, addPackage(parent, other) != nil, "accepted unrelated txs")
+	util.Assert(t, addPackage(child, parent) != nil, "accepted child before parent")
+	util.Assert(t, addPackage(parent, child, child) != nil, "accepted duplicate child")
+
+	// A bad child leaves its parent neither stored nor in the mempool
+	badChild := child
+	badChild.Outputs = append([]core.TxOut{}, child.Outputs...)
+	badChild.Outputs[0].Value--
+	util.Assert(t, addPackage(parent, badChild) != nil, "accepted bad child")
+	util.Assert(t, !memInv.HasTx(parent.Hash()), "stored parent of bad child")
+	util.Assert(t, !state.mempool.Includes(parent.Hash()), "added parent of bad child")
+
+	// The child's fee carries its parent past the min relay rate
+	util.AssertNoErr(t, addPackage(parent, child))
+	util.Assert(t, state.mempool.Includes(parent.Hash()), "parent not added")
+	util.Assert(t, state.mempool.Includes(child.Hash()), "child not added")
+}
+
+// Test that the txs of a rejected head only enter the mempool if they'd be accepted alone.
+func TestRejectedHeadTxs(t *testing.T) {
+	params := core.DevNetParams()
+	state, _, memInv, advance := newIndexedState(t, Indexes{})
+	priv, err := core.NewEcdsa()
+	util.AssertNoErr(t, err)
+	pub, err := core.MarshalEcdsaPublic(priv)
+	util.AssertNoErr(t, err)
+	pkh := core.DHashBytes(pub)
+	coinbase := core.Tx{
+		IsCoinbase: true,
+		MinBlock:   1,
+		Outputs: []core.TxOut{
+			{Value: 100000, PublicKeyHash: pkh},
+			{Value: 100000, PublicKeyHash: pkh},
+		},
+	}
+	advance(coinbase)
+	c := &Chain{
+		bus:           bus.NewBus(),
+		inv:           memInv,
+		state:         state,
+		mempoolParams: MempoolParams{MaxChainLength: 25},
+	}
+	spend := func(ind uint64, rate float64) core.Tx {
+		utxo := core.Utxo{TxId: coinbase.Id(params), Ind: ind, Value: coinbase.Outputs[ind].Value}
+		out, err := core.MakeOutboundTx(
+			params,
+			[]crypto.Signer{priv},
+			map[core.Utxo]core.HashT{utxo: pkh},
+			map[core.HashT]uint64{pkh: utxo.Value / 2},
+			rate,
+			2,
+		)
+		util.AssertNoErr(t, err)
+		return *out
+	}
+	cheap := spend(0, 1)
+	good := spend(1, 50)
+	otherCoinbase := core.Tx{
+		IsCoinbase: true,
+		MinBlock:   2,
+		Outputs:    []core.TxOut{{Value: 100000, PublicKeyHash: pkh}},
+	}
+	state.minRelayRate = 5
+
+	// Our own head is no improvement, so is rejected
+	err = c.handleCandidateHead(bus.CandidateHeadEvent{
+		Head: state.head,
+		Txs:  []core.Tx{otherCoinbase, cheap, good},
+	})
+	util.Assert(t, err != nil, "accepted head without more work")
+	util.Assert(t, !state.mempool.Includes(otherCoinbase.Hash()), "coinbase added")
+	util.Assert(t, !state.mempool.Includes(cheap.Hash()), "tx below min relay rate added")
+	util.Assert(t, state.mempool.Includes(good.Hash()), "tx not added")
+}
+
+// Test that txs spending unconfirmed outputs are accepted up to the chain length limit, and
+// mined after their ancestors.
+func TestUnconfirmedChains(t *testing.T) {
+	params := core.DevNetParams()
+	state, _, memInv, advance := newIndexedState(t, Indexes{})
+	coinbase := core.Tx{
+		IsCoinbase: true,
+		MinBlock:   1,
+		Outputs:    []core.TxOut{{Value: 100000, PublicKeyHash: core.NewHashTRand()}},
+	}
+	advance(coinbase)
+	makeTx := func(utxo core.Utxo, numOutputs int) core.Tx {
+		tx := core.Tx{MinBlock: 2, Inputs: []core.TxIn{{Utxo: utxo}}}
+		for i := 0; i < numOutputs; i++ {
+			value := (utxo.Value - 100) / uint64(numOutputs)
+			tx.Outputs = append(tx.Outputs, core.TxOut{Value: value, PublicKeyHash: core.NewHashTRand()})
+		}
+		return tx
+	}
+	addTx := func(tx core.Tx) {
+		util.AssertNoErr(t, state.VerifyMempoolTx(tx, 3))
+		memInv.StoreTrustedTx(tx)
+		state.AddMempoolTx(tx.Hash())
+	}
+	outOf := func(tx core.Tx, ind int) core.Utxo {
+		return core.Utxo{TxId: tx.Id(params), Ind: uint64(ind), Value: tx.Outputs[ind].Value}
+	}
+
+	// A chain of 3 is accepted, with the middle tx splitting its output
+	first := makeTx(core.Utxo{TxId: coinbase.Id(params), Ind: 0, Value: 100000}, 1)
+	addTx(first)
+	second := makeTx(outOf(first, 0), 2)
+	addTx(second)
+	third := makeTx(outOf(second, 0), 1)
+	addTx(third)
+	util.Assert(t, state.isMempoolTxOut(outOf(third, 0)), "unconfirmed output not tracked")
+	err := state.VerifyMempoolTx(makeTx(core.Utxo{TxId: core.NewHashTRand(), Value: 10}, 1), 3)
+	util.Assert(t, err != nil, "accepted tx spending unknown output")
+
+	// A 4th generation is too long, as is a 2nd child of the middle tx
+	util.Assert(t, state.VerifyMempoolTx(makeTx(outOf(third, 0), 1), 3) != nil, "accepted too many ancestors")
+	util.Assert(t, state.VerifyMempoolTx(makeTx(outOf(second, 1), 1), 3) != nil, "accepted too many descendants")
+	util.AssertNoErr(t, state.VerifyMempoolTx(makeTx(outOf(second, 1), 1), 0))
+
+	// The chain is mined in dependency order
+	packages := state.GetSortedMempoolPackages()
+	var longest mempoolPackage
+	for _, pkg := range packages {
+		if len(pkg.TxIds) > len(longest.TxIds) {
+			longest = pkg
+		}
+	}
+	util.Assert(t, len(longest.TxIds) == 3 && longest.TxIds[0] == first.Hash() &&
+		longest.TxIds[1] == second.Hash() && longest.TxIds[2] == third.Hash(), "wrong package order")
+
+	// Dropping a tx drops its unconfirmed outputs
+	util.AssertNoErr(t, state.removeMempoolTx(third.Hash()))
+	util.Assert(t, !state.isMempoolTxOut(outOf(third, 0)), "dropped output still tracked")
+
+	// A parent and child can be mined in the same block
+	advance(first, second)
+	util.Assert(t, !state.isMempoolTxOut(outOf(second, 1)), "mined output still unconfirmed")
+	util.Assert(t, state.utxos.Includes(outOf(second, 1)), "mined output not in utxo set")
+}
@@ -0,0 +1,213 @@
+package chain
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/levilutz/basiccoin/internal/inv"
+	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/set"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+// The utxo set and chain at some head, that a new node can bootstrap from instead of syncing
+// the whole chain. Serialized deterministically, so its hash identifies it.
+type utxoSnapshot struct {
+	// Every block from height 1 to the head, oldest first
+	Blocks []snapshotBlock `json:"blocks"`
+	// Txs with any unspent outputs, sorted by hash
+	Txs []core.Tx `json:"txs"`
+	// The unspent outputs, sorted by tx id then index
+	Utxos []core.Utxo `json:"utxos"`
+	// The utxo set hash of the utxos (see State.GetUtxoHash)
+	UtxoHash core.HashT `json:"utxoHash"`
+}
+
+// A block header in a snapshot, with the txs it included.
+type snapshotBlock struct {
+	Block core.Block `json:"block"`
+	// Ids (see core.Tx.Id) of the block's txs, sorted
+	TxIds []core.HashT `json:"txIds"`
+}
+
+// Serialize a state's chain and utxo set into a snapshot, and get its hash.
+// If several malleated versions of a tx are known, the one included in our chain is used.
+func exportSnapshot(state *State) ([]byte, core.HashT, error) {
+	if state.head.EqZero() {
+		return nil, core.HashT{}, fmt.Errorf("cannot snapshot the zero block")
+	}
+	blockIds := util.Reverse(state.inv.GetBlockAncestorsUntil(state.head, core.HashT{}))
+	blockIds = append(blockIds, state.head)
+	blockTxIds := make(map[core.HashT][]core.HashT, len(blockIds))
+	for txId, blockId := range state.includedTxBlocks {
+		blockTxIds[blockId] = append(blockTxIds[blockId], txId)
+	}
+	snap := utxoSnapshot{
+		Blocks:   make([]snapshotBlock, len(blockIds)),
+		Txs:      make([]core.Tx, 0),
+		Utxos:    state.utxos.ToList(),
+		UtxoHash: state.GetUtxoHash(),
+	}
+	for i, blockId := range blockIds {
+		txIds := blockTxIds[blockId]
+		sortHashes(txIds)
+		snap.Blocks[i] = snapshotBlock{
+			Block: state.inv.GetBlock(blockId),
+			TxIds: txIds,
+		}
+	}
+	txHashes := set.NewSet[core.HashT]()
+	for _, utxo := range snap.Utxos {
+		txHashes.Add(state.inv.GetTxHashById(utxo.TxId))
+	}
+	sortedTxHashes := txHashes.ToList()
+	sortHashes(sortedTxHashes)
+	for _, txHash := range sortedTxHashes {
+		snap.Txs = append(snap.Txs, state.inv.GetTx(txHash))
+	}
+	sort.Slice(snap.Utxos, func(i, j int) bool {
+		if snap.Utxos[i].TxId != snap.Utxos[j].TxId {
+			return snap.Utxos[i].TxId.Lt(snap.Utxos[j].TxId)
+		}
+		return snap.Utxos[i].Ind < snap.Utxos[j].Ind
+	})
+	raw, err := json.Marshal(snap)
+	if err != nil {
+		return nil, core.HashT{}, err
+	}
+	return raw, core.DHashBytes(raw), nil
+}
+
+// Parse a snapshot, if its hash is trusted by the network.
+func parseSnapshot(raw []byte, params core.Params) (utxoSnapshot, core.HashT, error) {
+	hash := core.DHashBytes(raw)
+	if !params.IsTrustedSnapshot(hash) {
+		return utxoSnapshot{}, core.HashT{}, fmt.Errorf("snapshot not trusted: %s", hash)
+	}
+	var snap utxoSnapshot
+	if err := json.Unmarshal(raw, &snap); err != nil {
+		return utxoSnapshot{}, core.HashT{}, fmt.Errorf("failed to parse snapshot: %s", err)
+	} else if len(snap.Blocks) == 0 {
+		return utxoSnapshot{}, core.HashT{}, fmt.Errorf("snapshot has no blocks")
+	}
+	return snap, hash, nil
+}
+
+// Store the snapshot's block headers and txs into the inv, and build the state it describes.
+func (snap utxoSnapshot) restore(inv *inv.Inv) (*State, error) {
+	state := NewState(inv)
+	for _, sb := range snap.Blocks {
+		blockId := sb.Block.Hash()
+		if sb.Block.PrevBlockId != state.head {
+			return nil, fmt.Errorf("snapshot block %s not based on %s", blockId, state.head)
+		}
+		if !inv.HasBlock(blockId) {
+			if err := inv.StoreTrustedBlock(sb.Block); err != nil {
+				return nil, err
+			}
+		}
+		for _, txId := range sb.TxIds {
+			if existing, ok := state.includedTxBlocks[txId]; ok {
+				return nil, fmt.Errorf("snapshot tx %s included twice, in %s", txId, existing)
+			}
+			state.includedTxBlocks[txId] = blockId
+		}
+		state.head = blockId
+		state.mainChain = append(state.mainChain, blockId)
+	}
+	txs := make(map[core.HashT]core.Tx, len(snap.Txs))
+	for _, tx := range snap.Txs {
+		inv.StoreTrustedTx(tx)
+		txs[tx.Id(inv.GetCoreParams())] = tx
+	}
+	for _, utxo := range snap.Utxos {
+		tx, ok := txs[utxo.TxId]
+		if !ok || utxo.Ind >= uint64(len(tx.Outputs)) {
+			return nil, fmt.Errorf("snapshot utxo has no tx output %s[%d]", utxo.TxId, utxo.Ind)
+		}
+		txo := tx.Outputs[utxo.Ind]
+		if txo.IsData() || txo.Value != utxo.Value {
+			return nil, fmt.Errorf("snapshot utxo mismatches tx output %s[%d]", utxo.TxId, utxo.Ind)
+		}
+		state.utxos.Add(utxo)
+		state.creditBalance(txo.PublicKeyHash, utxo)
+	}
+	if hash := state.GetUtxoHash(); hash != snap.UtxoHash {
+		return nil, fmt.Errorf("snapshot utxo hash mismatch: %s != %s", hash, snap.UtxoHash)
+	}
+	state.blockUtxoHashes[state.head] = snap.UtxoHash
+	return state, nil
+}
+
+// Bootstrap an empty chain from the trusted snapshot at the given path.
+// Block contents below the snapshot's head are treated as pruned, while its history is
+// fetched from peers and replayed in the background to verify it.
+func (c *Chain) LoadSnapshot(path string) error {
+	if c.stateStore == nil {
+		return fmt.Errorf("loading a snapshot requires a save dir")
+	} else if len(c.recentHeads) > 0 {
+		return fmt.Errorf("chain already has a saved head")
+	} else if c.indexes.Any() {
+		return fmt.Errorf("cannot build indexes from a snapshot, as it has no tx history")
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	snap, hash, err := parseSnapshot(raw, c.inv.GetCoreParams())
+	if err != nil {
+		return err
+	}
+	c.inv.BeginBatch()
+	state, err := snap.restore(c.inv)
+	if err != nil {
+		c.inv.DiscardBatch()
+		return err
+	}
+	if err := c.inv.CommitBatch(); err != nil {
+		return err
+	}
+	if err := c.stateStore.Reset(state, hash); err != nil {
+		return err
+	}
+	state.EnableJournal()
+	c.state = state
+	c.prunedHeight = c.inv.GetBlockHeight(state.head)
+	c.inv.SetPrunedHeight(c.prunedHeight)
+	if err := c.saveHeadToFile(state.head); err != nil {
+		return err
+	}
+	fmt.Printf(
+		"loaded snapshot %s at height %d, validating history in background\n",
+		hash, c.prunedHeight,
+	)
+	c.startHistory(hash, state.head)
+	return nil
+}
+
+// Export a snapshot of our chain at the given block, which must be on our chain and not
+// below the pruned height. The zero block means our head.
+func (c *Chain) exportSnapshotAt(blockId core.HashT) ([]byte, core.HashT, error) {
+	if blockId.EqZero() {
+		blockId = c.state.head
+	}
+	if _, ok := c.inv.GetBlockAncestorDepth(c.state.head, blockId); !ok {
+		return nil, core.HashT{}, fmt.Errorf("block not on our chain: %s", blockId)
+	} else if c.inv.GetBlockHeight(blockId) < c.prunedHeight {
+		return nil, core.HashT{}, fmt.Errorf("block below pruned height %d", c.prunedHeight)
+	}
+	state := c.state
+	if blockId != c.state.head {
+		state = c.state.Copy()
+		state.DisableJournal()
+		state.RewindUntil(blockId)
+	}
+	return exportSnapshot(state)
+}
+
+// Sort hashes ascending.
+func sortHashes(hashes []core.HashT) {
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i].Lt(hashes[j]) })
+}
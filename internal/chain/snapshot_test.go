@@ -0,0 +1,74 @@
+package chain
+
+import (
+	"testing"
+
+	"github.com/levilutz/basiccoin/internal/inv"
+	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+// Test that a snapshot restores the state it was exported from, and re-exports identically.
+func TestSnapshotRoundTrip(t *testing.T) {
+	params := core.DevNetParams()
+	srcInv := inv.NewInv(params, nil, inv.StoreParams{})
+	easiest := core.NewHashTFromStringAssert(
+		"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+	)
+	pkhA, pkhB := core.NewHashTRand(), core.NewHashTRand()
+
+	// Two blocks, each with a coinbase, where only some outputs remain unspent
+	state := NewState(srcInv)
+	for height := uint64(1); height <= 2; height++ {
+		tx := core.Tx{
+			IsCoinbase: true,
+			MinBlock:   height,
+			Inputs:     []core.TxIn{},
+			Outputs: []core.TxOut{
+				{Value: 600, PublicKeyHash: pkhA},
+				{Value: 400, PublicKeyHash: pkhB},
+			},
+		}
+		srcInv.StoreTrustedTx(tx)
+		block := core.Block{
+			PrevBlockId: state.head,
+			MerkleRoot:  tx.Hash(),
+			Target:      easiest,
+			Noise:       core.NewHashTRand(),
+		}
+		util.AssertNoErr(t, srcInv.StoreTrustedBlock(block))
+		id := tx.Id(params)
+		state.head = block.Hash()
+		state.includedTxBlocks[id] = state.head
+		for i, txo := range tx.Outputs {
+			if height == 1 && i == 1 {
+				continue
+			}
+			utxo := core.Utxo{TxId: id, Ind: uint64(i), Value: txo.Value}
+			state.utxos.Add(utxo)
+			state.creditBalance(txo.PublicKeyHash, utxo)
+		}
+	}
+	raw, hash, err := exportSnapshot(state)
+	util.AssertNoErr(t, err)
+
+	_, _, err = parseSnapshot(raw, params)
+	util.Assert(t, err != nil, "untrusted snapshot parsed")
+	params.TrustedSnapshots = []core.HashT{hash}
+	snap, parsedHash, err := parseSnapshot(raw, params)
+	util.AssertNoErr(t, err)
+	util.Assert(t, parsedHash == hash, "parsed hash mismatch")
+
+	dstInv := inv.NewInv(params, nil, inv.StoreParams{})
+	restored, err := snap.restore(dstInv)
+	util.AssertNoErr(t, err)
+	util.Assert(t, restored.head == state.head, "wrong head")
+	util.Assert(t, dstInv.GetBlockHeight(restored.head) == 2, "wrong head height")
+	util.Assert(t, restored.GetPkhBalance(pkhA) == 1200, "wrong balance A")
+	util.Assert(t, restored.GetPkhBalance(pkhB) == 400, "wrong balance B")
+	util.Assert(t, len(restored.includedTxBlocks) == 2, "wrong included txs")
+	util.Assert(t, restored.GetUtxoHash() == state.GetUtxoHash(), "wrong utxo hash")
+	_, rehash, err := exportSnapshot(restored)
+	util.AssertNoErr(t, err)
+	util.Assert(t, rehash == hash, "re-exported snapshot differs")
+}
@@ -3,9 +3,11 @@ package chain
 import (
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/levilutz/basiccoin/internal/inv"
 	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/muhash"
 	"github.com/levilutz/basiccoin/pkg/set"
 	"github.com/levilutz/basiccoin/pkg/util"
 )
@@ -16,6 +18,9 @@ type State struct {
 	// The head of our current chain
 	head core.HashT
 
+	// The id of each block of our chain, by height, from the zero block to head
+	mainChain []core.HashT
+
 	// The set of txs we have verified but are not included in current chain
 	mempool *set.Set[core.HashT]
 
@@ -28,27 +33,107 @@ type State struct {
 	// The fee rate for every tx in our mempool
 	mempoolRates map[core.HashT]float64
 
+	// When each tx in our mempool entered it
+	mempoolTimes map[core.HashT]time.Time
+
+	// The hash of each tx in our mempool, by tx id (see core.Tx.Id), to find unconfirmed parents
+	mempoolIds map[core.HashT]core.HashT
+
+	// The outputs created by txs in our mempool, which other mempool txs may spend
+	mempoolUtxos *set.Set[core.Utxo]
+
 	// For each utxo spent in the mempool, which mempool txIds spend it
 	mempoolUtxoSpends map[core.Utxo]*set.Set[core.HashT]
 
+	// The total vSize of the txs in our mempool
+	mempoolVSize uint64
+
+	// The fee rate below which txs aren't accepted to our mempool, raised by evictions
+	minRelayRate float64
+
 	// The set of utxos controlled by each public key hash with a balance
 	pkhUtxos map[core.HashT]*set.Set[core.Utxo]
 
-	// The block id at which each transaction was included
+	// The block id at which each transaction was included, by tx id (see core.Tx.Id)
 	includedTxBlocks map[core.HashT]core.HashT
+
+	// The ids of the txs crediting or debiting each public key hash, in chain order
+	// Nil unless the index is enabled
+	pkhTxs map[core.HashT][]core.HashT
+
+	// The tx (see core.Tx.Id) and block spending each utxo spent on our chain
+	// Nil unless the index is enabled
+	utxoSpenders map[core.Utxo]utxoSpender
+
+	// An incremental hash of the utxo set, and the pkh controlling each utxo
+	utxoHash *muhash.MuHash
+
+	// The utxo set hash after each block of our chain, where known
+	blockUtxoHashes map[core.HashT]core.HashT
+
+	// Whether to record the changes made by each Advance and Rewind, for persisting
+	journaling bool
+
+	// Changes made since the journal was last taken, oldest first
+	journal []stateChange
+}
+
+// A utxo along with the public key hash controlling it.
+type pkhUtxo struct {
+	Utxo core.Utxo  `json:"utxo"`
+	Pkh  core.HashT `json:"pkh"`
+}
+
+// An entry of a public key hash's tx history, at the given position.
+type pkhTx struct {
+	Pkh  core.HashT `json:"pkh"`
+	Ind  uint64     `json:"ind"`
+	TxId core.HashT `json:"txId"`
+}
+
+// The tx id (see core.Tx.Id) and block spending a utxo.
+type utxoSpender struct {
+	TxId    core.HashT
+	BlockId core.HashT
+}
+
+// How advancing to a block changed the utxo set and tx inclusions, so it can be undone.
+type blockUndo struct {
+	BlockId core.HashT   `json:"blockId"`
+	Spent   []pkhUtxo    `json:"spent"`
+	Created []pkhUtxo    `json:"created"`
+	TxIds   []core.HashT `json:"txIds"`
+	// The utxo set hash after the block
+	UtxoHash core.HashT `json:"utxoHash"`
+	// The tx history entries added, if indexing them
+	PkhTxs []pkhTx `json:"pkhTxs,omitempty"`
+	// The id of the tx spending each of Spent, if indexing spenders
+	SpentBy []core.HashT `json:"spentBy,omitempty"`
+}
+
+// A single Advance or Rewind. Rewinds only set Undo.BlockId, the block rewound.
+type stateChange struct {
+	Advanced bool
+	Undo     blockUndo
 }
 
 // Create a new empty state at the chain zero block.
 func NewState(inv inv.InvReader) *State {
 	return &State{
 		head:              core.HashT{},
+		mainChain:         []core.HashT{{}},
 		mempool:           set.NewSet[core.HashT](),
 		utxos:             set.NewSet[core.Utxo](),
 		inv:               inv,
 		mempoolRates:      make(map[core.HashT]float64),
+		mempoolTimes:      make(map[core.HashT]time.Time),
+		mempoolIds:        make(map[core.HashT]core.HashT),
+		mempoolUtxos:      set.NewSet[core.Utxo](),
 		mempoolUtxoSpends: make(map[core.Utxo]*set.Set[core.HashT]),
 		pkhUtxos:          make(map[core.HashT]*set.Set[core.Utxo]),
 		includedTxBlocks:  make(map[core.HashT]core.HashT),
+		utxoHash:          muhash.New(),
+		blockUtxoHashes:   make(map[core.HashT]core.HashT),
 	}
 }
 
@@ -64,19 +149,92 @@ func (s *State) Copy() *State {
 	for utxo, txIds := range s.mempoolUtxoSpends {
 		newMempoolUtxoSpends[utxo] = txIds.Copy()
 	}
+	// Must deep copy pkhTxs, as rewinding then advancing would overwrite shared entries
+	var newPkhTxs map[core.HashT][]core.HashT
+	if s.pkhTxs != nil {
+		newPkhTxs = make(map[core.HashT][]core.HashT, len(s.pkhTxs))
+		for pkh, txIds := range s.pkhTxs {
+			newPkhTxs[pkh] = util.CopyList(txIds)
+		}
+	}
+	var newUtxoSpenders map[core.Utxo]utxoSpender
+	if s.utxoSpenders != nil {
+		newUtxoSpenders = util.CopyMap(s.utxoSpenders)
+	}
 	// Shallow copy everything else
 	return &State{
 		head:              s.head,
+		mainChain:         util.CopyList(s.mainChain),
 		mempool:           s.mempool.Copy(),
 		utxos:             s.utxos.Copy(),
 		inv:               s.inv,
 		mempoolRates:      util.CopyMap(s.mempoolRates),
+		mempoolTimes:      util.CopyMap(s.mempoolTimes),
+		mempoolIds:        util.CopyMap(s.mempoolIds),
+		mempoolUtxos:      s.mempoolUtxos.Copy(),
 		mempoolUtxoSpends: newMempoolUtxoSpends,
+		mempoolVSize:      s.mempoolVSize,
+		minRelayRate:      s.minRelayRate,
 		pkhUtxos:          newPkhUtxos,
 		includedTxBlocks:  util.CopyMap(s.includedTxBlocks),
+		pkhTxs:            newPkhTxs,
+		utxoSpenders:      newUtxoSpenders,
+		utxoHash:          s.utxoHash.Copy(),
+		blockUtxoHashes:   util.CopyMap(s.blockUtxoHashes),
+		journaling:        s.journaling,
+		journal:           util.CopyList(s.journal),
+	}
+}
+
+// Copy a state's mempool, sharing everything else, to try changes to the mempool on.
+// The copy reads from the given inv, and must not Advance or Rewind, as it shares chain state.
+func (s *State) copyMempool(inv inv.InvReader) *State {
+	newMempoolUtxoSpends := make(map[core.Utxo]*set.Set[core.HashT], len(s.mempoolUtxoSpends))
+	for utxo, txIds := range s.mempoolUtxoSpends {
+		newMempoolUtxoSpends[utxo] = txIds.Copy()
+	}
+	out := *s
+	out.inv = inv
+	out.mempool = s.mempool.Copy()
+	out.mempoolRates = util.CopyMap(s.mempoolRates)
+	out.mempoolTimes = util.CopyMap(s.mempoolTimes)
+	out.mempoolIds = util.CopyMap(s.mempoolIds)
+	out.mempoolUtxos = s.mempoolUtxos.Copy()
+	out.mempoolUtxoSpends = newMempoolUtxoSpends
+	out.journaling = false
+	out.journal = nil
+	return &out
+}
+
+// Start recording the changes made by each Advance and Rewind.
+func (s *State) EnableJournal() {
+	s.journaling = true
+}
+
+// Stop recording changes, and drop any recorded.
+func (s *State) DisableJournal() {
+	s.journaling = false
+	s.journal = nil
+}
+
+// Start maintaining the given indexes. Must be enabled at the zero block, or the history
+// before it is missing.
+func (s *State) EnableIndexes(indexes Indexes) {
+	if indexes.PkhTxs && s.pkhTxs == nil {
+		s.pkhTxs = make(map[core.HashT][]core.HashT)
+	}
+	if indexes.UtxoSpenders && s.utxoSpenders == nil {
+		s.utxoSpenders = make(map[core.Utxo]utxoSpender)
 	}
 }
 
+// Get the changes made since the journal was last taken, and clear it.
+func (s *State) TakeJournal() []stateChange {
+	journal := s.journal
+	s.journal = nil
+	return journal
+}
+
 // Rewind a state to its parent block.
 // If this fails state will be corrupted, so copy before if necessary.
 func (s *State) Rewind() {
@@ -85,30 +243,33 @@ func (s *State) Rewind() {
 	}
 	rBlock := s.inv.GetBlock(s.head)
 	rTxs := s.inv.GetMerkleTxs(rBlock.MerkleRoot)
+	if s.pkhTxs != nil {
+		s.rewindPkhTxs(rTxs)
+	}
 	for _, tx := range rTxs {
 		txId := tx.Hash()
+		id := tx.Id(s.inv.GetCoreParams())
 		// Return tx back to mempool
-		s.mempool.Add(txId)
-		s.mempoolRates[txId] = tx.Rate()
-		for _, utxo := range tx.GetConsumedUtxos() {
-			if _, ok := s.mempoolUtxoSpends[utxo]; !ok {
-				s.mempoolUtxoSpends[utxo] = set.NewSet[core.HashT]()
-			}
-			s.mempoolUtxoSpends[utxo].Add(txId)
-		}
+		s.AddMempoolTx(txId)
 		// Return the tx inputs
 		for _, utxo := range tx.GetConsumedUtxos() {
+			if s.utxoSpenders != nil {
+				delete(s.utxoSpenders, utxo)
+			}
 			s.utxos.Add(utxo)
 			txo := s.inv.GetTxOut(utxo.TxId, utxo.Ind)
 			s.creditBalance(txo.PublicKeyHash, utxo)
 		}
-		// Remove the tx outputs from the utxo set
+		// Remove the tx outputs from the utxo set (data outputs were never added)
 		for i, txo := range tx.Outputs {
-			if !s.utxos.Remove(core.Utxo{TxId: txId, Ind: uint64(i), Value: txo.Value}) {
-				panic(fmt.Sprintf("state corrupt - missing utxo %s[%d]", txId, i))
+			if txo.IsData() {
+				continue
+			}
+			if !s.utxos.Remove(core.Utxo{TxId: id, Ind: uint64(i), Value: txo.Value}) {
+				panic(fmt.Sprintf("state corrupt - missing utxo %s[%d]", id, i))
 			}
 			if err := s.debitBalance(txo.PublicKeyHash, core.Utxo{
-				TxId:  txId,
+				TxId:  id,
 				Ind:   uint64(i),
 				Value: txo.Value,
 			}); err != nil {
@@ -116,13 +277,76 @@ func (s *State) Rewind() {
 			}
 		}
 		// Remove the tx included block (and continue to verify it existed)
-		existingBlockId, ok := s.includedTxBlocks[txId]
+		existingBlockId, ok := s.includedTxBlocks[id]
 		if !ok || existingBlockId != s.head {
-			panic(fmt.Sprintf("state corrupt - missing/wrong tx block %s", txId))
+			panic(fmt.Sprintf("state corrupt - missing/wrong tx block %s", id))
 		}
-		delete(s.includedTxBlocks, txId)
+		delete(s.includedTxBlocks, id)
+	}
+	if s.journaling {
+		s.journal = append(s.journal, stateChange{
+			Advanced: false,
+			Undo:     blockUndo{BlockId: s.head},
+		})
 	}
+	delete(s.blockUtxoHashes, s.head)
 	s.head = rBlock.PrevBlockId
+	s.mainChain = s.mainChain[:len(s.mainChain)-1]
+}
+
+// Rewind a state to its parent block using the head block's undo record alone, for when the
+// block's contents may be missing from the inventory. Its txs aren't returned to the mempool.
+// If this fails state will be corrupted, so copy before if necessary.
+func (s *State) RewindUndo(undo blockUndo) error {
+	if s.head.EqZero() {
+		return fmt.Errorf("cannot rewind - at root")
+	} else if undo.BlockId != s.head {
+		return fmt.Errorf("undo record is of block %s, not head %s", undo.BlockId, s.head)
+	}
+	// History entries were appended in order, so truncate them in reverse
+	for i := len(undo.PkhTxs) - 1; i >= 0; i-- {
+		entry := undo.PkhTxs[i]
+		if s.pkhTxs == nil {
+			break
+		} else if uint64(len(s.pkhTxs[entry.Pkh])) != entry.Ind+1 {
+			return fmt.Errorf("state corrupt - missing tx history of pkh %s", entry.Pkh)
+		} else if entry.Ind == 0 {
+			delete(s.pkhTxs, entry.Pkh)
+		} else {
+			s.pkhTxs[entry.Pkh] = s.pkhTxs[entry.Pkh][:entry.Ind]
+		}
+	}
+	for _, created := range undo.Created {
+		if !s.utxos.Remove(created.Utxo) {
+			return fmt.Errorf("state corrupt - missing utxo %s[%d]", created.Utxo.TxId, created.Utxo.Ind)
+		}
+		if err := s.debitBalance(created.Pkh, created.Utxo); err != nil {
+			return err
+		}
+	}
+	for _, spent := range undo.Spent {
+		if s.utxoSpenders != nil {
+			delete(s.utxoSpenders, spent.Utxo)
+		}
+		s.utxos.Add(spent.Utxo)
+		s.creditBalance(spent.Pkh, spent.Utxo)
+	}
+	for _, txId := range undo.TxIds {
+		delete(s.includedTxBlocks, txId)
+	}
+	if s.journaling {
+		s.journal = append(s.journal, stateChange{
+			Advanced: false,
+			Undo:     blockUndo{BlockId: s.head},
+		})
+	}
+	delete(s.blockUtxoHashes, s.head)
+	s.head = s.inv.GetBlock(s.head).PrevBlockId
+	s.mainChain = s.mainChain[:len(s.mainChain)-1]
+	if expected, ok := s.blockUtxoHashes[s.head]; ok && expected != s.GetUtxoHash() {
+		return fmt.Errorf("utxo hash mismatch after rewind: %s != %s", s.GetUtxoHash(), expected)
+	}
+	return nil
 }
 
 // Rewind a state until head is the given block.
@@ -153,8 +377,15 @@ func (s *State) Advance(nextBlockId core.HashT, autoAddMempoolInsecure bool) err
 			"block not based on this parent: %s != %s", nBlock.PrevBlockId, s.head,
 		)
 	}
+	undo := blockUndo{
+		BlockId: nextBlockId,
+		Spent:   make([]pkhUtxo, 0),
+		Created: make([]pkhUtxo, 0),
+		TxIds:   make([]core.HashT, 0, len(nTxs)),
+	}
 	for _, tx := range nTxs {
 		txId := tx.Hash()
+		id := tx.Id(s.inv.GetCoreParams())
 		err := s.VerifyTxIncludable(txId, autoAddMempoolInsecure)
 		if err != nil {
 			return fmt.Errorf("tx not includable: %s", err.Error())
@@ -165,23 +396,8 @@ func (s *State) Advance(nextBlockId core.HashT, autoAddMempoolInsecure bool) err
 			return fmt.Errorf("tx cannot be included in block - too low")
 		}
 		// Remove tx from mempool
-		if !s.mempool.Remove(txId) {
-			return fmt.Errorf("state corrupt - missing tx %s", txId)
-		}
-		delete(s.mempoolRates, txId)
-		for _, utxo := range tx.GetConsumedUtxos() {
-			txIds, ok := s.mempoolUtxoSpends[utxo]
-			if !ok {
-				return fmt.Errorf(
-					"state corrupt - %s missing mempool utxo set for %v", txId, utxo,
-				)
-			}
-			if !txIds.Remove(txId) {
-				return fmt.Errorf("state corrupt - mempool utxo set missing tx %s", txId)
-			}
-			if txIds.Size() == 0 {
-				delete(s.mempoolUtxoSpends, utxo)
-			}
+		if err := s.removeMempoolTx(txId); err != nil {
+			return err
 		}
 		// Consume the tx inputs
 		for _, utxo := range tx.GetConsumedUtxos() {
@@ -192,28 +408,112 @@ func (s *State) Advance(nextBlockId core.HashT, autoAddMempoolInsecure bool) err
 			if err := s.debitBalance(txo.PublicKeyHash, utxo); err != nil {
 				return err
 			}
+			undo.Spent = append(undo.Spent, pkhUtxo{Utxo: utxo, Pkh: txo.PublicKeyHash})
+			if s.utxoSpenders != nil {
+				s.utxoSpenders[utxo] = utxoSpender{TxId: id, BlockId: nextBlockId}
+				undo.SpentBy = append(undo.SpentBy, id)
+			}
 		}
-		// Add the tx outputs
+		// Add the tx outputs, except data outputs which are unspendable
 		for i, txo := range tx.Outputs {
-			s.utxos.Add(core.Utxo{TxId: txId, Ind: uint64(i), Value: txo.Value})
-			s.creditBalance(txo.PublicKeyHash, core.Utxo{
-				TxId:  txId,
-				Ind:   uint64(i),
-				Value: txo.Value,
-			})
+			if txo.IsData() {
+				continue
+			}
+			utxo := core.Utxo{TxId: id, Ind: uint64(i), Value: txo.Value}
+			s.utxos.Add(utxo)
+			s.creditBalance(txo.PublicKeyHash, utxo)
+			undo.Created = append(undo.Created, pkhUtxo{Utxo: utxo, Pkh: txo.PublicKeyHash})
 		}
 		// Add the tx included block (and continue to verify tx isn't already included)
-		existingBlockId, ok := s.includedTxBlocks[txId]
+		existingBlockId, ok := s.includedTxBlocks[id]
 		if ok {
 			return fmt.Errorf("tx already included in block %s", existingBlockId)
 		}
-		s.includedTxBlocks[txId] = nextBlockId
+		s.includedTxBlocks[id] = nextBlockId
+		undo.TxIds = append(undo.TxIds, id)
+		// Add the tx to the history of each pkh it touches
+		if s.pkhTxs != nil {
+			for _, pkh := range s.getTxPkhs(tx) {
+				undo.PkhTxs = append(undo.PkhTxs, pkhTx{
+					Pkh:  pkh,
+					Ind:  uint64(len(s.pkhTxs[pkh])),
+					TxId: id,
+				})
+				s.pkhTxs[pkh] = append(s.pkhTxs[pkh], id)
+			}
+		}
+	}
+	undo.UtxoHash = s.GetUtxoHash()
+	s.blockUtxoHashes[nextBlockId] = undo.UtxoHash
+	if s.journaling {
+		s.journal = append(s.journal, stateChange{Advanced: true, Undo: undo})
 	}
 	s.head = nextBlockId
+	s.mainChain = append(s.mainChain, nextBlockId)
 	return nil
 }
 
+// Move the head to a block without applying its changes, and rebuild the main chain index by
+// walking back from it. Only for building a state whose other fields are set directly.
+func (s *State) setHead(head core.HashT) {
+	height := s.inv.GetBlockHeight(head)
+	s.mainChain = make([]core.HashT, height+1)
+	s.mainChain[height] = head
+	for i := height; i > 0; i-- {
+		s.mainChain[i-1] = s.inv.GetBlock(s.mainChain[i]).PrevBlockId
+	}
+	s.head = head
+}
+
+// Remove the given txs of the head block from the history of each pkh they touch. As the
+// block is the last in each history, its txs are at the end.
+func (s *State) rewindPkhTxs(txs []core.Tx) {
+	blockTxIds := set.NewSet[core.HashT]()
+	pkhs := set.NewSet[core.HashT]()
+	for _, tx := range txs {
+		blockTxIds.Add(tx.Id(s.inv.GetCoreParams()))
+		pkhs.Add(s.getTxPkhs(tx)...)
+	}
+	for _, pkh := range pkhs.ToList() {
+		txIds := s.pkhTxs[pkh]
+		end := len(txIds)
+		for end > 0 && blockTxIds.Includes(txIds[end-1]) {
+			end--
+		}
+		if end == len(txIds) {
+			panic(fmt.Sprintf("state corrupt - missing tx history of pkh %s", pkh))
+		} else if end == 0 {
+			delete(s.pkhTxs, pkh)
+		} else {
+			s.pkhTxs[pkh] = txIds[:end]
+		}
+	}
+}
+
+// Get the public key hashes whose utxos a tx spends or creates, without duplicates.
+func (s *State) getTxPkhs(tx core.Tx) []core.HashT {
+	out := make([]core.HashT, 0)
+	seen := set.NewSet[core.HashT]()
+	add := func(pkh core.HashT) {
+		if !seen.Includes(pkh) {
+			seen.Add(pkh)
+			out = append(out, pkh)
+		}
+	}
+	for _, utxo := range tx.GetConsumedUtxos() {
+		add(s.inv.GetTxOut(utxo.TxId, utxo.Ind).PublicKeyHash)
+	}
+	for _, txo := range tx.Outputs {
+		if !txo.IsData() {
+			add(txo.PublicKeyHash)
+		}
+	}
+	return out
+}
+
 // Check whether a tx can be included in a new block based on this head.
+// Its inputs must be unspent at this head, so a tx spending another mempool tx's output is only
+// includable after that tx, earlier in the same block (see GetSortedMempoolPackages).
 func (s *State) VerifyTxIncludable(txId core.HashT, autoAddMempoolInsecure bool) error {
 	if !s.inv.HasTx(txId) {
 		return fmt.Errorf("tx unknown: %s", txId)
@@ -240,25 +540,23 @@ func (s *State) VerifyTxIncludable(txId core.HashT, autoAddMempoolInsecure bool)
 	return nil
 }
 
-// Get includable mempool txs sorted be fee rate, descending.
-func (s *State) GetSortedIncludableMempool() []core.HashT {
-	mem := s.mempool.Copy()
-	mem.Filter(func(txId core.HashT) bool {
-		return s.VerifyTxIncludable(txId, false) == nil && s.inv.GetTx(txId).HasSurplus()
-	})
-	memL := mem.ToList()
-	sort.Slice(memL, func(i, j int) bool {
-		// descending
-		return s.mempoolRates[memL[i]] > s.mempoolRates[memL[j]]
-	})
-	return memL
-}
-
 // Add a tx to the mempool.
 func (s *State) AddMempoolTx(txId core.HashT) {
+	if s.mempool.Includes(txId) {
+		return
+	}
 	tx := s.inv.GetTx(txId)
 	s.mempool.Add(txId)
 	s.mempoolRates[txId] = tx.Rate()
+	s.mempoolTimes[txId] = time.Now()
+	id := tx.Id(s.inv.GetCoreParams())
+	s.mempoolIds[id] = txId
+	for i, txo := range tx.Outputs {
+		if !txo.IsData() {
+			s.mempoolUtxos.Add(core.Utxo{TxId: id, Ind: uint64(i), Value: txo.Value})
+		}
+	}
+	s.mempoolVSize += tx.VSize()
 	for _, utxo := range tx.GetConsumedUtxos() {
 		if _, ok := s.mempoolUtxoSpends[utxo]; !ok {
 			s.mempoolUtxoSpends[utxo] = set.NewSet[core.HashT]()
@@ -267,8 +565,42 @@ func (s *State) AddMempoolTx(txId core.HashT) {
 	}
 }
 
-// Add to the utxo set of a public key hash.
+// Remove a tx from the mempool.
+func (s *State) removeMempoolTx(txId core.HashT) error {
+	if !s.mempool.Remove(txId) {
+		return fmt.Errorf("state corrupt - missing tx %s", txId)
+	}
+	tx := s.inv.GetTx(txId)
+	delete(s.mempoolRates, txId)
+	delete(s.mempoolTimes, txId)
+	// Txs differing only by signature share an id
+	if id := tx.Id(s.inv.GetCoreParams()); s.mempoolIds[id] == txId {
+		delete(s.mempoolIds, id)
+		for i, txo := range tx.Outputs {
+			s.mempoolUtxos.Remove(core.Utxo{TxId: id, Ind: uint64(i), Value: txo.Value})
+		}
+	}
+	s.mempoolVSize -= tx.VSize()
+	for _, utxo := range tx.GetConsumedUtxos() {
+		txIds, ok := s.mempoolUtxoSpends[utxo]
+		if !ok {
+			return fmt.Errorf(
+				"state corrupt - %s missing mempool utxo set for %v", txId, utxo,
+			)
+		}
+		if !txIds.Remove(txId) {
+			return fmt.Errorf("state corrupt - mempool utxo set missing tx %s", txId)
+		}
+		if txIds.Size() == 0 {
+			delete(s.mempoolUtxoSpends, utxo)
+		}
+	}
+	return nil
+}
+
+// Add to the utxo set of a public key hash, and to the utxo set hash.
 func (s *State) creditBalance(publicKeyHash core.HashT, credit core.Utxo) {
+	s.utxoHash.Add(utxoHashItem(credit, publicKeyHash))
 	_, ok := s.pkhUtxos[publicKeyHash]
 	if !ok {
 		s.pkhUtxos[publicKeyHash] = set.NewSet[core.Utxo]()
@@ -288,9 +620,32 @@ func (s *State) debitBalance(publicKeyHash core.HashT, debit core.Utxo) error {
 	if utxos.Size() == 0 {
 		delete(s.pkhUtxos, publicKeyHash)
 	}
+	s.utxoHash.Remove(utxoHashItem(debit, publicKeyHash))
 	return nil
 }
 
+// Get the hash of the current utxo set, and the pkh controlling each utxo.
+func (s *State) GetUtxoHash() core.HashT {
+	digest := s.utxoHash.Digest()
+	return core.NewHashTFromBytes(digest[:])
+}
+
+// Get the utxo set hash after each given block, for those on our chain where it's known.
+func (s *State) GetBlockUtxoHashes(blockIds []core.HashT) map[core.HashT]core.HashT {
+	out := make(map[core.HashT]core.HashT)
+	for _, blockId := range blockIds {
+		if hash, ok := s.blockUtxoHashes[blockId]; ok {
+			out[blockId] = hash
+		}
+	}
+	return out
+}
+
+// Serialize a utxo and its controlling pkh as an item of the utxo set hash.
+func utxoHashItem(utxo core.Utxo, pkh core.HashT) []byte {
+	return []byte(fmt.Sprintf("%s/%d/%d/%s", utxo.TxId, utxo.Ind, utxo.Value, pkh))
+}
+
 // Get the utxos of a public key hash. Optionally, exclude utxos that are spent in the mempool.
 func (s *State) GetPkhUtxos(publicKeyHash core.HashT, excludeMempool bool) []core.Utxo {
 	utxos, ok := s.pkhUtxos[publicKeyHash]
@@ -340,10 +695,11 @@ func (s *State) GetManyPkhBalances(publicKeyHashes []core.HashT) map[core.HashT]
 	return out
 }
 
+// Get the number of confirmations for each given tx id (see core.Tx.Id).
 func (s *State) GetTxConfirms(txIds []core.HashT) map[core.HashT]uint64 {
 	out := make(map[core.HashT]uint64)
 	for _, txId := range txIds {
-		if !s.inv.HasTx(txId) {
+		if !s.inv.HasTxById(txId) {
 			continue
 		}
 		blockId, ok := s.includedTxBlocks[txId]
@@ -357,10 +713,11 @@ func (s *State) GetTxConfirms(txIds []core.HashT) map[core.HashT]uint64 {
 	return out
 }
 
+// Get the block each given tx id (see core.Tx.Id) was included in.
 func (s *State) GetTxIncludedBlock(txIds []core.HashT) map[core.HashT]core.HashT {
 	out := make(map[core.HashT]core.HashT)
 	for _, txId := range txIds {
-		if !s.inv.HasTx(txId) {
+		if !s.inv.HasTxById(txId) {
 			continue
 		}
 		blockId, ok := s.includedTxBlocks[txId]
@@ -371,6 +728,75 @@ func (s *State) GetTxIncludedBlock(txIds []core.HashT) map[core.HashT]core.HashT
 	return out
 }
 
+// Get a page of the ids of txs crediting or debiting a public key hash, in chain order, and
+// how many there are in total. Errors if the index isn't enabled.
+func (s *State) GetPkhTxs(
+	publicKeyHash core.HashT, offset uint64, limit uint64,
+) ([]core.HashT, uint64, error) {
+	if s.pkhTxs == nil {
+		return nil, 0, fmt.Errorf("pkh tx index is not enabled")
+	}
+	txIds := s.pkhTxs[publicKeyHash]
+	total := uint64(len(txIds))
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if limit < total-offset {
+		end = offset + limit
+	}
+	return util.CopyList(txIds[offset:end]), total, nil
+}
+
+// Get the block of our chain at each given height, for those at or below our head.
+func (s *State) GetMainChainBlockIds(heights []uint64) map[uint64]core.HashT {
+	out := make(map[uint64]core.HashT, len(heights))
+	for _, height := range heights {
+		if height < uint64(len(s.mainChain)) {
+			out[height] = s.mainChain[height]
+		}
+	}
+	return out
+}
+
+// Get the blocks of our chain from the given height upward, up to limit of them.
+func (s *State) GetMainChainRange(start uint64, limit uint64) []core.HashT {
+	total := uint64(len(s.mainChain))
+	if start > total {
+		start = total
+	}
+	end := total
+	if limit < total-start {
+		end = start + limit
+	}
+	return util.CopyList(s.mainChain[start:end])
+}
+
+// Get the tx id (see core.Tx.Id) and block spending a utxo on our chain, if it's spent.
+// Errors if the index isn't enabled.
+func (s *State) GetUtxoSpender(
+	utxo core.Utxo,
+) (txId core.HashT, blockId core.HashT, ok bool, err error) {
+	if s.utxoSpenders == nil {
+		return core.HashT{}, core.HashT{}, false, fmt.Errorf("utxo spender index is not enabled")
+	}
+	spender, ok := s.utxoSpenders[utxo]
+	return spender.TxId, spender.BlockId, ok, nil
+}
+
+// Get the ids (see core.Tx.Id) of the mempool txs spending a utxo.
+func (s *State) GetMempoolUtxoSpenders(utxo core.Utxo) []core.HashT {
+	txIds, ok := s.mempoolUtxoSpends[utxo]
+	if !ok {
+		return []core.HashT{}
+	}
+	out := make([]core.HashT, 0, txIds.Size())
+	for _, txId := range txIds.ToList() {
+		out = append(out, s.inv.GetTx(txId).Id(s.inv.GetCoreParams()))
+	}
+	return out
+}
+
 func (s *State) GetRichList(maxLen uint64) map[core.HashT]uint64 {
 	pkhs := util.MapKeys(s.pkhUtxos)
 	pkhBals := make(map[core.HashT]uint64, len(pkhs))
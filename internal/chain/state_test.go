@@ -0,0 +1,213 @@
+package chain
+
+import (
+	"testing"
+
+	"github.com/levilutz/basiccoin/internal/inv"
+	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+// Create an empty indexed state, a store to persist it, and a func to advance it to a new block
+// of one or two txs.
+func newIndexedState(
+	t *testing.T, indexes Indexes,
+) (*State, *stateStore, *inv.Inv, func(txs ...core.Tx) core.HashT) {
+	return newStoredState(t, indexes, t.TempDir())
+}
+
+// Create an empty indexed state persisted to a store in the given dir, and a func to advance it
+// to a new block of one or two txs.
+func newStoredState(
+	t *testing.T, indexes Indexes, storeDir string,
+) (*State, *stateStore, *inv.Inv, func(txs ...core.Tx) core.HashT) {
+	memInv := inv.NewInv(core.DevNetParams(), nil, inv.StoreParams{})
+	easiest := core.NewHashTFromStringAssert(
+		"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+	)
+	state := NewState(memInv)
+	state.EnableIndexes(indexes)
+	state.EnableJournal()
+	ss, err := openStateStore(storeDir)
+	util.AssertNoErr(t, err)
+	advance := func(txs ...core.Tx) core.HashT {
+		root := txs[0].Hash()
+		for _, tx := range txs {
+			memInv.StoreTrustedTx(tx)
+		}
+		if len(txs) == 2 {
+			merkle := core.MerkleNode{LChild: txs[0].Hash(), RChild: txs[1].Hash()}
+			util.AssertNoErr(t, memInv.StoreMerkle(merkle))
+			root = merkle.Hash()
+		}
+		block := core.Block{PrevBlockId: state.head, MerkleRoot: root, Target: easiest}
+		util.AssertNoErr(t, memInv.StoreTrustedBlock(block))
+		util.AssertNoErr(t, state.Advance(block.Hash(), true))
+		util.AssertNoErr(t, ss.Apply(state.TakeJournal(), state))
+		return block.Hash()
+	}
+	return state, ss, memInv, advance
+}
+
+// Test that each pkh's tx history follows advances and rewinds, and persists.
+func TestPkhTxIndex(t *testing.T) {
+	params := core.DevNetParams()
+	indexes := Indexes{PkhTxs: true}
+	state, ss, memInv, advance := newIndexedState(t, indexes)
+	pkhA, pkhB := core.NewHashTRand(), core.NewHashTRand()
+
+	// Block 1 pays A, block 2 pays B and moves A's coin to B
+	coinbase1 := core.Tx{
+		IsCoinbase: true,
+		MinBlock:   1,
+		Outputs:    []core.TxOut{{Value: 100, PublicKeyHash: pkhA}},
+	}
+	advance(coinbase1)
+	id1 := coinbase1.Id(params)
+	coinbase2 := core.Tx{
+		IsCoinbase: true,
+		MinBlock:   2,
+		Outputs:    []core.TxOut{{Value: 100, PublicKeyHash: pkhB}},
+	}
+	spend := core.Tx{
+		MinBlock: 2,
+		Inputs:   []core.TxIn{{Utxo: core.Utxo{TxId: id1, Ind: 0, Value: 100}}},
+		Outputs:  []core.TxOut{{Value: 90, PublicKeyHash: pkhB}},
+	}
+	advance(coinbase2, spend)
+	id2, idSpend := coinbase2.Id(params), spend.Id(params)
+
+	txIds, total, err := state.GetPkhTxs(pkhA, 0, 10)
+	util.AssertNoErr(t, err)
+	util.Assert(t, total == 2 && len(txIds) == 2, "wrong history of A: %v", txIds)
+	util.Assert(t, txIds[0] == id1 && txIds[1] == idSpend, "wrong order of A: %v", txIds)
+	txIds, total, err = state.GetPkhTxs(pkhB, 1, 10)
+	util.AssertNoErr(t, err)
+	util.Assert(t, total == 2 && len(txIds) == 1, "wrong page of B: %v", txIds)
+	util.Assert(t, txIds[0] == id2 || txIds[0] == idSpend, "wrong tx of B: %v", txIds)
+
+	// The stored index loads, and only when asked for
+	loaded, err := ss.Load(memInv, indexes)
+	util.AssertNoErr(t, err)
+	txIds, _, err = loaded.GetPkhTxs(pkhA, 0, 10)
+	util.AssertNoErr(t, err)
+	util.Assert(t, len(txIds) == 2 && txIds[1] == idSpend, "wrong loaded history: %v", txIds)
+	loaded, err = ss.Load(memInv, Indexes{})
+	util.AssertNoErr(t, err)
+	_, _, err = loaded.GetPkhTxs(pkhA, 0, 10)
+	util.Assert(t, err != nil, "got history without index")
+
+	// Rewinding a copy leaves the original's history, and persists
+	rewound := state.Copy()
+	rewound.Rewind()
+	util.AssertNoErr(t, ss.Apply(rewound.TakeJournal(), rewound))
+	txIds, _, _ = rewound.GetPkhTxs(pkhA, 0, 10)
+	util.Assert(t, len(txIds) == 1 && txIds[0] == id1, "wrong rewound history: %v", txIds)
+	_, total, _ = rewound.GetPkhTxs(pkhB, 0, 10)
+	util.Assert(t, total == 0, "rewound history of B kept")
+	_, total, _ = state.GetPkhTxs(pkhA, 0, 10)
+	util.Assert(t, total == 2, "rewinding copy changed original")
+	loaded, err = ss.Load(memInv, indexes)
+	util.AssertNoErr(t, err)
+	_, total, _ = loaded.GetPkhTxs(pkhA, 0, 10)
+	util.Assert(t, total == 1, "rewind not persisted")
+
+	// Dropping the index needs it rebuilt to load it again
+	util.AssertNoErr(t, ss.DropIndexes(Indexes{}))
+	_, err = ss.Load(memInv, indexes)
+	util.Assert(t, err != nil, "loaded dropped index")
+}
+
+// Test that the spender of each utxo follows advances and rewinds, and persists.
+func TestUtxoSpenderIndex(t *testing.T) {
+	params := core.DevNetParams()
+	indexes := Indexes{UtxoSpenders: true}
+	state, ss, _, advance := newIndexedState(t, indexes)
+
+	// Block 1 creates a coin, block 2 spends it
+	coinbase1 := core.Tx{
+		IsCoinbase: true,
+		MinBlock:   1,
+		Outputs:    []core.TxOut{{Value: 100, PublicKeyHash: core.NewHashTRand()}},
+	}
+	advance(coinbase1)
+	utxo := core.Utxo{TxId: coinbase1.Id(params), Ind: 0, Value: 100}
+	_, _, spent, err := state.GetUtxoSpender(utxo)
+	util.AssertNoErr(t, err)
+	util.Assert(t, !spent, "unspent utxo has spender")
+	coinbase2 := core.Tx{
+		IsCoinbase: true,
+		MinBlock:   2,
+		Outputs:    []core.TxOut{{Value: 100, PublicKeyHash: core.NewHashTRand()}},
+	}
+	spend := core.Tx{
+		MinBlock: 2,
+		Inputs:   []core.TxIn{{Utxo: utxo}},
+		Outputs:  []core.TxOut{{Value: 90, PublicKeyHash: core.NewHashTRand()}},
+	}
+	block2 := advance(coinbase2, spend)
+	txId, blockId, spent, _ := state.GetUtxoSpender(utxo)
+	util.Assert(t, spent, "spent utxo has no spender")
+	util.Assert(t, txId == spend.Id(params) && blockId == block2, "wrong spender: %s", txId)
+
+	// The stored index loads, and only when asked for
+	loaded, err := ss.Load(state.inv, indexes)
+	util.AssertNoErr(t, err)
+	txId, blockId, _, _ = loaded.GetUtxoSpender(utxo)
+	util.Assert(t, txId == spend.Id(params) && blockId == block2, "wrong loaded spender")
+	loaded, err = ss.Load(state.inv, Indexes{})
+	util.AssertNoErr(t, err)
+	_, _, _, err = loaded.GetUtxoSpender(utxo)
+	util.Assert(t, err != nil, "got spender without index")
+
+	// Rewinding returns the spend to the mempool, and persists
+	rewound := state.Copy()
+	rewound.Rewind()
+	util.AssertNoErr(t, ss.Apply(rewound.TakeJournal(), rewound))
+	_, _, spent, _ = rewound.GetUtxoSpender(utxo)
+	util.Assert(t, !spent, "rewound spender kept")
+	mempoolTxIds := rewound.GetMempoolUtxoSpenders(utxo)
+	util.Assert(t, len(mempoolTxIds) == 1 && mempoolTxIds[0] == spend.Id(params), "spend not in mempool")
+	_, _, spent, _ = state.GetUtxoSpender(utxo)
+	util.Assert(t, spent, "rewinding copy changed original")
+	loaded, err = ss.Load(state.inv, indexes)
+	util.AssertNoErr(t, err)
+	_, _, spent, _ = loaded.GetUtxoSpender(utxo)
+	util.Assert(t, !spent, "rewind not persisted")
+
+	// Dropping the index needs it rebuilt to load it again
+	util.AssertNoErr(t, ss.DropIndexes(Indexes{PkhTxs: true}))
+	_, err = ss.Load(state.inv, indexes)
+	util.Assert(t, err != nil, "loaded dropped index")
+}
+
+// Test that the blocks of the main chain are indexed by height through advances and rewinds.
+func TestMainChainIndex(t *testing.T) {
+	state, _, _, advance := newIndexedState(t, Indexes{})
+	coinbase := func(height uint64) core.Tx {
+		return core.Tx{
+			IsCoinbase: true,
+			MinBlock:   height,
+			Outputs:    []core.TxOut{{Value: 100, PublicKeyHash: core.NewHashTRand()}},
+		}
+	}
+	block1, block2 := advance(coinbase(1)), advance(coinbase(2))
+	blockIds := state.GetMainChainRange(0, 10)
+	util.Assert(t, len(blockIds) == 3, "wrong main chain length: %d", len(blockIds))
+	util.Assert(t, blockIds[0].EqZero() && blockIds[1] == block1 && blockIds[2] == block2,
+		"wrong main chain: %v", blockIds)
+	blockIds = state.GetMainChainRange(2, 10)
+	util.Assert(t, len(blockIds) == 1 && blockIds[0] == block2, "wrong range: %v", blockIds)
+	util.Assert(t, len(state.GetMainChainRange(5, 10)) == 0, "got range above head")
+
+	// Rewinding then advancing to another block leaves a copy's index
+	original := state.Copy()
+	state.Rewind()
+	byHeight := state.GetMainChainBlockIds([]uint64{1, 2})
+	util.Assert(t, len(byHeight) == 1 && byHeight[1] == block1, "wrong rewound index: %v", byHeight)
+	forkBlock2 := advance(coinbase(2))
+	byHeight = state.GetMainChainBlockIds([]uint64{2})
+	util.Assert(t, byHeight[2] == forkBlock2, "wrong fork index: %v", byHeight)
+	byHeight = original.GetMainChainBlockIds([]uint64{2})
+	util.Assert(t, byHeight[2] == block2, "advancing changed copy: %v", byHeight)
+}
@@ -0,0 +1,624 @@
+package chain
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/levilutz/basiccoin/internal/inv"
+	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/kvstore"
+)
+
+// Key prefixes and keys within the state store.
+const (
+	stateUtxoPrefix = "u/"
+	stateTxPrefix   = "t/"
+	stateUndoPrefix = "undo/"
+	// The utxo set hash after each block, kept even once its undo record is pruned
+	stateUtxoHashPrefix = "h/"
+	// Each entry of each pkh's tx history, if indexed
+	statePkhTxPrefix = "p/"
+	// The spender of each spent utxo, if indexed
+	stateUtxoSpenderPrefix = "s/"
+	stateHeadKey           = "head"
+	stateCountsKey         = "counts"
+	statePrunedKey         = "pruned"
+	// How many pkh tx history entries there are, present only if they're indexed
+	statePkhTxCountKey = "pkhtxs"
+	// How many utxo spenders there are, present only if they're indexed
+	stateUtxoSpenderCountKey = "utxospenders"
+	// Hash and head of the snapshot the state was loaded from, while its history is unvalidated
+	stateSnapshotKey = "snapshot"
+)
+
+// The least size the store's log must reach before it's compacted of overwritten and deleted
+// records. A var so tests can compact small stores.
+var stateCompactMinSize int64 = 16 << 20
+
+// Persists a State's utxo set and tx inclusions, updated incrementally per block.
+// Each block advanced also stores an undo record, so it can be rewound from the store alone.
+type stateStore struct {
+	kv *kvstore.Store
+}
+
+// Open the state store in the given directory.
+func openStateStore(dir string) (*stateStore, error) {
+	kv, err := kvstore.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &stateStore{kv: kv}, nil
+}
+
+// Load the stored state, or error if it's missing or inconsistent with itself or the inv.
+// The loaded state has an empty mempool. Errors if any of the given indexes weren't stored.
+func (ss *stateStore) Load(inv inv.InvReader, indexes Indexes) (*State, error) {
+	rawHead, ok, err := ss.kv.Get([]byte(stateHeadKey))
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("no stored state")
+	}
+	head, err := core.NewHashTFromString(string(rawHead))
+	if err != nil {
+		return nil, err
+	}
+	if !inv.HasBlock(head) {
+		return nil, fmt.Errorf("stored state head unknown: %s", head)
+	}
+	state := NewState(inv)
+	state.setHead(head)
+
+	// Load the utxo set, and the pkh of each
+	var parseErr error
+	err = ss.kv.IteratePrefix([]byte(stateUtxoPrefix), func(key []byte, val []byte) bool {
+		utxo, pkh, err := parseStoredUtxo(key, val)
+		if err != nil {
+			parseErr = err
+			return false
+		}
+		state.utxos.Add(utxo)
+		state.creditBalance(pkh, utxo)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	} else if parseErr != nil {
+		return nil, parseErr
+	}
+
+	// Load the included tx blocks
+	err = ss.kv.IteratePrefix([]byte(stateTxPrefix), func(key []byte, val []byte) bool {
+		txId, err := core.NewHashTFromString(string(key[len(stateTxPrefix):]))
+		if err != nil {
+			parseErr = err
+			return false
+		}
+		blockId, err := core.NewHashTFromString(string(val))
+		if err != nil {
+			parseErr = err
+			return false
+		}
+		state.includedTxBlocks[txId] = blockId
+		return true
+	})
+	if err != nil {
+		return nil, err
+	} else if parseErr != nil {
+		return nil, parseErr
+	}
+
+	// Load the utxo set hash after each block
+	err = ss.kv.IteratePrefix([]byte(stateUtxoHashPrefix), func(key []byte, val []byte) bool {
+		blockId, err := core.NewHashTFromString(string(key[len(stateUtxoHashPrefix):]))
+		if err != nil {
+			parseErr = err
+			return false
+		}
+		hash, err := core.NewHashTFromString(string(val))
+		if err != nil {
+			parseErr = err
+			return false
+		}
+		state.blockUtxoHashes[blockId] = hash
+		return true
+	})
+	if err != nil {
+		return nil, err
+	} else if parseErr != nil {
+		return nil, parseErr
+	}
+
+	if indexes.PkhTxs {
+		if err := ss.loadPkhTxs(state); err != nil {
+			return nil, err
+		}
+	}
+	if indexes.UtxoSpenders {
+		if err := ss.loadUtxoSpenders(state); err != nil {
+			return nil, err
+		}
+	}
+
+	// Verify nothing was lost or altered
+	rawCounts, ok, err := ss.kv.Get([]byte(stateCountsKey))
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("stored state missing counts")
+	}
+	expected := formatStateCounts(state)
+	if string(rawCounts) != expected {
+		return nil, fmt.Errorf("stored state counts mismatch: %s != %s", rawCounts, expected)
+	}
+	if expected, ok := state.blockUtxoHashes[head]; !ok {
+		return nil, fmt.Errorf("stored state missing utxo hash of head")
+	} else if hash := state.GetUtxoHash(); hash != expected {
+		return nil, fmt.Errorf("stored state utxo hash mismatch: %s != %s", hash, expected)
+	}
+	return state, nil
+}
+
+// Atomically apply the given changes to the store, which must leave it matching the state.
+func (ss *stateStore) Apply(changes []stateChange, state *State) error {
+	batch := kvstore.NewBatch()
+	for _, change := range changes {
+		if change.Advanced {
+			if err := ss.applyAdvance(batch, change.Undo); err != nil {
+				return err
+			}
+		} else {
+			if err := ss.applyRewind(batch, change.Undo.BlockId); err != nil {
+				return err
+			}
+		}
+	}
+	batch.Put([]byte(stateHeadKey), []byte(state.head.String()))
+	batch.Put([]byte(stateCountsKey), []byte(formatStateCounts(state)))
+	if state.pkhTxs != nil {
+		batch.Put([]byte(statePkhTxCountKey), []byte(formatPkhTxCount(state)))
+	}
+	if state.utxoSpenders != nil {
+		batch.Put([]byte(stateUtxoSpenderCountKey), []byte(strconv.Itoa(len(state.utxoSpenders))))
+	}
+	if err := ss.kv.Write(batch); err != nil {
+		return err
+	}
+	return ss.compact()
+}
+
+// Load each pkh's tx history into the state, verifying none of it was lost.
+func (ss *stateStore) loadPkhTxs(state *State) error {
+	rawCount, ok, err := ss.kv.Get([]byte(statePkhTxCountKey))
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("stored state has no pkh tx index")
+	}
+	state.EnableIndexes(Indexes{PkhTxs: true})
+	var parseErr error
+	err = ss.kv.IteratePrefix([]byte(statePkhTxPrefix), func(key []byte, val []byte) bool {
+		entry, err := parseStoredPkhTx(key, val)
+		if err != nil {
+			parseErr = err
+			return false
+		}
+		// Keys sort by position within each pkh's history
+		if entry.Ind != uint64(len(state.pkhTxs[entry.Pkh])) {
+			parseErr = fmt.Errorf("stored tx history of pkh %s has a gap", entry.Pkh)
+			return false
+		}
+		state.pkhTxs[entry.Pkh] = append(state.pkhTxs[entry.Pkh], entry.TxId)
+		return true
+	})
+	if err != nil {
+		return err
+	} else if parseErr != nil {
+		return parseErr
+	}
+	if expected := formatPkhTxCount(state); string(rawCount) != expected {
+		return fmt.Errorf("stored pkh tx count mismatch: %s != %s", rawCount, expected)
+	}
+	return nil
+}
+
+// Load the spender of each spent utxo into the state, verifying none were lost.
+func (ss *stateStore) loadUtxoSpenders(state *State) error {
+	rawCount, ok, err := ss.kv.Get([]byte(stateUtxoSpenderCountKey))
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("stored state has no utxo spender index")
+	}
+	state.EnableIndexes(Indexes{UtxoSpenders: true})
+	var parseErr error
+	err = ss.kv.IteratePrefix([]byte(stateUtxoSpenderPrefix), func(key []byte, val []byte) bool {
+		utxo, spender, err := parseStoredUtxoSpender(key, val)
+		if err != nil {
+			parseErr = err
+			return false
+		}
+		state.utxoSpenders[utxo] = spender
+		return true
+	})
+	if err != nil {
+		return err
+	} else if parseErr != nil {
+		return parseErr
+	}
+	if expected := strconv.Itoa(len(state.utxoSpenders)); string(rawCount) != expected {
+		return fmt.Errorf("stored utxo spender count mismatch: %s != %s", rawCount, expected)
+	}
+	return nil
+}
+
+// Remove the stored indexes that aren't among those given, so they aren't left stale while
+// the state isn't maintaining them.
+func (ss *stateStore) DropIndexes(keep Indexes) error {
+	batch := kvstore.NewBatch()
+	if !keep.PkhTxs {
+		if err := ss.dropIndex(batch, statePkhTxPrefix, statePkhTxCountKey); err != nil {
+			return err
+		}
+	}
+	if !keep.UtxoSpenders {
+		if err := ss.dropIndex(batch, stateUtxoSpenderPrefix, stateUtxoSpenderCountKey); err != nil {
+			return err
+		}
+	}
+	return ss.kv.Write(batch)
+}
+
+// Add the deletes of an index's entries and count to the batch, if it's stored.
+func (ss *stateStore) dropIndex(batch *kvstore.Batch, prefix string, countKey string) error {
+	if _, ok, err := ss.kv.Get([]byte(countKey)); err != nil || !ok {
+		return err
+	}
+	err := ss.kv.IteratePrefix([]byte(prefix), func(key []byte, val []byte) bool {
+		batch.Delete(key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	batch.Delete([]byte(countKey))
+	return nil
+}
+
+// Get the height up to which block contents have been pruned, 0 if none have been.
+func (ss *stateStore) PrunedHeight() (uint64, error) {
+	raw, ok, err := ss.kv.Get([]byte(statePrunedKey))
+	if err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, nil
+	}
+	return strconv.ParseUint(string(raw), 10, 64)
+}
+
+// Record that block contents have been pruned up to the given height, and drop the undo
+// records of the given pruned blocks, as they can no longer be rewound.
+func (ss *stateStore) Prune(height uint64, blockIds []core.HashT) error {
+	batch := kvstore.NewBatch()
+	for _, blockId := range blockIds {
+		batch.Delete([]byte(stateUndoPrefix + blockId.String()))
+	}
+	batch.Put([]byte(statePrunedKey), []byte(strconv.FormatUint(height, 10)))
+	if err := ss.kv.Write(batch); err != nil {
+		return err
+	}
+	return ss.compact()
+}
+
+// Compact the store once it's mostly spent utxos, undo records and overwritten counts, so
+// loading it on start doesn't replay the whole chain's history.
+func (ss *stateStore) compact() error {
+	_, err := ss.kv.CompactIfWasteful(stateCompactMinSize)
+	return err
+}
+
+// Get the hash and head of the snapshot the stored state was loaded from, if its history is
+// still being validated.
+func (ss *stateStore) Snapshot() (hash core.HashT, head core.HashT, ok bool, err error) {
+	raw, ok, err := ss.kv.Get([]byte(stateSnapshotKey))
+	if err != nil || !ok {
+		return core.HashT{}, core.HashT{}, false, err
+	}
+	rawHash, rawHead, ok := strings.Cut(string(raw), "/")
+	if !ok {
+		return core.HashT{}, core.HashT{}, false, fmt.Errorf("malformed snapshot: %s", raw)
+	}
+	if hash, err = core.NewHashTFromString(rawHash); err != nil {
+		return core.HashT{}, core.HashT{}, false, err
+	}
+	if head, err = core.NewHashTFromString(rawHead); err != nil {
+		return core.HashT{}, core.HashT{}, false, err
+	}
+	return hash, head, true, nil
+}
+
+// Replace the store's contents with a state loaded from the given snapshot, with contents
+// pruned below its head.
+func (ss *stateStore) Reset(state *State, snapshotHash core.HashT) error {
+	if err := ss.Clear(); err != nil {
+		return err
+	}
+	batch := kvstore.NewBatch()
+	for _, utxo := range state.utxos.ToList() {
+		pkh := state.inv.GetTxOut(utxo.TxId, utxo.Ind).PublicKeyHash
+		batch.Put(storedUtxoKey(utxo), storedUtxoVal(pkhUtxo{Utxo: utxo, Pkh: pkh}))
+	}
+	for txId, blockId := range state.includedTxBlocks {
+		batch.Put([]byte(stateTxPrefix+txId.String()), []byte(blockId.String()))
+	}
+	batch.Put(
+		[]byte(stateUtxoHashPrefix+state.head.String()), []byte(state.GetUtxoHash().String()),
+	)
+	height := state.inv.GetBlockHeight(state.head)
+	batch.Put([]byte(stateHeadKey), []byte(state.head.String()))
+	batch.Put([]byte(stateCountsKey), []byte(formatStateCounts(state)))
+	batch.Put([]byte(statePrunedKey), []byte(strconv.FormatUint(height, 10)))
+	batch.Put([]byte(stateSnapshotKey), []byte(snapshotHash.String()+"/"+state.head.String()))
+	return ss.kv.Write(batch)
+}
+
+// Store the undo records of the given advances, without applying them to the utxo set.
+// Used when replaying history below a snapshot, so those blocks can be rewound later.
+func (ss *stateStore) StoreUndos(changes []stateChange) error {
+	batch := kvstore.NewBatch()
+	for _, change := range changes {
+		if !change.Advanced {
+			return fmt.Errorf("cannot store undo of rewind from %s", change.Undo.BlockId)
+		}
+		rawUndo, err := json.Marshal(change.Undo)
+		if err != nil {
+			return err
+		}
+		batch.Put([]byte(stateUndoPrefix+change.Undo.BlockId.String()), rawUndo)
+		batch.Put(
+			[]byte(stateUtxoHashPrefix+change.Undo.BlockId.String()),
+			[]byte(change.Undo.UtxoHash.String()),
+		)
+	}
+	return ss.kv.Write(batch)
+}
+
+// Record that the history below the loaded snapshot is validated, and contents are now
+// pruned only up to the given height.
+func (ss *stateStore) FinishSnapshot(prunedHeight uint64) error {
+	batch := kvstore.NewBatch()
+	batch.Delete([]byte(stateSnapshotKey))
+	batch.Put([]byte(statePrunedKey), []byte(strconv.FormatUint(prunedHeight, 10)))
+	return ss.kv.Write(batch)
+}
+
+// Remove everything from the store, so it can be rebuilt from the zero block.
+func (ss *stateStore) Clear() error {
+	batch := kvstore.NewBatch()
+	err := ss.kv.Iterate(nil, nil, func(key []byte, val []byte) bool {
+		batch.Delete(key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if err := ss.kv.Write(batch); err != nil {
+		return err
+	}
+	return ss.kv.Compact()
+}
+
+// Add the writes of advancing to a block to the batch.
+func (ss *stateStore) applyAdvance(batch *kvstore.Batch, undo blockUndo) error {
+	for _, spent := range undo.Spent {
+		batch.Delete(storedUtxoKey(spent.Utxo))
+	}
+	for _, created := range undo.Created {
+		batch.Put(storedUtxoKey(created.Utxo), storedUtxoVal(created))
+	}
+	for _, txId := range undo.TxIds {
+		batch.Put([]byte(stateTxPrefix+txId.String()), []byte(undo.BlockId.String()))
+	}
+	for _, entry := range undo.PkhTxs {
+		batch.Put(storedPkhTxKey(entry), []byte(entry.TxId.String()))
+	}
+	for i, txId := range undo.SpentBy {
+		spent := undo.Spent[i].Utxo
+		batch.Put(
+			storedUtxoSpenderKey(spent),
+			storedUtxoSpenderVal(spent, utxoSpender{TxId: txId, BlockId: undo.BlockId}),
+		)
+	}
+	rawUndo, err := json.Marshal(undo)
+	if err != nil {
+		return err
+	}
+	batch.Put([]byte(stateUndoPrefix+undo.BlockId.String()), rawUndo)
+	batch.Put([]byte(stateUtxoHashPrefix+undo.BlockId.String()), []byte(undo.UtxoHash.String()))
+	return nil
+}
+
+// Get the stored undo record of the given block.
+func (ss *stateStore) GetUndo(blockId core.HashT) (blockUndo, error) {
+	rawUndo, ok, err := ss.kv.Get([]byte(stateUndoPrefix + blockId.String()))
+	if err != nil {
+		return blockUndo{}, err
+	} else if !ok {
+		return blockUndo{}, fmt.Errorf("missing undo record for block %s", blockId)
+	}
+	var undo blockUndo
+	if err := json.Unmarshal(rawUndo, &undo); err != nil {
+		return blockUndo{}, fmt.Errorf("corrupt undo record for block %s: %s", blockId, err)
+	}
+	return undo, nil
+}
+
+// Add the writes of rewinding the given block to the batch, using its undo record.
+func (ss *stateStore) applyRewind(batch *kvstore.Batch, blockId core.HashT) error {
+	undoKey := []byte(stateUndoPrefix + blockId.String())
+	rawUndo, deleted, ok := batch.Lookup(undoKey)
+	if !ok {
+		var exists bool
+		var err error
+		rawUndo, exists, err = ss.kv.Get(undoKey)
+		if err != nil {
+			return err
+		}
+		deleted = !exists
+	}
+	if deleted {
+		return fmt.Errorf("missing undo record for block %s", blockId)
+	}
+	var undo blockUndo
+	if err := json.Unmarshal(rawUndo, &undo); err != nil {
+		return fmt.Errorf("corrupt undo record for block %s: %s", blockId, err)
+	}
+	for _, created := range undo.Created {
+		batch.Delete(storedUtxoKey(created.Utxo))
+	}
+	for _, spent := range undo.Spent {
+		batch.Put(storedUtxoKey(spent.Utxo), storedUtxoVal(spent))
+	}
+	for _, txId := range undo.TxIds {
+		batch.Delete([]byte(stateTxPrefix + txId.String()))
+	}
+	for _, entry := range undo.PkhTxs {
+		batch.Delete(storedPkhTxKey(entry))
+	}
+	for i := range undo.SpentBy {
+		batch.Delete(storedUtxoSpenderKey(undo.Spent[i].Utxo))
+	}
+	batch.Delete(undoKey)
+	batch.Delete([]byte(stateUtxoHashPrefix + blockId.String()))
+	return nil
+}
+
+// Close the store.
+func (ss *stateStore) Close() error {
+	return ss.kv.Close()
+}
+
+// Key a utxo by its tx id and output index.
+func storedUtxoKey(utxo core.Utxo) []byte {
+	return []byte(fmt.Sprintf("%s%s/%d", stateUtxoPrefix, utxo.TxId, utxo.Ind))
+}
+
+// Store a utxo's value and controlling pkh.
+func storedUtxoVal(pu pkhUtxo) []byte {
+	return []byte(fmt.Sprintf("%d/%s", pu.Utxo.Value, pu.Pkh))
+}
+
+// Parse a stored utxo and its controlling pkh.
+func parseStoredUtxo(key []byte, val []byte) (core.Utxo, core.HashT, error) {
+	rawTxId, rawInd, ok := strings.Cut(string(key[len(stateUtxoPrefix):]), "/")
+	if !ok {
+		return core.Utxo{}, core.HashT{}, fmt.Errorf("malformed utxo key: %s", key)
+	}
+	rawValue, rawPkh, ok := strings.Cut(string(val), "/")
+	if !ok {
+		return core.Utxo{}, core.HashT{}, fmt.Errorf("malformed utxo value: %s", val)
+	}
+	txId, err := core.NewHashTFromString(rawTxId)
+	if err != nil {
+		return core.Utxo{}, core.HashT{}, err
+	}
+	ind, err := strconv.ParseUint(rawInd, 10, 64)
+	if err != nil {
+		return core.Utxo{}, core.HashT{}, err
+	}
+	value, err := strconv.ParseUint(rawValue, 10, 64)
+	if err != nil {
+		return core.Utxo{}, core.HashT{}, err
+	}
+	pkh, err := core.NewHashTFromString(rawPkh)
+	if err != nil {
+		return core.Utxo{}, core.HashT{}, err
+	}
+	return core.Utxo{TxId: txId, Ind: ind, Value: value}, pkh, nil
+}
+
+// Key a pkh tx history entry by its pkh and position, zero-padded so keys sort in order.
+func storedPkhTxKey(entry pkhTx) []byte {
+	return []byte(fmt.Sprintf("%s%s/%020d", statePkhTxPrefix, entry.Pkh, entry.Ind))
+}
+
+// Parse a stored pkh tx history entry.
+func parseStoredPkhTx(key []byte, val []byte) (pkhTx, error) {
+	rawPkh, rawInd, ok := strings.Cut(string(key[len(statePkhTxPrefix):]), "/")
+	if !ok {
+		return pkhTx{}, fmt.Errorf("malformed pkh tx key: %s", key)
+	}
+	pkh, err := core.NewHashTFromString(rawPkh)
+	if err != nil {
+		return pkhTx{}, err
+	}
+	ind, err := strconv.ParseUint(rawInd, 10, 64)
+	if err != nil {
+		return pkhTx{}, err
+	}
+	txId, err := core.NewHashTFromString(string(val))
+	if err != nil {
+		return pkhTx{}, err
+	}
+	return pkhTx{Pkh: pkh, Ind: ind, TxId: txId}, nil
+}
+
+// Key a utxo's spender by the utxo's tx id and output index.
+func storedUtxoSpenderKey(utxo core.Utxo) []byte {
+	return []byte(fmt.Sprintf("%s%s/%d", stateUtxoSpenderPrefix, utxo.TxId, utxo.Ind))
+}
+
+// Store a spent utxo's value, and its spending tx and block.
+func storedUtxoSpenderVal(utxo core.Utxo, spender utxoSpender) []byte {
+	return []byte(fmt.Sprintf("%d/%s/%s", utxo.Value, spender.TxId, spender.BlockId))
+}
+
+// Parse a stored utxo spender, and the utxo it spends.
+func parseStoredUtxoSpender(key []byte, val []byte) (core.Utxo, utxoSpender, error) {
+	rawTxId, rawInd, ok := strings.Cut(string(key[len(stateUtxoSpenderPrefix):]), "/")
+	if !ok {
+		return core.Utxo{}, utxoSpender{}, fmt.Errorf("malformed utxo spender key: %s", key)
+	}
+	parts := strings.Split(string(val), "/")
+	if len(parts) != 3 {
+		return core.Utxo{}, utxoSpender{}, fmt.Errorf("malformed utxo spender value: %s", val)
+	}
+	txId, err := core.NewHashTFromString(rawTxId)
+	if err != nil {
+		return core.Utxo{}, utxoSpender{}, err
+	}
+	ind, err := strconv.ParseUint(rawInd, 10, 64)
+	if err != nil {
+		return core.Utxo{}, utxoSpender{}, err
+	}
+	value, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return core.Utxo{}, utxoSpender{}, err
+	}
+	spenderTxId, err := core.NewHashTFromString(parts[1])
+	if err != nil {
+		return core.Utxo{}, utxoSpender{}, err
+	}
+	blockId, err := core.NewHashTFromString(parts[2])
+	if err != nil {
+		return core.Utxo{}, utxoSpender{}, err
+	}
+	utxo := core.Utxo{TxId: txId, Ind: ind, Value: value}
+	return utxo, utxoSpender{TxId: spenderTxId, BlockId: blockId}, nil
+}
+
+// Count the entries of a state's pkh tx index, to detect lost records.
+func formatPkhTxCount(state *State) string {
+	total := 0
+	for _, txIds := range state.pkhTxs {
+		total += len(txIds)
+	}
+	return strconv.Itoa(total)
+}
+
+// Summarize the size of a state's indexes, to detect lost records.
+func formatStateCounts(state *State) string {
+	return fmt.Sprintf("%d/%d", state.utxos.Size(), len(state.includedTxBlocks))
+}
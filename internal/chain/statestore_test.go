@@ -0,0 +1,181 @@
+package chain
+
+import (
+	"testing"
+
+	"github.com/levilutz/basiccoin/internal/bus"
+	"github.com/levilutz/basiccoin/internal/inv"
+	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+// An inv that knows every block, each based on the previous of the given chain above the zero
+// block, and panics on anything else.
+type allBlocksInv struct {
+	inv.InvReader
+	chain []core.HashT
+}
+
+func (allBlocksInv) HasBlock(blockId core.HashT) bool { return true }
+
+func (i allBlocksInv) GetBlockHeight(blockId core.HashT) uint64 {
+	for h, id := range i.chain {
+		if id == blockId {
+			return uint64(h + 1)
+		}
+	}
+	panic("block not in chain")
+}
+
+func (i allBlocksInv) GetBlock(blockId core.HashT) core.Block {
+	if height := i.GetBlockHeight(blockId); height > 1 {
+		return core.Block{PrevBlockId: i.chain[height-2]}
+	}
+	return core.Block{}
+}
+
+// Test that advances and rewinds persist and reload through their undo records.
+func TestStateStoreAdvanceRewind(t *testing.T) {
+	dir := t.TempDir()
+	ss, err := openStateStore(dir)
+	util.AssertNoErr(t, err)
+	block1, block2 := core.NewHashTRand(), core.NewHashTRand()
+	blocksInv := allBlocksInv{chain: []core.HashT{block1, block2}}
+	state := NewState(blocksInv)
+	pkhA, pkhB := core.NewHashTRand(), core.NewHashTRand()
+	coinbase := pkhUtxo{Utxo: core.Utxo{TxId: core.NewHashTRand(), Value: 100}, Pkh: pkhA}
+	paid := pkhUtxo{Utxo: core.Utxo{TxId: core.NewHashTRand(), Value: 90}, Pkh: pkhB}
+
+	// Block 1 creates a coinbase, block 2 spends it
+	state.head = block1
+	state.utxos.Add(coinbase.Utxo)
+	state.creditBalance(pkhA, coinbase.Utxo)
+	state.includedTxBlocks[coinbase.Utxo.TxId] = block1
+	util.AssertNoErr(t, ss.Apply([]stateChange{{Advanced: true, Undo: blockUndo{
+		BlockId:  block1,
+		Created:  []pkhUtxo{coinbase},
+		TxIds:    []core.HashT{coinbase.Utxo.TxId},
+		UtxoHash: state.GetUtxoHash(),
+	}}}, state))
+	state.head = block2
+	state.utxos.Remove(coinbase.Utxo)
+	util.AssertNoErr(t, state.debitBalance(pkhA, coinbase.Utxo))
+	state.utxos.Add(paid.Utxo)
+	state.creditBalance(pkhB, paid.Utxo)
+	state.includedTxBlocks[paid.Utxo.TxId] = block2
+	util.AssertNoErr(t, ss.Apply([]stateChange{{Advanced: true, Undo: blockUndo{
+		BlockId:  block2,
+		Spent:    []pkhUtxo{coinbase},
+		Created:  []pkhUtxo{paid},
+		TxIds:    []core.HashT{paid.Utxo.TxId},
+		UtxoHash: state.GetUtxoHash(),
+	}}}, state))
+
+	loaded, err := ss.Load(blocksInv, Indexes{})
+	util.AssertNoErr(t, err)
+	util.Assert(t, loaded.head == block2, "wrong head")
+	heights := loaded.GetMainChainBlockIds([]uint64{0, 1, 2, 3})
+	util.Assert(t, len(heights) == 3 && heights[1] == block1 && heights[2] == block2,
+		"wrong main chain: %v", heights)
+	util.Assert(t, loaded.GetPkhBalance(pkhA) == 0, "spent utxo loaded")
+	util.Assert(t, loaded.GetPkhBalance(pkhB) == 90, "created utxo not loaded")
+	util.Assert(t, len(loaded.includedTxBlocks) == 2, "wrong included txs")
+	util.Assert(t, loaded.GetUtxoHash() == state.GetUtxoHash(), "wrong utxo hash")
+	util.Assert(t, len(loaded.blockUtxoHashes) == 2, "wrong block utxo hashes")
+
+	// Rewinding block 2 restores the coinbase from the undo record alone
+	loaded.head = block1
+	loaded.utxos.Remove(paid.Utxo)
+	loaded.utxos.Add(coinbase.Utxo)
+	delete(loaded.includedTxBlocks, paid.Utxo.TxId)
+	util.AssertNoErr(t, ss.Apply([]stateChange{{Undo: blockUndo{BlockId: block2}}}, loaded))
+	util.AssertNoErr(t, ss.kv.Close())
+	ss, err = openStateStore(dir)
+	util.AssertNoErr(t, err)
+	loaded, err = ss.Load(blocksInv, Indexes{})
+	util.AssertNoErr(t, err)
+	util.Assert(t, loaded.head == block1, "wrong head after rewind")
+	util.Assert(t, loaded.GetPkhBalance(pkhA) == 100, "spent utxo not restored")
+	util.Assert(t, loaded.GetPkhBalance(pkhB) == 0, "created utxo not removed")
+	util.Assert(t, len(loaded.blockUtxoHashes) == 1, "rewound block's utxo hash kept")
+	util.Assert(t, ss.Apply([]stateChange{{Undo: blockUndo{BlockId: block2}}}, loaded) != nil,
+		"rewound block without undo record")
+
+	// Clearing leaves nothing to load
+	util.AssertNoErr(t, ss.Clear())
+	_, err = ss.Load(blocksInv, Indexes{})
+	util.Assert(t, err != nil, "loaded cleared state")
+}
+
+// Test that a crash between saving the state and the head resumes from the state if its chain
+// is fully stored, and otherwise rewinds it to the saved head with its undo records.
+func TestResumeStateAheadOfHead(t *testing.T) {
+	saveDir := t.TempDir()
+	state, ss, memInv, advance := newStoredState(t, Indexes{PkhTxs: true}, saveDir+"/state")
+	coinbase := func(height uint64) core.Tx {
+		return core.Tx{
+			IsCoinbase: true,
+			MinBlock:   height,
+			Outputs:    []core.TxOut{{Value: 100, PublicKeyHash: core.NewHashTRand()}},
+		}
+	}
+	block1 := advance(coinbase(1))
+	block2 := advance(coinbase(2))
+	hash2 := state.GetUtxoHash()
+	coinbase3 := coinbase(3)
+	block3 := advance(coinbase3)
+	util.AssertNoErr(t, ss.Close())
+	newChain := func() *Chain {
+		return &Chain{
+			bus:         bus.NewBus(),
+			inv:         memInv,
+			state:       NewState(memInv),
+			saveDir:     &saveDir,
+			recentHeads: make([]core.HashT, 0),
+			indexes:     Indexes{PkhTxs: true},
+		}
+	}
+
+	// The state was saved at block 3, but the crash came before the head was
+	c := newChain()
+	util.AssertNoErr(t, c.saveHeadToFile(block1))
+	util.AssertNoErr(t, c.saveHeadToFile(block2))
+	c.loadSaved()
+	util.Assert(t, c.state.head == block3, "didn't resume from stored state: %s", c.state.head)
+	heads, err := loadHeadsFromFile(&saveDir)
+	util.AssertNoErr(t, err)
+	util.Assert(t, heads[0] == block3, "saved head not caught up: %s", heads[0])
+	util.AssertNoErr(t, c.stateStore.Close())
+
+	// Block 3's contents were then lost, so the head is rolled back and the state rewound
+	memInv.DeleteTx(coinbase3.Hash())
+	c = newChain()
+	c.loadSaved()
+	util.Assert(t, c.state.head == block2, "state not rewound: %s", c.state.head)
+	util.Assert(t, c.state.GetUtxoHash() == hash2, "wrong utxo hash after rewind")
+	txIds, total, err := c.state.GetPkhTxs(coinbase3.Outputs[0].PublicKeyHash, 0, 10)
+	util.AssertNoErr(t, err)
+	util.Assert(t, total == 0 && len(txIds) == 0, "rewound tx history kept")
+	loaded, err := c.stateStore.Load(memInv, Indexes{PkhTxs: true})
+	util.AssertNoErr(t, err)
+	util.Assert(t, loaded.head == block2, "rewind not persisted: %s", loaded.head)
+}
+
+// Test that the store's log is compacted as blocks are advanced and rewound, rather than growing
+// with every spent utxo and dropped undo record.
+func TestStateStoreCompacts(t *testing.T) {
+	defer func(size int64) { stateCompactMinSize = size }(stateCompactMinSize)
+	stateCompactMinSize = 4096
+	state, ss, _, advance := newIndexedState(t, Indexes{})
+	for i := 0; i < 500; i++ {
+		advance(core.Tx{
+			IsCoinbase: true,
+			MinBlock:   1,
+			Outputs:    []core.TxOut{{Value: 100, PublicKeyHash: core.NewHashTRand()}},
+		})
+		state.Rewind()
+		util.AssertNoErr(t, ss.Apply(state.TakeJournal(), state))
+	}
+	util.Assert(t, ss.kv.Size() < 4*stateCompactMinSize, "log not compacted: %d", ss.kv.Size())
+	util.AssertNoErr(t, ss.Close())
+}
@@ -8,36 +8,54 @@ import (
 
 // Create a new mining target and broadcast it.
 func (c *Chain) CreateMiningTarget() {
-	// Get candidate txs
-	candidateTxIds := c.state.GetSortedIncludableMempool()
-	// Build a tx list until we hit max size
+	// Get candidate txs, with the unconfirmed ancestors each needs
+	candidates := c.state.GetSortedMempoolPackages()
+	// Build a tx list until we hit max size, each tx after its ancestors
 	totalSize := core.CoinbaseVSize()
+	params := c.inv.GetCoreParams()
+	minTxVSize := core.MinNonCoinbaseVSize(params, c.inv.GetBlockHeight(c.state.head)+1)
 	consumedUtxos := set.NewSet[core.Utxo]()
+	included := set.NewSet[core.HashT]()
 	txIds := make([]core.HashT, 0)
-	for _, txId := range candidateTxIds {
-		tx := c.inv.GetTx(txId)
-		// Check if tx is too big to fit in remaining space
-		vSize := tx.VSize()
-		if totalSize+vSize > c.inv.GetCoreParams().MaxBlockVSize {
+	for _, candidate := range candidates {
+		// Get the package's txs not already included with an earlier package
+		pkgTxIds := make([]core.HashT, 0, len(candidate.TxIds))
+		pkgUtxos := make([]core.Utxo, 0)
+		vSize := uint64(0)
+		for _, txId := range candidate.TxIds {
+			if included.Includes(txId) {
+				continue
+			}
+			tx := c.inv.GetTx(txId)
+			pkgTxIds = append(pkgTxIds, txId)
+			pkgUtxos = append(pkgUtxos, tx.GetConsumedUtxos()...)
+			vSize += tx.VSize()
+		}
+		if len(pkgTxIds) == 0 {
+			continue
+		}
+		// Check if package is too big to fit in remaining space
+		if totalSize+vSize > params.MaxBlockVSize {
 			continue
 		}
-		// Check if tx uses already-consumed utxos
-		txUtxos := tx.GetConsumedUtxos()
-		if consumedUtxos.IncludesAny(txUtxos...) {
+		// Check if package uses already-consumed utxos, or the same utxo twice
+		if consumedUtxos.IncludesAny(pkgUtxos...) ||
+			set.NewSetFromList(pkgUtxos).Size() != len(pkgUtxos) {
 			continue
 		}
-		// Include tx in out set
-		txIds = append(txIds, txId)
+		// Include package in out set
+		txIds = append(txIds, pkgTxIds...)
+		included.Add(pkgTxIds...)
 		totalSize += vSize
-		consumedUtxos.Add(txUtxos...)
+		consumedUtxos.Add(pkgUtxos...)
 		// If we couldn't possibly store more txs, stop searching
-		if totalSize > c.inv.GetCoreParams().MaxBlockVSize-core.MinNonCoinbaseVSize() {
+		if totalSize > params.MaxBlockVSize-minTxVSize {
 			break
 		}
 	}
 	c.bus.MinerTarget.Pub(bus.MinerTargetEvent{
 		Head:   c.state.head,
-		Target: core.NextTarget(c.inv.GetCoreParams(), c.inv, c.state.head),
+		Target: core.NextTarget(params, c.inv, c.state.head),
 		TxIds:  txIds,
 	})
 }
@@ -0,0 +1,94 @@
+package chain
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/levilutz/basiccoin/internal/inv"
+	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+// Verify the saved head's chain is fully stored and replays cleanly through a State, and that
+// the stored state matches the replay. Below a pruned height, replay starts from the stored
+// state instead. If repairing, roll the saved head back to the newest fully stored one, and
+// clear a stored state that doesn't match so it's rebuilt on startup.
+// Should only be run offline, with the inv's records already verified.
+func VerifySaved(inv *inv.Inv, saveDir string, report *inv.VerifyReport, repair bool) error {
+	stateStore, err := openStateStore(saveDir + "/state")
+	if err != nil {
+		return err
+	}
+	defer stateStore.Close()
+	prunedHeight, err := stateStore.PrunedHeight()
+	if err != nil {
+		return err
+	}
+	inv.SetPrunedHeight(prunedHeight)
+
+	// Find the newest saved head whose chain is fully stored
+	heads, err := loadHeadsFromFile(&saveDir)
+	if err != nil {
+		report.Add(false, "no saved head: %s", err)
+		return nil
+	}
+	head, ok := recoverHead(inv, heads)
+	if !ok {
+		report.Add(false, "no saved head is fully stored")
+		return nil
+	} else if head != heads[0] {
+		if repair {
+			raw := strings.Join(core.MarshalHashTSlice(util.Prepend(heads, head)), "\n")
+			if err := util.WriteFileAtomic(saveDir+"/head", []byte(raw), 0666); err != nil {
+				return err
+			}
+		}
+		report.Add(repair, "saved head %s is not fully stored, newest usable head is %s", heads[0], head)
+	}
+
+	// Replay the chain up to the head, from the stored state if pruned
+	stored, loadErr := stateStore.Load(inv, Indexes{})
+	if loadErr == nil {
+		if _, ok := inv.GetBlockAncestorDepth(head, stored.head); !ok {
+			loadErr = fmt.Errorf("stored state head %s not on saved chain", stored.head)
+		}
+	}
+	state := NewState(inv)
+	if prunedHeight > 0 {
+		if loadErr != nil {
+			report.Add(false, "stored state of pruned chain is unusable, resync needed: %s", loadErr)
+			return nil
+		}
+		state = stored.Copy()
+	}
+	blockIds := util.Reverse(inv.GetBlockAncestorsUntil(head, state.head))
+	if head != state.head {
+		blockIds = append(blockIds, head)
+	}
+	for _, blockId := range blockIds {
+		if err := state.Advance(blockId, true); err != nil {
+			report.Add(false, "block %s fails to replay: %s", blockId, err)
+			return nil
+		}
+	}
+
+	// Compare the stored state against the replay
+	if loadErr == nil {
+		for blockId, expected := range state.blockUtxoHashes {
+			if hash, ok := stored.blockUtxoHashes[blockId]; ok && hash != expected {
+				loadErr = fmt.Errorf("utxo hash at block %s mismatches replay", blockId)
+				break
+			}
+		}
+	}
+	if loadErr != nil {
+		repaired := repair && prunedHeight == 0
+		if repaired {
+			if err := stateStore.Clear(); err != nil {
+				return err
+			}
+		}
+		report.Add(repaired, "stored state is inconsistent: %s", loadErr)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package inv_test
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	. "github.com/levilutz/basiccoin/internal/inv"
+	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+var easiestTarget = core.NewHashTFromStringAssert(
+	"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+)
+
+// Store a chain of the given length on the given parent, returning its block ids in order.
+func storeChain(t testing.TB, inv *Inv, parentId core.HashT, length int) []core.HashT {
+	blockIds := make([]core.HashT, 0, length)
+	for i := 0; i < length; i++ {
+		block := core.Block{PrevBlockId: parentId, Target: easiestTarget, Noise: core.NewHashTRand()}
+		if err := inv.StoreTrustedBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		parentId = block.Hash()
+		blockIds = append(blockIds, parentId)
+	}
+	return blockIds
+}
+
+// Get a block's ancestor by walking parents one at a time, as a reference.
+func walkAncestor(inv *Inv, blockId core.HashT, depth int) core.HashT {
+	for i := 0; i < depth && !blockId.EqZero(); i++ {
+		blockId = inv.GetBlockParentId(blockId)
+	}
+	return blockId
+}
+
+// Get the most recent common ancestor of two blocks by walking parents, as a reference.
+func walkLCA(inv *Inv, blockId core.HashT, otherBlockId core.HashT) core.HashT {
+	for inv.GetBlockHeight(blockId) > inv.GetBlockHeight(otherBlockId) {
+		blockId = inv.GetBlockParentId(blockId)
+	}
+	for inv.GetBlockHeight(otherBlockId) > inv.GetBlockHeight(blockId) {
+		otherBlockId = inv.GetBlockParentId(otherBlockId)
+	}
+	for blockId != otherBlockId {
+		blockId = inv.GetBlockParentId(blockId)
+		otherBlockId = inv.GetBlockParentId(otherBlockId)
+	}
+	return blockId
+}
+
+// Test that ancestry queries using skip pointers agree with walking parents, on a tree of forks.
+func TestSkipAncestry(t *testing.T) {
+	inv := NewInv(core.DevNetParams(), nil, StoreParams{})
+	rng := rand.New(rand.NewSource(1))
+	blockIds := []core.HashT{{}}
+	for i := 0; i < 20; i++ {
+		parentId := blockIds[rng.Intn(len(blockIds))]
+		blockIds = append(blockIds, storeChain(t, inv, parentId, 1+rng.Intn(100))...)
+	}
+	for i := 0; i < 1000; i++ {
+		blockId := blockIds[rng.Intn(len(blockIds))]
+		otherBlockId := blockIds[rng.Intn(len(blockIds))]
+		height := int(inv.GetBlockHeight(blockId))
+		depth := rng.Intn(height + 2)
+
+		expected := walkAncestor(inv, blockId, depth)
+		ancestor := inv.GetBlockSpecificAncestor(blockId, depth)
+		util.Assert(t, ancestor == expected, "wrong ancestor at depth %d of %s", depth, blockId)
+
+		if depth <= height {
+			got, ok := inv.GetBlockAncestorDepth(blockId, expected)
+			util.Assert(t, ok && got == uint64(depth), "wrong depth of %s: %d", expected, got)
+		}
+		lca := walkLCA(inv, blockId, otherBlockId)
+		util.Assert(t, inv.GetBlockLCA(blockId, otherBlockId) == lca, "wrong lca")
+		if lca != otherBlockId {
+			_, ok := inv.GetBlockAncestorDepth(blockId, otherBlockId)
+			util.Assert(t, !ok, "%s is not an ancestor of %s", otherBlockId, blockId)
+		}
+	}
+	_, ok := inv.GetBlockAncestorDepth(blockIds[1], core.NewHashTRand())
+	util.Assert(t, !ok, "unknown block is an ancestor")
+}
+
+// Lengths of the chains benchmarked.
+var benchChainLengths = []int{1000, 10000, 100000}
+
+// Create chains of each benchmarked length forking from the first block, so their heads'
+// common ancestor is at the bottom.
+func benchForks(b *testing.B) (*Inv, map[int][2]core.HashT) {
+	inv := NewInv(core.DevNetParams(), nil, StoreParams{})
+	root := storeChain(b, inv, core.HashT{}, 1)[0]
+	heads := make(map[int][2]core.HashT)
+	for _, length := range benchChainLengths {
+		left := storeChain(b, inv, root, length)
+		right := storeChain(b, inv, root, length)
+		heads[length] = [2]core.HashT{left[length-1], right[length-1]}
+	}
+	return inv, heads
+}
+
+func BenchmarkGetBlockSpecificAncestor(b *testing.B) {
+	inv, heads := benchForks(b)
+	for _, length := range benchChainLengths {
+		head := heads[length][0]
+		b.Run(fmt.Sprintf("skip/%d", length), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				inv.GetBlockSpecificAncestor(head, length-1)
+			}
+		})
+		b.Run(fmt.Sprintf("walk/%d", length), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				walkAncestor(inv, head, length-1)
+			}
+		})
+	}
+}
+
+func BenchmarkGetBlockAncestorDepth(b *testing.B) {
+	inv, heads := benchForks(b)
+	for _, length := range benchChainLengths {
+		head := heads[length][0]
+		ancestor := walkAncestor(inv, head, length-1)
+		b.Run(fmt.Sprintf("skip/%d", length), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				inv.GetBlockAncestorDepth(head, ancestor)
+			}
+		})
+	}
+}
+
+func BenchmarkGetBlockLCA(b *testing.B) {
+	inv, heads := benchForks(b)
+	for _, length := range benchChainLengths {
+		left, right := heads[length][0], heads[length][1]
+		b.Run(fmt.Sprintf("skip/%d", length), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				inv.GetBlockLCA(left, right)
+			}
+		})
+		b.Run(fmt.Sprintf("walk/%d", length), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				walkLCA(inv, left, right)
+			}
+		})
+	}
+}
@@ -1,12 +1,18 @@
 package inv
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"sync/atomic"
 
 	"github.com/levilutz/basiccoin/pkg/core"
 	"github.com/levilutz/basiccoin/pkg/disksyncmap"
+	"github.com/levilutz/basiccoin/pkg/lru"
 	"github.com/levilutz/basiccoin/pkg/queue"
+	"github.com/levilutz/basiccoin/pkg/segsyncmap"
 	"github.com/levilutz/basiccoin/pkg/syncmap"
+	"github.com/levilutz/basiccoin/pkg/util"
 )
 
 // Interface of all the inv methods that can't invoke SyncMap.Store.
@@ -26,14 +32,19 @@ type InvReader interface {
 	GetMerkleTxIds(root core.HashT) []core.HashT
 	GetMerkleTxs(root core.HashT) []core.Tx
 	GetMerkleVSize(merkleId core.HashT) uint64
+	GetPrunedHeight() uint64
 	GetTx(txId core.HashT) core.Tx
+	GetTxById(txId core.HashT) core.Tx
+	GetTxHashById(txId core.HashT) core.HashT
 	GetTxOut(txId core.HashT, ind uint64) core.TxOut
 	GetTxVSize(txId core.HashT) uint64
 	HasAnyBlock(blockIds []core.HashT) (core.HashT, bool)
 	HasBlock(blockId core.HashT) bool
+	HasBlockContents(blockId core.HashT) bool
 	HasEntity(entityId core.HashT) bool
 	HasMerkle(nodeId core.HashT) bool
 	HasTx(txId core.HashT) bool
+	HasTxById(txId core.HashT) bool
 	HasTxOut(txId core.HashT, ind uint64) bool
 }
 
@@ -46,12 +57,68 @@ type SomeSyncMap[K comparableStringer, V fmt.Stringer] interface {
 	Has(key K) bool
 	Get(key K) V
 	Store(key K, val V)
+	Delete(key K)
+}
+
+// How the inventory is persisted within the save dir.
+type StoreBackend string
+
+const (
+	// One file per entity, under blocks/, merkles/, txs/, etc.
+	StoreBackendFiles StoreBackend = "files"
+	// Records appended to segmented flat files, with an in-memory offset index.
+	StoreBackendSegments StoreBackend = "segments"
+	// An embedded ordered kv store, committing each batch of entities atomically.
+	StoreBackendKV StoreBackend = "kv"
+)
+
+// Parse a store backend from a string.
+func ParseStoreBackend(raw string) (StoreBackend, error) {
+	switch backend := StoreBackend(raw); backend {
+	case StoreBackendFiles, StoreBackendSegments, StoreBackendKV:
+		return backend, nil
+	default:
+		return "", fmt.Errorf("unknown store backend: %s", raw)
+	}
+}
+
+// How the inventory is persisted when given a save dir.
+type StoreParams struct {
+	// Which backend to store entities with.
+	Backend StoreBackend
+	// Total bytes of entities to cache in memory, split between entity types.
+	// Non-positive caches every loaded entity.
+	CacheBytes int64
+}
+
+// A map whose in-memory cache can pin entries and report stats.
+type cachingSyncMap[K comparableStringer] interface {
+	Pin(key K)
+	Unpin(key K)
+	CacheStats() lru.Stats
+}
+
+// How many of the most recently stored blocks to keep pinned in cache.
+const pinnedRecentBlocks = 64
+
+// Create a map persisted at the given path by the given backend, with the given cache budget.
+func newDiskMap[K comparableStringer, V fmt.Stringer](
+	backend StoreBackend, path string, parseFunc func(raw string) (V, error), cacheBytes int64,
+) SomeSyncMap[K, V] {
+	switch backend {
+	case StoreBackendSegments:
+		return segsyncmap.NewSegSyncMapWithBudget[K, V](path, parseFunc, cacheBytes)
+	default:
+		return disksyncmap.NewDiskSyncMapWithBudget[K, V](path, parseFunc, cacheBytes)
+	}
 }
 
 type BlockRecord struct {
 	Block     core.Block
 	Height    uint64
 	TotalWork core.HashT
+	// The ancestor at skipHeight(Height), to walk back in big steps
+	Skip core.HashT
 }
 
 type MerkleRecord struct {
@@ -73,29 +140,79 @@ type Inv struct {
 	blocks  SomeSyncMap[core.HashT, BlockRecord]
 	merkles SomeSyncMap[core.HashT, MerkleRecord]
 	txs     SomeSyncMap[core.HashT, TxRecord]
+	// Tx id -> full hash, for txs whose id excludes signatures
+	txIds SomeSyncMap[core.HashT, core.HashT]
+	// Shared kv store backing the above, if using the kv backend
+	kv *kvBackend
+	// Recently stored blocks pinned in cache, oldest first
+	recentBlocks *queue.Queue[core.HashT]
+	// Height up to which block contents may have been deleted, 0 if not pruning
+	prunedHeight atomic.Uint64
 	// Save dir
 	saveDir *string
 }
 
-func NewInv(coreParams core.Params, saveDir *string) *Inv {
+func NewInv(coreParams core.Params, saveDir *string, storeParams StoreParams) *Inv {
 	inv := &Inv{
-		coreParams: coreParams,
-		saveDir:    saveDir,
+		coreParams:   coreParams,
+		saveDir:      saveDir,
+		recentBlocks: queue.NewQueue[core.HashT](),
 	}
+	backend := storeParams.Backend
+	if backend == "" {
+		backend = StoreBackendFiles
+	}
+	hadRecords := false
 	if saveDir != nil {
-		inv.blocks = disksyncmap.NewDiskSyncMap[core.HashT, BlockRecord](
-			*saveDir+"/blocks", BlockRecordFromString,
+		var err error
+		if err = checkStoreBackend(*saveDir, backend); err != nil {
+			panic(fmt.Sprintf("failed to open save dir: %s", err))
+		} else if hadRecords, err = hasStoredRecords(*saveDir); err != nil {
+			panic(fmt.Sprintf("failed to open save dir: %s", err))
+		}
+	}
+	// Txs dominate, then merkles - blocks are few and mostly pinned while hot
+	cacheBytes := storeParams.CacheBytes
+	if saveDir != nil && backend == StoreBackendKV {
+		inv.kv = newKvBackend(*saveDir + "/kv")
+		inv.blocks = newKvSyncMap[core.HashT, BlockRecord](inv.kv, "b/", BlockRecordFromString)
+		inv.merkles = newKvSyncMap[core.HashT, MerkleRecord](inv.kv, "m/", MerkleRecordFromString)
+		inv.txs = newKvSyncMap[core.HashT, TxRecord](inv.kv, "t/", TxRecordFromString)
+		inv.txIds = newKvSyncMap[core.HashT, core.HashT](inv.kv, "i/", core.NewHashTFromString)
+	} else if saveDir != nil {
+		inv.blocks = newDiskMap[core.HashT, BlockRecord](
+			backend, *saveDir+"/blocks", BlockRecordFromString, cacheBytes/8,
 		)
-		inv.merkles = disksyncmap.NewDiskSyncMap[core.HashT, MerkleRecord](
-			*saveDir+"/merkles", MerkleRecordFromString,
+		inv.merkles = newDiskMap[core.HashT, MerkleRecord](
+			backend, *saveDir+"/merkles", MerkleRecordFromString, cacheBytes/4,
 		)
-		inv.txs = disksyncmap.NewDiskSyncMap[core.HashT, TxRecord](
-			*saveDir+"/txs", TxRecordFromString,
+		inv.txs = newDiskMap[core.HashT, TxRecord](
+			backend, *saveDir+"/txs", TxRecordFromString, cacheBytes/2,
+		)
+		inv.txIds = newDiskMap[core.HashT, core.HashT](
+			backend, *saveDir+"/txids", core.NewHashTFromString, cacheBytes/8,
 		)
 	} else {
 		inv.blocks = syncmap.NewSyncMap[core.HashT, BlockRecord]()
 		inv.merkles = syncmap.NewSyncMap[core.HashT, MerkleRecord]()
 		inv.txs = syncmap.NewSyncMap[core.HashT, TxRecord]()
+		inv.txIds = syncmap.NewSyncMap[core.HashT, core.HashT]()
+	}
+	if saveDir != nil {
+		// Migrate first, as records in an old format would otherwise read as corrupt
+		if err := inv.migrate(hadRecords); err != nil {
+			panic(fmt.Sprintf("failed to migrate inventory: %s", err))
+		}
+		// Only a crash can leave torn records behind, so skip checking them after a clean exit
+		if clean, err := inv.takeCleanMarker(); err != nil {
+			panic(fmt.Sprintf("failed to check for clean shutdown: %s", err))
+		} else if !clean {
+			if quarantined, err := inv.Recover(); err != nil {
+				panic(fmt.Sprintf("failed to recover inventory: %s", err))
+			} else if quarantined > 0 {
+				fmt.Printf("quarantined %d corrupt inventory records\n", quarantined)
+			}
+		}
 	}
 	inv.verifier = core.NewVerifier(coreParams, inv)
 	inv.blocks.Store(core.HashT{}, BlockRecord{
@@ -106,6 +223,139 @@ func NewInv(coreParams core.Params, saveDir *string) *Inv {
 	return inv
 }
 
+// Start a batch, so entities stored until CommitBatch are persisted together or not at all.
+// Stored entities are visible immediately. Only atomic with the kv backend.
+func (inv *Inv) BeginBatch() {
+	if inv.kv != nil {
+		inv.kv.begin()
+	}
+}
+
+// Persist every entity stored since BeginBatch, compacting the kv store once it's mostly
+// deleted and overwritten entities. With other backends, syncs every entity stored so far.
+func (inv *Inv) CommitBatch() error {
+	if inv.kv != nil {
+		if err := inv.kv.commit(); err != nil {
+			return err
+		}
+		return inv.Compact()
+	}
+	return inv.Sync()
+}
+
+// Forget every entity stored since BeginBatch, if the backend supports it.
+func (inv *Inv) DiscardBatch() {
+	if inv.kv != nil {
+		inv.kv.discard()
+	}
+}
+
+// Reclaim the space of deleted and overwritten entities, once they're most of the kv store.
+// Other backends reclaim it as entities are deleted, or never for segments.
+func (inv *Inv) Compact() error {
+	if inv.kv != nil {
+		return inv.kv.compact()
+	}
+	return nil
+}
+
+// A map that defers syncing its stored records to disk.
+type syncableSyncMap interface {
+	Sync() error
+}
+
+// Sync every stored entity to disk, if the backend defers it.
+func (inv *Inv) Sync() error {
+	for _, m := range []any{inv.blocks, inv.merkles, inv.txs, inv.txIds} {
+		if sm, ok := m.(syncableSyncMap); ok {
+			if err := sm.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Get the path of the file marking a save dir as cleanly shut down.
+func cleanMarkerPath(saveDir string) string {
+	return saveDir + "/clean"
+}
+
+// Sync every stored entity, compact the kv store if it's mostly garbage, and mark the save dir
+// as cleanly shut down, so it isn't checked for corruption when next opened. No more entities
+// may be stored afterwards.
+func (inv *Inv) Close() error {
+	if inv.saveDir == nil {
+		return nil
+	}
+	if err := inv.Sync(); err != nil {
+		return err
+	} else if err := inv.Compact(); err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(cleanMarkerPath(*inv.saveDir), []byte{}, 0666)
+}
+
+// Remove the clean shutdown marker, returning whether there was one.
+func (inv *Inv) takeCleanMarker() (bool, error) {
+	path := cleanMarkerPath(*inv.saveDir)
+	if err := os.Remove(path); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	// Make sure the removal is durable before storing anything, where dirs can be synced
+	util.SyncPaths([]string{*inv.saveDir})
+	return true, nil
+}
+
+// A map that can detect and quarantine its own corrupt records.
+type recoverableSyncMap interface {
+	Recover() ([]string, error)
+}
+
+// Check the stored entities for corruption, quarantining any corrupt records so they read
+// as missing. Returns how many records were quarantined.
+func (inv *Inv) Recover() (int, error) {
+	maps := map[string]any{
+		"blocks":  inv.blocks,
+		"merkles": inv.merkles,
+		"txs":     inv.txs,
+		"txIds":   inv.txIds,
+	}
+	total := 0
+	for name, m := range maps {
+		rm, ok := m.(recoverableSyncMap)
+		if !ok {
+			continue
+		}
+		quarantined, err := rm.Recover()
+		if err != nil {
+			return total, fmt.Errorf("failed to recover %s: %s", name, err)
+		}
+		total += len(quarantined)
+	}
+	return total, nil
+}
+
+// Get the stats of each entity type's in-memory cache, if its backend has one.
+func (inv *Inv) GetCacheStats() map[string]lru.Stats {
+	out := make(map[string]lru.Stats)
+	if m, ok := inv.blocks.(cachingSyncMap[core.HashT]); ok {
+		out["blocks"] = m.CacheStats()
+	}
+	if m, ok := inv.merkles.(cachingSyncMap[core.HashT]); ok {
+		out["merkles"] = m.CacheStats()
+	}
+	if m, ok := inv.txs.(cachingSyncMap[core.HashT]); ok {
+		out["txs"] = m.CacheStats()
+	}
+	if m, ok := inv.txIds.(cachingSyncMap[core.HashT]); ok {
+		out["txIds"] = m.CacheStats()
+	}
+	return out
+}
+
 // Get the stored core params.
 func (inv *Inv) GetCoreParams() core.Params {
 	return inv.coreParams
@@ -167,26 +417,25 @@ func (inv *Inv) GetBlockAncestors(blockId core.HashT, maxLen int) []core.HashT {
 
 // Get the blockId that's `depth` hops up from here, or the zero block we hit chain start first.
 func (inv *Inv) GetBlockSpecificAncestor(blockId core.HashT, depth int) core.HashT {
-	// If no hops or we're already at zero, return this block
-	if depth == 0 || blockId.EqZero() {
-		return blockId
+	height := inv.GetBlockHeight(blockId)
+	if uint64(depth) >= height {
+		return core.HashT{}
 	}
-	ancestorIds := inv.GetBlockAncestors(blockId, depth)
-	// Since blockId != 0, we know we have at least one ancestor
-	return ancestorIds[len(ancestorIds)-1]
+	return ancestorAtHeight(blockId, height-uint64(depth), inv.blocks.Get)
 }
 
 // Returns how many blocks deep the ancestor is, and whether we have this ancestor.
 func (inv *Inv) GetBlockAncestorDepth(blockId, ancestorId core.HashT) (uint64, bool) {
-	depth := uint64(0)
-	for blockId != ancestorId && !blockId.EqZero() {
-		blockId = inv.GetBlockParentId(blockId)
-		depth += 1
+	if !inv.HasBlock(ancestorId) {
+		return 0, false
 	}
-	if blockId != ancestorId {
+	height, ancestorHeight := inv.GetBlockHeight(blockId), inv.GetBlockHeight(ancestorId)
+	if ancestorHeight > height {
+		return 0, false
+	} else if ancestorAtHeight(blockId, ancestorHeight, inv.blocks.Get) != ancestorId {
 		return 0, false
 	}
-	return depth, true
+	return height - ancestorHeight, true
 }
 
 // Gets block ancestors, from top, until the given block.
@@ -216,20 +465,88 @@ func (inv *Inv) GetBlockAncestorsUntil(blockId, untilId core.HashT) []core.HashT
 // Return the most recent common ancestor of the two block ids.
 func (inv *Inv) GetBlockLCA(blockId, otherBlockId core.HashT) core.HashT {
 	// Move the higher block down until it's even with the other
-	for inv.GetBlockHeight(blockId) > inv.GetBlockHeight(otherBlockId) {
-		blockId = inv.GetBlockParentId(blockId)
+	height, otherHeight := inv.GetBlockHeight(blockId), inv.GetBlockHeight(otherBlockId)
+	if height > otherHeight {
+		blockId = ancestorAtHeight(blockId, otherHeight, inv.blocks.Get)
+	} else if otherHeight > height {
+		otherBlockId = ancestorAtHeight(otherBlockId, height, inv.blocks.Get)
 	}
-	for inv.GetBlockHeight(otherBlockId) > inv.GetBlockHeight(blockId) {
-		otherBlockId = inv.GetBlockParentId(otherBlockId)
-	}
-	// Step both blocks until they're even
+	// Step both blocks back until they meet, skipping while their skips differ. Blocks at
+	// the same height skip to the same height, so they stay even.
 	for blockId != otherBlockId {
-		blockId = inv.GetBlockParentId(blockId)
-		otherBlockId = inv.GetBlockParentId(otherBlockId)
+		record, otherRecord := inv.blocks.Get(blockId), inv.blocks.Get(otherBlockId)
+		if record.Skip != otherRecord.Skip {
+			blockId, otherBlockId = record.Skip, otherRecord.Skip
+		} else {
+			blockId, otherBlockId = record.Block.PrevBlockId, otherRecord.Block.PrevBlockId
+		}
+	}
+	return blockId
+}
+
+// Get the height a block at the given height keeps a skip pointer to. Pointing at heights
+// with fewer low set bits than its own means each can be reached from any descendant in
+// O(log n) steps, and alternating odd heights more aggressively keeps the steps short.
+// Follows Bitcoin's GetSkipHeight.
+func skipHeight(height uint64) uint64 {
+	if height < 2 {
+		return 0
+	}
+	// Clear the lowest set bit
+	invertLowestOne := func(n uint64) uint64 { return n & (n - 1) }
+	if height&1 == 1 {
+		return invertLowestOne(invertLowestOne(height-1)) + 1
+	}
+	return invertLowestOne(height)
+}
+
+// Get the ancestor of a block at the given height, at or below its own, taking each skip
+// that doesn't overshoot it. Follows Bitcoin's CBlockIndex::GetAncestor.
+func ancestorAtHeight(
+	blockId core.HashT, height uint64, getRecord func(blockId core.HashT) BlockRecord,
+) core.HashT {
+	record := getRecord(blockId)
+	if height > record.Height {
+		panic(fmt.Sprintf("block %s is below height %d", blockId, height))
+	}
+	for record.Height > height {
+		jump := skipHeight(record.Height)
+		jumpPrev := skipHeight(record.Height - 1)
+		// Skip if it lands on the height, or overshoots less than the parent's skip would
+		if jump == height || (jump > height && !(jumpPrev+2 < jump && jumpPrev >= height)) {
+			blockId = record.Skip
+		} else {
+			blockId = record.Block.PrevBlockId
+		}
+		record = getRecord(blockId)
 	}
 	return blockId
 }
 
+// Derive a block's record from its parent's, looking up the records of its ancestors to
+// find its skip pointer.
+func deriveBlockRecord(
+	block core.Block, parent BlockRecord, getRecord func(blockId core.HashT) BlockRecord,
+) BlockRecord {
+	height := parent.Height + 1
+	return BlockRecord{
+		Block:     block,
+		Height:    height,
+		TotalWork: parent.TotalWork.WorkAppendTarget(block.Target),
+		Skip:      blockSkip(block.PrevBlockId, height, getRecord),
+	}
+}
+
+// Get the skip pointer of a block at the given height, with the given parent.
+func blockSkip(
+	prevBlockId core.HashT, height uint64, getRecord func(blockId core.HashT) BlockRecord,
+) core.HashT {
+	if jump := skipHeight(height); jump > 0 {
+		return ancestorAtHeight(prevBlockId, jump, getRecord)
+	}
+	return core.HashT{}
+}
+
 // Return whether the given merkle id exists.
 func (inv *Inv) HasMerkle(nodeId core.HashT) bool {
 	return inv.merkles.Has(nodeId)
@@ -269,6 +586,36 @@ func (inv *Inv) GetMerkleTxIds(root core.HashT) []core.HashT {
 	return outTxIds
 }
 
+// Return whether the given block and every merkle node and tx under it are fully stored.
+// Unlike the getters, this doesn't panic on missing entities.
+func (inv *Inv) HasBlockContents(blockId core.HashT) bool {
+	if !inv.HasBlock(blockId) {
+		return false
+	}
+	if blockId.EqZero() {
+		return true
+	}
+	idQueue := queue.NewQueue(inv.GetBlock(blockId).MerkleRoot)
+	for idQueue.Size() > 0 {
+		nextId, _ := idQueue.Pop()
+		if inv.HasTx(nextId) {
+			id := inv.GetTx(nextId).Id(inv.coreParams)
+			if id != nextId && !inv.txIds.Has(id) {
+				return false
+			}
+		} else if inv.HasMerkle(nextId) {
+			merkle := inv.GetMerkle(nextId)
+			idQueue.Push(merkle.LChild)
+			if merkle.RChild != merkle.LChild {
+				idQueue.Push(merkle.RChild)
+			}
+		} else {
+			return false
+		}
+	}
+	return true
+}
+
 // Load all txs descended from a merkle node.
 func (inv *Inv) GetMerkleTxs(root core.HashT) []core.Tx {
 	txIds := inv.GetMerkleTxIds(root)
@@ -294,17 +641,44 @@ func (inv *Inv) GetTxVSize(txId core.HashT) uint64 {
 	return inv.txs.Get(txId).VSize
 }
 
-// Return whether the given tx has the given output index.
+// Return whether a tx with the given id (see core.Tx.Id) exists.
+func (inv *Inv) HasTxById(txId core.HashT) bool {
+	if inv.txIds.Has(txId) {
+		return true
+	}
+	// Txs identified by their full hash aren't stored in txIds
+	return inv.HasTx(txId) && inv.GetTx(txId).Id(inv.coreParams) == txId
+}
+
+// Get the full hash of a tx from its id, panic if it doesn't exist.
+// If several malleated versions of the tx are known, returns the one last included in our
+// chain (see SetIncludedTx), else the first one stored.
+func (inv *Inv) GetTxHashById(txId core.HashT) core.HashT {
+	if inv.txIds.Has(txId) {
+		return inv.txIds.Get(txId)
+	}
+	if !inv.HasTxById(txId) {
+		panic(fmt.Sprintf("tx id not known: %s", txId))
+	}
+	return txId
+}
+
+// Get a tx from its id, panic if it doesn't exist.
+func (inv *Inv) GetTxById(txId core.HashT) core.Tx {
+	return inv.GetTx(inv.GetTxHashById(txId))
+}
+
+// Return whether the tx with the given id has the given output index.
 func (inv *Inv) HasTxOut(txId core.HashT, ind uint64) bool {
-	if !inv.HasTx(txId) {
+	if !inv.HasTxById(txId) {
 		return false
 	}
-	return ind < uint64(len(inv.GetTx(txId).Outputs))
+	return ind < uint64(len(inv.GetTxById(txId).Outputs))
 }
 
-// Get the given output from the given tx.
+// Get the given output from the tx with the given id.
 func (inv *Inv) GetTxOut(txId core.HashT, ind uint64) core.TxOut {
-	return inv.GetTx(txId).Outputs[ind]
+	return inv.GetTxById(txId).Outputs[ind]
 }
 
 // Return whether the given id exists as either a merkle or a tx.
@@ -320,6 +694,35 @@ func (inv *Inv) GetEntityVSize(entityId core.HashT) uint64 {
 	return inv.GetTxVSize(entityId)
 }
 
+// Get the height up to which block contents may have been pruned, 0 if none have been.
+// Headers are kept at every height.
+func (inv *Inv) GetPrunedHeight() uint64 {
+	return inv.prunedHeight.Load()
+}
+
+// Set the height up to which block contents may have been pruned.
+func (inv *Inv) SetPrunedHeight(height uint64) {
+	inv.prunedHeight.Store(height)
+}
+
+// Delete a merkle node, if it exists. Only for pruning, the caller must ensure it isn't needed.
+func (inv *Inv) DeleteMerkle(merkleId core.HashT) {
+	inv.merkles.Delete(merkleId)
+}
+
+// Delete a tx (and its id mapping), if it exists.
+// Only for pruning, the caller must ensure it isn't needed.
+func (inv *Inv) DeleteTx(txId core.HashT) {
+	if !inv.HasTx(txId) {
+		return
+	}
+	id := inv.GetTx(txId).Id(inv.coreParams)
+	if id != txId && inv.txIds.Has(id) && inv.txIds.Get(id) == txId {
+		inv.txIds.Delete(id)
+	}
+	inv.txs.Delete(txId)
+}
+
 // Verify and store a new block.
 // For efficiency, this won't verify that each tx's claimed utxos are available.
 // Thus the caller (usually a State) should verify to prevent double-spends.
@@ -334,15 +737,44 @@ func (inv *Inv) StoreBlock(block core.Block) error {
 	if err := inv.verifier.VerifyBlock(block); err != nil {
 		return err
 	}
-	prevWork := inv.GetBlockTotalWork(block.PrevBlockId)
-	inv.blocks.Store(blockId, BlockRecord{
-		Block:     block,
-		Height:    inv.GetBlockHeight(block.PrevBlockId) + 1,
-		TotalWork: prevWork.WorkAppendTarget(block.Target),
-	})
+	inv.blocks.Store(blockId, inv.newBlockRecord(block))
+	// Keep the newest blocks in memory, they're read constantly by the chain and peers
+	if m, ok := inv.blocks.(cachingSyncMap[core.HashT]); ok {
+		m.Pin(blockId)
+		inv.recentBlocks.Push(blockId)
+		if inv.recentBlocks.Size() > pinnedRecentBlocks {
+			oldId, _ := inv.recentBlocks.Pop()
+			m.Unpin(oldId)
+		}
+	}
+	return nil
+}
+
+// Store a block header trusted from a snapshot, without its contents or their verification.
+// Its parent must already be stored, and it must still beat its claimed target.
+func (inv *Inv) StoreTrustedBlock(block core.Block) error {
+	blockId := block.Hash()
+	if inv.HasBlock(blockId) {
+		return fmt.Errorf("trusted block already known: %s", blockId)
+	} else if !inv.HasBlock(block.PrevBlockId) {
+		return fmt.Errorf("trusted block parent unknown: %s", block.PrevBlockId)
+	} else if !blockId.Lt(block.Target) {
+		return fmt.Errorf("trusted block does not beat claimed target: %s", blockId)
+	}
+	inv.blocks.Store(blockId, inv.newBlockRecord(block))
 	return nil
 }
 
+// Derive the record of a block from its stored parent.
+func (inv *Inv) newBlockRecord(block core.Block) BlockRecord {
+	return deriveBlockRecord(block, inv.blocks.Get(block.PrevBlockId), inv.blocks.Get)
+}
+
+// Verify a stored block against its contents, which may have been stored after it.
+func (inv *Inv) VerifyStoredBlock(blockId core.HashT) error {
+	return inv.verifier.VerifyBlock(inv.GetBlock(blockId))
+}
+
 // Verify and store a new merkle node.
 func (inv *Inv) StoreMerkle(merkle core.MerkleNode) error {
 	nodeId := merkle.Hash()
@@ -363,6 +795,17 @@ func (inv *Inv) StoreMerkle(merkle core.MerkleNode) error {
 	return nil
 }
 
+// Verify a tx as StoreTx would, without storing it, reading the outputs it spends from the
+// given reader (e.g. one that also knows txs not yet stored).
+func (inv *Inv) VerifyTxWith(reader core.InvVerifier, tx core.Tx) error {
+	return inv.verifier.WithInv(reader).VerifyTx(tx)
+}
+
+// Verify the signatures of many txs in parallel, so storing them later needn't re-verify.
+func (inv *Inv) VerifyTxsSigs(txs []core.Tx) error {
+	return inv.verifier.VerifyTxsSigs(txs)
+}
+
 // Verify and store a new transaction.
 func (inv *Inv) StoreTx(tx core.Tx) error {
 	txId := tx.Hash()
@@ -376,5 +819,38 @@ func (inv *Inv) StoreTx(tx core.Tx) error {
 		Tx:    tx,
 		VSize: tx.VSize(),
 	})
+	// Malleated versions share an id, so keep the first one we see until one is included
+	if id := tx.Id(inv.coreParams); id != txId && !inv.txIds.Has(id) {
+		inv.txIds.Store(id, txId)
+	}
 	return nil
 }
+
+// Point a stored tx's id at it, as it's the version of the tx included in our chain, rather than
+// another malleated version stored first.
+func (inv *Inv) SetIncludedTx(txId core.HashT) {
+	id := inv.GetTx(txId).Id(inv.coreParams)
+	if id == txId {
+		// Txs identified by their full hash are found without txIds
+		if inv.txIds.Has(id) {
+			inv.txIds.Delete(id)
+		}
+	} else if !inv.txIds.Has(id) || inv.txIds.Get(id) != txId {
+		overwriteRecord(inv.txIds, id, txId)
+	}
+}
+
+// Store a tx trusted from a snapshot, without verification (its inputs may be unknown).
+func (inv *Inv) StoreTrustedTx(tx core.Tx) {
+	txId := tx.Hash()
+	if inv.HasTx(txId) {
+		return
+	}
+	inv.txs.Store(txId, TxRecord{
+		Tx:    tx,
+		VSize: tx.VSize(),
+	})
+	if id := tx.Id(inv.coreParams); id != txId && !inv.txIds.Has(id) {
+		inv.txIds.Store(id, txId)
+	}
+}
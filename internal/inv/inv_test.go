@@ -0,0 +1,98 @@
+package inv
+
+import (
+	"os"
+	"testing"
+
+	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+// Test that stored records are only checked for corruption when opened after a crash.
+func TestRecoverOnlyAfterCrash(t *testing.T) {
+	saveDir := t.TempDir()
+	tx := core.Tx{
+		IsCoinbase: true,
+		MinBlock:   1,
+		Outputs:    []core.TxOut{{Value: 100, PublicKeyHash: core.NewHashTRand()}},
+	}
+	inv := NewInv(core.DevNetParams(), &saveDir, StoreParams{})
+	inv.StoreTrustedTx(tx)
+	util.AssertNoErr(t, inv.Close())
+
+	// Tear the tx's record, and leave a temp file behind
+	txPath := saveDir + "/txs/" + tx.Hash().String()
+	raw, err := os.ReadFile(txPath)
+	util.AssertNoErr(t, err)
+	util.AssertNoErr(t, os.WriteFile(txPath, raw[:len(raw)-1], 0666))
+	tmpPath := saveDir + "/txs/" + util.TempFilePrefix + "x"
+	util.AssertNoErr(t, os.WriteFile(tmpPath, nil, 0666))
+
+	// After a clean shutdown nothing is checked
+	NewInv(core.DevNetParams(), &saveDir, StoreParams{})
+	_, err = os.Stat(tmpPath)
+	util.AssertNoErr(t, err)
+
+	// That open wasn't closed, so the next is treated as after a crash
+	inv = NewInv(core.DevNetParams(), &saveDir, StoreParams{})
+	_, err = os.Stat(tmpPath)
+	util.Assert(t, os.IsNotExist(err), "temp file not removed")
+	util.Assert(t, !inv.HasTx(tx.Hash()), "torn record not quarantined")
+}
+
+// Test that committing a batch deleting most of a kv inv's entities reclaims their space.
+func TestKvCompactsDeleted(t *testing.T) {
+	defer func(size int64) { kvCompactMinSize = size }(kvCompactMinSize)
+	kvCompactMinSize = 4096
+	saveDir := t.TempDir()
+	inv := NewInv(core.DevNetParams(), &saveDir, StoreParams{Backend: StoreBackendKV})
+	txs := make([]core.Tx, 100)
+	for i := range txs {
+		txs[i] = core.Tx{
+			IsCoinbase: true,
+			MinBlock:   uint64(i + 1),
+			Outputs:    []core.TxOut{{Value: 100, PublicKeyHash: core.NewHashTRand()}},
+		}
+		inv.StoreTrustedTx(txs[i])
+	}
+	size := inv.kv.store.Size()
+
+	inv.BeginBatch()
+	for _, tx := range txs[1:] {
+		inv.DeleteTx(tx.Hash())
+	}
+	util.AssertNoErr(t, inv.CommitBatch())
+	util.Assert(t, inv.kv.store.Size() < size/4, "deleted txs not reclaimed")
+	util.Assert(t, inv.HasTx(txs[0].Hash()), "kept tx lost")
+	util.Assert(t, !inv.HasTx(txs[1].Hash()), "deleted tx kept")
+}
+
+// Test that a tx id maps to the malleated version included in our chain, once there is one.
+func TestSetIncludedTx(t *testing.T) {
+	for _, backend := range []StoreBackend{StoreBackendFiles, StoreBackendSegments, StoreBackendKV} {
+		saveDir := t.TempDir()
+		inv := NewInv(core.DevNetParams(), &saveDir, StoreParams{Backend: backend})
+		first := core.Tx{
+			MinBlock: 1,
+			Inputs: []core.TxIn{{
+				Utxo:      core.Utxo{TxId: core.NewHashTRand(), Ind: 0, Value: 20},
+				PublicKey: []byte("pubKey"),
+				Signature: []byte("sig"),
+			}},
+			Outputs: []core.TxOut{{Value: 15, PublicKeyHash: core.NewHashTRand()}},
+		}
+		second := first
+		second.Inputs = []core.TxIn{first.Inputs[0]}
+		second.Inputs[0].Signature = []byte("malleated sig")
+		id := first.Id(inv.coreParams)
+		inv.StoreTrustedTx(first)
+		inv.StoreTrustedTx(second)
+		util.Assert(t, inv.GetTxHashById(id) == first.Hash(), "%s: id not of first stored", backend)
+
+		inv.SetIncludedTx(second.Hash())
+		util.Assert(t, inv.GetTxHashById(id) == second.Hash(), "%s: id not of included", backend)
+		util.AssertNoErr(t, inv.Close())
+		inv = NewInv(core.DevNetParams(), &saveDir, StoreParams{Backend: backend})
+		util.Assert(t, inv.GetTxHashById(id) == second.Hash(), "%s: included not kept", backend)
+	}
+}
@@ -0,0 +1,177 @@
+package inv
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/levilutz/basiccoin/pkg/kvstore"
+)
+
+// The least size the kv store's log must reach before it's compacted of deleted and overwritten
+// records. A var so tests can compact small stores.
+var kvCompactMinSize int64 = 64 << 20
+
+// A kv store shared by several maps, with an optional open write batch.
+type kvBackend struct {
+	store *kvstore.Store
+	mu    sync.Mutex
+	batch *kvstore.Batch
+}
+
+// Open the kv store in the given directory.
+func newKvBackend(dir string) *kvBackend {
+	store, err := kvstore.Open(dir)
+	if err != nil {
+		panic(fmt.Sprintf("failed to open kv store: %s", err))
+	}
+	return &kvBackend{store: store}
+}
+
+// Start buffering writes into a batch, so they're committed together.
+func (kv *kvBackend) begin() {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.batch != nil {
+		panic("kv batch already open")
+	}
+	kv.batch = kvstore.NewBatch()
+}
+
+// Atomically write the open batch.
+func (kv *kvBackend) commit() error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.batch == nil {
+		panic("no kv batch open")
+	}
+	batch := kv.batch
+	kv.batch = nil
+	return kv.store.Write(batch)
+}
+
+// Drop the open batch without writing it.
+func (kv *kvBackend) discard() {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.batch = nil
+}
+
+// Compact the kv store if over half of its log is deleted or overwritten records.
+func (kv *kvBackend) compact() error {
+	_, err := kv.store.CompactIfWasteful(kvCompactMinSize)
+	return err
+}
+
+// Get a key's value, from the open batch if it's been written there.
+func (kv *kvBackend) get(key []byte) ([]byte, bool, error) {
+	kv.mu.Lock()
+	if kv.batch != nil {
+		if val, deleted, ok := kv.batch.Lookup(key); ok {
+			kv.mu.Unlock()
+			return val, !deleted, nil
+		}
+	}
+	kv.mu.Unlock()
+	return kv.store.Get(key)
+}
+
+// Put a key's value, into the open batch if there is one.
+func (kv *kvBackend) put(key []byte, val []byte) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.batch != nil {
+		kv.batch.Put(key, val)
+		return nil
+	}
+	return kv.store.Put(key, val)
+}
+
+// Delete a key, in the open batch if there is one.
+func (kv *kvBackend) delete(key []byte) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.batch != nil {
+		kv.batch.Delete(key)
+		return nil
+	}
+	return kv.store.Delete(key)
+}
+
+// A sync map stored under a key prefix of a shared kv store.
+type kvSyncMap[K comparableStringer, V fmt.Stringer] struct {
+	kv        *kvBackend
+	prefix    string
+	parseFunc func(raw string) (V, error)
+}
+
+// Create a new kv-backed sync map under the given prefix.
+func newKvSyncMap[K comparableStringer, V fmt.Stringer](
+	kv *kvBackend, prefix string, parseFunc func(raw string) (V, error),
+) *kvSyncMap[K, V] {
+	return &kvSyncMap[K, V]{
+		kv:        kv,
+		prefix:    prefix,
+		parseFunc: parseFunc,
+	}
+}
+
+// Check whether the given key exists in the map.
+func (m *kvSyncMap[K, V]) Has(key K) bool {
+	_, ok, err := m.kv.get(m.key(key))
+	if err != nil {
+		panic(fmt.Sprintf("failed to read key %s: %s", key, err))
+	}
+	return ok
+}
+
+// Retrieve the given key from the map, panics if it doesn't exist.
+func (m *kvSyncMap[K, V]) Get(key K) V {
+	raw, ok, err := m.kv.get(m.key(key))
+	if err != nil {
+		panic(fmt.Sprintf("failed to read key %s: %s", key, err))
+	} else if !ok {
+		panic(fmt.Sprintf("attempted to load unknown key: %s", key))
+	}
+	val, err := m.parseFunc(string(raw))
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse key %s: %s", key, err))
+	}
+	return val
+}
+
+// Store the given key in the map.
+func (m *kvSyncMap[K, V]) Store(key K, val V) {
+	if err := m.kv.put(m.key(key), []byte(val.String())); err != nil {
+		fmt.Printf("failed to store key %s: %s\n", key, err)
+	}
+}
+
+// Delete the given key from the map.
+func (m *kvSyncMap[K, V]) Delete(key K) {
+	if err := m.kv.delete(m.key(key)); err != nil {
+		fmt.Printf("failed to delete key %s: %s\n", key, err)
+	}
+}
+
+// Walk every committed record in key order, passing its key and raw serialized value.
+// Stops if fn returns false.
+func (m *kvSyncMap[K, V]) IterateRaw(fn func(key string, raw string, err error) bool) error {
+	return m.IterateRawAfter("", fn)
+}
+
+func (m *kvSyncMap[K, V]) IterateRawAfter(
+	after string, fn func(key string, raw string, err error) bool,
+) error {
+	prefix := []byte(m.prefix)
+	var afterKey []byte
+	if after != "" {
+		afterKey = []byte(m.prefix + after)
+	}
+	return m.kv.store.IteratePrefixAfter(prefix, afterKey, func(key []byte, val []byte) bool {
+		return fn(string(key[len(m.prefix):]), string(val), nil)
+	})
+}
+
+func (m *kvSyncMap[K, V]) key(key K) []byte {
+	return []byte(m.prefix + key.String())
+}
@@ -0,0 +1,315 @@
+package inv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/segsyncmap"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+// The version of the save dir's record format written by this build.
+// Version 1 stored records as newline-separated text, and had no version file.
+// Version 2 stored block records without skip pointers.
+const saveDirVersion = 3
+
+// An upgrade of a save dir's records to the next version.
+type migration struct {
+	// The version the save dir is at once migrated
+	Version uint64
+	Desc    string
+	// Rewrite the records in place. Must be safe to re-run after an interruption.
+	Migrate func(inv *Inv) error
+}
+
+// Each migration, in order of version.
+var migrations = []migration{
+	{Version: 2, Desc: "binary records", Migrate: migrateBinaryRecords},
+	{Version: 3, Desc: "block skip pointers", Migrate: migrateBlockSkips},
+}
+
+// Get the path of a save dir's version file.
+func versionPath(saveDir string) string {
+	return saveDir + "/version"
+}
+
+// Get the path of the file naming a save dir's store backend.
+func storeBackendPath(saveDir string) string {
+	return saveDir + "/store"
+}
+
+// Check that the save dir is stored with the given backend, recording it if it isn't yet.
+// Other backends' records would otherwise read as missing, resyncing the chain from scratch.
+func checkStoreBackend(saveDir string, backend StoreBackend) error {
+	stored, recorded, err := loadStoreBackend(saveDir)
+	if err != nil {
+		return err
+	} else if stored != "" && stored != backend {
+		return fmt.Errorf(
+			"save dir is stored with the %s backend, can't open it with %s", stored, backend,
+		)
+	} else if recorded {
+		return nil
+	}
+	raw := string(backend) + "\n"
+	return util.WriteFileAtomic(storeBackendPath(saveDir), []byte(raw), 0666)
+}
+
+// Load the save dir's store backend, and whether it's recorded. Save dirs from before it was
+// recorded are recognized by their layout. Returns "" for an empty save dir.
+func loadStoreBackend(saveDir string) (StoreBackend, bool, error) {
+	raw, err := os.ReadFile(storeBackendPath(saveDir))
+	if err == nil {
+		backend, err := ParseStoreBackend(strings.TrimSpace(string(raw)))
+		return backend, true, err
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", false, err
+	}
+	if _, err := os.Stat(saveDir + "/kv"); err == nil {
+		return StoreBackendKV, false, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", false, err
+	}
+	// Files and segments share the blocks dir
+	if segs, err := filepath.Glob(saveDir + "/blocks/seg-*.dat"); err != nil {
+		return "", false, err
+	} else if len(segs) > 0 {
+		return StoreBackendSegments, false, nil
+	}
+	if hasBlocks, err := hasBlockFiles(saveDir); err != nil {
+		return "", false, err
+	} else if hasBlocks {
+		return StoreBackendFiles, false, nil
+	}
+	return "", false, nil
+}
+
+// Check whether the save dir has any stored records, whichever backend stored them. Must be
+// checked before the backend is opened, as the kv backend creates its dir when opened.
+func hasStoredRecords(saveDir string) (bool, error) {
+	if hasBlocks, err := hasBlockFiles(saveDir); err != nil || hasBlocks {
+		return hasBlocks, err
+	}
+	if _, err := os.Stat(saveDir + "/kv"); errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Check whether the save dir's blocks dir has any entries, without listing them all.
+func hasBlockFiles(saveDir string) (bool, error) {
+	dir, err := os.Open(saveDir + "/blocks")
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer dir.Close()
+	entries, err := dir.ReadDir(1)
+	if errors.Is(err, io.EOF) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return len(entries) > 0, nil
+}
+
+// Bring the save dir's records up to the current version, recording each step in the version
+// file so an interrupted upgrade resumes where it stopped. Whether the save dir had records
+// before it was opened tells a save dir predating versioning from a fresh one.
+func (inv *Inv) migrate(hadRecords bool) error {
+	version, err := inv.loadSaveDirVersion(hadRecords)
+	if err != nil {
+		return err
+	} else if version == 0 {
+		return inv.storeSaveDirVersion(saveDirVersion)
+	} else if version > saveDirVersion {
+		return fmt.Errorf(
+			"save dir version %d is newer than supported version %d", version, saveDirVersion,
+		)
+	}
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		fmt.Printf("migrating save dir to version %d: %s\n", m.Version, m.Desc)
+		if err := m.Migrate(inv); err != nil {
+			return fmt.Errorf("failed to migrate to version %d: %s", m.Version, err)
+		}
+		version = m.Version
+		// The rewritten records must be durable before the version says they're done
+		if err := inv.Sync(); err != nil {
+			return err
+		} else if err := inv.storeSaveDirVersion(version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load the save dir's version. Without a version file, a save dir with stored records predates
+// versioning, and an empty one is fresh, which is version 0.
+func (inv *Inv) loadSaveDirVersion(hadRecords bool) (uint64, error) {
+	raw, err := os.ReadFile(versionPath(*inv.saveDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		if hadRecords {
+			return 1, nil
+		}
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	version, err := strconv.ParseUint(strings.TrimSpace(string(raw)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse save dir version: %s", err)
+	}
+	return version, nil
+}
+
+func (inv *Inv) storeSaveDirVersion(version uint64) error {
+	raw := strconv.FormatUint(version, 10) + "\n"
+	return util.WriteFileAtomic(versionPath(*inv.saveDir), []byte(raw), 0666)
+}
+
+// Rewrite each text record as binary. Records that don't parse as text are already binary from
+// an interrupted run, or corrupt and left for recovery to quarantine.
+func migrateBinaryRecords(inv *Inv) error {
+	if err := migrateRecords(inv.blocks, blockRecordFromText); err != nil {
+		return fmt.Errorf("blocks: %s", err)
+	} else if err := migrateRecords(inv.merkles, merkleRecordFromText); err != nil {
+		return fmt.Errorf("merkles: %s", err)
+	} else if err := migrateRecords(inv.txs, txRecordFromText); err != nil {
+		return fmt.Errorf("txs: %s", err)
+	}
+	return nil
+}
+
+// Rewrite each block record with its skip pointer, found from its ancestors by their stored
+// heights. Records already rewritten are re-derived, and blocks without a consistent chain of
+// records are rewritten without one, for verify-db to find. Only each block's parent and height
+// are held in memory, not whole records.
+func migrateBlockSkips(inv *Inv) error {
+	type blockLink struct {
+		prevBlockId core.HashT
+		height      uint64
+	}
+	type parsedRecord struct {
+		record BlockRecord
+		isV2   bool
+	}
+	parse := func(raw string) (parsedRecord, error) {
+		if record, err := blockRecordFromV2(raw); err == nil {
+			return parsedRecord{record: record, isV2: true}, nil
+		}
+		record, err := BlockRecordFromString(raw)
+		return parsedRecord{record: record}, err
+	}
+	// Rewrite old records in the current format first, so they can be loaded in height order
+	links := make(map[core.HashT]blockLink)
+	err := walkRecordChunks(inv.blocks, parse, func(chunk map[core.HashT]parsedRecord) error {
+		for blockId, parsed := range chunk {
+			links[blockId] = blockLink{parsed.record.Block.PrevBlockId, parsed.record.Height}
+			if parsed.isV2 {
+				overwriteRecord(inv.blocks, blockId, parsed.record)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Parents sort before children, so each block's ancestors are done before it
+	blockIds := util.MapKeys(links)
+	sort.Slice(blockIds, func(i, j int) bool {
+		return links[blockIds[i]].height < links[blockIds[j]].height
+	})
+	doneHeights := map[core.HashT]uint64{{}: 0}
+	for _, blockId := range blockIds {
+		if blockId.EqZero() {
+			continue
+		}
+		link := links[blockId]
+		record := inv.blocks.Get(blockId)
+		if height, ok := doneHeights[link.prevBlockId]; ok && height+1 == link.height {
+			record.Skip = blockSkip(link.prevBlockId, link.height, inv.blocks.Get)
+			doneHeights[blockId] = link.height
+		} else {
+			record.Skip = core.HashT{}
+		}
+		overwriteRecord(inv.blocks, blockId, record)
+	}
+	return nil
+}
+
+// Re-store each record of a map that parses in an old format, in the current format.
+func migrateRecords[V fmt.Stringer](
+	m SomeSyncMap[core.HashT, V], parseFunc func(raw string) (V, error),
+) error {
+	return walkRecordChunks(m, parseFunc, func(chunk map[core.HashT]V) error {
+		for key, val := range chunk {
+			overwriteRecord(m, key, val)
+		}
+		return nil
+	})
+}
+
+// A map whose raw records can be walked in key order, resuming after the last key seen.
+type resumableRawSyncMap interface {
+	IterateRawAfter(after string, fn func(key string, raw string, err error) bool) error
+}
+
+// The most records a migration walks before handling them, so a whole map is never loaded.
+// A var so tests can walk in several chunks.
+var migrateChunkSize = 4096
+
+// Walk a map's records in key order, passing each chunk of up to migrateChunkSize records that
+// parse to fn. The walk is paused while fn runs, as a map can't be written while it's walked.
+func walkRecordChunks[V any](
+	m any, parseFunc func(raw string) (V, error), fn func(chunk map[core.HashT]V) error,
+) error {
+	rm, ok := m.(resumableRawSyncMap)
+	if !ok {
+		return fmt.Errorf("records can't be walked")
+	}
+	after := ""
+	for {
+		chunk := make(map[core.HashT]V)
+		walked := 0
+		err := rm.IterateRawAfter(after, func(rawKey string, raw string, err error) bool {
+			after = rawKey
+			walked++
+			key, keyErr := core.NewHashTFromString(rawKey)
+			if err == nil && keyErr == nil {
+				if val, err := parseFunc(raw); err == nil {
+					chunk[key] = val
+				}
+			}
+			return walked < migrateChunkSize
+		})
+		if err != nil {
+			return err
+		} else if err := fn(chunk); err != nil {
+			return err
+		} else if walked < migrateChunkSize {
+			return nil
+		}
+	}
+}
+
+// Replace a stored record. Segment maps ignore stores of existing keys, so delete it first.
+func overwriteRecord[V fmt.Stringer](m SomeSyncMap[core.HashT, V], key core.HashT, val V) {
+	if _, ok := m.(*segsyncmap.SegSyncMap[core.HashT, V]); ok {
+		m.Delete(key)
+	}
+	m.Store(key, val)
+}
@@ -0,0 +1,146 @@
+package inv
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+// Test that a save dir of version 1 text records is migrated in place when opened.
+func TestMigrateTextRecords(t *testing.T) {
+	saveDir := t.TempDir()
+	tx := core.Tx{
+		MinBlock: 3,
+		Inputs: []core.TxIn{{
+			Utxo:      core.Utxo{TxId: core.NewHashTRand(), Ind: 1, Value: 20},
+			PublicKey: []byte("pubKey"),
+			Signature: []byte("sig"),
+		}},
+		Outputs: []core.TxOut{{Value: 15, PublicKeyHash: core.NewHashTRand()}},
+	}
+	merkle := core.MerkleNode{LChild: tx.Hash(), RChild: tx.Hash()}
+	block := core.Block{MerkleRoot: merkle.Hash(), Noise: core.NewHashTRand(), Nonce: 9}
+
+	// Write the records as a version 1 build would have, without a version file
+	writeText := func(dir string, id core.HashT, text string) {
+		util.AssertNoErr(t, os.MkdirAll(saveDir+"/"+dir, 0750))
+		util.AssertNoErr(t, os.WriteFile(saveDir+"/"+dir+"/"+id.String(), []byte(text), 0666))
+	}
+	writeText("txs", tx.Hash(), TxRecord{Tx: tx, VSize: tx.VSize()}.text())
+	writeText("merkles", merkle.Hash(), MerkleRecord{Merkle: merkle, VSize: tx.VSize()}.text())
+	writeText("blocks", core.HashT{}, BlockRecord{}.text())
+	writeText("blocks", block.Hash(), BlockRecord{Block: block, Height: 1}.text())
+
+	for i := 0; i < 2; i++ {
+		inv := NewInv(core.DevNetParams(), &saveDir, StoreParams{})
+		util.Assert(t, inv.GetTx(tx.Hash()).Hash() == tx.Hash(), "tx not migrated")
+		util.Assert(t, inv.GetMerkle(merkle.Hash()) == merkle, "merkle not migrated")
+		util.Assert(t, inv.GetBlock(block.Hash()) == block, "block not migrated")
+		util.Assert(t, inv.GetBlockHeight(block.Hash()) == 1, "block height not migrated")
+		raw, err := os.ReadFile(versionPath(saveDir))
+		util.AssertNoErr(t, err)
+		version := strconv.Itoa(saveDirVersion)
+		util.Assert(t, strings.TrimSpace(string(raw)) == version, "wrong version: %s", raw)
+		err = inv.blocks.(rawIterableSyncMap).IterateRaw(func(key string, raw string, err error) bool {
+			util.AssertNoErr(t, err)
+			_, err = BlockRecordFromString(raw)
+			util.AssertNoErr(t, err)
+			return true
+		})
+		util.AssertNoErr(t, err)
+	}
+
+	// A save dir from a newer build can't be opened
+	util.AssertNoErr(t, os.WriteFile(versionPath(saveDir), []byte("99\n"), 0666))
+	inv := &Inv{saveDir: &saveDir}
+	util.Assert(t, inv.migrate(true) != nil, "migrated from newer version")
+}
+
+// Test that the block records of a version 2 save dir gain their skip pointers when opened.
+func TestMigrateBlockSkips(t *testing.T) {
+	saveDir := t.TempDir()
+	params := core.DevNetParams()
+	easiest := core.NewHashTFromStringAssert(
+		"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+	)
+	inv := NewInv(params, &saveDir, StoreParams{})
+	blockIds := []core.HashT{{}}
+	for i := 0; i < 40; i++ {
+		block := core.Block{PrevBlockId: blockIds[i], Target: easiest, Noise: core.NewHashTRand()}
+		util.AssertNoErr(t, inv.StoreTrustedBlock(block))
+		blockIds = append(blockIds, block.Hash())
+	}
+	expected := make(map[core.HashT]BlockRecord)
+	for _, blockId := range blockIds {
+		expected[blockId] = inv.blocks.Get(blockId)
+	}
+
+	// Write the records as a version 2 build would have
+	for blockId, record := range expected {
+		util.AssertNoErr(t, os.WriteFile(
+			saveDir+"/blocks/"+blockId.String(), []byte(record.v2String()), 0666,
+		))
+	}
+	util.AssertNoErr(t, os.WriteFile(versionPath(saveDir), []byte("2\n"), 0666))
+
+	// Walk in several chunks, so blocks are rewritten before their ancestors are seen
+	defer func(size int) { migrateChunkSize = size }(migrateChunkSize)
+	migrateChunkSize = 7
+	inv = NewInv(params, &saveDir, StoreParams{})
+	for blockId, record := range expected {
+		util.Assert(t, inv.blocks.Get(blockId) == record, "wrong migrated record %s", blockId)
+	}
+	util.Assert(t, expected[blockIds[40]].Skip == blockIds[32], "wrong skip of block 40")
+	util.Assert(t, inv.GetBlockSpecificAncestor(blockIds[40], 27) == blockIds[13], "wrong ancestor")
+
+	// Re-running an interrupted migration changes nothing
+	util.AssertNoErr(t, migrateBlockSkips(inv))
+	for blockId, record := range expected {
+		util.Assert(t, inv.blocks.Get(blockId) == record, "wrong re-migrated record %s", blockId)
+	}
+}
+
+// Test that a save dir can only be reopened with the backend it was stored with.
+func TestCheckStoreBackend(t *testing.T) {
+	saveDir := t.TempDir()
+	NewInv(core.DevNetParams(), &saveDir, StoreParams{Backend: StoreBackendSegments}).Close()
+	util.AssertNoErr(t, checkStoreBackend(saveDir, StoreBackendSegments))
+	err := checkStoreBackend(saveDir, StoreBackendFiles)
+	util.Assert(t, err != nil, "opened segments save dir with files")
+
+	// A save dir from before the backend was recorded is recognized, then recorded
+	saveDir = t.TempDir()
+	NewInv(core.DevNetParams(), &saveDir, StoreParams{}).Close()
+	util.AssertNoErr(t, os.Remove(storeBackendPath(saveDir)))
+	err = checkStoreBackend(saveDir, StoreBackendKV)
+	util.Assert(t, err != nil, "opened unrecorded files save dir with kv")
+	util.AssertNoErr(t, checkStoreBackend(saveDir, StoreBackendFiles))
+	backend, recorded, err := loadStoreBackend(saveDir)
+	util.AssertNoErr(t, err)
+	util.Assert(t, backend == StoreBackendFiles && recorded, "backend not recorded: %s", backend)
+}
+
+// Test that a save dir predating versioning is migrated whichever backend stored it.
+func TestMigrateUnversionedBackends(t *testing.T) {
+	for _, backend := range []StoreBackend{StoreBackendFiles, StoreBackendSegments, StoreBackendKV} {
+		saveDir := t.TempDir()
+		hadRecords, err := hasStoredRecords(saveDir)
+		util.AssertNoErr(t, err)
+		util.Assert(t, !hadRecords, "%s: fresh save dir has records", backend)
+		NewInv(core.DevNetParams(), &saveDir, StoreParams{Backend: backend}).Close()
+
+		// Drop the version file, as if written before versioning
+		util.AssertNoErr(t, os.Remove(versionPath(saveDir)))
+		hadRecords, err = hasStoredRecords(saveDir)
+		util.AssertNoErr(t, err)
+		util.Assert(t, hadRecords, "%s: records not found", backend)
+		inv := &Inv{saveDir: &saveDir}
+		version, err := inv.loadSaveDirVersion(hadRecords)
+		util.AssertNoErr(t, err)
+		util.Assert(t, version == 1, "%s: wrong version %d", backend, version)
+	}
+}
@@ -1,232 +1,251 @@
 package inv
 
 import (
-	"encoding/base64"
+	"encoding/binary"
 	"fmt"
-	"strconv"
-	"strings"
 
 	"github.com/levilutz/basiccoin/pkg/core"
 )
 
+// Records are stored in a compact binary encoding: hashes as their 32 raw bytes, integers as
+// uvarints, bools as a byte, and byte strings prefixed by their uvarint length.
+// Changing a record's layout needs a new save dir version, with a migration (see migrate.go).
+
 func BlockRecordFromString(raw string) (record BlockRecord, err error) {
-	rows := strings.Split(strings.Trim(raw, "\n"), "\n")
-	if len(rows) != 8 {
-		return BlockRecord{}, fmt.Errorf("incorrect number of rows: %d", len(rows))
-	}
-	prevBlockId, err := core.NewHashTFromString(rows[0])
-	if err != nil {
-		return BlockRecord{}, fmt.Errorf("failed to parse PrevBlockId: %s", err)
-	}
-	merkleRoot, err := core.NewHashTFromString(rows[1])
-	if err != nil {
-		return BlockRecord{}, fmt.Errorf("failed to parse MerkleRoot: %s", err)
-	}
-	target, err := core.NewHashTFromString(rows[2])
-	if err != nil {
-		return BlockRecord{}, fmt.Errorf("failed to parse Target: %s", err)
-	}
-	noise, err := core.NewHashTFromString(rows[3])
-	if err != nil {
-		return BlockRecord{}, fmt.Errorf("failed to parse Noise: %s", err)
-	}
-	nonce, err := strconv.ParseUint(rows[4], 10, 64)
-	if err != nil {
-		return BlockRecord{}, fmt.Errorf("failed to parse Nonce: %s", err)
-	}
-	minedTime, err := strconv.ParseUint(rows[5], 10, 64)
-	if err != nil {
-		return BlockRecord{}, fmt.Errorf("failed to parse MinedTime: %s", err)
-	}
-	height, err := strconv.ParseUint(rows[6], 10, 64)
-	if err != nil {
-		return BlockRecord{}, fmt.Errorf("failed to parse Height: %s", err)
-	}
-	totalWork, err := core.NewHashTFromString(rows[7])
-	if err != nil {
-		return BlockRecord{}, fmt.Errorf("failed to parse TotalWork: %s", err)
-	}
-	return BlockRecord{
+	r := newRecordReader(raw)
+	record = BlockRecord{
 		Block: core.Block{
-			PrevBlockId: prevBlockId,
-			MerkleRoot:  merkleRoot,
-			Target:      target,
-			Noise:       noise,
-			Nonce:       nonce,
-			MinedTime:   minedTime,
+			PrevBlockId: r.hash(),
+			MerkleRoot:  r.hash(),
+			Target:      r.hash(),
+			Noise:       r.hash(),
+			Nonce:       r.uvarint(),
+			MinedTime:   r.uvarint(),
 		},
-		Height:    height,
-		TotalWork: totalWork,
-	}, nil
+		Height:    r.uvarint(),
+		TotalWork: r.hash(),
+		Skip:      r.hash(),
+	}
+	if err := r.finish(); err != nil {
+		return BlockRecord{}, fmt.Errorf("failed to parse block record: %s", err)
+	}
+	return record, nil
 }
 
 func (b BlockRecord) String() string {
-	return strings.Join([]string{
-		b.Block.PrevBlockId.String(),
-		b.Block.MerkleRoot.String(),
-		b.Block.Target.String(),
-		b.Block.Noise.String(),
-		strconv.FormatUint(b.Block.Nonce, 10),
-		strconv.FormatUint(b.Block.MinedTime, 10),
-		strconv.FormatUint(b.Height, 10),
-		b.TotalWork.String(),
-	}, "\n")
+	w := &recordWriter{}
+	w.hash(b.Block.PrevBlockId)
+	w.hash(b.Block.MerkleRoot)
+	w.hash(b.Block.Target)
+	w.hash(b.Block.Noise)
+	w.uvarint(b.Block.Nonce)
+	w.uvarint(b.Block.MinedTime)
+	w.uvarint(b.Height)
+	w.hash(b.TotalWork)
+	w.hash(b.Skip)
+	return string(w.buf)
 }
 
 func MerkleRecordFromString(raw string) (record MerkleRecord, err error) {
-	rows := strings.Split(strings.Trim(raw, "\n"), "\n")
-	if len(rows) != 3 {
-		return MerkleRecord{}, fmt.Errorf("incorrect number of rows: %d", len(rows))
-	}
-	lChild, err := core.NewHashTFromString(rows[0])
-	if err != nil {
-		return MerkleRecord{}, fmt.Errorf("failed to parse LChild: %s", err)
-	}
-	rChild, err := core.NewHashTFromString(rows[1])
-	if err != nil {
-		return MerkleRecord{}, fmt.Errorf("failed to parse RChild: %s", err)
-	}
-	vSize, err := strconv.ParseUint(rows[2], 10, 64)
-	if err != nil {
-		return MerkleRecord{}, fmt.Errorf("failed to parse VSize: %s", err)
-	}
-	return MerkleRecord{
+	r := newRecordReader(raw)
+	record = MerkleRecord{
 		Merkle: core.MerkleNode{
-			LChild: lChild,
-			RChild: rChild,
+			LChild: r.hash(),
+			RChild: r.hash(),
 		},
-		VSize: vSize,
-	}, nil
+		VSize: r.uvarint(),
+	}
+	if err := r.finish(); err != nil {
+		return MerkleRecord{}, fmt.Errorf("failed to parse merkle record: %s", err)
+	}
+	return record, nil
 }
 
 func (m MerkleRecord) String() string {
-	return strings.Join([]string{
-		m.Merkle.LChild.String(),
-		m.Merkle.RChild.String(),
-		strconv.FormatUint(m.VSize, 10),
-	}, "\n")
+	w := &recordWriter{}
+	w.hash(m.Merkle.LChild)
+	w.hash(m.Merkle.RChild)
+	w.uvarint(m.VSize)
+	return string(w.buf)
 }
 
 func TxRecordFromString(raw string) (record TxRecord, err error) {
-	rows := strings.Split(strings.Trim(raw, "\n"), "\n")
-	if len(rows) < 5 {
-		return TxRecord{}, fmt.Errorf("too few rows: %d", len(rows))
-	}
-	vSize, err := strconv.ParseUint(rows[0], 10, 64)
-	if err != nil {
-		return TxRecord{}, fmt.Errorf("failed to parse VSize: %s", err)
-	}
-	var isCoinbase bool
-	if rows[1] == "true" {
-		isCoinbase = true
-	} else if rows[1] == "false" {
-		isCoinbase = false
-	} else {
-		return TxRecord{}, fmt.Errorf("failed to parse IsCoinbase")
-	}
-	minBlock, err := strconv.ParseUint(rows[2], 10, 64)
-	if err != nil {
-		return TxRecord{}, fmt.Errorf("failed to parse MinBlock: %s", err)
-	}
-	numInputs, err := strconv.Atoi(rows[3])
-	if err != nil {
-		return TxRecord{}, fmt.Errorf("failed to parse NumInputs: %s", err)
-	}
-	numOutputs, err := strconv.Atoi(rows[4])
-	if err != nil {
-		return TxRecord{}, fmt.Errorf("failed to parse NumOutputs: %s", err)
-	}
-	expectRows := 5 + numInputs*5 + numOutputs*2
-	if len(rows) != expectRows {
-		return TxRecord{}, fmt.Errorf("expected %d rows, got %d", expectRows, len(rows))
-	}
-	inputs := make([]core.TxIn, numInputs)
-	outputs := make([]core.TxOut, numOutputs)
-	currentRow := 5
-	for i := range inputs {
-		txId, err := core.NewHashTFromString(rows[currentRow])
-		currentRow++
-		if err != nil {
-			return TxRecord{}, fmt.Errorf("failed to parse input %d TxId: %s", i, err)
-		}
-		ind, err := strconv.ParseUint(rows[currentRow], 10, 64)
-		currentRow++
-		if err != nil {
-			return TxRecord{}, fmt.Errorf("failed to parse input %d Ind: %s", i, err)
-		}
-		value, err := strconv.ParseUint(rows[currentRow], 10, 64)
-		currentRow++
-		if err != nil {
-			return TxRecord{}, fmt.Errorf("failed to parse input %d Value: %s", i, err)
-		}
-		publicKey, err := base64.StdEncoding.DecodeString(rows[currentRow])
-		currentRow++
-		if err != nil {
-			return TxRecord{}, fmt.Errorf("failed to parse input %d PublicKey: %s", i, err)
-		}
-		signature, err := base64.StdEncoding.DecodeString(rows[currentRow])
-		currentRow++
-		if err != nil {
-			return TxRecord{}, fmt.Errorf("failed to parse input %d Signature: %s", i, err)
-		}
-		inputs[i] = core.TxIn{
+	r := newRecordReader(raw)
+	record = TxRecord{
+		VSize: r.uvarint(),
+		Tx: core.Tx{
+			IsCoinbase: r.bool(),
+			MinBlock:   r.uvarint(),
+		},
+	}
+	record.Tx.Inputs = make([]core.TxIn, r.count())
+	for i := range record.Tx.Inputs {
+		record.Tx.Inputs[i] = core.TxIn{
 			Utxo: core.Utxo{
-				TxId:  txId,
-				Ind:   ind,
-				Value: value,
+				TxId:  r.hash(),
+				Ind:   r.uvarint(),
+				Value: r.uvarint(),
 			},
-			PublicKey: publicKey,
-			Signature: signature,
+			PublicKey:   r.bytes(),
+			Signature:   r.bytes(),
+			SigHashType: core.SigHashType(r.uint8()),
+			KeyType:     core.KeyType(r.uint8()),
 		}
 	}
-	for i := range outputs {
-		value, err := strconv.ParseUint(rows[currentRow], 10, 64)
-		currentRow++
-		if err != nil {
-			return TxRecord{}, fmt.Errorf("failed to parse output %d Value: %s", i, err)
-		}
-		pkh, err := core.NewHashTFromString(rows[currentRow])
-		currentRow++
-		if err != nil {
-			return TxRecord{}, fmt.Errorf("failed to parse input %d PublicKeyHash: %s", i, err)
-		}
-		outputs[i] = core.TxOut{
-			Value:         value,
-			PublicKeyHash: pkh,
+	record.Tx.Outputs = make([]core.TxOut, r.count())
+	for i := range record.Tx.Outputs {
+		record.Tx.Outputs[i] = core.TxOut{
+			Value:         r.uvarint(),
+			PublicKeyHash: r.hash(),
+			Data:          r.bytes(),
 		}
 	}
-	return TxRecord{
-		Tx: core.Tx{
-			IsCoinbase: isCoinbase,
-			MinBlock:   minBlock,
-			Inputs:     inputs,
-			Outputs:    outputs,
-		},
-		VSize: vSize,
-	}, nil
+	if err := r.finish(); err != nil {
+		return TxRecord{}, fmt.Errorf("failed to parse tx record: %s", err)
+	}
+	return record, nil
 }
 
 func (t TxRecord) String() string {
-	rows := make([]string, 5)
-	rows[0] = strconv.FormatUint(t.VSize, 10)
-	rows[1] = fmt.Sprintf("%t", t.Tx.IsCoinbase)
-	rows[2] = strconv.FormatUint(t.Tx.MinBlock, 10)
-	rows[3] = strconv.Itoa(len(t.Tx.Inputs))
-	rows[4] = strconv.Itoa(len(t.Tx.Outputs))
+	w := &recordWriter{}
+	w.uvarint(t.VSize)
+	w.bool(t.Tx.IsCoinbase)
+	w.uvarint(t.Tx.MinBlock)
+	w.uvarint(uint64(len(t.Tx.Inputs)))
 	for _, input := range t.Tx.Inputs {
-		rows = append(rows, []string{
-			input.Utxo.TxId.String(),
-			strconv.FormatUint(input.Utxo.Ind, 10),
-			strconv.FormatUint(input.Utxo.Value, 10),
-			base64.StdEncoding.EncodeToString(input.PublicKey),
-			base64.StdEncoding.EncodeToString(input.Signature),
-		}...)
-	}
+		w.hash(input.Utxo.TxId)
+		w.uvarint(input.Utxo.Ind)
+		w.uvarint(input.Utxo.Value)
+		w.bytes(input.PublicKey)
+		w.bytes(input.Signature)
+		w.uvarint(uint64(input.SigHashType))
+		w.uvarint(uint64(input.KeyType))
+	}
+	w.uvarint(uint64(len(t.Tx.Outputs)))
 	for _, output := range t.Tx.Outputs {
-		rows = append(rows, []string{
-			strconv.FormatUint(output.Value, 10),
-			output.PublicKeyHash.String(),
-		}...)
+		w.uvarint(output.Value)
+		w.hash(output.PublicKeyHash)
+		w.bytes(output.Data)
+	}
+	return string(w.buf)
+}
+
+// Builds a binary record.
+type recordWriter struct {
+	buf []byte
+}
+
+func (w *recordWriter) hash(h core.HashT) {
+	data := h.Data()
+	w.buf = append(w.buf, data[:]...)
+}
+
+func (w *recordWriter) uvarint(v uint64) {
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+func (w *recordWriter) bool(b bool) {
+	if b {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
 	}
-	return strings.Join(rows, "\n")
+}
+
+func (w *recordWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+// Reads a binary record field by field. After the first error, every read returns the zero
+// value, and the error is returned by finish.
+type recordReader struct {
+	raw []byte
+	err error
+}
+
+func newRecordReader(raw string) *recordReader {
+	return &recordReader{raw: []byte(raw)}
+}
+
+// Take the next n bytes, or nil if there aren't enough.
+func (r *recordReader) take(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	} else if n > uint64(len(r.raw)) {
+		r.err = fmt.Errorf("truncated record")
+		return nil
+	}
+	out := r.raw[:n]
+	r.raw = r.raw[n:]
+	return out
+}
+
+func (r *recordReader) hash() core.HashT {
+	raw := r.take(32)
+	if raw == nil {
+		return core.HashT{}
+	}
+	return core.NewHashTFromBytes(raw)
+}
+
+func (r *recordReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.raw)
+	if n <= 0 {
+		r.err = fmt.Errorf("malformed uvarint")
+		return 0
+	}
+	r.raw = r.raw[n:]
+	return v
+}
+
+func (r *recordReader) uint8() uint8 {
+	v := r.uvarint()
+	if v > 0xff && r.err == nil {
+		r.err = fmt.Errorf("value out of range: %d", v)
+	}
+	return uint8(v)
+}
+
+// Read the length of a list whose every element takes at least a byte.
+func (r *recordReader) count() uint64 {
+	v := r.uvarint()
+	if v > uint64(len(r.raw)) && r.err == nil {
+		r.err = fmt.Errorf("count exceeds record: %d", v)
+		return 0
+	}
+	return v
+}
+
+func (r *recordReader) bool() bool {
+	raw := r.take(1)
+	if raw == nil {
+		return false
+	} else if raw[0] > 1 {
+		r.err = fmt.Errorf("malformed bool: %d", raw[0])
+		return false
+	}
+	return raw[0] == 1
+}
+
+func (r *recordReader) bytes() []byte {
+	n := r.uvarint()
+	raw := r.take(n)
+	if raw == nil || n == 0 {
+		return nil
+	}
+	return append([]byte(nil), raw...)
+}
+
+// Get the first error reading the record, or an error if any of it wasn't read.
+func (r *recordReader) finish() error {
+	if r.err != nil {
+		return r.err
+	} else if len(r.raw) > 0 {
+		return fmt.Errorf("%d trailing bytes", len(r.raw))
+	}
+	return nil
 }
@@ -113,3 +113,43 @@ func TestSerializeTxRecord(t *testing.T) {
 	}
 	util.Assert(t, recon.Tx.Hash().Eq(record.Tx.Hash()), "Hash mismatch")
 }
+
+func TestSerializeTxRecordOptionalFields(t *testing.T) {
+	tx := core.Tx{
+		IsCoinbase: false,
+		MinBlock:   4124,
+		Inputs: []core.TxIn{
+			{
+				Utxo: core.Utxo{
+					TxId:  core.NewHashTRand(),
+					Ind:   5,
+					Value: 500,
+				},
+				PublicKey:   []byte("pubKey1"),
+				Signature:   []byte("sig1"),
+				SigHashType: core.SigHashSingle | core.SigHashAnyoneCanPay,
+				KeyType:     core.KeyTypeEd25519,
+			},
+		},
+		Outputs: []core.TxOut{
+			core.NewDataTxOut([]byte("anchored data")),
+			{
+				Value:         400,
+				PublicKeyHash: core.NewHashTRand(),
+			},
+		},
+	}
+	record := TxRecord{
+		Tx:    tx,
+		VSize: tx.VSize(),
+	}
+	recon, err := TxRecordFromString(record.String())
+	util.Assert(t, err == nil, "failed to reconstruct: %s", err)
+	util.Assert(t, recon.Tx.Inputs[0].SigHashType == tx.Inputs[0].SigHashType, "Input 0 SigHashType mismatch")
+	util.Assert(t, recon.Tx.Inputs[0].KeyType == tx.Inputs[0].KeyType, "Input 0 KeyType mismatch")
+	util.Assert(t, len(recon.Tx.Outputs) == 2, "NumOutputs mismatch")
+	util.Assert(t, recon.Tx.Outputs[0].IsData(), "Output 0 should be data")
+	util.Assert(t, bytes.Equal(recon.Tx.Outputs[0].Data, tx.Outputs[0].Data), "Output 0 Data mismatch")
+	util.Assert(t, !recon.Tx.Outputs[1].IsData(), "Output 1 should not be data")
+	util.Assert(t, recon.Tx.Hash().Eq(record.Tx.Hash()), "Hash mismatch")
+}
@@ -0,0 +1,306 @@
+package inv
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/levilutz/basiccoin/pkg/core"
+)
+
+// Parse a block record from the newline-separated text of save dir version 1.
+func blockRecordFromText(raw string) (record BlockRecord, err error) {
+	rows := strings.Split(strings.Trim(raw, "\n"), "\n")
+	if len(rows) != 8 {
+		return BlockRecord{}, fmt.Errorf("incorrect number of rows: %d", len(rows))
+	}
+	prevBlockId, err := core.NewHashTFromString(rows[0])
+	if err != nil {
+		return BlockRecord{}, fmt.Errorf("failed to parse PrevBlockId: %s", err)
+	}
+	merkleRoot, err := core.NewHashTFromString(rows[1])
+	if err != nil {
+		return BlockRecord{}, fmt.Errorf("failed to parse MerkleRoot: %s", err)
+	}
+	target, err := core.NewHashTFromString(rows[2])
+	if err != nil {
+		return BlockRecord{}, fmt.Errorf("failed to parse Target: %s", err)
+	}
+	noise, err := core.NewHashTFromString(rows[3])
+	if err != nil {
+		return BlockRecord{}, fmt.Errorf("failed to parse Noise: %s", err)
+	}
+	nonce, err := strconv.ParseUint(rows[4], 10, 64)
+	if err != nil {
+		return BlockRecord{}, fmt.Errorf("failed to parse Nonce: %s", err)
+	}
+	minedTime, err := strconv.ParseUint(rows[5], 10, 64)
+	if err != nil {
+		return BlockRecord{}, fmt.Errorf("failed to parse MinedTime: %s", err)
+	}
+	height, err := strconv.ParseUint(rows[6], 10, 64)
+	if err != nil {
+		return BlockRecord{}, fmt.Errorf("failed to parse Height: %s", err)
+	}
+	totalWork, err := core.NewHashTFromString(rows[7])
+	if err != nil {
+		return BlockRecord{}, fmt.Errorf("failed to parse TotalWork: %s", err)
+	}
+	return BlockRecord{
+		Block: core.Block{
+			PrevBlockId: prevBlockId,
+			MerkleRoot:  merkleRoot,
+			Target:      target,
+			Noise:       noise,
+			Nonce:       nonce,
+			MinedTime:   minedTime,
+		},
+		Height:    height,
+		TotalWork: totalWork,
+	}, nil
+}
+
+// Serialize a block record as the newline-separated text of save dir version 1.
+func (b BlockRecord) text() string {
+	return strings.Join([]string{
+		b.Block.PrevBlockId.String(),
+		b.Block.MerkleRoot.String(),
+		b.Block.Target.String(),
+		b.Block.Noise.String(),
+		strconv.FormatUint(b.Block.Nonce, 10),
+		strconv.FormatUint(b.Block.MinedTime, 10),
+		strconv.FormatUint(b.Height, 10),
+		b.TotalWork.String(),
+	}, "\n")
+}
+
+// Parse a merkle record from the newline-separated text of save dir version 1.
+func merkleRecordFromText(raw string) (record MerkleRecord, err error) {
+	rows := strings.Split(strings.Trim(raw, "\n"), "\n")
+	if len(rows) != 3 {
+		return MerkleRecord{}, fmt.Errorf("incorrect number of rows: %d", len(rows))
+	}
+	lChild, err := core.NewHashTFromString(rows[0])
+	if err != nil {
+		return MerkleRecord{}, fmt.Errorf("failed to parse LChild: %s", err)
+	}
+	rChild, err := core.NewHashTFromString(rows[1])
+	if err != nil {
+		return MerkleRecord{}, fmt.Errorf("failed to parse RChild: %s", err)
+	}
+	vSize, err := strconv.ParseUint(rows[2], 10, 64)
+	if err != nil {
+		return MerkleRecord{}, fmt.Errorf("failed to parse VSize: %s", err)
+	}
+	return MerkleRecord{
+		Merkle: core.MerkleNode{
+			LChild: lChild,
+			RChild: rChild,
+		},
+		VSize: vSize,
+	}, nil
+}
+
+// Serialize a merkle record as the newline-separated text of save dir version 1.
+func (m MerkleRecord) text() string {
+	return strings.Join([]string{
+		m.Merkle.LChild.String(),
+		m.Merkle.RChild.String(),
+		strconv.FormatUint(m.VSize, 10),
+	}, "\n")
+}
+
+// Parse a tx record from the newline-separated text of save dir version 1.
+func txRecordFromText(raw string) (record TxRecord, err error) {
+	rows := strings.Split(strings.Trim(raw, "\n"), "\n")
+	if len(rows) < 5 {
+		return TxRecord{}, fmt.Errorf("too few rows: %d", len(rows))
+	}
+	vSize, err := strconv.ParseUint(rows[0], 10, 64)
+	if err != nil {
+		return TxRecord{}, fmt.Errorf("failed to parse VSize: %s", err)
+	}
+	var isCoinbase bool
+	if rows[1] == "true" {
+		isCoinbase = true
+	} else if rows[1] == "false" {
+		isCoinbase = false
+	} else {
+		return TxRecord{}, fmt.Errorf("failed to parse IsCoinbase")
+	}
+	minBlock, err := strconv.ParseUint(rows[2], 10, 64)
+	if err != nil {
+		return TxRecord{}, fmt.Errorf("failed to parse MinBlock: %s", err)
+	}
+	numInputs, err := strconv.Atoi(rows[3])
+	if err != nil {
+		return TxRecord{}, fmt.Errorf("failed to parse NumInputs: %s", err)
+	}
+	numOutputs, err := strconv.Atoi(rows[4])
+	if err != nil {
+		return TxRecord{}, fmt.Errorf("failed to parse NumOutputs: %s", err)
+	}
+	// Any rows beyond the outputs are pairs of optional fields
+	expectRows := 5 + numInputs*5 + numOutputs*2
+	if len(rows) < expectRows || (len(rows)-expectRows)%2 != 0 {
+		return TxRecord{}, fmt.Errorf("expected %d rows plus optional pairs, got %d", expectRows, len(rows))
+	}
+	inputs := make([]core.TxIn, numInputs)
+	outputs := make([]core.TxOut, numOutputs)
+	currentRow := 5
+	for i := range inputs {
+		txId, err := core.NewHashTFromString(rows[currentRow])
+		currentRow++
+		if err != nil {
+			return TxRecord{}, fmt.Errorf("failed to parse input %d TxId: %s", i, err)
+		}
+		ind, err := strconv.ParseUint(rows[currentRow], 10, 64)
+		currentRow++
+		if err != nil {
+			return TxRecord{}, fmt.Errorf("failed to parse input %d Ind: %s", i, err)
+		}
+		value, err := strconv.ParseUint(rows[currentRow], 10, 64)
+		currentRow++
+		if err != nil {
+			return TxRecord{}, fmt.Errorf("failed to parse input %d Value: %s", i, err)
+		}
+		publicKey, err := base64.StdEncoding.DecodeString(rows[currentRow])
+		currentRow++
+		if err != nil {
+			return TxRecord{}, fmt.Errorf("failed to parse input %d PublicKey: %s", i, err)
+		}
+		signature, err := base64.StdEncoding.DecodeString(rows[currentRow])
+		currentRow++
+		if err != nil {
+			return TxRecord{}, fmt.Errorf("failed to parse input %d Signature: %s", i, err)
+		}
+		inputs[i] = core.TxIn{
+			Utxo: core.Utxo{
+				TxId:  txId,
+				Ind:   ind,
+				Value: value,
+			},
+			PublicKey: publicKey,
+			Signature: signature,
+		}
+	}
+	for i := range outputs {
+		value, err := strconv.ParseUint(rows[currentRow], 10, 64)
+		currentRow++
+		if err != nil {
+			return TxRecord{}, fmt.Errorf("failed to parse output %d Value: %s", i, err)
+		}
+		pkh, err := core.NewHashTFromString(rows[currentRow])
+		currentRow++
+		if err != nil {
+			return TxRecord{}, fmt.Errorf("failed to parse input %d PublicKeyHash: %s", i, err)
+		}
+		outputs[i] = core.TxOut{
+			Value:         value,
+			PublicKeyHash: pkh,
+		}
+	}
+	// Optional fields follow as (field:index, value) pairs
+	for currentRow < len(rows) {
+		field, indStr, ok := strings.Cut(rows[currentRow], ":")
+		currentRow++
+		if !ok {
+			return TxRecord{}, fmt.Errorf("failed to parse optional field key")
+		}
+		ind, err := strconv.Atoi(indStr)
+		if err != nil {
+			return TxRecord{}, fmt.Errorf("failed to parse %s index: %s", field, err)
+		}
+		value := rows[currentRow]
+		currentRow++
+		switch field {
+		case "data":
+			if ind < 0 || ind >= numOutputs {
+				return TxRecord{}, fmt.Errorf("data output index out of range: %d", ind)
+			}
+			data, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return TxRecord{}, fmt.Errorf("failed to parse output %d Data: %s", ind, err)
+			}
+			outputs[ind].Data = data
+		case "sigHashType":
+			if ind < 0 || ind >= numInputs {
+				return TxRecord{}, fmt.Errorf("sig hash type input index out of range: %d", ind)
+			}
+			sigHashType, err := strconv.ParseUint(value, 10, 8)
+			if err != nil {
+				return TxRecord{}, fmt.Errorf("failed to parse input %d SigHashType: %s", ind, err)
+			}
+			inputs[ind].SigHashType = core.SigHashType(sigHashType)
+		case "keyType":
+			if ind < 0 || ind >= numInputs {
+				return TxRecord{}, fmt.Errorf("key type input index out of range: %d", ind)
+			}
+			keyType, err := strconv.ParseUint(value, 10, 8)
+			if err != nil {
+				return TxRecord{}, fmt.Errorf("failed to parse input %d KeyType: %s", ind, err)
+			}
+			inputs[ind].KeyType = core.KeyType(keyType)
+		default:
+			return TxRecord{}, fmt.Errorf("unrecognized optional field: %s", field)
+		}
+	}
+	return TxRecord{
+		Tx: core.Tx{
+			IsCoinbase: isCoinbase,
+			MinBlock:   minBlock,
+			Inputs:     inputs,
+			Outputs:    outputs,
+		},
+		VSize: vSize,
+	}, nil
+}
+
+// Serialize a tx record as the newline-separated text of save dir version 1.
+func (t TxRecord) text() string {
+	rows := make([]string, 5)
+	rows[0] = strconv.FormatUint(t.VSize, 10)
+	rows[1] = fmt.Sprintf("%t", t.Tx.IsCoinbase)
+	rows[2] = strconv.FormatUint(t.Tx.MinBlock, 10)
+	rows[3] = strconv.Itoa(len(t.Tx.Inputs))
+	rows[4] = strconv.Itoa(len(t.Tx.Outputs))
+	for _, input := range t.Tx.Inputs {
+		rows = append(rows, []string{
+			input.Utxo.TxId.String(),
+			strconv.FormatUint(input.Utxo.Ind, 10),
+			strconv.FormatUint(input.Utxo.Value, 10),
+			base64.StdEncoding.EncodeToString(input.PublicKey),
+			base64.StdEncoding.EncodeToString(input.Signature),
+		}...)
+	}
+	for _, output := range t.Tx.Outputs {
+		rows = append(rows, []string{
+			strconv.FormatUint(output.Value, 10),
+			output.PublicKeyHash.String(),
+		}...)
+	}
+	for i, input := range t.Tx.Inputs {
+		if input.SigHashType != core.SigHashLegacy {
+			rows = append(rows, []string{
+				fmt.Sprintf("sigHashType:%d", i),
+				strconv.FormatUint(uint64(input.SigHashType), 10),
+			}...)
+		}
+		if input.KeyType != core.KeyTypeEcdsa {
+			rows = append(rows, []string{
+				fmt.Sprintf("keyType:%d", i),
+				strconv.FormatUint(uint64(input.KeyType), 10),
+			}...)
+		}
+	}
+	for i, output := range t.Tx.Outputs {
+		if output.IsData() {
+			rows = append(rows, []string{
+				fmt.Sprintf("data:%d", i),
+				base64.StdEncoding.EncodeToString(output.Data),
+			}...)
+		}
+	}
+	return strings.Join(rows, "\n")
+}
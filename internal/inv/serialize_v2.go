@@ -0,0 +1,42 @@
+package inv
+
+import (
+	"fmt"
+
+	"github.com/levilutz/basiccoin/pkg/core"
+)
+
+// Parse a block record of save dir version 2, which had no skip pointer.
+func blockRecordFromV2(raw string) (record BlockRecord, err error) {
+	r := newRecordReader(raw)
+	record = BlockRecord{
+		Block: core.Block{
+			PrevBlockId: r.hash(),
+			MerkleRoot:  r.hash(),
+			Target:      r.hash(),
+			Noise:       r.hash(),
+			Nonce:       r.uvarint(),
+			MinedTime:   r.uvarint(),
+		},
+		Height:    r.uvarint(),
+		TotalWork: r.hash(),
+	}
+	if err := r.finish(); err != nil {
+		return BlockRecord{}, fmt.Errorf("failed to parse v2 block record: %s", err)
+	}
+	return record, nil
+}
+
+// Serialize a block record as save dir version 2 did, without its skip pointer.
+func (b BlockRecord) v2String() string {
+	w := &recordWriter{}
+	w.hash(b.Block.PrevBlockId)
+	w.hash(b.Block.MerkleRoot)
+	w.hash(b.Block.Target)
+	w.hash(b.Block.Noise)
+	w.uvarint(b.Block.Nonce)
+	w.uvarint(b.Block.MinedTime)
+	w.uvarint(b.Height)
+	w.hash(b.TotalWork)
+	return string(w.buf)
+}
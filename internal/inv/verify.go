@@ -0,0 +1,261 @@
+package inv
+
+import (
+	"fmt"
+
+	"github.com/levilutz/basiccoin/pkg/core"
+)
+
+// A map whose stored records can be walked in their raw serialized form.
+type rawIterableSyncMap interface {
+	IterateRaw(fn func(key string, raw string, err error) bool) error
+}
+
+// The inconsistencies found verifying a save dir.
+type VerifyReport struct {
+	// How many records were checked
+	Checked int
+	// Each inconsistency found, and whether it was repaired
+	Problems []string
+	Repaired int
+}
+
+// Record an inconsistency, and whether it was repaired.
+func (r *VerifyReport) Add(repaired bool, format string, args ...any) {
+	problem := fmt.Sprintf(format, args...)
+	if repaired {
+		problem += " (repaired)"
+		r.Repaired++
+	}
+	r.Problems = append(r.Problems, problem)
+}
+
+// Walk every stored record, re-parsing it and checking it's stored under its own hash, and
+// re-derive what each record caches (block heights and total work, entity sizes) and the links
+// between them. If repairing, delete records that are corrupt or orphaned so they read as
+// missing, and rewrite records whose cached fields are wrong.
+// Returns the report of what was found, for further checks to add to.
+// Should only be run offline, as no other goroutine may store entities meanwhile.
+func (inv *Inv) VerifyRecords(repair bool) (*VerifyReport, error) {
+	report := &VerifyReport{Problems: make([]string, 0)}
+	// Txs first, as merkles and tx ids are checked against them
+	txs := make(map[core.HashT]TxRecord)
+	err := verifyRawRecords(
+		inv.txs, "tx", TxRecordFromString,
+		func(r TxRecord) core.HashT { return r.Tx.Hash() },
+		report, repair, func(txId core.HashT, record TxRecord) {
+			txs[txId] = record
+		},
+	)
+	if err != nil {
+		return report, err
+	}
+	for txId, record := range txs {
+		if vSize := record.Tx.VSize(); record.VSize != vSize {
+			record.VSize = vSize
+			if repair {
+				overwriteRecord(inv.txs, txId, record)
+			}
+			report.Add(repair, "tx %s has wrong vsize, should be %d", txId, vSize)
+		}
+	}
+
+	// Merkles, whose children must be stored and whose size is the sum of theirs
+	merkles := make(map[core.HashT]MerkleRecord)
+	err = verifyRawRecords(
+		inv.merkles, "merkle", MerkleRecordFromString,
+		func(r MerkleRecord) core.HashT { return r.Merkle.Hash() },
+		report, repair, func(merkleId core.HashT, record MerkleRecord) {
+			merkles[merkleId] = record
+		},
+	)
+	if err != nil {
+		return report, err
+	}
+	entityVSize := func(id core.HashT) (uint64, bool) {
+		if record, ok := txs[id]; ok {
+			return record.Tx.VSize(), true
+		} else if record, ok := merkles[id]; ok {
+			return record.VSize, true
+		}
+		return 0, false
+	}
+	// Dropping a merkle can leave its parent missing a child too
+	for changed := true; changed; {
+		changed = false
+		for merkleId, record := range merkles {
+			_, lOk := entityVSize(record.Merkle.LChild)
+			_, rOk := entityVSize(record.Merkle.RChild)
+			if !lOk || !rOk {
+				if repair {
+					inv.merkles.Delete(merkleId)
+				}
+				report.Add(repair, "merkle %s has a missing child", merkleId)
+				delete(merkles, merkleId)
+				changed = true
+			}
+		}
+	}
+	for merkleId, record := range merkles {
+		lSize, _ := entityVSize(record.Merkle.LChild)
+		rSize, _ := entityVSize(record.Merkle.RChild)
+		vSize := lSize
+		if record.Merkle.RChild != record.Merkle.LChild {
+			vSize += rSize
+		}
+		if record.VSize != vSize {
+			record.VSize = vSize
+			if repair {
+				overwriteRecord(inv.merkles, merkleId, record)
+			}
+			report.Add(repair, "merkle %s has wrong vsize, should be %d", merkleId, vSize)
+		}
+	}
+
+	// Tx ids, which must point to a stored tx with that id
+	badIds := make([]core.HashT, 0)
+	err = verifyRawRecords(
+		inv.txIds, "tx id", core.NewHashTFromString, nil,
+		report, repair, func(id core.HashT, txId core.HashT) {
+			record, ok := txs[txId]
+			if !ok || record.Tx.Id(inv.coreParams) != id {
+				badIds = append(badIds, id)
+				report.Add(repair, "tx id %s points to missing or different tx %s", id, txId)
+			}
+		},
+	)
+	if err != nil {
+		return report, err
+	}
+	if repair {
+		for _, id := range badIds {
+			inv.txIds.Delete(id)
+		}
+	}
+
+	// Blocks, whose height and total work are re-derived from their ancestors
+	blocks := make(map[core.HashT]BlockRecord)
+	err = verifyRawRecords(
+		inv.blocks, "block", BlockRecordFromString,
+		func(r BlockRecord) core.HashT {
+			if r.Block == (core.Block{}) {
+				return core.HashT{}
+			}
+			return r.Block.Hash()
+		},
+		report, repair, func(blockId core.HashT, record BlockRecord) {
+			blocks[blockId] = record
+		},
+	)
+	if err != nil {
+		return report, err
+	}
+	derived, orphaned := deriveBlockRecords(blocks)
+	for blockId, record := range blocks {
+		if orphaned[blockId] {
+			if repair {
+				inv.blocks.Delete(blockId)
+			}
+			report.Add(repair, "block %s has no stored chain to the zero block", blockId)
+			continue
+		}
+		expected := derived[blockId]
+		if record != expected {
+			if repair {
+				overwriteRecord(inv.blocks, blockId, expected)
+			}
+			report.Add(
+				repair, "block %s has wrong height, total work or skip, should be %d, %s and %s",
+				blockId, expected.Height, expected.TotalWork, expected.Skip,
+			)
+		}
+	}
+	return report, nil
+}
+
+// Re-derive the cached fields of each block record from its ancestors, and find the blocks
+// with no chain of records to the zero block.
+func deriveBlockRecords(
+	blocks map[core.HashT]BlockRecord,
+) (derived map[core.HashT]BlockRecord, orphaned map[core.HashT]bool) {
+	derived = map[core.HashT]BlockRecord{{}: {}}
+	orphaned = make(map[core.HashT]bool)
+	getDerived := func(blockId core.HashT) BlockRecord {
+		return derived[blockId]
+	}
+	for blockId := range blocks {
+		// Walk back to a block already derived or orphaned, then derive forwards from it
+		walk := make([]core.HashT, 0)
+		cur := blockId
+		for {
+			if _, ok := derived[cur]; ok || orphaned[cur] {
+				break
+			} else if _, ok := blocks[cur]; !ok {
+				orphaned[cur] = true
+				break
+			}
+			walk = append(walk, cur)
+			cur = blocks[cur].Block.PrevBlockId
+		}
+		for i := len(walk) - 1; i >= 0; i-- {
+			record := blocks[walk[i]]
+			parent, ok := derived[record.Block.PrevBlockId]
+			if !ok {
+				orphaned[walk[i]] = true
+				continue
+			}
+			derived[walk[i]] = deriveBlockRecord(record.Block, parent, getDerived)
+		}
+	}
+	return derived, orphaned
+}
+
+// Walk a map's raw records, parsing each and checking it's stored under its own hash, if
+// hashFunc is given. Records that fail are reported (and deleted if repairing), and the rest
+// are passed to fn.
+func verifyRawRecords[V fmt.Stringer](
+	m SomeSyncMap[core.HashT, V],
+	name string,
+	parseFunc func(raw string) (V, error),
+	hashFunc func(V) core.HashT,
+	report *VerifyReport,
+	repair bool,
+	fn func(key core.HashT, val V),
+) error {
+	rm, ok := m.(rawIterableSyncMap)
+	if !ok {
+		return fmt.Errorf("%s records can't be walked", name)
+	}
+	corrupt := make([]core.HashT, 0)
+	err := rm.IterateRaw(func(rawKey string, raw string, err error) bool {
+		report.Checked++
+		key, keyErr := core.NewHashTFromString(rawKey)
+		if keyErr != nil {
+			report.Add(false, "%s record has malformed key %s", name, rawKey)
+			return true
+		}
+		var val V
+		if err == nil {
+			val, err = parseFunc(raw)
+		}
+		if err == nil && hashFunc != nil && hashFunc(val) != key {
+			err = fmt.Errorf("contents hash to %s", hashFunc(val))
+		}
+		if err != nil {
+			corrupt = append(corrupt, key)
+			report.Add(repair, "%s record %s is corrupt: %s", name, key, err)
+			return true
+		}
+		fn(key, val)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if repair {
+		for _, key := range corrupt {
+			m.Delete(key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package inv_test
+
+import (
+	"os"
+	"testing"
+
+	. "github.com/levilutz/basiccoin/internal/inv"
+	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+// Test that records with wrong cached fields or no chain are found, then repaired.
+func TestVerifyRecordsRepair(t *testing.T) {
+	saveDir := t.TempDir()
+	params := core.DevNetParams()
+	easiest := core.NewHashTFromStringAssert(
+		"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+	)
+	inv := NewInv(params, &saveDir, StoreParams{})
+	good := core.Block{Target: easiest, Noise: core.NewHashTRand()}
+	util.AssertNoErr(t, inv.StoreTrustedBlock(good))
+	report, err := inv.VerifyRecords(false)
+	util.AssertNoErr(t, err)
+	util.Assert(t, len(report.Problems) == 0, "problems in good records: %v", report.Problems)
+
+	// A block claiming the wrong height, and one whose parent isn't stored
+	wrong := core.Block{PrevBlockId: good.Hash(), Target: easiest, Noise: core.NewHashTRand()}
+	orphan := core.Block{PrevBlockId: core.NewHashTRand(), Target: easiest}
+	writeRecord := func(block core.Block, height uint64) {
+		record := BlockRecord{Block: block, Height: height, TotalWork: easiest}
+		path := saveDir + "/blocks/" + block.Hash().String()
+		util.AssertNoErr(t, os.WriteFile(path, []byte(record.String()), 0666))
+	}
+	writeRecord(wrong, 7)
+	writeRecord(orphan, 1)
+	inv = NewInv(params, &saveDir, StoreParams{})
+	report, err = inv.VerifyRecords(false)
+	util.AssertNoErr(t, err)
+	util.Assert(t, len(report.Problems) == 2, "wrong problems: %v", report.Problems)
+	util.Assert(t, report.Repaired == 0, "repaired without repairing")
+
+	report, err = inv.VerifyRecords(true)
+	util.AssertNoErr(t, err)
+	util.Assert(t, report.Repaired == 2, "wrong repairs: %v", report.Problems)
+	inv = NewInv(params, &saveDir, StoreParams{})
+	report, err = inv.VerifyRecords(false)
+	util.AssertNoErr(t, err)
+	util.Assert(t, len(report.Problems) == 0, "problems after repair: %v", report.Problems)
+	util.Assert(t, inv.GetBlockHeight(wrong.Hash()) == 2, "height not repaired")
+	util.Assert(t, !inv.HasBlock(orphan.Hash()), "orphan not removed")
+}
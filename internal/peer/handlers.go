@@ -1,8 +1,11 @@
 package peer
 
 import (
+	"fmt"
+
 	"github.com/levilutz/basiccoin/internal/bus"
 	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/util"
 )
 
 var announceAddrCmd = "announce-addr"
@@ -97,3 +100,71 @@ func (p *Peer) handleWriteNewTx(txId core.HashT) error {
 	}
 	return nil
 }
+
+var prunedHeightCmd = "pruned-height"
+
+func (p *Peer) handleReadPrunedHeight() error {
+	prunedHeight := p.conn.ReadUint64()
+	if p.conn.HasErr() {
+		return p.conn.Err()
+	}
+	p.theirPrunedHeight = prunedHeight
+	return nil
+}
+
+func (p *Peer) handleWritePrunedHeight() error {
+	p.conn.WriteUint64(p.inv.GetPrunedHeight())
+	return p.conn.Err()
+}
+
+var blockContentsCmd = "block-contents"
+
+// Most blocks whose contents may be requested at once.
+const maxBlockContentsBatch = 64
+
+func (p *Peer) handleReadBlockContents() error {
+	numBlocks := p.conn.ReadUint64()
+	if p.conn.HasErr() {
+		return p.conn.Err()
+	} else if numBlocks > maxBlockContentsBatch {
+		return fmt.Errorf("peer requested too many block contents: %d", numBlocks)
+	}
+	for i := uint64(0); i < numBlocks; i++ {
+		blockId := p.conn.ReadHashT()
+		if p.conn.HasErr() {
+			return p.conn.Err()
+		}
+		p.conn.WriteBool(p.inv.HasBlockContents(blockId))
+	}
+	return p.serveEntities()
+}
+
+func (p *Peer) handleWriteBlockContents(blockIds []core.HashT) error {
+	p.conn.WriteUint64(uint64(len(blockIds)))
+	roots := make([]core.HashT, 0, len(blockIds))
+	servedIds := make([]core.HashT, 0, len(blockIds))
+	for _, blockId := range blockIds {
+		p.conn.WriteHashT(blockId)
+		if p.conn.ReadBool() {
+			roots = append(roots, p.inv.GetBlock(blockId).MerkleRoot)
+			servedIds = append(servedIds, blockId)
+		}
+	}
+	if p.conn.HasErr() {
+		return p.conn.Err()
+	}
+	merkles, txs, err := p.requestEntities(roots)
+	if err != nil {
+		return err
+	} else if len(servedIds) == 0 {
+		return nil
+	}
+	// Reversed so they're inserted in correct order
+	p.bus.BlockContents.Pub(bus.BlockContentsEvent{
+		PeerRuntimeId: p.conn.PeerRuntimeId(),
+		BlockIds:      servedIds,
+		Merkles:       util.Reverse(merkles),
+		Txs:           util.Reverse(txs),
+	})
+	return nil
+}
@@ -18,12 +18,13 @@ var errPeerClosed = fmt.Errorf("peer requested close")
 // The peer's subscriptions.
 // Ensure each of these is initialized in NewPeer.
 type subscriptions struct {
-	PrintUpdate        *topic.SubCh[bus.PrintUpdateEvent]
-	SendPeers          *topic.SubCh[bus.SendPeersEvent]
-	ShouldAnnounceAddr *topic.SubCh[bus.ShouldAnnounceAddrEvent]
-	ShouldRequestPeers *topic.SubCh[bus.ShouldRequestPeersEvent]
-	ValidatedHead      *topic.SubCh[bus.ValidatedHeadEvent]
-	ValidatedTx        *topic.SubCh[bus.ValidatedTxEvent]
+	PrintUpdate                *topic.SubCh[bus.PrintUpdateEvent]
+	SendPeers                  *topic.SubCh[bus.SendPeersEvent]
+	ShouldAnnounceAddr         *topic.SubCh[bus.ShouldAnnounceAddrEvent]
+	ShouldRequestBlockContents *topic.SubCh[bus.ShouldRequestBlockContentsEvent]
+	ShouldRequestPeers         *topic.SubCh[bus.ShouldRequestPeersEvent]
+	ValidatedHead              *topic.SubCh[bus.ValidatedHeadEvent]
+	ValidatedTx                *topic.SubCh[bus.ValidatedTxEvent]
 }
 
 // Close our subscriptions as we close.
@@ -31,6 +32,7 @@ func (s subscriptions) Close() {
 	s.PrintUpdate.Close()
 	s.SendPeers.Close()
 	s.ShouldAnnounceAddr.Close()
+	s.ShouldRequestBlockContents.Close()
 	s.ShouldRequestPeers.Close()
 	s.ValidatedHead.Close()
 	s.ValidatedTx.Close()
@@ -44,17 +46,20 @@ type Peer struct {
 	conn        *prot.Conn
 	shouldClose bool
 	curHead     core.HashT
+	// Height up to which the peer can't serve block contents
+	theirPrunedHeight uint64
 }
 
 // Create a new peer given a message bus instance.
 func NewPeer(msgBus *bus.Bus, inv inv.InvReader, conn *prot.Conn, curHead core.HashT) *Peer {
 	subs := &subscriptions{
-		PrintUpdate:        msgBus.PrintUpdate.SubCh(),
-		SendPeers:          msgBus.SendPeers.SubCh(),
-		ShouldAnnounceAddr: msgBus.ShouldAnnounceAddr.SubCh(),
-		ShouldRequestPeers: msgBus.ShouldRequestPeers.SubCh(),
-		ValidatedHead:      msgBus.ValidatedHead.SubCh(),
-		ValidatedTx:        msgBus.ValidatedTx.SubCh(),
+		PrintUpdate:                msgBus.PrintUpdate.SubCh(),
+		SendPeers:                  msgBus.SendPeers.SubCh(),
+		ShouldAnnounceAddr:         msgBus.ShouldAnnounceAddr.SubCh(),
+		ShouldRequestBlockContents: msgBus.ShouldRequestBlockContents.SubCh(),
+		ShouldRequestPeers:         msgBus.ShouldRequestPeers.SubCh(),
+		ValidatedHead:              msgBus.ValidatedHead.SubCh(),
+		ValidatedTx:                msgBus.ValidatedTx.SubCh(),
 	}
 	return &Peer{
 		bus:         msgBus,
@@ -82,6 +87,8 @@ func (p *Peer) Loop() {
 		})
 	}()
 
+	// Tell the peer which blocks we can't serve before any sync
+	p.issueCommandPrintErr(prunedHeightCmd, p.handleWritePrunedHeight)
 	if p.conn.WeAreInitiator() {
 		p.issueCommandPrintErr(syncChainCmd, p.handleSyncChain)
 	}
@@ -114,6 +121,24 @@ func (p *Peer) Loop() {
 				return p.handleWriteAnnounceAddr(event.Addr)
 			})
 
+		case event := <-p.subs.ShouldRequestBlockContents.C:
+			if event.TargetRuntimeId != "" && event.TargetRuntimeId != p.conn.PeerRuntimeId() {
+				continue
+			}
+			// Only ask for blocks the peer hasn't pruned
+			blockIds := make([]core.HashT, 0, len(event.BlockIds))
+			for _, blockId := range event.BlockIds {
+				if p.inv.GetBlockHeight(blockId) > p.theirPrunedHeight {
+					blockIds = append(blockIds, blockId)
+				}
+			}
+			if len(blockIds) == 0 {
+				continue
+			}
+			p.issueCommandPrintErr(blockContentsCmd, func() error {
+				return p.handleWriteBlockContents(blockIds)
+			})
+
 		case event := <-p.subs.ValidatedTx.C:
 			p.issueCommandPrintErr(newTxCmd, func() error {
 				return p.handleWriteNewTx(event.TxId)
@@ -170,6 +195,12 @@ func (p *Peer) handleReceivedMessage(msg []byte) error {
 	} else if command == newTxCmd {
 		return p.handleReadNewTx()
 
+	} else if command == blockContentsCmd {
+		return p.handleReadBlockContents()
+
+	} else if command == prunedHeightCmd {
+		return p.handleReadPrunedHeight()
+
 	} else if command == syncChainCmd {
 		return p.handleSyncChain()
 
@@ -89,20 +89,14 @@ func (p *Peer) handleOutboundSyncChain() error {
 	resp = p.conn.ReadBool()
 	if p.conn.HasErr() {
 		return p.conn.Err()
+	} else if !resp && p.inv.GetBlockHeight(lcaId) < p.inv.GetPrunedHeight() {
+		return fmt.Errorf("peer needs blocks we've pruned")
 	} else if !resp {
 		return fmt.Errorf("peer failed to verify our chain")
 	}
 	// Send peer the entities it doesn't know about
-	for id := p.conn.ReadHashT(); !p.conn.HasErr() && !id.EqZero(); id = p.conn.ReadHashT() {
-		if p.inv.HasMerkle(id) {
-			p.conn.WriteBool(false)
-			p.conn.WriteMerkle(p.inv.GetMerkle(id))
-		} else if p.inv.HasTx(id) {
-			p.conn.WriteBool(true)
-			p.conn.WriteTx(p.inv.GetTx(id))
-		} else {
-			return fmt.Errorf("peer requested unknown entity %s", id)
-		}
+	if err := p.serveEntities(); err != nil {
+		return err
 	}
 	p.conn.ReadStringExpected("complete")
 	return p.conn.Err() // This catches err in entity negotiation too
@@ -141,18 +135,48 @@ func (p *Peer) handleInboundSyncChain() error {
 		}
 		return fmt.Errorf("failed to verify received chain: %s", p.conn.Err().Error())
 	}
+	// The peer can send headers, but not the contents of blocks it's pruned
+	if p.inv.GetBlockHeight(lcaId) < p.theirPrunedHeight {
+		p.conn.WriteBool(false)
+		if p.conn.HasErr() {
+			return p.conn.Err()
+		}
+		return fmt.Errorf("peer has pruned blocks we need, from height %d", p.theirPrunedHeight)
+	}
 	p.conn.WriteBool(true)
 	if p.conn.HasErr() {
 		return p.conn.Err()
 	}
 	// Request the peer for entities we don't know about
+	roots := make([]core.HashT, len(newBlocks))
+	for i, block := range newBlocks {
+		roots[i] = block.MerkleRoot
+	}
+	newMerkles, newTxs, err := p.requestEntities(roots)
+	if err != nil {
+		return err
+	}
+	p.conn.WriteString("complete")
+	if p.conn.HasErr() {
+		return p.conn.Err()
+	}
+	// Send the new entities to the head (reversed so they're inserted in correct order)
+	p.bus.CandidateHead.Pub(bus.CandidateHeadEvent{
+		Head:                   newHead,
+		Blocks:                 util.Reverse(newBlocks),
+		Merkles:                util.Reverse(newMerkles),
+		Txs:                    util.Reverse(newTxs),
+		AutoAddMempoolInsecure: false,
+	})
+	return nil
+}
+
+// Request the merkle nodes and txs under the given roots that we don't know about.
+func (p *Peer) requestEntities(roots []core.HashT) ([]core.MerkleNode, []core.Tx, error) {
 	newMerkles := make([]core.MerkleNode, 0)
 	newTxs := make([]core.Tx, 0)
-	idQueue := queue.NewQueue[core.HashT]()
+	idQueue := queue.NewQueue(roots...)
 	receivedIds := set.NewSet[core.HashT]()
-	for _, block := range newBlocks {
-		idQueue.Push(block.MerkleRoot)
-	}
 	for idQueue.Size() > 0 {
 		id, _ := idQueue.Pop()
 		if p.inv.HasEntity(id) || receivedIds.Includes(id) {
@@ -161,37 +185,41 @@ func (p *Peer) handleInboundSyncChain() error {
 		p.conn.WriteHashT(id)
 		isTx := p.conn.ReadBool()
 		if p.conn.HasErr() {
-			return p.conn.Err()
+			return nil, nil, p.conn.Err()
 		} else if !isTx {
 			merkle := p.conn.ReadMerkle(id)
 			if p.conn.HasErr() {
-				return p.conn.Err()
+				return nil, nil, p.conn.Err()
 			}
 			newMerkles = append(newMerkles, merkle)
 			idQueue.Push(merkle.LChild, merkle.RChild)
 		} else {
 			tx := p.conn.ReadTx(id)
 			if p.conn.HasErr() {
-				return p.conn.Err()
+				return nil, nil, p.conn.Err()
 			}
 			newTxs = append(newTxs, tx)
 		}
 		receivedIds.Add(id)
 	}
 	p.conn.WriteHashT(core.HashT{})
-	p.conn.WriteString("complete")
-	if p.conn.HasErr() {
-		return p.conn.Err()
+	return newMerkles, newTxs, p.conn.Err()
+}
+
+// Serve the merkle nodes and txs the peer requests, until it sends the zero hash.
+func (p *Peer) serveEntities() error {
+	for id := p.conn.ReadHashT(); !p.conn.HasErr() && !id.EqZero(); id = p.conn.ReadHashT() {
+		if p.inv.HasMerkle(id) {
+			p.conn.WriteBool(false)
+			p.conn.WriteMerkle(p.inv.GetMerkle(id))
+		} else if p.inv.HasTx(id) {
+			p.conn.WriteBool(true)
+			p.conn.WriteTx(p.inv.GetTx(id))
+		} else {
+			return fmt.Errorf("peer requested unknown entity %s", id)
+		}
 	}
-	// Send the new entities to the head (reversed so they're inserted in correct order)
-	p.bus.CandidateHead.Pub(bus.CandidateHeadEvent{
-		Head:                   newHead,
-		Blocks:                 util.Reverse(newBlocks),
-		Merkles:                util.Reverse(newMerkles),
-		Txs:                    util.Reverse(newTxs),
-		AutoAddMempoolInsecure: false,
-	})
-	return nil
+	return p.conn.Err()
 }
 
 // Verify a new chain's continuity, expected endpoints, and proof-of-work.
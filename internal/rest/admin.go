@@ -2,8 +2,30 @@ package rest
 
 import (
 	"net/http"
+
+	"github.com/levilutz/basiccoin/pkg/core"
 )
 
 func (s *Server) handleAdminPostTerminate(w http.ResponseWriter, r *http.Request) {
 	s.busClient.TerminateCommand()
 }
+
+// Export a utxo snapshot at the given block id, or the head if none is given.
+// The snapshot's hash is returned in the Snapshot-Hash header.
+func (s *Server) handleAdminGetSnapshot(w http.ResponseWriter, r *http.Request) {
+	var blockId core.HashT
+	if raw := r.URL.Query().Get("blockId"); raw != "" {
+		var err error
+		if blockId, err = core.NewHashTFromString(raw); err != nil {
+			write400(w, err)
+			return
+		}
+	}
+	result := s.busClient.UtxoSnapshotQuery(blockId)
+	if result.Err != nil {
+		write400(w, result.Err)
+		return
+	}
+	w.Header().Set("Snapshot-Hash", result.Hash.String())
+	w.Write(result.Snapshot)
+}
@@ -24,6 +24,15 @@ func (c *BusClient) NewTxEvent(tx core.Tx) error {
 	return <-ret
 }
 
+func (c *BusClient) NewTxPackageEvent(txs []core.Tx) error {
+	ret := make(chan error)
+	c.bus.CandidatePackage.Pub(bus.CandidatePackageEvent{
+		Ret: ret,
+		Txs: txs,
+	})
+	return <-ret
+}
+
 func (c *BusClient) TerminateCommand() {
 	c.bus.Terminate.Pub(bus.TerminateCommand{})
 }
@@ -36,6 +45,25 @@ func (c *BusClient) HeadHeightQuery() uint64 {
 	return <-ret
 }
 
+func (c *BusClient) BlockIdsByHeightQuery(heights []uint64) map[uint64]core.HashT {
+	ret := make(chan map[uint64]core.HashT)
+	c.bus.BlockIdsByHeight.Pub(bus.BlockIdsByHeightQuery{
+		Ret:     ret,
+		Heights: heights,
+	})
+	return <-ret
+}
+
+func (c *BusClient) MainChainRangeQuery(start uint64, limit uint64) []core.HashT {
+	ret := make(chan []core.HashT)
+	c.bus.MainChainRange.Pub(bus.MainChainRangeQuery{
+		Ret:   ret,
+		Start: start,
+		Limit: limit,
+	})
+	return <-ret
+}
+
 func (c *BusClient) BalanceQuery(publicKeyHashes []core.HashT) map[core.HashT]uint64 {
 	ret := make(chan map[core.HashT]uint64)
 	c.bus.PkhBalance.Pub(bus.PkhBalanceQuery{
@@ -55,6 +83,26 @@ func (c *BusClient) UtxosQuery(publicKeyHashes []core.HashT, excludeMempool bool
 	return <-ret
 }
 
+func (c *BusClient) PkhTxsQuery(publicKeyHash core.HashT, offset uint64, limit uint64) bus.PkhTxsResult {
+	ret := make(chan bus.PkhTxsResult)
+	c.bus.PkhTxs.Pub(bus.PkhTxsQuery{
+		Ret:           ret,
+		PublicKeyHash: publicKeyHash,
+		Offset:        offset,
+		Limit:         limit,
+	})
+	return <-ret
+}
+
+func (c *BusClient) UtxoSpenderQuery(utxo core.Utxo) bus.UtxoSpenderResult {
+	ret := make(chan bus.UtxoSpenderResult)
+	c.bus.UtxoSpender.Pub(bus.UtxoSpenderQuery{
+		Ret:  ret,
+		Utxo: utxo,
+	})
+	return <-ret
+}
+
 func (c *BusClient) TxConfirmsQuery(txIds []core.HashT) map[core.HashT]uint64 {
 	ret := make(chan map[core.HashT]uint64)
 	c.bus.TxConfirms.Pub(bus.TxConfirmsQuery{
@@ -73,6 +121,15 @@ func (c *BusClient) TxIncludedBlockQuery(txIds []core.HashT) map[core.HashT]core
 	return <-ret
 }
 
+func (c *BusClient) BlockUtxoHashQuery(blockIds []core.HashT) map[core.HashT]core.HashT {
+	ret := make(chan map[core.HashT]core.HashT)
+	c.bus.BlockUtxoHash.Pub(bus.BlockUtxoHashQuery{
+		Ret:      ret,
+		BlockIds: blockIds,
+	})
+	return <-ret
+}
+
 func (c *BusClient) RichListQuery(maxLen uint64) map[core.HashT]uint64 {
 	ret := make(chan map[core.HashT]uint64)
 	c.bus.RichList.Pub(bus.RichListQuery{
@@ -81,3 +138,12 @@ func (c *BusClient) RichListQuery(maxLen uint64) map[core.HashT]uint64 {
 	})
 	return <-ret
 }
+
+func (c *BusClient) UtxoSnapshotQuery(blockId core.HashT) bus.UtxoSnapshotResult {
+	ret := make(chan bus.UtxoSnapshotResult)
+	c.bus.UtxoSnapshot.Pub(bus.UtxoSnapshotQuery{
+		Ret:     ret,
+		BlockId: blockId,
+	})
+	return <-ret
+}
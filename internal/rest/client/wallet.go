@@ -109,6 +109,26 @@ func (c *WalletClient) GetManyUtxos(
 	return resp.Utxos, nil
 }
 
+// Query the node for a page of the ids of txs crediting or debiting a pkh, in chain order,
+// and how many there are in total.
+func (c *WalletClient) GetPkhTxs(
+	publicKeyHash core.HashT, offset uint64, limit uint64,
+) ([]core.HashT, uint64, error) {
+	queryStr := fmt.Sprintf("?publicKeyHash=%s&offset=%d&limit=%d", publicKeyHash, offset, limit)
+	resp, err := GetParse[models.PkhTxsResp](c.baseUrl + "history" + queryStr)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.TxIds, resp.Total, nil
+}
+
+// Query the node for the tx and block spending a utxo on its chain, and the mempool txs
+// spending it.
+func (c *WalletClient) GetUtxoSpender(utxo core.Utxo) (models.UtxoSpenderResp, error) {
+	queryStr := fmt.Sprintf("?txId=%s&ind=%d&value=%d", utxo.TxId, utxo.Ind, utxo.Value)
+	return GetParse[models.UtxoSpenderResp](c.baseUrl + "utxo/spender" + queryStr)
+}
+
 // Send a tx to the node.
 func (c *WalletClient) PostTx(tx core.Tx) (core.HashT, error) {
 	txJson, err := json.Marshal(tx)
@@ -129,12 +149,40 @@ func (c *WalletClient) PostTx(tx core.Tx) (core.HashT, error) {
 	if err != nil {
 		return core.HashT{}, fmt.Errorf("received txId failed to parse: %s - %s", txId, err.Error())
 	}
-	if txId != tx.Hash() {
-		return core.HashT{}, fmt.Errorf("received incorrect txId: %s != %s", txId, tx.Hash())
+	// Depending on network upgrades, the node identifies the tx with or without signatures
+	if txId != tx.Hash() && txId != tx.HashNoSigs() {
+		return core.HashT{}, fmt.Errorf(
+			"received incorrect txId: %s, not the tx hash %s nor id %s",
+			txId, tx.Hash(), tx.HashNoSigs(),
+		)
 	}
 	return txId, nil
 }
 
+// Send txs to the node to be accepted together, each after the txs whose outputs it spends, so
+// children can pay for parents below its min fee rate. Returns the tx ids.
+func (c *WalletClient) PostTxPackage(txs []core.Tx) ([]core.HashT, error) {
+	txsJson, err := json.Marshal(txs)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(c.baseUrl+"tx/package", "application/json", bytes.NewReader(txsJson))
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("tx package non-2XX response: %d - %s", resp.StatusCode, body)
+	}
+	out := models.TxPackageResp{}
+	if err = json.Unmarshal(body, &out); err != nil {
+		return nil, err
+	}
+	return out.TxIds, nil
+}
+
 // Get tx confirmations.
 func (c *WalletClient) GetTxConfirms(txIds []core.HashT) (map[core.HashT]uint64, error) {
 	txIdStrs := core.MarshalHashTSlice(txIds)
@@ -146,6 +194,17 @@ func (c *WalletClient) GetTxConfirms(txIds []core.HashT) (map[core.HashT]uint64,
 	return resp.Confirms, nil
 }
 
+// Get why each given tx id was dropped from the mempool, for those dropped recently.
+func (c *WalletClient) GetTxDropped(txIds []core.HashT) (map[core.HashT]string, error) {
+	txIdStrs := core.MarshalHashTSlice(txIds)
+	queryStr := fmt.Sprintf("?txId=%s", strings.Join(txIdStrs, "&txId="))
+	resp, err := GetParse[models.TxDroppedResp](c.baseUrl + "tx/dropped" + queryStr)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Reasons, nil
+}
+
 // Get tx confirmations.
 func (c *WalletClient) GetTxIncludedBlock(txIds []core.HashT) (map[core.HashT]core.HashT, error) {
 	txIdStrs := core.MarshalHashTSlice(txIds)
@@ -157,6 +216,17 @@ func (c *WalletClient) GetTxIncludedBlock(txIds []core.HashT) (map[core.HashT]co
 	return resp.IncludedBlocks, nil
 }
 
+// Get the utxo set hash after each given block.
+func (c *WalletClient) GetBlockUtxoHash(blockIds []core.HashT) (map[core.HashT]core.HashT, error) {
+	blockIdStrs := core.MarshalHashTSlice(blockIds)
+	queryStr := fmt.Sprintf("?blockId=%s", strings.Join(blockIdStrs, "&blockId="))
+	resp, err := GetParse[models.BlockUtxoHashResp](c.baseUrl + "block/utxohash" + queryStr)
+	if err != nil {
+		return nil, err
+	}
+	return resp.UtxoHashes, nil
+}
+
 // Get tx data.
 func (c *WalletClient) GetTx(txIds []core.HashT) (map[core.HashT]core.Tx, error) {
 	txIdStrs := core.MarshalHashTSlice(txIds)
@@ -168,6 +238,17 @@ func (c *WalletClient) GetTx(txIds []core.HashT) (map[core.HashT]core.Tx, error)
 	return resp.Txs, nil
 }
 
+// Get the data-carrier outputs of txs.
+func (c *WalletClient) GetTxData(txIds []core.HashT) (map[core.HashT]map[uint64][]byte, error) {
+	txIdStrs := core.MarshalHashTSlice(txIds)
+	queryStr := fmt.Sprintf("?txId=%s", strings.Join(txIdStrs, "&txId="))
+	resp, err := GetParse[models.TxDataResp](c.baseUrl + "tx/data" + queryStr)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
 // Get merkle data.
 func (c *WalletClient) GetMerkle(merkleIds []core.HashT) (map[core.HashT]core.MerkleNode, error) {
 	merkleIdStrs := core.MarshalHashTSlice(merkleIds)
@@ -190,6 +271,30 @@ func (c *WalletClient) GetBlock(blockIds []core.HashT) (map[core.HashT]core.Bloc
 	return resp.Blocks, nil
 }
 
+// Get the block of the node's chain at each given height, for those at or below its head.
+func (c *WalletClient) GetBlockIdsByHeight(heights []uint64) (map[uint64]core.HashT, error) {
+	heightStrs := make([]string, len(heights))
+	for i, height := range heights {
+		heightStrs[i] = strconv.FormatUint(height, 10)
+	}
+	queryStr := fmt.Sprintf("?height=%s", strings.Join(heightStrs, "&height="))
+	resp, err := GetParse[models.BlockIdsByHeightResp](c.baseUrl + "block/height" + queryStr)
+	if err != nil {
+		return nil, err
+	}
+	return resp.BlockIds, nil
+}
+
+// Get the headers of the node's chain from the given height upward, up to limit of them.
+func (c *WalletClient) GetBlockHeaders(start uint64, limit uint64) ([]models.BlockHeader, error) {
+	queryStr := fmt.Sprintf("?start=%d&limit=%d", start, limit)
+	resp, err := GetParse[models.BlockHeadersResp](c.baseUrl + "block/headers" + queryStr)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Headers, nil
+}
+
 // Get the richest pkhs.
 func (c *WalletClient) GetRichList(maxLen uint64) (map[core.HashT]uint64, error) {
 	queryStr := fmt.Sprintf("?maxLen=%d", maxLen)
@@ -0,0 +1,71 @@
+package rest
+
+import (
+	"github.com/levilutz/basiccoin/internal/bus"
+	"github.com/levilutz/basiccoin/internal/inv"
+	"github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/lru"
+	"github.com/levilutz/basiccoin/pkg/topic"
+)
+
+// How many recently dropped txs to remember the reasons for.
+const maxDroppedTxs = 10000
+
+// The reasons recently dropped txs left the mempool, by tx id (see core.Tx.Id), so wallets can
+// tell a dropped tx from one still waiting to be mined. A tx accepted again is forgotten.
+type droppedTxs struct {
+	inv inv.InvReader
+	// Each entry has size 1, so the cache is bounded by count
+	reasons *lru.Cache[core.HashT, bus.DropReason]
+	// Subscriptions to the bus
+	dropped   *topic.SubCh[bus.DroppedTxsEvent]
+	validated *topic.SubCh[bus.ValidatedTxEvent]
+}
+
+// Subscribe to the bus's dropped and validated txs.
+func newDroppedTxs(msgBus *bus.Bus, inv inv.InvReader) *droppedTxs {
+	return &droppedTxs{
+		inv:       inv,
+		reasons:   lru.NewCache[core.HashT, bus.DropReason](maxDroppedTxs),
+		dropped:   msgBus.DroppedTxs.SubCh(),
+		validated: msgBus.ValidatedTx.SubCh(),
+	}
+}
+
+// Record the txs dropped from and accepted to the mempool, forever.
+func (d *droppedTxs) Loop() {
+	for {
+		select {
+		case event := <-d.dropped.C:
+			for _, txHash := range event.TxIds {
+				if txId, ok := d.getTxId(txHash); ok {
+					d.reasons.Add(txId, event.Reason, 1)
+				}
+			}
+
+		case event := <-d.validated.C:
+			if txId, ok := d.getTxId(event.TxId); ok {
+				d.reasons.Remove(txId)
+			}
+		}
+	}
+}
+
+// Get the reason each given tx id was dropped from the mempool, if it was recently.
+func (d *droppedTxs) Get(txIds []core.HashT) map[core.HashT]bus.DropReason {
+	out := make(map[core.HashT]bus.DropReason)
+	for _, txId := range txIds {
+		if reason, ok := d.reasons.Get(txId); ok {
+			out[txId] = reason
+		}
+	}
+	return out
+}
+
+// Get the id of a tx from its full hash, if it's still stored.
+func (d *droppedTxs) getTxId(txHash core.HashT) (core.HashT, bool) {
+	if !d.inv.HasTx(txHash) {
+		return core.HashT{}, false
+	}
+	return d.inv.GetTx(txHash).Id(d.inv.GetCoreParams()), true
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/hex"
 	"encoding/json"
 
 	"github.com/levilutz/basiccoin/pkg/core"
@@ -76,6 +77,94 @@ func (r *UtxosResp) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+type PkhTxsResp struct {
+	TxIds []core.HashT
+	Total uint64
+}
+
+type pkhTxsRespJSON struct {
+	TxIds []core.HashT `json:"txIds"`
+	Total uint64       `json:"total"`
+}
+
+func (r PkhTxsResp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(pkhTxsRespJSON{
+		TxIds: r.TxIds,
+		Total: r.Total,
+	})
+}
+
+func (r *PkhTxsResp) UnmarshalJSON(data []byte) error {
+	raw := pkhTxsRespJSON{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	r.TxIds = raw.TxIds
+	r.Total = raw.Total
+	return nil
+}
+
+type UtxoSpenderResp struct {
+	Spent        bool
+	TxId         core.HashT
+	BlockId      core.HashT
+	MempoolTxIds []core.HashT
+}
+
+type utxoSpenderRespJSON struct {
+	Spent        bool         `json:"spent"`
+	TxId         core.HashT   `json:"txId"`
+	BlockId      core.HashT   `json:"blockId"`
+	MempoolTxIds []core.HashT `json:"mempoolTxIds"`
+}
+
+func (r UtxoSpenderResp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(utxoSpenderRespJSON{
+		Spent:        r.Spent,
+		TxId:         r.TxId,
+		BlockId:      r.BlockId,
+		MempoolTxIds: r.MempoolTxIds,
+	})
+}
+
+func (r *UtxoSpenderResp) UnmarshalJSON(data []byte) error {
+	raw := utxoSpenderRespJSON{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	r.Spent = raw.Spent
+	r.TxId = raw.TxId
+	r.BlockId = raw.BlockId
+	r.MempoolTxIds = raw.MempoolTxIds
+	return nil
+}
+
+type TxPackageResp struct {
+	TxIds []core.HashT
+}
+
+type txPackageRespJSON struct {
+	TxIds []core.HashT `json:"txIds"`
+}
+
+func (r TxPackageResp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(txPackageRespJSON{
+		TxIds: r.TxIds,
+	})
+}
+
+func (r *TxPackageResp) UnmarshalJSON(data []byte) error {
+	raw := txPackageRespJSON{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	r.TxIds = raw.TxIds
+	return nil
+}
+
 type TxConfirmsResp struct {
 	Confirms map[core.HashT]uint64
 }
@@ -104,6 +193,34 @@ func (r *TxConfirmsResp) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+type TxDroppedResp struct {
+	Reasons map[core.HashT]string
+}
+
+type txDroppedRespJSON struct {
+	Reasons map[string]string `json:"reasons"`
+}
+
+func (r TxDroppedResp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(txDroppedRespJSON{
+		Reasons: core.MarshalHashTMap(r.Reasons),
+	})
+}
+
+func (r *TxDroppedResp) UnmarshalJSON(data []byte) error {
+	raw := txDroppedRespJSON{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	reasons, err := core.UnmarshalHashTMap(raw.Reasons)
+	if err != nil {
+		return err
+	}
+	r.Reasons = reasons
+	return nil
+}
+
 type TxIncludedBlockResp struct {
 	IncludedBlocks map[core.HashT]core.HashT
 }
@@ -132,6 +249,34 @@ func (r *TxIncludedBlockResp) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+type BlockUtxoHashResp struct {
+	UtxoHashes map[core.HashT]core.HashT
+}
+
+type blockUtxoHashRespJSON struct {
+	UtxoHashes map[string]core.HashT `json:"utxoHashes"`
+}
+
+func (r BlockUtxoHashResp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(blockUtxoHashRespJSON{
+		UtxoHashes: core.MarshalHashTMap(r.UtxoHashes),
+	})
+}
+
+func (r *BlockUtxoHashResp) UnmarshalJSON(data []byte) error {
+	raw := blockUtxoHashRespJSON{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	utxoHashes, err := core.UnmarshalHashTMap(raw.UtxoHashes)
+	if err != nil {
+		return err
+	}
+	r.UtxoHashes = utxoHashes
+	return nil
+}
+
 type GetTxResp struct {
 	Txs map[core.HashT]core.Tx
 }
@@ -160,6 +305,51 @@ func (r *GetTxResp) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+type TxDataResp struct {
+	Data map[core.HashT]map[uint64][]byte
+}
+
+type txDataRespJSON struct {
+	Data map[string]map[uint64]string `json:"data"`
+}
+
+func (r TxDataResp) MarshalJSON() ([]byte, error) {
+	raw := make(map[string]map[uint64]string, len(r.Data))
+	for txId, outputs := range r.Data {
+		raw[txId.String()] = make(map[uint64]string, len(outputs))
+		for ind, data := range outputs {
+			raw[txId.String()][ind] = hex.EncodeToString(data)
+		}
+	}
+	return json.Marshal(txDataRespJSON{
+		Data: raw,
+	})
+}
+
+func (r *TxDataResp) UnmarshalJSON(data []byte) error {
+	raw := txDataRespJSON{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	rawData, err := core.UnmarshalHashTMap(raw.Data)
+	if err != nil {
+		return err
+	}
+	out := make(map[core.HashT]map[uint64][]byte, len(rawData))
+	for txId, outputs := range rawData {
+		out[txId] = make(map[uint64][]byte, len(outputs))
+		for ind, dataStr := range outputs {
+			out[txId][ind], err = hex.DecodeString(dataStr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	r.Data = out
+	return nil
+}
+
 type GetMerkleResp struct {
 	Merkles map[core.HashT]core.MerkleNode
 }
@@ -216,6 +406,61 @@ func (r *GetBlockResp) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+type BlockIdsByHeightResp struct {
+	BlockIds map[uint64]core.HashT
+}
+
+type blockIdsByHeightRespJSON struct {
+	BlockIds map[uint64]core.HashT `json:"blockIds"`
+}
+
+func (r BlockIdsByHeightResp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(blockIdsByHeightRespJSON{
+		BlockIds: r.BlockIds,
+	})
+}
+
+func (r *BlockIdsByHeightResp) UnmarshalJSON(data []byte) error {
+	raw := blockIdsByHeightRespJSON{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	r.BlockIds = raw.BlockIds
+	return nil
+}
+
+// A block of the main chain, with its id and height.
+type BlockHeader struct {
+	BlockId core.HashT `json:"blockId"`
+	Height  uint64     `json:"height"`
+	Block   core.Block `json:"block"`
+}
+
+type BlockHeadersResp struct {
+	Headers []BlockHeader
+}
+
+type blockHeadersRespJSON struct {
+	Headers []BlockHeader `json:"headers"`
+}
+
+func (r BlockHeadersResp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(blockHeadersRespJSON{
+		Headers: r.Headers,
+	})
+}
+
+func (r *BlockHeadersResp) UnmarshalJSON(data []byte) error {
+	raw := blockHeadersRespJSON{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	r.Headers = raw.Headers
+	return nil
+}
+
 type RichListResp struct {
 	RichList map[core.HashT]uint64
 }
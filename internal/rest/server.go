@@ -15,17 +15,23 @@ var walletPrefix = "/wallet"
 type HttpHandler = func(http.ResponseWriter, *http.Request)
 
 type Server struct {
-	params    Params
-	busClient *BusClient
-	inv       inv.InvReader
+	params     Params
+	busClient  *BusClient
+	inv        inv.InvReader
+	droppedTxs *droppedTxs
 }
 
 func NewServer(params Params, msgBus *bus.Bus, inv inv.InvReader) *Server {
-	return &Server{
+	s := &Server{
 		params:    params,
 		busClient: NewBusClient(msgBus),
 		inv:       inv,
 	}
+	// Subscribe now, so txs dropped before starting are known
+	if params.EnableWallet {
+		s.droppedTxs = newDroppedTxs(msgBus, inv)
+	}
+	return s
 }
 
 func (s *Server) Start() {
@@ -39,9 +45,15 @@ func (s *Server) Start() {
 		s.mountHandlers(true, adminPrefix+"/terminate", map[string]HttpHandler{
 			"POST": s.handleAdminPostTerminate,
 		})
+
+		s.mountHandlers(true, adminPrefix+"/snapshot", map[string]HttpHandler{
+			"GET": s.handleAdminGetSnapshot,
+		})
 	}
 
 	if s.params.EnableWallet {
+		go s.droppedTxs.Loop()
+
 		s.mountHandlers(false, walletPrefix+"/head/height", map[string]HttpHandler{
 			"GET": s.handleWalletGetHeadHeight,
 		})
@@ -54,19 +66,39 @@ func (s *Server) Start() {
 			"GET": s.handleWalletGetUtxos,
 		})
 
+		s.mountHandlers(false, walletPrefix+"/history", map[string]HttpHandler{
+			"GET": s.handleWalletGetHistory,
+		})
+
+		s.mountHandlers(false, walletPrefix+"/utxo/spender", map[string]HttpHandler{
+			"GET": s.handleWalletGetUtxoSpender,
+		})
+
 		s.mountHandlers(false, walletPrefix+"/tx", map[string]HttpHandler{
 			"GET":  s.handleWalletGetTx,
 			"POST": s.handleWalletPostTx,
 		})
 
+		s.mountHandlers(false, walletPrefix+"/tx/package", map[string]HttpHandler{
+			"POST": s.handleWalletPostTxPackage,
+		})
+
 		s.mountHandlers(false, walletPrefix+"/tx/confirms", map[string]HttpHandler{
 			"GET": s.handleWalletGetTxConfirms,
 		})
 
+		s.mountHandlers(false, walletPrefix+"/tx/dropped", map[string]HttpHandler{
+			"GET": s.handleWalletGetTxDropped,
+		})
+
 		s.mountHandlers(false, walletPrefix+"/tx/block", map[string]HttpHandler{
 			"GET": s.handleWalletGetTxIncludedBlock,
 		})
 
+		s.mountHandlers(false, walletPrefix+"/tx/data", map[string]HttpHandler{
+			"GET": s.handleWalletGetTxData,
+		})
+
 		s.mountHandlers(false, walletPrefix+"/merkle", map[string]HttpHandler{
 			"GET": s.handleWalletGetMerkle,
 		})
@@ -75,6 +107,18 @@ func (s *Server) Start() {
 			"GET": s.handleWalletGetBlock,
 		})
 
+		s.mountHandlers(false, walletPrefix+"/block/height", map[string]HttpHandler{
+			"GET": s.handleWalletGetBlockIdsByHeight,
+		})
+
+		s.mountHandlers(false, walletPrefix+"/block/headers", map[string]HttpHandler{
+			"GET": s.handleWalletGetBlockHeaders,
+		})
+
+		s.mountHandlers(false, walletPrefix+"/block/utxohash", map[string]HttpHandler{
+			"GET": s.handleWalletGetBlockUtxoHash,
+		})
+
 		s.mountHandlers(false, walletPrefix+"/richlist", map[string]HttpHandler{
 			"GET": s.handleWalletGetRichList,
 		})
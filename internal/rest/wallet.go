@@ -30,8 +30,8 @@ func (s *Server) handleWalletGetTx(w http.ResponseWriter, r *http.Request) {
 	}
 	out := make(map[core.HashT]core.Tx)
 	for _, txId := range txIds {
-		if s.inv.HasTx(txId) {
-			out[txId] = s.inv.GetTx(txId)
+		if tx, ok := s.getTxByIdOrHash(txId); ok {
+			out[txId] = tx
 		}
 	}
 	if len(out) == 0 {
@@ -48,6 +48,47 @@ func (s *Server) handleWalletGetTx(w http.ResponseWriter, r *http.Request) {
 	w.Write(outJson)
 }
 
+// Look up a tx by its id (see core.Tx.Id), falling back to its full hash.
+func (s *Server) getTxByIdOrHash(txId core.HashT) (core.Tx, bool) {
+	if s.inv.HasTxById(txId) {
+		return s.inv.GetTxById(txId), true
+	} else if s.inv.HasTx(txId) {
+		return s.inv.GetTx(txId), true
+	}
+	return core.Tx{}, false
+}
+
+func (s *Server) handleWalletGetTxData(w http.ResponseWriter, r *http.Request) {
+	txIdStrs, ok := r.URL.Query()["txId"]
+	if !ok {
+		write400(w, fmt.Errorf("no tx ids provided"))
+		return
+	}
+	txIds, err := core.UnmarshalHashTSlice(txIdStrs)
+	if err != nil {
+		write400(w, err)
+		return
+	}
+	out := make(map[core.HashT]map[uint64][]byte)
+	for _, txId := range txIds {
+		if tx, ok := s.getTxByIdOrHash(txId); ok {
+			out[txId] = tx.GetDataOutputs()
+		}
+	}
+	if len(out) == 0 {
+		write400(w, fmt.Errorf("no provided tx ids known"))
+		return
+	}
+	outJson, err := json.Marshal(models.TxDataResp{
+		Data: out,
+	})
+	if err != nil {
+		write500(w, err)
+		return
+	}
+	w.Write(outJson)
+}
+
 func (s *Server) handleWalletGetMerkle(w http.ResponseWriter, r *http.Request) {
 	merkleIdStrs, ok := r.URL.Query()["merkleId"]
 	if !ok {
@@ -110,6 +151,75 @@ func (s *Server) handleWalletGetBlock(w http.ResponseWriter, r *http.Request) {
 	w.Write(outJson)
 }
 
+func (s *Server) handleWalletGetBlockIdsByHeight(w http.ResponseWriter, r *http.Request) {
+	heightStrs, ok := r.URL.Query()["height"]
+	if !ok {
+		write400(w, fmt.Errorf("no heights provided"))
+		return
+	}
+	heights := make([]uint64, len(heightStrs))
+	for i, heightStr := range heightStrs {
+		height, err := strconv.ParseUint(heightStr, 10, 64)
+		if err != nil {
+			write400(w, err)
+			return
+		}
+		heights[i] = height
+	}
+	blockIds := s.busClient.BlockIdsByHeightQuery(heights)
+	outJson, err := json.Marshal(models.BlockIdsByHeightResp{
+		BlockIds: blockIds,
+	})
+	if err != nil {
+		write500(w, err)
+		return
+	}
+	w.Write(outJson)
+}
+
+// The most headers returned in one range of the main chain.
+const maxHeadersLimit = 1000
+
+func (s *Server) handleWalletGetBlockHeaders(w http.ResponseWriter, r *http.Request) {
+	startStr := r.URL.Query().Get("start")
+	if startStr == "" {
+		write400(w, fmt.Errorf("no start height provided"))
+		return
+	}
+	start, err := strconv.ParseUint(startStr, 10, 64)
+	if err != nil {
+		write400(w, err)
+		return
+	}
+	limit := uint64(100)
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if limit, err = strconv.ParseUint(limitStr, 10, 64); err != nil {
+			write400(w, err)
+			return
+		} else if limit > maxHeadersLimit {
+			write400(w, fmt.Errorf("limit must be at most %d", maxHeadersLimit))
+			return
+		}
+	}
+	blockIds := s.busClient.MainChainRangeQuery(start, limit)
+	headers := make([]models.BlockHeader, len(blockIds))
+	for i, blockId := range blockIds {
+		headers[i] = models.BlockHeader{
+			BlockId: blockId,
+			Height:  start + uint64(i),
+			Block:   s.inv.GetBlock(blockId),
+		}
+	}
+	outJson, err := json.Marshal(models.BlockHeadersResp{
+		Headers: headers,
+	})
+	if err != nil {
+		write500(w, err)
+		return
+	}
+	w.Write(outJson)
+}
+
 func (s *Server) handleWalletGetBalance(w http.ResponseWriter, r *http.Request) {
 	pkhStrs, ok := r.URL.Query()["publicKeyHash"]
 	if !ok {
@@ -159,6 +269,91 @@ func (s *Server) handleWalletGetUtxos(w http.ResponseWriter, r *http.Request) {
 	w.Write(outJson)
 }
 
+// The most tx ids returned in one page of a pkh's history.
+const maxHistoryLimit = 1000
+
+func (s *Server) handleWalletGetHistory(w http.ResponseWriter, r *http.Request) {
+	pkhStr := r.URL.Query().Get("publicKeyHash")
+	if pkhStr == "" {
+		write400(w, fmt.Errorf("no public key hash provided"))
+		return
+	}
+	pkh, err := core.NewHashTFromString(pkhStr)
+	if err != nil {
+		write400(w, err)
+		return
+	}
+	offset, limit := uint64(0), uint64(100)
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		if offset, err = strconv.ParseUint(offsetStr, 10, 64); err != nil {
+			write400(w, err)
+			return
+		}
+	}
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if limit, err = strconv.ParseUint(limitStr, 10, 64); err != nil {
+			write400(w, err)
+			return
+		} else if limit > maxHistoryLimit {
+			write400(w, fmt.Errorf("limit must be at most %d", maxHistoryLimit))
+			return
+		}
+	}
+	result := s.busClient.PkhTxsQuery(pkh, offset, limit)
+	if result.Err != nil {
+		write400(w, result.Err)
+		return
+	}
+	outJson, err := json.Marshal(models.PkhTxsResp{
+		TxIds: result.TxIds,
+		Total: result.Total,
+	})
+	if err != nil {
+		write500(w, err)
+		return
+	}
+	w.Write(outJson)
+}
+
+func (s *Server) handleWalletGetUtxoSpender(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("txId") == "" || query.Get("ind") == "" || query.Get("value") == "" {
+		write400(w, fmt.Errorf("utxo txId, ind and value must be provided"))
+		return
+	}
+	txId, err := core.NewHashTFromString(query.Get("txId"))
+	if err != nil {
+		write400(w, err)
+		return
+	}
+	ind, err := strconv.ParseUint(query.Get("ind"), 10, 64)
+	if err != nil {
+		write400(w, err)
+		return
+	}
+	value, err := strconv.ParseUint(query.Get("value"), 10, 64)
+	if err != nil {
+		write400(w, err)
+		return
+	}
+	result := s.busClient.UtxoSpenderQuery(core.Utxo{TxId: txId, Ind: ind, Value: value})
+	if result.Err != nil {
+		write400(w, result.Err)
+		return
+	}
+	outJson, err := json.Marshal(models.UtxoSpenderResp{
+		Spent:        result.Spent,
+		TxId:         result.TxId,
+		BlockId:      result.BlockId,
+		MempoolTxIds: result.MempoolTxIds,
+	})
+	if err != nil {
+		write500(w, err)
+		return
+	}
+	w.Write(outJson)
+}
+
 func (s *Server) handleWalletPostTx(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -178,7 +373,44 @@ func (s *Server) handleWalletPostTx(w http.ResponseWriter, r *http.Request) {
 		write400(w, err)
 		return
 	}
-	io.WriteString(w, tx.Hash().String())
+	io.WriteString(w, tx.Id(s.inv.GetCoreParams()).String())
+}
+
+func (s *Server) handleWalletPostTxPackage(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		write400(w, err)
+		return
+	}
+	txs := []core.Tx{}
+	if err = json.Unmarshal(body, &txs); err != nil {
+		write422(w, err)
+		return
+	}
+	if len(txs) == 0 {
+		write400(w, fmt.Errorf("no txs provided"))
+		return
+	}
+	txIds := make([]core.HashT, len(txs))
+	for i, tx := range txs {
+		if !tx.HasSurplus() {
+			write400(w, fmt.Errorf("tx without surplus would never be included"))
+			return
+		}
+		txIds[i] = tx.Id(s.inv.GetCoreParams())
+	}
+	if err = s.busClient.NewTxPackageEvent(txs); err != nil {
+		write400(w, err)
+		return
+	}
+	outJson, err := json.Marshal(models.TxPackageResp{
+		TxIds: txIds,
+	})
+	if err != nil {
+		write500(w, err)
+		return
+	}
+	w.Write(outJson)
 }
 
 func (s *Server) handleWalletGetTxConfirms(w http.ResponseWriter, r *http.Request) {
@@ -203,6 +435,31 @@ func (s *Server) handleWalletGetTxConfirms(w http.ResponseWriter, r *http.Reques
 	w.Write(outJson)
 }
 
+func (s *Server) handleWalletGetTxDropped(w http.ResponseWriter, r *http.Request) {
+	txIdStrs, ok := r.URL.Query()["txId"]
+	if !ok {
+		write400(w, fmt.Errorf("no txIds provided"))
+		return
+	}
+	txIds, err := core.UnmarshalHashTSlice(txIdStrs)
+	if err != nil {
+		write400(w, err)
+		return
+	}
+	reasons := make(map[core.HashT]string)
+	for txId, reason := range s.droppedTxs.Get(txIds) {
+		reasons[txId] = string(reason)
+	}
+	outJson, err := json.Marshal(models.TxDroppedResp{
+		Reasons: reasons,
+	})
+	if err != nil {
+		write500(w, err)
+		return
+	}
+	w.Write(outJson)
+}
+
 func (s *Server) handleWalletGetTxIncludedBlock(w http.ResponseWriter, r *http.Request) {
 	txIdStrs, ok := r.URL.Query()["txId"]
 	if !ok {
@@ -225,6 +482,28 @@ func (s *Server) handleWalletGetTxIncludedBlock(w http.ResponseWriter, r *http.R
 	w.Write(outJson)
 }
 
+func (s *Server) handleWalletGetBlockUtxoHash(w http.ResponseWriter, r *http.Request) {
+	blockIdStrs, ok := r.URL.Query()["blockId"]
+	if !ok {
+		write400(w, fmt.Errorf("no blockIds provided"))
+		return
+	}
+	blockIds, err := core.UnmarshalHashTSlice(blockIdStrs)
+	if err != nil {
+		write400(w, err)
+		return
+	}
+	utxoHashes := s.busClient.BlockUtxoHashQuery(blockIds)
+	outJson, err := json.Marshal(models.BlockUtxoHashResp{
+		UtxoHashes: utxoHashes,
+	})
+	if err != nil {
+		write500(w, err)
+		return
+	}
+	w.Write(outJson)
+}
+
 func (s *Server) handleWalletGetRichList(w http.ResponseWriter, r *http.Request) {
 	maxLenStr, ok := r.URL.Query()["maxLen"]
 	var maxLen uint64
@@ -28,19 +28,21 @@ func (b Block) Hash() HashT {
 	return DHashVarious(b.PrevBlockId, b.MerkleRoot, b.Target, b.Noise, b.Nonce)
 }
 
-// The maximum number of txs that could theoretically be in a block, including coinbase.
-func BlockMaxTxs(params Params) uint64 {
+// The maximum number of txs that could theoretically be in a block at the given height,
+// including coinbase.
+func BlockMaxTxs(params Params, height uint64) uint64 {
 	standardTxSpace := params.MaxBlockVSize - CoinbaseVSize()
 	// +1 to "round up"
-	maxStandardTxs := standardTxSpace/MinNonCoinbaseVSize() + 1
+	maxStandardTxs := standardTxSpace/MinNonCoinbaseVSize(params, height) + 1
 	// +1 to re-include coinbase tx
 	return maxStandardTxs + 1
 }
 
-// The (overestimated) max possible size of any block's merkle tree, including tx leafs.
-func MerkleTreeMaxSize(params Params) uint64 {
+// The (overestimated) max possible size of the merkle tree of a block at the given height,
+// including tx leafs.
+func MerkleTreeMaxSize(params Params, height uint64) uint64 {
 	// Actual tree size <= floor(leafs * 20 / 9)
-	return uint64(float64(BlockMaxTxs(params)) * 20.0 / 9.0)
+	return uint64(float64(BlockMaxTxs(params, height)) * 20.0 / 9.0)
 }
 
 // Construct a merkle tree from a list of txIds.
@@ -18,11 +18,11 @@ func TestMerkleFromTxIds(t *testing.T) {
 	util.Assert(t, len(merkleMap) == len(merkleIds), "out lengths mismatched")
 	util.Assert(t, len(merkleIds) == 6, "out length unexpected")
 	util.Assert(
-		t, len(merkleIds) <= int(MerkleTreeMaxSize(ProdNetParams())),
+		t, len(merkleIds) <= int(MerkleTreeMaxSize(ProdNetParams(), 1)),
 		"prod tree max size too small",
 	)
 	util.Assert(
-		t, len(merkleIds) <= int(MerkleTreeMaxSize(DevNetParams())),
+		t, len(merkleIds) <= int(MerkleTreeMaxSize(DevNetParams(), 1)),
 		"dev tree max size too small",
 	)
 	expected := []MerkleNode{
@@ -57,3 +57,12 @@ func TestMerkleFromTxIds(t *testing.T) {
 		util.Assert(t, merkleMap[nodeId] == expected[i], "content mismatch")
 	}
 }
+
+// Test that blocks only fit more txs once the smaller Ed25519 keys are enabled.
+func TestBlockMaxTxsUpgrade(t *testing.T) {
+	params := ProdNetParams()
+	before := BlockMaxTxs(params, params.Ed25519UpgradeHeight-1)
+	after := BlockMaxTxs(params, params.Ed25519UpgradeHeight)
+	util.Assert(t, before < after, "max txs not raised by upgrade: %d >= %d", before, after)
+	util.Assert(t, BlockMaxTxs(params, 1) == before, "max txs changed before upgrade")
+}
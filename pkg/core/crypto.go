@@ -1,7 +1,9 @@
 package core
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
@@ -9,6 +11,92 @@ import (
 	"fmt"
 )
 
+// The signature scheme of a key.
+type KeyType uint8
+
+const (
+	// P-256 ECDSA, with PKIX DER public keys and ASN.1 signatures. The original scheme.
+	KeyTypeEcdsa KeyType = 0x00
+	// Ed25519, with raw 32-byte public keys and 64-byte signatures.
+	KeyTypeEd25519 KeyType = 0x01
+)
+
+// Get the KeyType of a private key.
+func KeyTypeOf(priv crypto.Signer) (KeyType, error) {
+	switch priv.(type) {
+	case *ecdsa.PrivateKey:
+		return KeyTypeEcdsa, nil
+	case ed25519.PrivateKey:
+		return KeyTypeEd25519, nil
+	default:
+		return 0, fmt.Errorf("unsupported private key type: %T", priv)
+	}
+}
+
+// Marshal a private key's public part to the form used in tx inputs for its KeyType.
+func MarshalPublic(priv crypto.Signer) ([]byte, error) {
+	switch typed := priv.(type) {
+	case *ecdsa.PrivateKey:
+		return MarshalEcdsaPublic(typed)
+	case ed25519.PrivateKey:
+		return typed.Public().(ed25519.PublicKey), nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type: %T", priv)
+	}
+}
+
+// Sign a hash with the given private key, in the signature form for its KeyType.
+func Sign(priv crypto.Signer, hash HashT) ([]byte, error) {
+	switch typed := priv.(type) {
+	case *ecdsa.PrivateKey:
+		return EcdsaSign(typed, hash)
+	case ed25519.PrivateKey:
+		return Ed25519Sign(typed, hash), nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type: %T", priv)
+	}
+}
+
+// Verify a signature made by a key of the given KeyType.
+func VerifySig(keyType KeyType, pub []byte, hash HashT, sig []byte) (bool, error) {
+	switch keyType {
+	case KeyTypeEcdsa:
+		return EcdsaVerify(pub, hash, sig)
+	case KeyTypeEd25519:
+		return Ed25519Verify(pub, hash, sig)
+	default:
+		return false, fmt.Errorf("unsupported key type: %#x", keyType)
+	}
+}
+
+// Marshal a private key to SEC1 DER form for ecdsa, or PKCS #8 DER form for others.
+func MarshalPrivate(priv crypto.Signer) ([]byte, error) {
+	if typed, ok := priv.(*ecdsa.PrivateKey); ok {
+		return MarshalEcdsaPrivate(typed)
+	}
+	return x509.MarshalPKCS8PrivateKey(priv)
+}
+
+// Parse a private key of the given KeyType, as marshalled by MarshalPrivate.
+func ParsePrivate(keyType KeyType, priv []byte) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeEcdsa:
+		return ParseECDSAPrivate(priv)
+	case KeyTypeEd25519:
+		parsed, err := x509.ParsePKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		typed, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key is not ed25519: %T", parsed)
+		}
+		return typed, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %#x", keyType)
+	}
+}
+
 // Generate a new ecdsa private key.
 func NewEcdsa() (*ecdsa.PrivateKey, error) {
 	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
@@ -80,3 +168,58 @@ func ExampleMaxSigAsn() []byte {
 	}
 	return sig
 }
+
+// Generate a new ed25519 private key.
+func NewEd25519() (ed25519.PrivateKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	return priv, err
+}
+
+// Sign data with Ed25519.
+// priv is an ed25519 private key.
+// hash is the hash of the content that needs to be signed.
+func Ed25519Sign(priv ed25519.PrivateKey, hash HashT) []byte {
+	return ed25519.Sign(priv, hash.data[:])
+}
+
+// Verify an Ed25519 signature.
+// pub is the raw 32-byte ed25519 public key.
+// hash is the hash of the content that should have been signed.
+// sig is the raw 64-byte ed25519 signature.
+func Ed25519Verify(pub []byte, hash HashT, sig []byte) (bool, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return false, fmt.Errorf("ed25519 public key has wrong length: %d", len(pub))
+	}
+	return ed25519.Verify(ed25519.PublicKey(pub), hash.data[:], sig), nil
+}
+
+// An example raw ed25519 public key of expected length 32 bytes.
+func ExampleEd25519Pub() []byte {
+	pub, err := hex.DecodeString(
+		"d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a",
+	)
+	if err != nil {
+		panic(err)
+	}
+	return pub
+}
+
+// An example ed25519 signature of expected length 64 bytes.
+func ExampleEd25519Sig() []byte {
+	sig, err := hex.DecodeString(
+		"e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e06522490155" +
+			"5fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b",
+	)
+	if err != nil {
+		panic(err)
+	}
+	return sig
+}
+
+// Example public key and max-length signature for the given key type, for estimating vSize.
+func ExamplePubAndMaxSig(keyType KeyType) ([]byte, []byte) {
+	if keyType == KeyTypeEd25519 {
+		return ExampleEd25519Pub(), ExampleEd25519Sig()
+	}
+	return ExamplePubDer(), ExampleMaxSigAsn()
+}
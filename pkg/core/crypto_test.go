@@ -48,3 +48,33 @@ func TestEcdsaBadSign(t *testing.T) {
 	util.AssertNoErr(t, err)
 	util.Assert(t, !valid, "incorrectly valid signature")
 }
+
+// Test that an ed25519 key round trips and signs through the generic helpers.
+func TestEd25519SignReconstruct(t *testing.T) {
+	priv, err := NewEd25519()
+	util.AssertNoErr(t, err)
+	keyType, err := KeyTypeOf(priv)
+	util.AssertNoErr(t, err)
+	util.Assert(t, keyType == KeyTypeEd25519, "wrong key type %d", keyType)
+	privDer, err := MarshalPrivate(priv)
+	util.AssertNoErr(t, err)
+	privRecon, err := ParsePrivate(keyType, privDer)
+	util.AssertNoErr(t, err)
+	pub, err := MarshalPublic(privRecon)
+	util.AssertNoErr(t, err)
+	util.Assert(t, len(pub) == len(ExampleEd25519Pub()), "wrong pub len %d", len(pub))
+
+	content := []byte("Hello World")
+	sig, err := Sign(priv, DHashBytes(content))
+	util.AssertNoErr(t, err)
+	valid, err := VerifySig(keyType, pub, DHashBytes(content), sig)
+	util.AssertNoErr(t, err)
+	util.Assert(t, valid, "invalid signature")
+	valid, err = VerifySig(keyType, pub, DHashBytes([]byte("Hello World.")), sig)
+	util.AssertNoErr(t, err)
+	util.Assert(t, !valid, "incorrectly valid signature")
+
+	// A signature can't be verified as the wrong key type
+	_, err = VerifySig(KeyTypeEcdsa, pub, DHashBytes(content), sig)
+	util.Assert(t, err != nil, "ed25519 pub parsed as ecdsa")
+}
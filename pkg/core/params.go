@@ -9,8 +9,45 @@ type Params struct {
 	BlockTargetTime  uint64 `json:"blockTargetTime"`  // Difficulty target for how long to mine a block.
 	MaxBlockVSize    uint64 `json:"maxBlockVSize"`    // Maximum number of total hashed bytes in a block's txs.
 	MaxTxVSize       uint64 `json:"maxTxVSize"`       // Maximum number of hashed bytes in a single tx.
+	MaxTxOutDataSize uint64 `json:"maxTxOutDataSize"` // Maximum number of bytes in a data-carrier output.
 	MaxTarget        HashT  `json:"maxTarget"`        // Maximum (easiest) allowed target value.
 	OriginalTarget   HashT  `json:"originalTarget"`   // First block's required target difficulty
+
+	// Network upgrade heights
+	TxIdUpgradeHeight       uint64 `json:"txIdUpgradeHeight"`       // MinBlock from which tx ids exclude signatures.
+	DataOutputUpgradeHeight uint64 `json:"dataOutputUpgradeHeight"` // MinBlock from which txs may have data outputs.
+	SigHashUpgradeHeight    uint64 `json:"sigHashUpgradeHeight"`    // MinBlock from which inputs may use non-legacy sig hashes.
+	Ed25519UpgradeHeight    uint64 `json:"ed25519UpgradeHeight"`    // MinBlock from which inputs may use Ed25519 keys.
+
+	// Hashes of utxo set snapshots that new nodes may trust to bootstrap from.
+	TrustedSnapshots []HashT `json:"trustedSnapshots"`
+}
+
+// Return whether the given snapshot hash is trusted by this network.
+func (p Params) IsTrustedSnapshot(hash HashT) bool {
+	for _, trusted := range p.TrustedSnapshots {
+		if trusted == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the sig hash type to sign whole txs with at the given MinBlock: SigHashAll once it's
+// enabled, else SigHashLegacy.
+func (p Params) DefaultSigHashType(minBlock uint64) SigHashType {
+	if minBlock >= p.SigHashUpgradeHeight {
+		return SigHashAll
+	}
+	return SigHashLegacy
+}
+
+// Get the key type with the smallest public keys that inputs may use at the given MinBlock.
+func (p Params) minKeyType(minBlock uint64) KeyType {
+	if minBlock >= p.Ed25519UpgradeHeight {
+		return KeyTypeEd25519
+	}
+	return KeyTypeEcdsa
 }
 
 // Verify the parameters don't exceed limits.
@@ -38,12 +75,18 @@ func ProdNetParams() Params {
 		BlockTargetTime:  720,     // 12 minutes
 		MaxBlockVSize:    1048576, // 2^20 vBytes
 		MaxTxVSize:       16384,   // 2^14 vBytes
+		MaxTxOutDataSize: 80,      // 80 bytes
 		MaxTarget: NewHashTFromStringAssert(
 			"0000000fffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
 		), // 28 bits of 0s
 		OriginalTarget: NewHashTFromStringAssert(
 			"0000000fffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
 		), // 28 bits of 0s
+		TxIdUpgradeHeight:       32768, // 2^15 blocks
+		DataOutputUpgradeHeight: 32768, // 2^15 blocks
+		SigHashUpgradeHeight:    32768, // 2^15 blocks
+		Ed25519UpgradeHeight:    32768, // 2^15 blocks
+		TrustedSnapshots:        []HashT{},
 	}
 	params.verify()
 	return params
@@ -57,12 +100,18 @@ func DevNetParams() Params {
 		BlockTargetTime:  10,      // 10 seconds
 		MaxBlockVSize:    1048576, // 2^20 vBytes
 		MaxTxVSize:       16384,   // 2^14 vBytes
+		MaxTxOutDataSize: 80,      // 80 bytes
 		MaxTarget: NewHashTFromStringAssert(
 			"000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
 		), // 24 bits of 0s
 		OriginalTarget: NewHashTFromStringAssert(
 			"000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
 		), // 24 bits of 0s
+		TxIdUpgradeHeight:       0, // Always upgraded
+		DataOutputUpgradeHeight: 0, // Always upgraded
+		SigHashUpgradeHeight:    0, // Always upgraded
+		Ed25519UpgradeHeight:    0, // Always upgraded
+		TrustedSnapshots:        []HashT{},
 	}
 	params.verify()
 	return params
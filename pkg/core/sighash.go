@@ -0,0 +1,66 @@
+package core
+
+import "fmt"
+
+// Which parts of a tx an input's signature commits to.
+type SigHashType uint8
+
+const (
+	// Sign MinBlock and all outputs, but no inputs. The original signature scheme.
+	SigHashLegacy SigHashType = 0x00
+	// Sign MinBlock, all inputs, and all outputs.
+	SigHashAll SigHashType = 0x01
+	// Sign MinBlock, all inputs, and only the output at this input's index.
+	SigHashSingle SigHashType = 0x02
+	// Modifier - sign only this input, so anyone may add further inputs.
+	SigHashAnyoneCanPay SigHashType = 0x80
+)
+
+// Check whether this is a recognized signature hash type.
+func (t SigHashType) Valid() bool {
+	base := t &^ SigHashAnyoneCanPay
+	if t == SigHashLegacy {
+		return true
+	}
+	return base == SigHashAll || base == SigHashSingle
+}
+
+// Whether this signature only commits to its own input.
+func (t SigHashType) AnyoneCanPay() bool {
+	return t&SigHashAnyoneCanPay != 0
+}
+
+// Compute the hash the signature of the given input must sign, according to its SigHashType.
+func TxSigHash(tx Tx, inputInd int) (HashT, error) {
+	if inputInd < 0 || inputInd >= len(tx.Inputs) {
+		return HashT{}, fmt.Errorf("input index out of range: %d", inputInd)
+	}
+	sigHashType := tx.Inputs[inputInd].SigHashType
+	if !sigHashType.Valid() {
+		return HashT{}, fmt.Errorf("unrecognized sig hash type: %#x", sigHashType)
+	}
+	if sigHashType == SigHashLegacy {
+		return TxHashPreSig(tx.MinBlock, tx.Outputs), nil
+	}
+
+	// Commit to either just this input's utxo, or every input's
+	var inputsHash HashT
+	if sigHashType.AnyoneCanPay() {
+		inputsHash = DHashList([]Utxo{tx.Inputs[inputInd].Utxo})
+	} else {
+		inputsHash = DHashList(tx.GetConsumedUtxos())
+	}
+
+	// Commit to either every output, or just the one paired with this input
+	var outputsHash HashT
+	if sigHashType&^SigHashAnyoneCanPay == SigHashSingle {
+		if inputInd >= len(tx.Outputs) {
+			return HashT{}, fmt.Errorf("no output paired with input %d", inputInd)
+		}
+		outputsHash = DHashList([]TxOut{tx.Outputs[inputInd]})
+	} else {
+		outputsHash = DHashList(tx.Outputs)
+	}
+
+	return DHashVarious(uint64(sigHashType), tx.MinBlock, inputsHash, outputsHash), nil
+}
@@ -0,0 +1,101 @@
+package core_test
+
+import (
+	"crypto/ecdsa"
+	"testing"
+
+	. "github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+// Test that anyone-can-pay inputs let others contribute to a tx, while sig hash all doesn't.
+func TestSigHashAnyoneCanPay(t *testing.T) {
+	verifier := NewVerifier(DevNetParams(), nil)
+	newUtxo := func(value uint64) Utxo {
+		return Utxo{TxId: NewHashTRand(), Ind: 0, Value: value}
+	}
+	newPriv := func() *ecdsa.PrivateKey {
+		priv, err := NewEcdsa()
+		util.AssertNoErr(t, err)
+		return priv
+	}
+
+	// Two contributors crowdfund a single output
+	tx := Tx{
+		IsCoinbase: false,
+		MinBlock:   10,
+		Inputs:     []TxIn{},
+		Outputs:    []TxOut{{Value: 150, PublicKeyHash: NewHashTRand()}},
+	}
+	util.AssertNoErr(t, AddSignedInput(&tx, newUtxo(100), newPriv(), false))
+	util.AssertNoErr(t, AddSignedInput(&tx, newUtxo(100), newPriv(), false))
+	util.AssertNoErr(t, verifier.VerifyTxIsolated(tx))
+
+	// Changing the outputs invalidates contributions
+	changed := tx
+	changed.Outputs = []TxOut{{Value: 150, PublicKeyHash: NewHashTRand()}}
+	util.Assert(t, verifier.VerifyTxIsolated(changed) != nil, "changed outputs accepted")
+
+	// A sig hash all input is invalidated by adding another input
+	tx.Inputs = append(tx.Inputs, TxIn{Utxo: newUtxo(10)})
+	util.AssertNoErr(t, SignTxInput(&tx, len(tx.Inputs)-1, newPriv(), SigHashAll))
+	util.AssertNoErr(t, verifier.VerifyTxIsolated(tx))
+	util.AssertNoErr(t, AddSignedInput(&tx, newUtxo(10), newPriv(), false))
+	util.Assert(t, verifier.VerifyTxIsolated(tx) != nil, "sig hash all input not invalidated")
+}
+
+// Test that sig hash single only commits to the paired output.
+func TestSigHashSingle(t *testing.T) {
+	verifier := NewVerifier(DevNetParams(), nil)
+	priv, err := NewEcdsa()
+	util.AssertNoErr(t, err)
+	tx := Tx{
+		IsCoinbase: false,
+		MinBlock:   10,
+		Inputs:     []TxIn{},
+		Outputs:    []TxOut{{Value: 50, PublicKeyHash: NewHashTRand()}},
+	}
+	util.AssertNoErr(t, AddSignedInput(&tx, Utxo{TxId: NewHashTRand(), Value: 100}, priv, true))
+	util.AssertNoErr(t, verifier.VerifyTxIsolated(tx))
+
+	// Other outputs can be added freely
+	tx.Outputs = append(tx.Outputs, TxOut{Value: 20, PublicKeyHash: NewHashTRand()})
+	util.AssertNoErr(t, verifier.VerifyTxIsolated(tx))
+
+	// But the paired output can't change
+	tx.Outputs[0].Value = 60
+	util.Assert(t, verifier.VerifyTxIsolated(tx) != nil, "changed paired output accepted")
+
+	// And an input without a paired output can't sign single
+	err = AddSignedInput(&tx, Utxo{TxId: NewHashTRand(), Value: 100}, priv, true)
+	util.AssertNoErr(t, err)
+	err = AddSignedInput(&tx, Utxo{TxId: NewHashTRand(), Value: 100}, priv, true)
+	util.Assert(t, err != nil, "signed single without paired output")
+}
+
+// Test that ed25519 inputs verify, and are smaller than ecdsa inputs.
+func TestEd25519TxInput(t *testing.T) {
+	verifier := NewVerifier(DevNetParams(), nil)
+	edPriv, err := NewEd25519()
+	util.AssertNoErr(t, err)
+	ecPriv, err := NewEcdsa()
+	util.AssertNoErr(t, err)
+	tx := Tx{
+		IsCoinbase: false,
+		MinBlock:   10,
+		Inputs:     []TxIn{},
+		Outputs:    []TxOut{{Value: 50, PublicKeyHash: NewHashTRand()}},
+	}
+	util.AssertNoErr(t, AddSignedInput(&tx, Utxo{TxId: NewHashTRand(), Value: 100}, edPriv, false))
+	util.AssertNoErr(t, AddSignedInput(&tx, Utxo{TxId: NewHashTRand(), Value: 100}, ecPriv, false))
+	util.AssertNoErr(t, verifier.VerifyTxIsolated(tx))
+	util.Assert(t, tx.Inputs[0].KeyType == KeyTypeEd25519, "wrong key type")
+	util.Assert(t, tx.Inputs[1].KeyType == KeyTypeEcdsa, "wrong key type")
+	util.Assert(
+		t, tx.Inputs[0].VSize() < tx.Inputs[1].VSize(), "ed25519 input not smaller",
+	)
+
+	// Claiming the wrong key type fails
+	tx.Inputs[0].KeyType = KeyTypeEcdsa
+	util.Assert(t, verifier.VerifyTxIsolated(tx) != nil, "wrong key type accepted")
+}
@@ -0,0 +1,146 @@
+package core
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// Default maximum number of signatures remembered by a SigVerifier's cache.
+const DefaultSigCacheSize = 1 << 16
+
+// A single signature to be checked.
+type sigCheck struct {
+	keyType KeyType
+	pub     []byte
+	sigHash HashT
+	sig     []byte
+}
+
+// Key this check by everything that determines its result.
+func (c sigCheck) cacheKey() HashT {
+	return DHashVarious(uint64(c.keyType), c.pub, c.sigHash, c.sig)
+}
+
+// Verifies tx input signatures across a pool of workers, remembering valid signatures.
+// Safe for concurrent use.
+type SigVerifier struct {
+	workers   int
+	cacheSize int
+	cache     map[HashT]struct{}
+	mu        sync.Mutex
+}
+
+// Create a new SigVerifier with the given number of workers and cache size.
+// A non-positive worker count uses one worker per cpu.
+func NewSigVerifier(workers int, cacheSize int) *SigVerifier {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &SigVerifier{
+		workers:   workers,
+		cacheSize: cacheSize,
+		cache:     make(map[HashT]struct{}),
+	}
+}
+
+// Verify the signatures of each input of the given tx.
+func (sv *SigVerifier) VerifyTxSigs(tx Tx) error {
+	return sv.VerifyTxsSigs([]Tx{tx})
+}
+
+// Verify the signatures of each input of each given tx, in parallel.
+// Signatures already in the cache are not verified again.
+func (sv *SigVerifier) VerifyTxsSigs(txs []Tx) error {
+	checks := make([]sigCheck, 0)
+	keys := make([]HashT, 0)
+	for _, tx := range txs {
+		for i, txi := range tx.Inputs {
+			sigHash, err := TxSigHash(tx, i)
+			if err != nil {
+				return err
+			}
+			check := sigCheck{
+				keyType: txi.KeyType,
+				pub:     txi.PublicKey,
+				sigHash: sigHash,
+				sig:     txi.Signature,
+			}
+			key := check.cacheKey()
+			if sv.cacheHas(key) {
+				continue
+			}
+			checks = append(checks, check)
+			keys = append(keys, key)
+		}
+	}
+	if len(checks) == 0 {
+		return nil
+	}
+
+	// Distribute checks among workers, stopping early once any fails
+	workers := sv.workers
+	if workers > len(checks) {
+		workers = len(checks)
+	}
+	jobs := make(chan int, len(checks))
+	for i := range checks {
+		jobs <- i
+	}
+	close(jobs)
+	done := make(chan struct{})
+	var failOnce sync.Once
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				check := checks[i]
+				valid, err := VerifySig(check.keyType, check.pub, check.sigHash, check.sig)
+				if err != nil || !valid {
+					failOnce.Do(func() { close(done) })
+					return
+				}
+				sv.cacheStore(keys[i])
+			}
+		}()
+	}
+	wg.Wait()
+	select {
+	case <-done:
+		return fmt.Errorf("tx signature invalid")
+	default:
+		return nil
+	}
+}
+
+// Check whether the given signature is known to be valid.
+func (sv *SigVerifier) cacheHas(key HashT) bool {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	_, ok := sv.cache[key]
+	return ok
+}
+
+// Remember a valid signature, evicting an arbitrary entry if full.
+func (sv *SigVerifier) cacheStore(key HashT) {
+	if sv.cacheSize <= 0 {
+		return
+	}
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if len(sv.cache) >= sv.cacheSize {
+		// Map iteration order is randomized, so this is a random eviction
+		for k := range sv.cache {
+			delete(sv.cache, k)
+			break
+		}
+	}
+	sv.cache[key] = struct{}{}
+}
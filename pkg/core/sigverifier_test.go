@@ -0,0 +1,39 @@
+package core_test
+
+import (
+	"testing"
+
+	. "github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+// Test that signatures across many txs verify in parallel, and a single bad one is caught.
+func TestSigVerifierParallel(t *testing.T) {
+	priv, err := NewEcdsa()
+	util.AssertNoErr(t, err)
+	txs := make([]Tx, 20)
+	for i := range txs {
+		txs[i] = Tx{
+			IsCoinbase: false,
+			MinBlock:   uint64(i),
+			Inputs:     []TxIn{},
+			Outputs:    []TxOut{{Value: 50, PublicKeyHash: NewHashTRand()}},
+		}
+		for j := 0; j < 3; j++ {
+			utxo := Utxo{TxId: NewHashTRand(), Value: 100}
+			util.AssertNoErr(t, AddSignedInput(&txs[i], utxo, priv, false))
+		}
+	}
+	sv := NewSigVerifier(4, 100)
+	util.AssertNoErr(t, sv.VerifyTxsSigs(txs))
+	// Verifying again is served from the cache (which evicts when full)
+	util.AssertNoErr(t, sv.VerifyTxsSigs(txs))
+
+	// A fresh verifier catches a tampered signature
+	txs[13].Inputs[1].Signature = txs[12].Inputs[1].Signature
+	err = NewSigVerifier(4, 100).VerifyTxsSigs(txs)
+	util.Assert(t, err != nil, "tampered signature accepted")
+	err = NewSigVerifier(0, 0).VerifyTxSigs(txs[13])
+	util.Assert(t, err != nil, "tampered signature accepted")
+	util.AssertNoErr(t, NewSigVerifier(0, 0).VerifyTxSigs(txs[12]))
+}
@@ -18,36 +18,82 @@ func (utxo Utxo) VSize() uint64 {
 
 // A transaction input.
 type TxIn struct {
-	Utxo      Utxo   `json:"utxo"`
-	PublicKey []byte `json:"publicKey"`
-	Signature []byte `json:"signature"`
+	Utxo        Utxo        `json:"utxo"`
+	PublicKey   []byte      `json:"publicKey"`
+	Signature   []byte      `json:"signature"`
+	SigHashType SigHashType `json:"sigHashType,omitempty"`
+	KeyType     KeyType     `json:"keyType,omitempty"`
 }
 
 func (txi TxIn) Hash() HashT {
 	return DHashVarious(
-		txi.Utxo,
-		txi.PublicKey,
-		txi.Signature,
+		append([]any{txi.Utxo, txi.PublicKey, txi.Signature}, txi.optionalHashItems()...)...,
 	)
 }
 
+// Hash the input without its signature, which can be malleated by relayers.
+func (txi TxIn) HashNoSig() HashT {
+	return DHashVarious(
+		append([]any{txi.Utxo, txi.PublicKey}, txi.optionalHashItems()...)...,
+	)
+}
+
+// Fields only included in hashes when set, so legacy input hashes are unchanged.
+// Earlier fields are always included when later ones are, so hashes stay unambiguous.
+func (txi TxIn) optionalHashItems() []any {
+	if txi.KeyType != KeyTypeEcdsa {
+		return []any{uint64(txi.SigHashType), uint64(txi.KeyType)}
+	} else if txi.SigHashType != SigHashLegacy {
+		return []any{uint64(txi.SigHashType)}
+	}
+	return []any{}
+}
+
 func (txi TxIn) VSize() uint64 {
-	return txi.Utxo.VSize() + uint64(len(txi.PublicKey)+len(txi.Signature))
+	vSize := txi.Utxo.VSize() + uint64(len(txi.PublicKey)+len(txi.Signature))
+	// 1 each from SigHashType and KeyType, if set
+	if txi.SigHashType != SigHashLegacy {
+		vSize += 1
+	}
+	if txi.KeyType != KeyTypeEcdsa {
+		vSize += 1
+	}
+	return vSize
 }
 
 // A transaction output.
+// If Data is set, this is a provably-unspendable data-carrier output.
 type TxOut struct {
 	Value         uint64 `json:"value"`
 	PublicKeyHash HashT  `json:"publicKeyHash"`
+	Data          []byte `json:"data,omitempty"`
+}
+
+// Create a new data-carrier output holding the given data.
+func NewDataTxOut(data []byte) TxOut {
+	return TxOut{
+		Value:         0,
+		PublicKeyHash: HashT{},
+		Data:          data,
+	}
 }
 
 func (txo TxOut) Hash() HashT {
+	// Only include data if present, so standard output hashes are unchanged
+	if txo.IsData() {
+		return DHashVarious(txo.Value, txo.PublicKeyHash, txo.Data)
+	}
 	return DHashVarious(txo.Value, txo.PublicKeyHash)
 }
 
 func (txo TxOut) VSize() uint64 {
-	// 8 from Value, 32 from PublicKeyHash
-	return uint64(8 + 32)
+	// 8 from Value, 32 from PublicKeyHash, plus any data
+	return uint64(8 + 32 + len(txo.Data))
+}
+
+// Whether this is a data-carrier output, which can never be spent.
+func (txo TxOut) IsData() bool {
+	return len(txo.Data) > 0
 }
 
 // A transaction.
@@ -64,6 +110,28 @@ func (tx Tx) Hash() HashT {
 	)
 }
 
+// Hash the tx without any input signatures.
+func (tx Tx) HashNoSigs() HashT {
+	inputHashes := make([]HashT, len(tx.Inputs))
+	for i, txi := range tx.Inputs {
+		inputHashes[i] = txi.HashNoSig()
+	}
+	return DHashVarious(
+		tx.IsCoinbase, tx.MinBlock, DHashHashes(inputHashes), DHashList(tx.Outputs),
+	)
+}
+
+// Get the id by which this tx's outputs are referenced.
+// Txs with MinBlock at or above params.TxIdUpgradeHeight exclude signatures from their id,
+// so it can't be changed before confirmation. Older txs are identified by their full Hash.
+// The full Hash is always what gets committed in the merkle tree.
+func (tx Tx) Id(params Params) HashT {
+	if tx.MinBlock >= params.TxIdUpgradeHeight {
+		return tx.HashNoSigs()
+	}
+	return tx.Hash()
+}
+
 func (tx Tx) InputsValue() uint64 {
 	total := uint64(0)
 	for _, txi := range tx.Inputs {
@@ -97,6 +165,10 @@ func (tx Tx) Rate() float64 {
 	return (float64(tx.InputsValue()) - float64(tx.OutputsValue())) / float64(tx.VSize())
 }
 
+// How much more fee rate, in coin / vByte, nodes require of a tx than the txs it replaces or
+// the txs last evicted to make room. So also the least a fee bump adds.
+const IncrementalRelayRate = 0.1
+
 // What fees would be paid at the given fee rate.
 func (tx Tx) FeeFromRate(targetFeeRate float64) uint64 {
 	return uint64(targetFeeRate * float64(tx.VSize()))
@@ -114,11 +186,27 @@ func (tx Tx) GetConsumedUtxos() []Utxo {
 	return out
 }
 
+// Get the data held by each of this tx's data-carrier outputs, by output index.
+func (tx Tx) GetDataOutputs() map[uint64][]byte {
+	out := make(map[uint64][]byte)
+	for i, txo := range tx.Outputs {
+		if txo.IsData() {
+			out[uint64(i)] = txo.Data
+		}
+	}
+	return out
+}
+
+// The hash signed by inputs using SigHashLegacy. See TxSigHash for other types.
 func TxHashPreSig(minBlock uint64, outputs []TxOut) HashT {
 	return DHashVarious(minBlock, DHashList(outputs))
 }
 
-func MinNonCoinbaseVSize() uint64 {
+// The smallest possible vSize of a non-coinbase tx in a block at the given height.
+// Its txs have MinBlock at most the height, which determines the smallest public key allowed.
+func MinNonCoinbaseVSize(params Params, height uint64) uint64 {
+	keyType := params.minKeyType(height)
+	pub, _ := ExamplePubAndMaxSig(keyType)
 	return Tx{
 		MinBlock: 0,
 		Inputs: []TxIn{
@@ -128,8 +216,9 @@ func MinNonCoinbaseVSize() uint64 {
 					Ind:   0,
 					Value: 0,
 				},
-				PublicKey: ExamplePubDer(),
+				PublicKey: pub,      // Smallest supported public key
 				Signature: []byte{}, // No lower bound on signature length
+				KeyType:   keyType,
 			},
 		},
 		Outputs: make([]TxOut, 0),
@@ -2,8 +2,10 @@ package core_test
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ecdsa"
 	"encoding/json"
+	"math/big"
 	"testing"
 
 	. "github.com/levilutz/basiccoin/pkg/core"
@@ -128,3 +130,137 @@ func TestTxJson(t *testing.T) {
 	util.Assert(t, bytes.Equal(txJs, txRJs), "serialization not preserved")
 	t.Log(string(txJs))
 }
+
+// Test that data outputs are verified against size and spendability limits.
+func TestTxDataOutputVerify(t *testing.T) {
+	params := DevNetParams()
+	verifier := NewVerifier(params, nil)
+	priv, err := NewEcdsa()
+	util.AssertNoErr(t, err)
+	pubDer, err := MarshalEcdsaPublic(priv)
+	util.AssertNoErr(t, err)
+	makeTx := func(outputs []TxOut) Tx {
+		sig, err := EcdsaSign(priv, TxHashPreSig(0, outputs))
+		util.AssertNoErr(t, err)
+		return Tx{
+			IsCoinbase: false,
+			MinBlock:   0,
+			Inputs: []TxIn{
+				{
+					Utxo:      Utxo{TxId: NewHashTRand(), Ind: 0, Value: 100},
+					PublicKey: pubDer,
+					Signature: sig,
+				},
+			},
+			Outputs: outputs,
+		}
+	}
+
+	// Valid data output
+	tx := makeTx([]TxOut{NewDataTxOut([]byte("hello"))})
+	util.AssertNoErr(t, verifier.VerifyTxIsolated(tx))
+
+	// Data output too large
+	tx = makeTx([]TxOut{NewDataTxOut(make([]byte, params.MaxTxOutDataSize+1))})
+	util.Assert(t, verifier.VerifyTxIsolated(tx) != nil, "oversized data output accepted")
+
+	// Data output carrying value
+	dataOut := NewDataTxOut([]byte("hello"))
+	dataOut.Value = 5
+	tx = makeTx([]TxOut{dataOut})
+	util.Assert(t, verifier.VerifyTxIsolated(tx) != nil, "data output with value accepted")
+
+	// Data changes the output hash, plain outputs keep the original hash
+	plain := TxOut{Value: 5, PublicKeyHash: NewHashTRand()}
+	util.Assert(t, plain.Hash().Eq(DHashVarious(plain.Value, plain.PublicKeyHash)), "plain hash changed")
+	util.Assert(t, !NewDataTxOut([]byte("a")).Hash().Eq(NewDataTxOut([]byte("b")).Hash()), "data not hashed")
+}
+
+// Test that tx ids exclude signatures only from the upgrade height on.
+func TestTxIdUpgrade(t *testing.T) {
+	params := DevNetParams()
+	params.TxIdUpgradeHeight = 100
+	outputs := []TxOut{{Value: 5, PublicKeyHash: NewHashTRand()}}
+	makeTx := func(minBlock uint64, sig []byte) Tx {
+		return Tx{
+			IsCoinbase: false,
+			MinBlock:   minBlock,
+			Inputs: []TxIn{
+				{
+					Utxo:      Utxo{TxId: NewHashTFromBigInt(big.NewInt(1)), Ind: 0, Value: 10},
+					PublicKey: []byte("pubKey"),
+					Signature: sig,
+				},
+			},
+			Outputs: outputs,
+		}
+	}
+
+	// Before the upgrade, the id is the full hash and so changes with the signature
+	tx1 := makeTx(99, []byte("sig1"))
+	tx2 := makeTx(99, []byte("sig2"))
+	util.Assert(t, tx1.Id(params).Eq(tx1.Hash()), "pre-upgrade id should be full hash")
+	util.Assert(t, !tx1.Id(params).Eq(tx2.Id(params)), "pre-upgrade ids should differ")
+
+	// From the upgrade on, the id ignores the signature while the full hash doesn't
+	tx1 = makeTx(100, []byte("sig1"))
+	tx2 = makeTx(100, []byte("sig2"))
+	util.Assert(t, tx1.Id(params).Eq(tx2.Id(params)), "post-upgrade ids should match")
+	util.Assert(t, !tx1.Hash().Eq(tx2.Hash()), "full hashes should differ")
+}
+
+// Test that data outputs, sig hash types, and ed25519 keys are only valid from their upgrade
+// heights on, and that wallets only use them once they are.
+func TestTxFeatureUpgrades(t *testing.T) {
+	params := DevNetParams()
+	params.DataOutputUpgradeHeight = 100
+	params.SigHashUpgradeHeight = 100
+	params.Ed25519UpgradeHeight = 100
+	verifier := NewVerifier(params, nil)
+	makeTx := func(minBlock uint64, priv crypto.Signer, sigHashType SigHashType, data bool) Tx {
+		tx := Tx{
+			MinBlock: minBlock,
+			Inputs:   []TxIn{{Utxo: Utxo{TxId: NewHashTRand(), Ind: 0, Value: 100}}},
+			Outputs:  []TxOut{{Value: 90, PublicKeyHash: NewHashTRand()}},
+		}
+		if data {
+			tx.Outputs = append(tx.Outputs, NewDataTxOut([]byte("anchor")))
+		}
+		util.AssertNoErr(t, SignTxInput(&tx, 0, priv, sigHashType))
+		return tx
+	}
+	ecdsaPriv, err := NewEcdsa()
+	util.AssertNoErr(t, err)
+	edPriv, err := NewEd25519()
+	util.AssertNoErr(t, err)
+
+	// Before the upgrades, only legacy ecdsa txs without data are valid
+	util.AssertNoErr(t, verifier.VerifyTxIsolated(makeTx(99, ecdsaPriv, SigHashLegacy, false)))
+	err = verifier.VerifyTxIsolated(makeTx(99, ecdsaPriv, SigHashAll, false))
+	util.Assert(t, err != nil, "sig hash all accepted before upgrade")
+	err = verifier.VerifyTxIsolated(makeTx(99, edPriv, SigHashLegacy, false))
+	util.Assert(t, err != nil, "ed25519 accepted before upgrade")
+	err = verifier.VerifyTxIsolated(makeTx(99, ecdsaPriv, SigHashLegacy, true))
+	util.Assert(t, err != nil, "data output accepted before upgrade")
+
+	// From the upgrades on, all are valid
+	util.AssertNoErr(t, verifier.VerifyTxIsolated(makeTx(100, ecdsaPriv, SigHashAll, false)))
+	util.AssertNoErr(t, verifier.VerifyTxIsolated(makeTx(100, edPriv, SigHashAll, true)))
+
+	// Wallets sign legacy and refuse the rest before the upgrades
+	pub, err := MarshalPublic(ecdsaPriv)
+	util.AssertNoErr(t, err)
+	utxos := map[Utxo]HashT{{TxId: NewHashTRand(), Ind: 0, Value: 1000}: DHashBytes(pub)}
+	dests := map[HashT]uint64{NewHashTRand(): 100}
+	tx, err := MakeOutboundTx(params, []crypto.Signer{ecdsaPriv}, utxos, dests, 1.0, 99)
+	util.AssertNoErr(t, err)
+	util.Assert(t, tx.Inputs[0].SigHashType == SigHashLegacy, "wallet signed new sig hash type")
+	util.AssertNoErr(t, verifier.VerifyTxIsolated(*tx))
+	_, err = MakeAnchorTx(params, []crypto.Signer{ecdsaPriv}, utxos, []byte("a"), 1.0, 99)
+	util.Assert(t, err != nil, "wallet anchored data before upgrade")
+	edPub, err := MarshalPublic(edPriv)
+	util.AssertNoErr(t, err)
+	edUtxos := map[Utxo]HashT{{TxId: NewHashTRand(), Ind: 0, Value: 1000}: DHashBytes(edPub)}
+	_, err = MakeOutboundTx(params, []crypto.Signer{edPriv}, edUtxos, dests, 1.0, 99)
+	util.Assert(t, err != nil, "wallet spent ed25519 key before upgrade")
+}
@@ -1,8 +1,9 @@
 package core
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"fmt"
+	"math"
 	"sort"
 
 	"github.com/levilutz/basiccoin/pkg/util"
@@ -17,11 +18,57 @@ import (
 // minBlock is the minBlock to put on the tx.
 func MakeOutboundTx(
 	params Params,
-	privateKeys []*ecdsa.PrivateKey,
+	privateKeys []crypto.Signer,
 	utxoPkhs map[Utxo]HashT,
 	dests map[HashT]uint64,
 	targetFeeRate float64,
 	minBlock uint64,
+) (*Tx, error) {
+	outputs := make([]TxOut, 0, len(dests))
+	for pkh, val := range dests {
+		outputs = append(outputs, TxOut{
+			Value:         val,
+			PublicKeyHash: pkh,
+		})
+	}
+	return makeOutboundTx(params, privateKeys, utxoPkhs, outputs, targetFeeRate, minBlock)
+}
+
+// Manufacture a Tx anchoring the given data in a data-carrier output, paying only fees.
+// params is the core Params to use.
+// privateKeys is a list of controlled private keys.
+// utxoPkhs is a mapping of controlled utxos to their corresponding publicKeyHashes.
+// data is the data to anchor, at most params.MaxTxOutDataSize bytes.
+// targetFeeRate is the goal fee rate in coin / vByte.
+// minBlock is the minBlock to put on the tx.
+func MakeAnchorTx(
+	params Params,
+	privateKeys []crypto.Signer,
+	utxoPkhs map[Utxo]HashT,
+	data []byte,
+	targetFeeRate float64,
+	minBlock uint64,
+) (*Tx, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("must provide data to anchor")
+	} else if minBlock < params.DataOutputUpgradeHeight {
+		return nil, fmt.Errorf("data can't be anchored until block %d", params.DataOutputUpgradeHeight)
+	} else if uint64(len(data)) > params.MaxTxOutDataSize {
+		return nil, fmt.Errorf("data exceeds max size: %d > %d", len(data), params.MaxTxOutDataSize)
+	}
+	outputs := []TxOut{NewDataTxOut(data)}
+	return makeOutboundTx(params, privateKeys, utxoPkhs, outputs, targetFeeRate, minBlock)
+}
+
+// Manufacture a Tx paying the given outputs, plus a change output to the wealthiest pkh.
+// The change output is always placed first.
+func makeOutboundTx(
+	params Params,
+	privateKeys []crypto.Signer,
+	utxoPkhs map[Utxo]HashT,
+	outputs []TxOut,
+	targetFeeRate float64,
+	minBlock uint64,
 ) (*Tx, error) {
 	// Make mapping from pkh to private keys
 	pkhPrivs, err := getPkkPrivs(privateKeys)
@@ -37,8 +84,8 @@ func MakeOutboundTx(
 
 	// Get total outputs and verify <= utxos
 	totalOut := uint64(0)
-	for _, val := range dests {
-		totalOut += val
+	for _, txo := range outputs {
+		totalOut += txo.Value
 	}
 	if totalOut >= balance {
 		return nil, fmt.Errorf("insufficient balance: %d < %d", balance, totalOut)
@@ -56,7 +103,7 @@ func MakeOutboundTx(
 		IsCoinbase: false,
 		MinBlock:   minBlock,
 		Inputs:     []TxIn{},
-		Outputs:    make([]TxOut, len(dests)+1),
+		Outputs:    make([]TxOut, len(outputs)+1),
 	}
 
 	// Add placeholder change output, going to wealthiest controlled pkh
@@ -66,26 +113,19 @@ func MakeOutboundTx(
 	}
 
 	// Add normal outputs
-	i := 1
-	for pkh, val := range dests {
-		tx.Outputs[i] = TxOut{
-			Value:         val,
-			PublicKeyHash: pkh,
-		}
-		i++
-	}
+	copy(tx.Outputs[1:], outputs)
 
 	// Add utxos, starting with the wealthiest, until we reach target input
-	// Only using placeholder sigs, since preSigHash will change when we set change output value.
+	// Only using placeholder sigs, since the sig hash will change when we set change output value.
 	totalIn := uint64(0)
 	for i, utxo := range utxos {
 		// Add the input
 		totalIn += utxo.Value
-		tx.Inputs = append(tx.Inputs, TxIn{
-			Utxo:      utxo,
-			PublicKey: ExamplePubDer(),
-			Signature: ExampleMaxSigAsn(),
-		})
+		txIn, err := placeholderInput(params, utxo, pkhPrivs[utxoPkhs[utxo]], minBlock)
+		if err != nil {
+			return nil, err
+		}
+		tx.Inputs = append(tx.Inputs, txIn)
 
 		// Check if we just can't make a tx that fits within vSize limit
 		if tx.VSize() > params.MaxTxVSize {
@@ -109,25 +149,17 @@ func MakeOutboundTx(
 
 	// Set the change output
 	// Ideally we would do this after replacing sigs bc vSize and thus fee would decrease
-	// But unfortunately we need this output finalized so we can compute preSigHash
+	// But unfortunately we need this output finalized so we can compute the sig hash
 	// Thus we will on average overestimate vSize by ~1 vByte per output (<1% fee diff)
 	tx.Outputs[0].Value = totalIn - totalOut - tx.FeeFromRate(targetFeeRate)
 
 	// Sign the inputs, replacing placeholders
-	preSigHash := TxHashPreSig(tx.MinBlock, tx.Outputs)
 	for i := range tx.Inputs {
 		utxo := utxos[i] // Don't range utxos as it's usually longer than tx.Inputs
 		priv := pkhPrivs[utxoPkhs[utxo]]
-		pub, err := MarshalEcdsaPublic(priv)
-		if err != nil {
-			return nil, err
-		}
-		sig, err := EcdsaSign(priv, preSigHash)
-		if err != nil {
+		if err := SignTxInput(&tx, i, priv, tx.Inputs[i].SigHashType); err != nil {
 			return nil, err
 		}
-		tx.Inputs[i].PublicKey = pub
-		tx.Inputs[i].Signature = sig
 	}
 
 	return &tx, nil
@@ -141,7 +173,7 @@ func MakeOutboundTx(
 // minBlock is the minBlock to put on the tx.
 func MakeConsolidateTx(
 	params Params,
-	privateKeys []*ecdsa.PrivateKey,
+	privateKeys []crypto.Signer,
 	utxoPkhs map[Utxo]HashT,
 	targetFeeRate float64,
 	minBlock uint64,
@@ -188,10 +220,9 @@ func MakeConsolidateTx(
 	// Add utxos until we reach max size
 	totalIn := uint64(0)
 	for _, utxo := range utxos {
-		txIn := TxIn{
-			Utxo:      utxo,
-			PublicKey: ExamplePubDer(),
-			Signature: ExampleMaxSigAsn(),
+		txIn, err := placeholderInput(params, utxo, pkhPrivs[utxoPkhs[utxo]], minBlock)
+		if err != nil {
+			return nil, err
 		}
 		if tx.VSize()+txIn.VSize() > params.MaxTxVSize {
 			break
@@ -204,30 +235,169 @@ func MakeConsolidateTx(
 	tx.Outputs[0].Value = totalIn - tx.FeeFromRate(targetFeeRate)
 
 	// Sign the inputs, replacing placeholders
-	preSigHash := TxHashPreSig(tx.MinBlock, tx.Outputs)
 	for i := range tx.Inputs {
 		utxo := utxos[i] // Don't range utxos as it's usually longer than tx.Inputs
 		priv := pkhPrivs[utxoPkhs[utxo]]
-		pub, err := MarshalEcdsaPublic(priv)
-		if err != nil {
+		if err := SignTxInput(&tx, i, priv, tx.Inputs[i].SigHashType); err != nil {
 			return nil, err
 		}
-		sig, err := EcdsaSign(priv, preSigHash)
-		if err != nil {
+	}
+
+	return &tx, nil
+}
+
+// Manufacture a Tx replacing the given unconfirmed tx at a higher fee rate, spending the same
+// inputs to the same outputs, and taking the extra fee from its change.
+// privateKeys is a list of controlled private keys, which must control every input.
+// tx is the tx to replace, whose first output paying a controlled pkh is taken as its change.
+// targetFeeRate is the goal fee rate in coin / vByte, which must exceed the tx's fee rate. At
+// least IncrementalRelayRate more is paid, as nodes require of replacements.
+func MakeBumpFeeTx(privateKeys []crypto.Signer, tx Tx, targetFeeRate float64) (*Tx, error) {
+	if tx.IsCoinbase || !tx.HasSurplus() {
+		return nil, fmt.Errorf("can only bump the fee of a tx already paying one")
+	} else if targetFeeRate <= tx.Rate() {
+		return nil, fmt.Errorf("target fee rate must exceed current rate %.3f", tx.Rate())
+	}
+
+	// Make mapping from pkh to private keys
+	pkhPrivs, err := getPkkPrivs(privateKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy the tx, with placeholder sigs, checking each input is controlled
+	bumped := Tx{
+		IsCoinbase: false,
+		MinBlock:   tx.MinBlock,
+		Inputs:     make([]TxIn, len(tx.Inputs)),
+		Outputs:    make([]TxOut, len(tx.Outputs)),
+	}
+	privs := make([]crypto.Signer, len(tx.Inputs))
+	for i, txi := range tx.Inputs {
+		priv, ok := pkhPrivs[DHashBytes(txi.PublicKey)]
+		if !ok {
+			return nil, fmt.Errorf("input %d not controlled by private keys", i)
+		}
+		privs[i] = priv
+		pub, sig := ExamplePubAndMaxSig(txi.KeyType)
+		bumped.Inputs[i] = TxIn{
+			Utxo:        txi.Utxo,
+			PublicKey:   pub,
+			Signature:   sig,
+			SigHashType: txi.SigHashType,
+			KeyType:     txi.KeyType,
+		}
+	}
+	copy(bumped.Outputs, tx.Outputs)
+
+	// Find the change output
+	changeInd := -1
+	for i, txo := range bumped.Outputs {
+		if _, ok := pkhPrivs[txo.PublicKeyHash]; ok && !txo.IsData() {
+			changeInd = i
+			break
+		}
+	}
+	if changeInd == -1 {
+		return nil, fmt.Errorf("tx has no change output to pay a higher fee from")
+	}
+
+	// Take the new fee from the change, paying at least the incremental rate more than before
+	oldFee := tx.InputsValue() - tx.OutputsValue()
+	newFee := bumped.FeeFromRate(targetFeeRate)
+	minFee := oldFee + uint64(math.Ceil(IncrementalRelayRate*float64(bumped.VSize())))
+	if newFee < minFee {
+		newFee = minFee
+	}
+	change := bumped.Outputs[changeInd].Value
+	if newFee-oldFee >= change {
+		return nil, fmt.Errorf("insufficient change to pay fee - %d < %d", change, newFee-oldFee)
+	}
+	bumped.Outputs[changeInd].Value = change - (newFee - oldFee)
+
+	// Sign the inputs, replacing placeholders
+	for i := range bumped.Inputs {
+		if err := SignTxInput(&bumped, i, privs[i], bumped.Inputs[i].SigHashType); err != nil {
 			return nil, err
 		}
-		tx.Inputs[i].PublicKey = pub
-		tx.Inputs[i].Signature = sig
 	}
 
-	return &tx, nil
+	return &bumped, nil
+}
+
+// Sign the input at the given index of a tx, committing to the parts given by sigHashType.
+// Sets the input's PublicKey, SigHashType, KeyType, and Signature.
+// Any parts of the tx committed to must be finalized before signing.
+func SignTxInput(tx *Tx, inputInd int, priv crypto.Signer, sigHashType SigHashType) error {
+	if inputInd < 0 || inputInd >= len(tx.Inputs) {
+		return fmt.Errorf("input index out of range: %d", inputInd)
+	}
+	keyType, err := KeyTypeOf(priv)
+	if err != nil {
+		return err
+	}
+	pub, err := MarshalPublic(priv)
+	if err != nil {
+		return err
+	}
+	tx.Inputs[inputInd].SigHashType = sigHashType
+	tx.Inputs[inputInd].KeyType = keyType
+	sigHash, err := TxSigHash(*tx, inputInd)
+	if err != nil {
+		return err
+	}
+	sig, err := Sign(priv, sigHash)
+	if err != nil {
+		return err
+	}
+	tx.Inputs[inputInd].PublicKey = pub
+	tx.Inputs[inputInd].Signature = sig
+	return nil
+}
+
+// Add an input spending the given utxo to a partially-signed tx, and sign it.
+// The input commits only to itself, so others can keep adding inputs (e.g. to crowdfund outputs).
+// If single is set, it also commits only to the output at the same index as the new input.
+func AddSignedInput(tx *Tx, utxo Utxo, priv crypto.Signer, single bool) error {
+	sigHashType := SigHashAll | SigHashAnyoneCanPay
+	if single {
+		sigHashType = SigHashSingle | SigHashAnyoneCanPay
+	}
+	tx.Inputs = append(tx.Inputs, TxIn{Utxo: utxo})
+	if err := SignTxInput(tx, len(tx.Inputs)-1, priv, sigHashType); err != nil {
+		tx.Inputs = tx.Inputs[:len(tx.Inputs)-1]
+		return err
+	}
+	return nil
+}
+
+// Make an input spending the given utxo with placeholder public key and signature of max size,
+// to be signed with the default sig hash type at the given MinBlock.
+// Errors if the key's type isn't enabled at that MinBlock.
+func placeholderInput(params Params, utxo Utxo, priv crypto.Signer, minBlock uint64) (TxIn, error) {
+	keyType, err := KeyTypeOf(priv)
+	if err != nil {
+		return TxIn{}, err
+	} else if keyType == KeyTypeEd25519 && minBlock < params.Ed25519UpgradeHeight {
+		return TxIn{}, fmt.Errorf(
+			"ed25519 keys can't be spent from until block %d", params.Ed25519UpgradeHeight,
+		)
+	}
+	pub, sig := ExamplePubAndMaxSig(keyType)
+	return TxIn{
+		Utxo:        utxo,
+		PublicKey:   pub,
+		Signature:   sig,
+		SigHashType: params.DefaultSigHashType(minBlock),
+		KeyType:     keyType,
+	}, nil
 }
 
 // Given private keys, make a mapping from their public key hashes to each private key.
-func getPkkPrivs(privateKeys []*ecdsa.PrivateKey) (map[HashT]*ecdsa.PrivateKey, error) {
-	out := make(map[HashT]*ecdsa.PrivateKey, len(privateKeys))
+func getPkkPrivs(privateKeys []crypto.Signer) (map[HashT]crypto.Signer, error) {
+	out := make(map[HashT]crypto.Signer, len(privateKeys))
 	for _, priv := range privateKeys {
-		pub, err := MarshalEcdsaPublic(priv)
+		pub, err := MarshalPublic(priv)
 		if err != nil {
 			return nil, err
 		}
@@ -238,7 +408,7 @@ func getPkkPrivs(privateKeys []*ecdsa.PrivateKey) (map[HashT]*ecdsa.PrivateKey,
 
 // Get total balance, the pkh with the highest balance, and verify each pkh exists in given pkhPrivs.
 func getBalanceAndRichestPkh(
-	utxoPkhs map[Utxo]HashT, pkhPrivs map[HashT]*ecdsa.PrivateKey,
+	utxoPkhs map[Utxo]HashT, pkhPrivs map[HashT]crypto.Signer,
 ) (uint64, HashT, error) {
 	balance := uint64(0)
 	pkhBalances := make(map[HashT]uint64)
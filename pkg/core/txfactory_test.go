@@ -0,0 +1,42 @@
+package core_test
+
+import (
+	"crypto"
+	"testing"
+
+	. "github.com/levilutz/basiccoin/pkg/core"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+// Test that bumping a tx's fee keeps its inputs and payments, paying the fee from its change.
+func TestMakeBumpFeeTx(t *testing.T) {
+	params := DevNetParams()
+	verifier := NewVerifier(params, nil)
+	priv, err := NewEcdsa()
+	util.AssertNoErr(t, err)
+	pub, err := MarshalPublic(priv)
+	util.AssertNoErr(t, err)
+	utxos := map[Utxo]HashT{{TxId: NewHashTRand(), Ind: 0, Value: 100000}: DHashBytes(pub)}
+	dest := NewHashTRand()
+	tx, err := MakeOutboundTx(params, []crypto.Signer{priv}, utxos, map[HashT]uint64{dest: 5000}, 1.0, 10)
+	util.AssertNoErr(t, err)
+
+	bumped, err := MakeBumpFeeTx([]crypto.Signer{priv}, *tx, 3.0)
+	util.AssertNoErr(t, err)
+	util.AssertNoErr(t, verifier.VerifyTxIsolated(*bumped))
+	util.Assert(t, bumped.Rate() >= 3.0 && bumped.Rate() > tx.Rate(), "rate not bumped: %f", bumped.Rate())
+	util.Assert(t, bumped.Inputs[0].Utxo == tx.Inputs[0].Utxo, "inputs changed")
+	util.Assert(t, bumped.Outputs[1].Hash() == tx.Outputs[1].Hash(), "payment changed")
+	util.Assert(t, bumped.Outputs[0].Value < tx.Outputs[0].Value, "change not reduced")
+	util.Assert(t, bumped.MinBlock == tx.MinBlock, "min block changed")
+
+	// The fee rate must rise, and the inputs must be controlled
+	_, err = MakeBumpFeeTx([]crypto.Signer{priv}, *tx, tx.Rate())
+	util.Assert(t, err != nil, "bumped to the same rate")
+	other, err := NewEcdsa()
+	util.AssertNoErr(t, err)
+	_, err = MakeBumpFeeTx([]crypto.Signer{other}, *tx, 3.0)
+	util.Assert(t, err != nil, "bumped without controlling inputs")
+	_, err = MakeBumpFeeTx([]crypto.Signer{priv}, *tx, 1000.0)
+	util.Assert(t, err != nil, "bumped beyond change")
+}
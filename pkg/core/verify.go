@@ -29,6 +29,7 @@ type InvVerifier interface {
 type Verifier struct {
 	params Params
 	inv    InvVerifier
+	sigs   *SigVerifier
 }
 
 // Create a new Verifier.
@@ -36,9 +37,25 @@ func NewVerifier(params Params, inv InvVerifier) *Verifier {
 	return &Verifier{
 		params: params,
 		inv:    inv,
+		sigs:   NewSigVerifier(0, DefaultSigCacheSize),
 	}
 }
 
+// Get a verifier by the same rules and signature cache, reading entities from the given inv.
+func (v Verifier) WithInv(inv InvVerifier) *Verifier {
+	return &Verifier{
+		params: v.params,
+		inv:    inv,
+		sigs:   v.sigs,
+	}
+}
+
+// Verify the input signatures of many txs in parallel, caching those that are valid.
+// Later verification of these txs then skips their signatures.
+func (v Verifier) VerifyTxsSigs(txs []Tx) error {
+	return v.sigs.VerifyTxsSigs(txs)
+}
+
 // Verify a tx.
 func (v Verifier) VerifyTx(tx Tx) error {
 	if err := v.VerifyTxIsolated(tx); err != nil {
@@ -51,6 +68,9 @@ func (v Verifier) VerifyTx(tx Tx) error {
 			return fmt.Errorf("failed to find utxo %s[%d]", txi.Utxo.TxId, txi.Utxo.Ind)
 		}
 		origin := v.inv.GetTxOut(txi.Utxo.TxId, txi.Utxo.Ind)
+		if origin.IsData() {
+			return fmt.Errorf("cannot spend data output %s[%d]", txi.Utxo.TxId, txi.Utxo.Ind)
+		}
 		if !DHashBytes(txi.PublicKey).Eq(origin.PublicKeyHash) {
 			return fmt.Errorf("given public key does not match claimed utxo")
 		}
@@ -115,11 +135,11 @@ func (v Verifier) VerifyBlock(b Block) error {
 	txs := v.inv.GetMerkleTxs(b.MerkleRoot)
 	if len(txs) == 0 {
 		return fmt.Errorf("new block has no txs")
-	} else if len(txs) > int(BlockMaxTxs(v.params)) {
-		return fmt.Errorf("new block has too many txs")
 	}
-
 	newBlockHeight := v.inv.GetBlockHeight(b.PrevBlockId) + 1
+	if len(txs) > int(BlockMaxTxs(v.params, newBlockHeight)) {
+		return fmt.Errorf("new block has too many txs")
+	}
 
 	// Verify coinbase MinBlock is this block's height
 	if txs[0].MinBlock != newBlockHeight {
@@ -235,18 +255,42 @@ func (v Verifier) VerifyBlock(b Block) error {
 
 // Verify what we can about this transaction in isolation.
 func (v Verifier) VerifyTxIsolated(tx Tx) error {
-	// Verify input signatures match outputs
-	preSigHash := TxHashPreSig(tx.MinBlock, tx.Outputs)
+	// Verify within vSize limit
+	if tx.VSize() > v.params.MaxTxVSize {
+		return fmt.Errorf("tx vSize exceeds limit")
+	}
+
+	// Verify inputs only use the sig hash and key types enabled by MinBlock
 	for _, txi := range tx.Inputs {
-		valid, err := EcdsaVerify(txi.PublicKey, preSigHash, txi.Signature)
-		if err != nil || !valid {
-			return fmt.Errorf("tx signature invalid")
+		if txi.SigHashType != SigHashLegacy && tx.MinBlock < v.params.SigHashUpgradeHeight {
+			return fmt.Errorf(
+				"sig hash types other than legacy require MinBlock %d", v.params.SigHashUpgradeHeight,
+			)
+		}
+		if txi.KeyType != KeyTypeEcdsa && tx.MinBlock < v.params.Ed25519UpgradeHeight {
+			return fmt.Errorf("ed25519 keys require MinBlock %d", v.params.Ed25519UpgradeHeight)
 		}
 	}
 
-	// Verify within vSize limit
-	if tx.VSize() > v.params.MaxTxVSize {
-		return fmt.Errorf("tx vSize exceeds limit")
+	// Verify data outputs are enabled, within size limit, and provably unspendable
+	for _, txo := range tx.Outputs {
+		if !txo.IsData() {
+			continue
+		}
+		if tx.MinBlock < v.params.DataOutputUpgradeHeight {
+			return fmt.Errorf("data outputs require MinBlock %d", v.params.DataOutputUpgradeHeight)
+		}
+		if uint64(len(txo.Data)) > v.params.MaxTxOutDataSize {
+			return fmt.Errorf("data output exceeds size limit")
+		}
+		if txo.Value != 0 || !txo.PublicKeyHash.EqZero() {
+			return fmt.Errorf("data output cannot have value or public key hash")
+		}
+	}
+
+	// Verify input signatures match what their sig hash types commit to
+	if err := v.sigs.VerifyTxSigs(tx); err != nil {
+		return err
 	}
 
 	if tx.IsCoinbase {
@@ -260,6 +304,11 @@ func (v Verifier) VerifyTxIsolated(tx Tx) error {
 			return fmt.Errorf("coinbase must have 1 output")
 		}
 
+		// Verify coinbase output isn't data
+		if tx.Outputs[0].IsData() {
+			return fmt.Errorf("coinbase output cannot be data")
+		}
+
 		// Verify coinbase has at least the minimum block reward
 		if tx.OutputsValue() < v.params.BlockReward {
 			return fmt.Errorf("coinbase has insufficient block reward")
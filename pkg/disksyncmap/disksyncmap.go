@@ -3,95 +3,258 @@ package disksyncmap
 import (
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 
-	"github.com/levilutz/basiccoin/pkg/syncmap"
+	"github.com/levilutz/basiccoin/pkg/lru"
+	"github.com/levilutz/basiccoin/pkg/util"
 )
 
+// Prefix of the checksum line at the start of each record file.
+// Files without it predate checksums, and are only validated by parsing.
+const checksumPrefix = "#crc32:"
+
 type comparableStringer interface {
 	comparable
 	fmt.Stringer
 }
 
-// A sync map backed by disk.
+// A sync map backed by disk, caching recently used entries in memory.
+// Stored records aren't durable until Sync, so many can be synced at once.
 type DiskSyncMap[K comparableStringer, V fmt.Stringer] struct {
-	m         *syncmap.SyncMap[K, V]
+	cache     *lru.Cache[K, V]
 	basePath  string
 	parseFunc func(raw string) (v V, err error)
+	// Paths of records written since the last Sync
+	unsyncedMu sync.Mutex
+	unsynced   map[string]struct{}
 }
 
-// Create a new disk-backed sync map.
+// Create a new disk-backed sync map, caching every loaded entry.
 func NewDiskSyncMap[K comparableStringer, V fmt.Stringer](
 	basePath string,
 	parseFunc func(raw string) (v V, err error),
+) *DiskSyncMap[K, V] {
+	return NewDiskSyncMapWithBudget[K, V](basePath, parseFunc, 0)
+}
+
+// Create a new disk-backed sync map, caching up to maxBytes of serialized entries in memory.
+// A non-positive budget caches every loaded entry.
+func NewDiskSyncMapWithBudget[K comparableStringer, V fmt.Stringer](
+	basePath string,
+	parseFunc func(raw string) (v V, err error),
+	maxBytes int64,
 ) *DiskSyncMap[K, V] {
 	if err := os.MkdirAll(basePath, 0750); err != nil {
 		panic(fmt.Sprintf("failed to make DiskSyncMap dir: %s", err))
 	}
 	return &DiskSyncMap[K, V]{
-		m:         syncmap.NewSyncMap[K, V](),
+		cache:     lru.NewCache[K, V](maxBytes),
 		basePath:  basePath,
 		parseFunc: parseFunc,
+		unsynced:  make(map[string]struct{}),
 	}
 }
 
 // Check whether the given key exists in the disk-backend sync map.
 func (dsm *DiskSyncMap[K, V]) Has(key K) bool {
-	if dsm.m.Has(key) {
+	if dsm.cache.Has(key) {
 		return true
 	}
-	return dsm.tryLoadKeyFromDisk(key)
+	return dsm.fileExists(dsm.keyPath(key))
 }
 
 // Retrieve the given key from the disk map.
 func (dsm *DiskSyncMap[K, V]) Get(key K) V {
-	exists := dsm.tryLoadKeyFromDisk(key)
-	if !exists {
+	if val, ok := dsm.cache.Get(key); ok {
+		return val
+	}
+	val, size, err := dsm.loadFile(dsm.keyPath(key))
+	if err != nil {
 		panic(fmt.Sprintf("attempted to load unknown key: %s", key))
 	}
-	return dsm.m.Get(key)
+	dsm.cache.Add(key, val, size)
+	return val
 }
 
-// Store the given key to the map and disk.
+// Store the given key to the map and disk. A crash before the next Sync may lose or truncate
+// the record, which its checksum then catches.
 func (dsm *DiskSyncMap[K, V]) Store(key K, val V) {
-	dsm.m.Store(key, val)
-	if err := dsm.saveFile(dsm.keyPath(key), val); err != nil {
-		fmt.Printf("failed to save file %s: %s\n", dsm.keyPath(key), err)
+	raw := val.String()
+	dsm.cache.Add(key, val, int64(len(raw)))
+	path := dsm.keyPath(key)
+	if err := util.WriteFileRenamed(path, encodeRecord(raw), 0666); err != nil {
+		fmt.Printf("failed to save file %s: %s\n", path, err)
+		return
 	}
+	dsm.unsyncedMu.Lock()
+	dsm.unsynced[path] = struct{}{}
+	dsm.unsyncedMu.Unlock()
 }
 
-// Load the key from files into the sync map if not present, return whether it exists.
-func (dsm *DiskSyncMap[K, V]) tryLoadKeyFromDisk(key K) bool {
-	if dsm.m.Has(key) {
-		return true
+// Fsync every record stored since the last Sync, then their dir once.
+func (dsm *DiskSyncMap[K, V]) Sync() error {
+	dsm.unsyncedMu.Lock()
+	defer dsm.unsyncedMu.Unlock()
+	if len(dsm.unsynced) == 0 {
+		return nil
+	}
+	paths := make([]string, 0, len(dsm.unsynced))
+	for path := range dsm.unsynced {
+		paths = append(paths, path)
+	}
+	if err := util.SyncPaths(paths); err != nil {
+		return err
 	}
-	val, err := dsm.loadFile(dsm.keyPath(key))
+	// Sync the dir so the renames are durable, where dirs can be synced
+	util.SyncPaths([]string{dsm.basePath})
+	dsm.unsynced = make(map[string]struct{})
+	return nil
+}
+
+// Check every record on disk, moving any that are corrupt to the quarantine dir.
+// Also removes temp files left behind by interrupted writes.
+// Returns the names of the quarantined records.
+func (dsm *DiskSyncMap[K, V]) Recover() ([]string, error) {
+	entries, err := os.ReadDir(dsm.basePath)
 	if err != nil {
-		return false
+		return nil, err
 	}
-	dsm.m.Store(key, val)
-	return true
+	quarantined := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		path := dsm.basePath + "/" + entry.Name()
+		if strings.HasPrefix(entry.Name(), util.TempFilePrefix) {
+			if err := os.Remove(path); err != nil {
+				return quarantined, err
+			}
+			continue
+		}
+		if _, _, err := dsm.loadFile(path); err != nil {
+			quarantined = append(quarantined, entry.Name())
+		}
+	}
+	return quarantined, nil
 }
 
-// Write to the given file on disk.
-func (dsm *DiskSyncMap[K, V]) saveFile(path string, val V) error {
-	return os.WriteFile(path, []byte(val.String()), 0666)
+// Walk every record on disk in name order, passing its key, its raw serialized value, and any
+// error reading or checksumming it, without parsing or caching it. Stops if fn returns false.
+func (dsm *DiskSyncMap[K, V]) IterateRaw(fn func(key string, raw string, err error) bool) error {
+	return dsm.IterateRawAfter("", fn)
 }
 
-// Load the given file from disk and parse.
-func (dsm *DiskSyncMap[K, V]) loadFile(path string) (val V, err error) {
+// Walk the records on disk like IterateRaw, but only those named after the given key, so a
+// walk can be resumed after the last key it saw.
+func (dsm *DiskSyncMap[K, V]) IterateRawAfter(
+	after string, fn func(key string, raw string, err error) bool,
+) error {
+	entries, err := os.ReadDir(dsm.basePath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), util.TempFilePrefix) {
+			continue
+		} else if entry.Name() <= after {
+			continue
+		}
+		raw := ""
+		rawFile, err := os.ReadFile(dsm.basePath + "/" + entry.Name())
+		if err == nil {
+			raw, err = decodeRecord(string(rawFile))
+		}
+		if !fn(entry.Name(), raw, err) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Delete the given key from the map and disk, if it exists.
+func (dsm *DiskSyncMap[K, V]) Delete(key K) {
+	dsm.cache.Remove(key)
+	if err := os.Remove(dsm.keyPath(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("failed to delete file %s: %s\n", dsm.keyPath(key), err)
+	}
+}
+
+// Keep the given key in memory once loaded, regardless of the cache budget.
+func (dsm *DiskSyncMap[K, V]) Pin(key K) {
+	dsm.cache.Pin(key)
+}
+
+// Allow the given key to be evicted from memory again.
+func (dsm *DiskSyncMap[K, V]) Unpin(key K) {
+	dsm.cache.Unpin(key)
+}
+
+// Get the in-memory cache's stats.
+func (dsm *DiskSyncMap[K, V]) CacheStats() lru.Stats {
+	return dsm.cache.Stats()
+}
+
+// Load the given file from disk and parse, also returning its size.
+func (dsm *DiskSyncMap[K, V]) loadFile(path string) (val V, size int64, err error) {
 	if !dsm.fileExists(path) {
-		return val, fmt.Errorf("file does not exist: %s", path)
+		return val, 0, fmt.Errorf("file does not exist: %s", path)
 	}
-	raw, err := os.ReadFile(path)
+	rawFile, err := os.ReadFile(path)
 	if err != nil {
-		return val, fmt.Errorf("failed to read %s: %s", path, err)
+		return val, 0, fmt.Errorf("failed to read %s: %s", path, err)
+	}
+	raw, err := decodeRecord(string(rawFile))
+	if err == nil {
+		val, err = dsm.parseFunc(raw)
 	}
-	val, err = dsm.parseFunc(string(raw))
 	if err != nil {
-		return val, fmt.Errorf("failed to parse %s: %s", path, err)
+		dsm.quarantine(path)
+		return val, 0, fmt.Errorf("corrupt record %s: %s", path, err)
+	}
+	return val, int64(len(raw)), nil
+}
+
+// Move a corrupt record out of the map, so it reads as missing and may be refetched.
+func (dsm *DiskSyncMap[K, V]) quarantine(path string) {
+	quarantineDir := dsm.basePath + ".quarantine"
+	if err := os.MkdirAll(quarantineDir, 0750); err != nil {
+		fmt.Printf("failed to make quarantine dir: %s\n", err)
+		return
+	}
+	dest := quarantineDir + "/" + path[strings.LastIndex(path, "/")+1:]
+	if err := os.Rename(path, dest); err != nil {
+		fmt.Printf("failed to quarantine %s: %s\n", path, err)
+		return
+	}
+	fmt.Printf("quarantined corrupt record %s\n", path)
+}
+
+// Prepend a checksum line to a record's contents.
+func encodeRecord(raw string) []byte {
+	return []byte(fmt.Sprintf("%s%08x\n%s", checksumPrefix, crc32.ChecksumIEEE([]byte(raw)), raw))
+}
+
+// Strip and verify a record's checksum line, if it has one.
+func decodeRecord(rawFile string) (string, error) {
+	if !strings.HasPrefix(rawFile, checksumPrefix) {
+		return rawFile, nil
+	}
+	header, raw, ok := strings.Cut(rawFile, "\n")
+	if !ok {
+		return "", fmt.Errorf("truncated checksum line")
+	}
+	expected, err := strconv.ParseUint(header[len(checksumPrefix):], 16, 32)
+	if err != nil {
+		return "", fmt.Errorf("malformed checksum: %s", err)
+	}
+	if crc32.ChecksumIEEE([]byte(raw)) != uint32(expected) {
+		return "", fmt.Errorf("checksum mismatch")
 	}
-	return val, nil
+	return raw, nil
 }
 
 // Check whether the given file exists on disk.
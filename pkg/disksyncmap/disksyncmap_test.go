@@ -0,0 +1,50 @@
+package disksyncmap_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/levilutz/basiccoin/pkg/disksyncmap"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+type strKey string
+
+func (k strKey) String() string { return string(k) }
+
+type strVal string
+
+func (v strVal) String() string { return string(v) }
+
+func parseStrVal(raw string) (strVal, error) { return strVal(raw), nil }
+
+// Test that corrupt records and leftover temp files are cleaned up by recovery.
+func TestDiskSyncMapRecover(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "map")
+	dsm := NewDiskSyncMap[strKey, strVal](dir, parseStrVal)
+	dsm.Store("good", "hello")
+	dsm.Store("bad", "world")
+	util.AssertNoErr(t, os.WriteFile(filepath.Join(dir, "legacy"), []byte("old"), 0666))
+	util.AssertNoErr(t, os.WriteFile(filepath.Join(dir, util.TempFilePrefix+"x"), nil, 0666))
+
+	// Flip a byte of one record's contents
+	badPath := filepath.Join(dir, "bad")
+	raw, err := os.ReadFile(badPath)
+	util.AssertNoErr(t, err)
+	raw[len(raw)-1] ^= 0xff
+	util.AssertNoErr(t, os.WriteFile(badPath, raw, 0666))
+
+	dsm = NewDiskSyncMap[strKey, strVal](dir, parseStrVal)
+	quarantined, err := dsm.Recover()
+	util.AssertNoErr(t, err)
+	util.Assert(t, len(quarantined) == 1 && quarantined[0] == "bad", "wrong quarantined %v", quarantined)
+	util.Assert(t, !dsm.Has("bad"), "corrupt record still present")
+	util.Assert(t, dsm.Get("good") == "hello", "good record lost")
+	util.Assert(t, dsm.Get("legacy") == "old", "legacy record without checksum lost")
+	_, err = os.Stat(filepath.Join(dir+".quarantine", "bad"))
+	util.AssertNoErr(t, err)
+	entries, err := os.ReadDir(dir)
+	util.AssertNoErr(t, err)
+	util.Assert(t, len(entries) == 2, "temp file not removed: %d entries", len(entries))
+}
@@ -0,0 +1,146 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+type opType byte
+
+const (
+	opPut    opType = 1
+	opDelete opType = 2
+)
+
+type batchOp struct {
+	op  opType
+	key string
+	val []byte
+}
+
+// A set of writes to be applied to a Store atomically.
+// Not safe for concurrent use.
+type Batch struct {
+	ops     []batchOp
+	pending map[string]int
+}
+
+// Create a new empty batch.
+func NewBatch() *Batch {
+	return &Batch{
+		ops:     make([]batchOp, 0),
+		pending: make(map[string]int),
+	}
+}
+
+// Set the given key to the given value when the batch is written.
+func (b *Batch) Put(key []byte, val []byte) {
+	b.add(batchOp{op: opPut, key: string(key), val: append([]byte{}, val...)})
+}
+
+// Delete the given key when the batch is written.
+func (b *Batch) Delete(key []byte) {
+	b.add(batchOp{op: opDelete, key: string(key)})
+}
+
+// Number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Discard all writes in the batch.
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+	b.pending = make(map[string]int)
+}
+
+// Look up a key's pending write in this batch.
+// Returns the value, whether it's deleted, and whether the batch writes this key at all.
+func (b *Batch) Lookup(key []byte) (val []byte, deleted bool, ok bool) {
+	ind, ok := b.pending[string(key)]
+	if !ok {
+		return nil, false, false
+	}
+	op := b.ops[ind]
+	return op.val, op.op == opDelete, true
+}
+
+func (b *Batch) add(op batchOp) {
+	b.pending[op.key] = len(b.ops)
+	b.ops = append(b.ops, op)
+}
+
+// Encode the batch, also returning the offset of each op's value within the encoding.
+// Layout: uvarint op count, then per op: op type, uvarint key len, key, uvarint val len, val.
+func (b *Batch) encode() ([]byte, []int) {
+	out := binary.AppendUvarint(nil, uint64(len(b.ops)))
+	valOffsets := make([]int, len(b.ops))
+	for i, op := range b.ops {
+		out = append(out, byte(op.op))
+		out = binary.AppendUvarint(out, uint64(len(op.key)))
+		out = append(out, op.key...)
+		out = binary.AppendUvarint(out, uint64(len(op.val)))
+		valOffsets[i] = len(out)
+		out = append(out, op.val...)
+	}
+	return out, valOffsets
+}
+
+// Decode a batch, also returning the offset of each op's value within the encoding.
+func decodeBatch(raw []byte) (*Batch, []int, error) {
+	b := NewBatch()
+	pos := 0
+	readUvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(raw[pos:])
+		if n <= 0 {
+			return 0, fmt.Errorf("malformed uvarint at %d", pos)
+		}
+		pos += n
+		return v, nil
+	}
+	readBytes := func(n uint64) ([]byte, error) {
+		if n > uint64(len(raw)-pos) {
+			return nil, fmt.Errorf("truncated batch at %d", pos)
+		}
+		out := raw[pos : pos+int(n)]
+		pos += int(n)
+		return out, nil
+	}
+	count, err := readUvarint()
+	if err != nil {
+		return nil, nil, err
+	}
+	valOffsets := make([]int, 0)
+	for i := uint64(0); i < count; i++ {
+		opRaw, err := readBytes(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		op := opType(opRaw[0])
+		if op != opPut && op != opDelete {
+			return nil, nil, fmt.Errorf("unknown op type %d", op)
+		}
+		keyLen, err := readUvarint()
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := readBytes(keyLen)
+		if err != nil {
+			return nil, nil, err
+		}
+		valLen, err := readUvarint()
+		if err != nil {
+			return nil, nil, err
+		}
+		valOffsets = append(valOffsets, pos)
+		val, err := readBytes(valLen)
+		if err != nil {
+			return nil, nil, err
+		}
+		b.add(batchOp{op: op, key: string(key), val: val})
+	}
+	if pos != len(raw) {
+		return nil, nil, fmt.Errorf("trailing bytes after batch")
+	}
+	return b, valOffsets, nil
+}
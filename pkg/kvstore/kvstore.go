@@ -0,0 +1,359 @@
+package kvstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	logFileName     = "data.log"
+	compactFileName = "data.log.compact"
+	// Bytes in a log record header: payload length, then payload crc32.
+	recordHeaderSize = 8
+	// Ops per batch when rewriting the log during compaction.
+	compactBatchSize = 1024
+)
+
+// Where a key's current value lives in the log.
+type valueLoc struct {
+	offset int64
+	length uint32
+}
+
+// An embedded, ordered key-value store.
+// Writes are appended to a log as atomic batches, each fsynced and checksummed, so a
+// batch is either entirely applied or (if torn by a crash) entirely discarded on open.
+// An ordered index of each key's latest value is kept in memory.
+// Safe for concurrent use.
+type Store struct {
+	dir     string
+	mu      sync.RWMutex
+	log     *os.File
+	logSize int64
+	index   *skipList[valueLoc]
+	garbage int64
+	// Incremented each time Compact rewrites the log, moving every value
+	generation uint64
+}
+
+// Open the store in the given directory, creating it if necessary.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	// A leftover compaction file means compaction didn't finish, the log is still valid
+	if err := os.Remove(filepath.Join(dir, compactFileName)); err != nil &&
+		!errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	s := &Store{dir: dir}
+	if err := s.openLog(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Check whether the given key exists.
+func (s *Store) Has(key []byte) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.index.Get(string(key))
+	return ok
+}
+
+// Get the value of the given key, and whether it exists.
+func (s *Store) Get(key []byte) ([]byte, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	loc, ok := s.index.Get(string(key))
+	if !ok {
+		return nil, false, nil
+	}
+	val, err := s.readValue(loc)
+	if err != nil {
+		return nil, false, err
+	}
+	return val, true, nil
+}
+
+// Set the given key to the given value.
+func (s *Store) Put(key []byte, val []byte) error {
+	b := NewBatch()
+	b.Put(key, val)
+	return s.Write(b)
+}
+
+// Delete the given key.
+func (s *Store) Delete(key []byte) error {
+	b := NewBatch()
+	b.Delete(key)
+	return s.Write(b)
+}
+
+// Atomically apply every write in the batch, durably.
+func (s *Store) Write(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload, valOffsets := b.encode()
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+	if _, err := s.log.WriteAt(record, s.logSize); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	s.applyBatch(b, s.logSize+recordHeaderSize, valOffsets)
+	s.logSize += int64(len(record))
+	return nil
+}
+
+// Call fn with each key and value where start <= key < end, in key order, until fn
+// returns false. A nil end means no upper bound. fn may write to the store.
+// Values are as of the start of the walk, unless the log is compacted meanwhile, after which
+// each key's latest value is read instead, and keys deleted since are skipped.
+func (s *Store) Iterate(start []byte, end []byte, fn func(key []byte, val []byte) bool) error {
+	type entry struct {
+		key string
+		loc valueLoc
+	}
+	s.mu.RLock()
+	entries := make([]entry, 0)
+	s.index.Ascend(string(start), string(end), func(key string, loc valueLoc) bool {
+		entries = append(entries, entry{key, loc})
+		return true
+	})
+	generation := s.generation
+	s.mu.RUnlock()
+	for _, e := range entries {
+		s.mu.RLock()
+		loc, ok := e.loc, true
+		// Compaction moved every value, so the walked locations are stale
+		if s.generation != generation {
+			loc, ok = s.index.Get(e.key)
+		}
+		var val []byte
+		var err error
+		if ok {
+			val, err = s.readValue(loc)
+		}
+		s.mu.RUnlock()
+		if err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		if !fn([]byte(e.key), val) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Call fn with each key and value with the given prefix, in key order, until fn returns false.
+func (s *Store) IteratePrefix(prefix []byte, fn func(key []byte, val []byte) bool) error {
+	return s.Iterate(prefix, prefixEnd(prefix), fn)
+}
+
+// Call fn with each key and value with the given prefix that sorts after the given key, in key
+// order, until fn returns false. So a walk can be resumed after the last key it saw.
+func (s *Store) IteratePrefixAfter(
+	prefix []byte, after []byte, fn func(key []byte, val []byte) bool,
+) error {
+	start := prefix
+	if string(after) >= string(prefix) {
+		start = append(append([]byte{}, after...), 0)
+	}
+	return s.Iterate(start, prefixEnd(prefix), fn)
+}
+
+// Number of keys in the store.
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index.Len()
+}
+
+// Rewrite the log with only live values, reclaiming space from overwrites and deletes.
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	compactPath := filepath.Join(s.dir, compactFileName)
+	f, err := os.OpenFile(compactPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	b := NewBatch()
+	var readErr error
+	flush := func() error {
+		payload, _ := b.encode()
+		header := make([]byte, recordHeaderSize)
+		binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		_, err := w.Write(payload)
+		b.Reset()
+		return err
+	}
+	s.index.Ascend("", "", func(key string, loc valueLoc) bool {
+		val, err := s.readValue(loc)
+		if err != nil {
+			readErr = err
+			return false
+		}
+		b.Put([]byte(key), val)
+		if b.Len() >= compactBatchSize {
+			readErr = flush()
+		}
+		return readErr == nil
+	})
+	if readErr == nil && b.Len() > 0 {
+		readErr = flush()
+	}
+	if readErr == nil {
+		readErr = w.Flush()
+	}
+	if readErr == nil {
+		readErr = f.Sync()
+	}
+	f.Close()
+	if readErr != nil {
+		os.Remove(compactPath)
+		return readErr
+	}
+	if err := os.Rename(compactPath, filepath.Join(s.dir, logFileName)); err != nil {
+		return err
+	}
+	s.log.Close()
+	s.generation++
+	return s.openLog()
+}
+
+// Bytes of the log taken by the keys and values of overwrites and deletes.
+func (s *Store) Garbage() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.garbage
+}
+
+// Bytes of the log, live or not.
+func (s *Store) Size() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.logSize
+}
+
+// Compact the log if it's at least minSize bytes and over half of it is garbage, so it stays
+// within about twice the size of the live data. Returns whether it compacted.
+func (s *Store) CompactIfWasteful(minSize int64) (bool, error) {
+	s.mu.RLock()
+	wasteful := s.logSize >= minSize && s.garbage > s.logSize/2
+	s.mu.RUnlock()
+	if !wasteful {
+		return false, nil
+	}
+	return true, s.Compact()
+}
+
+// Close the store. It must not be used afterwards.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Close()
+}
+
+// Open the log and rebuild the index, truncating any torn or corrupt trailing batch.
+// Caller must hold the write lock, or have exclusive access.
+func (s *Store) openLog() error {
+	f, err := os.OpenFile(filepath.Join(s.dir, logFileName), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	s.log = f
+	s.index = newSkipList[valueLoc]()
+	s.garbage = 0
+	r := bufio.NewReader(f)
+	offset := int64(0)
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			break
+		}
+		b, valOffsets, err := decodeBatch(payload)
+		if err != nil {
+			break
+		}
+		s.applyBatch(b, offset+recordHeaderSize, valOffsets)
+		offset += recordHeaderSize + int64(len(payload))
+	}
+	if err := f.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate torn log: %s", err)
+	}
+	s.logSize = offset
+	return nil
+}
+
+// Apply a batch written to the log at the given payload offset to the index.
+func (s *Store) applyBatch(b *Batch, payloadOffset int64, valOffsets []int) {
+	for i, op := range b.ops {
+		if old, ok := s.index.Get(op.key); ok {
+			s.garbage += int64(len(op.key)) + int64(old.length)
+		}
+		// A delete is dead as soon as it's applied, it's only kept until compaction
+		if op.op == opDelete {
+			s.garbage += int64(len(op.key))
+		}
+		switch op.op {
+		case opPut:
+			s.index.Set(op.key, valueLoc{
+				offset: payloadOffset + int64(valOffsets[i]),
+				length: uint32(len(op.val)),
+			})
+		case opDelete:
+			s.index.Delete(op.key)
+		}
+	}
+}
+
+// Read a value from the log. Caller must hold a lock.
+func (s *Store) readValue(loc valueLoc) ([]byte, error) {
+	val := make([]byte, loc.length)
+	if _, err := s.log.ReadAt(val, loc.offset); err != nil {
+		return nil, fmt.Errorf("failed to read value at %d: %s", loc.offset, err)
+	}
+	return val, nil
+}
+
+// The smallest key greater than every key with the given prefix, or nil if unbounded.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package kvstore_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/levilutz/basiccoin/pkg/kvstore"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+// Collect every key with the given prefix, in order.
+func prefixKeys(t *testing.T, s *Store, prefix string) []string {
+	keys := make([]string, 0)
+	err := s.IteratePrefix([]byte(prefix), func(key []byte, val []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	util.AssertNoErr(t, err)
+	return keys
+}
+
+// Test writes, ordered iteration, and persistence across reopening and compaction.
+func TestStoreOrderedPersist(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	util.AssertNoErr(t, err)
+	for _, i := range []int{5, 3, 9, 1, 7} {
+		util.AssertNoErr(t, s.Put([]byte(fmt.Sprint("a/", i)), []byte(fmt.Sprint("v", i))))
+	}
+	util.AssertNoErr(t, s.Put([]byte("b/1"), []byte("other")))
+	util.AssertNoErr(t, s.Put([]byte("a/5"), []byte("v5-new")))
+	util.AssertNoErr(t, s.Delete([]byte("a/3")))
+	util.Assert(t, s.Garbage() > 0, "overwrites not counted as garbage")
+	compacted, err := s.CompactIfWasteful(1 << 20)
+	util.AssertNoErr(t, err)
+	util.Assert(t, !compacted, "compacted a log below the min size")
+
+	check := func() {
+		keys := prefixKeys(t, s, "a/")
+		util.Assert(t, fmt.Sprint(keys) == "[a/1 a/5 a/7 a/9]", "wrong keys %v", keys)
+		val, ok, err := s.Get([]byte("a/5"))
+		util.AssertNoErr(t, err)
+		util.Assert(t, ok && string(val) == "v5-new", "wrong value %s", val)
+		util.Assert(t, !s.Has([]byte("a/3")), "deleted key present")
+		util.Assert(t, s.Len() == 5, "wrong len %d", s.Len())
+	}
+	check()
+	util.AssertNoErr(t, s.Close())
+	s, err = Open(dir)
+	util.AssertNoErr(t, err)
+	check()
+	util.AssertNoErr(t, s.Compact())
+	util.Assert(t, s.Garbage() == 0, "garbage remaining after compaction")
+	check()
+	util.AssertNoErr(t, s.Close())
+	s, err = Open(dir)
+	util.AssertNoErr(t, err)
+	check()
+	util.AssertNoErr(t, s.Close())
+}
+
+// Test that a batch torn by a crash is discarded entirely, while earlier batches survive.
+func TestStoreTornBatch(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	util.AssertNoErr(t, err)
+	b := NewBatch()
+	b.Put([]byte("x"), []byte("1"))
+	b.Put([]byte("y"), []byte("2"))
+	util.AssertNoErr(t, s.Write(b))
+	b = NewBatch()
+	for i := 0; i < 10; i++ {
+		b.Put([]byte(fmt.Sprint("z", i)), []byte("3"))
+	}
+	val, deleted, ok := b.Lookup([]byte("z4"))
+	util.Assert(t, ok && !deleted && string(val) == "3", "batch lookup failed")
+	util.AssertNoErr(t, s.Write(b))
+	util.AssertNoErr(t, s.Close())
+
+	// Chop the end off the last batch
+	path := filepath.Join(dir, "data.log")
+	stat, err := os.Stat(path)
+	util.AssertNoErr(t, err)
+	util.AssertNoErr(t, os.Truncate(path, stat.Size()-5))
+
+	s, err = Open(dir)
+	util.AssertNoErr(t, err)
+	util.Assert(t, s.Has([]byte("x")) && s.Has([]byte("y")), "earlier batch lost")
+	util.Assert(t, len(prefixKeys(t, s, "z")) == 0, "torn batch partially applied")
+	util.AssertNoErr(t, s.Put([]byte("w"), []byte("4")))
+	util.AssertNoErr(t, s.Close())
+	s, err = Open(dir)
+	util.AssertNoErr(t, err)
+	util.Assert(t, s.Has([]byte("w")), "write after recovery lost")
+	util.AssertNoErr(t, s.Close())
+}
+
+// Test that a walk interrupted by compaction still reads each key's value, not whatever the
+// rewritten log holds at its old location.
+func TestStoreIterateDuringCompact(t *testing.T) {
+	s, err := Open(t.TempDir())
+	util.AssertNoErr(t, err)
+	for i := 0; i < 10; i++ {
+		util.AssertNoErr(t, s.Put([]byte(fmt.Sprint("a/", i)), []byte(fmt.Sprint("old", i))))
+	}
+	for i := 0; i < 10; i++ {
+		util.AssertNoErr(t, s.Put([]byte(fmt.Sprint("a/", i)), []byte(fmt.Sprint("v", i))))
+	}
+
+	// Compact after the first key, also deleting a later one
+	vals := make([]string, 0)
+	err = s.IteratePrefix([]byte("a/"), func(key []byte, val []byte) bool {
+		if len(vals) == 0 {
+			util.AssertNoErr(t, s.Delete([]byte("a/5")))
+			util.AssertNoErr(t, s.Compact())
+		}
+		vals = append(vals, string(val))
+		return true
+	})
+	util.AssertNoErr(t, err)
+	expected := "[v0 v1 v2 v3 v4 v6 v7 v8 v9]"
+	util.Assert(t, fmt.Sprint(vals) == expected, "wrong values %v", vals)
+
+	// A walk can be resumed after the last key seen
+	keys := make([]string, 0)
+	err = s.IteratePrefixAfter([]byte("a/"), []byte("a/6"), func(key []byte, val []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	util.AssertNoErr(t, err)
+	util.Assert(t, fmt.Sprint(keys) == "[a/7 a/8 a/9]", "wrong resumed keys %v", keys)
+	util.AssertNoErr(t, s.Close())
+}
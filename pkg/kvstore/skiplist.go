@@ -0,0 +1,115 @@
+package kvstore
+
+import "math/rand"
+
+const maxSkipLevel = 24
+
+type skipNode[V any] struct {
+	key  string
+	val  V
+	next []*skipNode[V]
+}
+
+// An ordered map from string keys, as a skip list. Not safe for concurrent use.
+type skipList[V any] struct {
+	head   *skipNode[V]
+	level  int
+	length int
+}
+
+func newSkipList[V any]() *skipList[V] {
+	return &skipList[V]{
+		head:  &skipNode[V]{next: make([]*skipNode[V], maxSkipLevel)},
+		level: 1,
+	}
+}
+
+// Find the last node at each level whose key is less than the given key.
+func (sl *skipList[V]) findPrev(key string) []*skipNode[V] {
+	prev := make([]*skipNode[V], maxSkipLevel)
+	node := sl.head
+	for lvl := sl.level - 1; lvl >= 0; lvl-- {
+		for node.next[lvl] != nil && node.next[lvl].key < key {
+			node = node.next[lvl]
+		}
+		prev[lvl] = node
+	}
+	return prev
+}
+
+// Get the value at the given key, and whether it exists.
+func (sl *skipList[V]) Get(key string) (V, bool) {
+	node := sl.head
+	for lvl := sl.level - 1; lvl >= 0; lvl-- {
+		for node.next[lvl] != nil && node.next[lvl].key < key {
+			node = node.next[lvl]
+		}
+	}
+	node = node.next[0]
+	if node != nil && node.key == key {
+		return node.val, true
+	}
+	var zero V
+	return zero, false
+}
+
+// Set the value at the given key.
+func (sl *skipList[V]) Set(key string, val V) {
+	prev := sl.findPrev(key)
+	if node := prev[0].next[0]; node != nil && node.key == key {
+		node.val = val
+		return
+	}
+	level := 1
+	for level < maxSkipLevel && rand.Intn(4) == 0 {
+		level++
+	}
+	if level > sl.level {
+		for lvl := sl.level; lvl < level; lvl++ {
+			prev[lvl] = sl.head
+		}
+		sl.level = level
+	}
+	node := &skipNode[V]{key: key, val: val, next: make([]*skipNode[V], level)}
+	for lvl := 0; lvl < level; lvl++ {
+		node.next[lvl] = prev[lvl].next[lvl]
+		prev[lvl].next[lvl] = node
+	}
+	sl.length++
+}
+
+// Delete the given key, return whether it existed.
+func (sl *skipList[V]) Delete(key string) bool {
+	prev := sl.findPrev(key)
+	node := prev[0].next[0]
+	if node == nil || node.key != key {
+		return false
+	}
+	for lvl := 0; lvl < len(node.next); lvl++ {
+		prev[lvl].next[lvl] = node.next[lvl]
+	}
+	for sl.level > 1 && sl.head.next[sl.level-1] == nil {
+		sl.level--
+	}
+	sl.length--
+	return true
+}
+
+// Call fn on each entry with start <= key < end in order, until fn returns false.
+// An empty end means no upper bound.
+func (sl *skipList[V]) Ascend(start string, end string, fn func(key string, val V) bool) {
+	node := sl.findPrev(start)[0].next[0]
+	for ; node != nil; node = node.next[0] {
+		if end != "" && node.key >= end {
+			return
+		}
+		if !fn(node.key, node.val) {
+			return
+		}
+	}
+}
+
+// Number of entries.
+func (sl *skipList[V]) Len() int {
+	return sl.length
+}
@@ -0,0 +1,182 @@
+package lru
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// Counters describing a cache's effectiveness and usage.
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int64
+	MaxBytes  int64
+	Pinned    int
+}
+
+// Describe the stats in a single line.
+func (s Stats) String() string {
+	hitRate := 0.0
+	if s.Hits+s.Misses > 0 {
+		hitRate = float64(s.Hits) / float64(s.Hits+s.Misses)
+	}
+	return fmt.Sprintf(
+		"%d entries (%d pinned), %d/%d bytes, %d hits, %d misses (%.1f%% hit), %d evictions",
+		s.Entries, s.Pinned, s.Bytes, s.MaxBytes, s.Hits, s.Misses, hitRate*100, s.Evictions,
+	)
+}
+
+type entry[K comparable, V any] struct {
+	key    K
+	val    V
+	size   int64
+	pinned bool
+}
+
+// A least-recently-used cache bounded by the total size of its entries.
+// Pinned entries are never evicted, and don't count towards the budget.
+// Safe for concurrent use.
+type Cache[K comparable, V any] struct {
+	maxBytes int64
+	mu       sync.Mutex
+	order    *list.List
+	items    map[K]*list.Element
+	pinned   map[K]struct{}
+	stats    Stats
+}
+
+// Create a new cache holding up to maxBytes of unpinned entries. Non-positive is unbounded.
+func NewCache[K comparable, V any](maxBytes int64) *Cache[K, V] {
+	return &Cache[K, V]{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    make(map[K]*list.Element),
+		pinned:   make(map[K]struct{}),
+		stats:    Stats{MaxBytes: maxBytes},
+	}
+}
+
+// Check whether the given key is cached, without affecting recency or stats.
+func (c *Cache[K, V]) Has(key K) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.items[key]
+	return ok
+}
+
+// Get the given key, marking it most recently used.
+func (c *Cache[K, V]) Get(key K) (val V, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		c.stats.Misses++
+		return val, false
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*entry[K, V]).val, true
+}
+
+// Add or replace the given key with a value of the given size, evicting others as needed.
+func (c *Cache[K, V]) Add(key K, val V, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		e := elem.Value.(*entry[K, V])
+		if !e.pinned {
+			c.stats.Bytes += size - e.size
+		}
+		e.val = val
+		e.size = size
+		c.order.MoveToFront(elem)
+	} else {
+		_, pinned := c.pinned[key]
+		c.items[key] = c.order.PushFront(&entry[K, V]{
+			key: key, val: val, size: size, pinned: pinned,
+		})
+		if !pinned {
+			c.stats.Bytes += size
+		}
+	}
+	c.evict()
+}
+
+// Remove the given key, if cached. It stays pinned if it was.
+func (c *Cache[K, V]) Remove(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return
+	}
+	e := elem.Value.(*entry[K, V])
+	if !e.pinned {
+		c.stats.Bytes -= e.size
+	}
+	c.order.Remove(elem)
+	delete(c.items, key)
+}
+
+// Pin the given key so it isn't evicted, including if it's only added later.
+func (c *Cache[K, V]) Pin(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pinned[key]; ok {
+		return
+	}
+	c.pinned[key] = struct{}{}
+	if elem, ok := c.items[key]; ok {
+		e := elem.Value.(*entry[K, V])
+		e.pinned = true
+		c.stats.Bytes -= e.size
+	}
+}
+
+// Unpin the given key, so it may be evicted again.
+func (c *Cache[K, V]) Unpin(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pinned[key]; !ok {
+		return
+	}
+	delete(c.pinned, key)
+	if elem, ok := c.items[key]; ok {
+		e := elem.Value.(*entry[K, V])
+		e.pinned = false
+		c.stats.Bytes += e.size
+	}
+	c.evict()
+}
+
+// Get a snapshot of the cache's stats.
+func (c *Cache[K, V]) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.items)
+	stats.Pinned = len(c.pinned)
+	return stats
+}
+
+// Evict least recently used unpinned entries until within budget. Caller must hold lock.
+func (c *Cache[K, V]) evict() {
+	if c.maxBytes <= 0 {
+		return
+	}
+	elem := c.order.Back()
+	for c.stats.Bytes > c.maxBytes && elem != nil {
+		prev := elem.Prev()
+		e := elem.Value.(*entry[K, V])
+		if !e.pinned {
+			c.order.Remove(elem)
+			delete(c.items, e.key)
+			c.stats.Bytes -= e.size
+			c.stats.Evictions++
+		}
+		elem = prev
+	}
+}
@@ -0,0 +1,43 @@
+package lru_test
+
+import (
+	"testing"
+
+	. "github.com/levilutz/basiccoin/pkg/lru"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+// Test that least recently used entries are evicted first, and pinned entries never are.
+func TestCacheEvictPin(t *testing.T) {
+	c := NewCache[string, int](30)
+	c.Add("a", 1, 10)
+	c.Add("b", 2, 10)
+	c.Add("c", 3, 10)
+	_, ok := c.Get("a")
+	util.Assert(t, ok, "a missing")
+	c.Add("d", 4, 10)
+	util.Assert(t, !c.Has("b"), "b should be evicted as least recently used")
+	util.Assert(t, c.Has("a") && c.Has("c") && c.Has("d"), "wrong entry evicted")
+
+	// Pinned entries survive and don't use the budget
+	c.Pin("c")
+	c.Pin("e")
+	c.Add("e", 5, 10)
+	c.Add("f", 6, 10)
+	c.Add("g", 7, 10)
+	util.Assert(t, c.Has("c") && c.Has("e"), "pinned entry evicted")
+	util.Assert(t, !c.Has("a") && c.Has("d"), "wrong unpinned entry evicted")
+	stats := c.Stats()
+	util.Assert(t, stats.Bytes == 30, "wrong bytes %d", stats.Bytes)
+	util.Assert(t, stats.Pinned == 2, "wrong pinned %d", stats.Pinned)
+
+	// Unpinning brings entries back under budget
+	c.Unpin("c")
+	util.Assert(t, !c.Has("c"), "unpinned least recent entry not evicted")
+	util.Assert(t, c.Stats().Bytes <= 30, "over budget after unpin")
+	_, ok = c.Get("zzz")
+	util.Assert(t, !ok, "unknown key found")
+	stats = c.Stats()
+	util.Assert(t, stats.Hits == 1 && stats.Misses == 1, "wrong hits/misses %s", stats)
+	util.Assert(t, stats.Evictions == 3, "wrong evictions %d", stats.Evictions)
+}
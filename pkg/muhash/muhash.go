@@ -0,0 +1,85 @@
+package muhash
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+)
+
+// Bytes in each element and the modulus.
+const elementSize = 384
+
+// The largest 3072-bit safe prime, 2^3072 - 1103717.
+var prime = func() *big.Int {
+	p := new(big.Int).Lsh(big.NewInt(1), elementSize*8)
+	return p.Sub(p, big.NewInt(1103717))
+}()
+
+// An incremental hash of a multiset of byte strings, independent of the order they're added.
+// Each item is mapped to a number mod a 3072-bit prime, and the set hash is their product.
+// Removals multiply a separate denominator, so each update is a single modular multiplication.
+// Not safe for concurrent use.
+type MuHash struct {
+	num *big.Int
+	den *big.Int
+}
+
+// Create a hash of the empty set.
+func New() *MuHash {
+	return &MuHash{
+		num: big.NewInt(1),
+		den: big.NewInt(1),
+	}
+}
+
+// Add an item to the set.
+func (m *MuHash) Add(item []byte) {
+	m.num.Mul(m.num, toElement(item))
+	m.num.Mod(m.num, prime)
+}
+
+// Remove an item from the set. Removing an item that wasn't added gives a meaningless hash.
+func (m *MuHash) Remove(item []byte) {
+	m.den.Mul(m.den, toElement(item))
+	m.den.Mod(m.den, prime)
+}
+
+// Copy the hash, so the copy can be updated independently.
+func (m *MuHash) Copy() *MuHash {
+	return &MuHash{
+		num: new(big.Int).Set(m.num),
+		den: new(big.Int).Set(m.den),
+	}
+}
+
+// Get the 32-byte digest of the set.
+func (m *MuHash) Digest() [32]byte {
+	inv := new(big.Int).ModInverse(m.den, prime)
+	val := inv.Mul(inv, m.num)
+	val.Mod(val, prime)
+	// Fold the denominator in, so later digests needn't invert it again
+	m.num.Set(val)
+	m.den.SetInt64(1)
+	buf := make([]byte, elementSize)
+	val.FillBytes(buf)
+	return sha256.Sum256(buf)
+}
+
+// Expand an item into a non-zero number mod the prime.
+func toElement(item []byte) *big.Int {
+	seed := sha256.Sum256(item)
+	buf := make([]byte, 0, elementSize)
+	block := make([]byte, len(seed)+4)
+	copy(block, seed[:])
+	for i := uint32(0); len(buf) < elementSize; i++ {
+		binary.BigEndian.PutUint32(block[len(seed):], i)
+		sum := sha256.Sum256(block)
+		buf = append(buf, sum[:]...)
+	}
+	elem := new(big.Int).SetBytes(buf)
+	elem.Mod(elem, prime)
+	if elem.Sign() == 0 {
+		elem.SetInt64(1)
+	}
+	return elem
+}
@@ -0,0 +1,34 @@
+package muhash_test
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/levilutz/basiccoin/pkg/muhash"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+// Test the hash depends only on the resulting set, not how it was built.
+func TestMuHashOrderIndependent(t *testing.T) {
+	empty := New().Digest()
+	a := New()
+	b := New()
+	for i := 0; i < 10; i++ {
+		a.Add([]byte(fmt.Sprint("item", i)))
+		b.Add([]byte(fmt.Sprint("item", 9-i)))
+	}
+	util.Assert(t, a.Digest() == b.Digest(), "insertion order changed hash")
+	util.Assert(t, a.Digest() != empty, "non-empty set hashed as empty")
+
+	// Removing then re-adding, and copies, are consistent
+	c := a.Copy()
+	c.Remove([]byte("item3"))
+	util.Assert(t, c.Digest() != a.Digest(), "removal didn't change hash")
+	c.Add([]byte("item3"))
+	util.Assert(t, c.Digest() == a.Digest(), "remove and re-add changed hash")
+	for i := 0; i < 10; i++ {
+		c.Remove([]byte(fmt.Sprint("item", i)))
+	}
+	util.Assert(t, c.Digest() == empty, "removing everything didn't give empty hash")
+	util.Assert(t, a.Digest() == b.Digest(), "copy shares state with original")
+}
@@ -11,10 +11,16 @@ import (
 
 const defaultTimeout = time.Second * 30
 
-// A low-level connection to a peer.
+// The version of the wire protocol, which peers must share to connect.
+// Bump whenever the encoding of any message changes.
+const protocolVersion = "v0.1.0"
+
+// A low-level connection to a peer, or a stream of the same wire encoding.
 type Conn struct {
 	params        Params
-	tc            *net.TCPConn
+	tc            *net.TCPConn // nil for streams
+	r             io.Reader
+	w             io.Writer
 	peerRuntimeId string
 	err           error
 }
@@ -25,6 +31,8 @@ func NewConn(params Params, tcpConn *net.TCPConn) *Conn {
 	conn := &Conn{
 		params: params,
 		tc:     tcpConn,
+		r:      tcpConn,
+		w:      tcpConn,
 		err:    nil,
 		// peerRuntimeId is initialized by handshake
 	}
@@ -32,6 +40,16 @@ func NewConn(params Params, tcpConn *net.TCPConn) *Conn {
 	return conn
 }
 
+// Create a conn that reads and writes the wire encoding over the given streams (e.g. files),
+// without a handshake or timeouts. Either stream may be nil if it won't be used.
+func NewStreamConn(r io.Reader, w io.Writer) *Conn {
+	return &Conn{
+		r:   r,
+		w:   w,
+		err: nil,
+	}
+}
+
 func ResolveConn(params Params, addr string) (*Conn, error) {
 	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
@@ -51,16 +69,23 @@ func (c *Conn) handshake() {
 	}
 	// Transmit handshake
 	c.WriteString("levilutz/basiccoin")
-	c.WriteString("v0.0.0") // If protocol is ever versioned this'll matter
+	c.WriteString(protocolVersion)
 	c.WriteString(c.params.RuntimeID)
 	// Receive handshake
 	c.ReadStringExpected("levilutz/basiccoin")
-	c.ReadStringExpected("v0.0.0")
+	peerVersion := c.ReadString()
 	peerRuntimeId := c.ReadString()
 	// Cancel or continue the connection
 	if c.err != nil {
 		return
 	}
+	if peerVersion != protocolVersion {
+		c.err = fmt.Errorf(
+			"peer protocol version %s incompatible with ours %s", peerVersion, protocolVersion,
+		)
+		c.Close()
+		return
+	}
 	if peerRuntimeId == c.params.RuntimeID {
 		c.WriteString("cancel")
 		if c.err == nil {
@@ -108,10 +133,12 @@ func (c *Conn) readRawTimeout(numBytes uint16, timeout time.Duration) []byte {
 	if c.err != nil {
 		return nil
 	}
-	c.tc.SetReadDeadline(time.Now().Add(timeout))
-	defer c.tc.SetReadDeadline(time.Time{})
+	if c.tc != nil {
+		c.tc.SetReadDeadline(time.Now().Add(timeout))
+		defer c.tc.SetReadDeadline(time.Time{})
+	}
 	data := make([]byte, numBytes)
-	_, err := io.ReadFull(c.tc, data)
+	_, err := io.ReadFull(c.r, data)
 	if err != nil {
 		c.err = err
 		return nil
@@ -135,9 +162,11 @@ func (c *Conn) writeRawTimeout(data []byte, timeout time.Duration) {
 	if c.params.Debug {
 		fmt.Printf("net_write %d: %s\n", len(data), data)
 	}
-	c.tc.SetWriteDeadline(time.Now().Add(timeout))
-	defer c.tc.SetWriteDeadline(time.Time{})
-	_, err := c.tc.Write(data)
+	if c.tc != nil {
+		c.tc.SetWriteDeadline(time.Now().Add(timeout))
+		defer c.tc.SetWriteDeadline(time.Time{})
+	}
+	_, err := c.w.Write(data)
 	if err != nil {
 		c.err = err
 	}
@@ -180,8 +209,11 @@ func (c *Conn) Write(data []byte) {
 	c.writeRawTimeout(data, defaultTimeout)
 }
 
-// Close the connection.
+// Close the connection. Streams are left for their owner to close.
 func (c *Conn) Close() error {
+	if c.tc == nil {
+		return nil
+	}
 	return c.tc.Close()
 }
 
@@ -114,14 +114,17 @@ func (c *Conn) ReadTx(expectId core.HashT) core.Tx {
 				Ind:   c.ReadUint64(),
 				Value: c.ReadUint64(),
 			},
-			PublicKey: c.Read(),
-			Signature: c.Read(),
+			PublicKey:   c.Read(),
+			Signature:   c.Read(),
+			SigHashType: core.SigHashType(c.ReadUint8()),
+			KeyType:     core.KeyType(c.ReadUint8()),
 		}
 	}
 	for i := range tx.Outputs {
 		tx.Outputs[i] = core.TxOut{
 			Value:         c.ReadUint64(),
 			PublicKeyHash: c.ReadHashT(),
+			Data:          c.Read(),
 		}
 	}
 	if c.err != nil {
@@ -150,9 +153,12 @@ func (c *Conn) WriteTx(data core.Tx) {
 		c.WriteUint64(txi.Utxo.Value)
 		c.Write(txi.PublicKey)
 		c.Write(txi.Signature)
+		c.WriteUint8(uint8(txi.SigHashType))
+		c.WriteUint8(uint8(txi.KeyType))
 	}
 	for _, txo := range data.Outputs {
 		c.WriteUint64(txo.Value)
 		c.WriteHashT(txo.PublicKeyHash)
+		c.Write(txo.Data)
 	}
 }
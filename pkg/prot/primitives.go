@@ -61,6 +61,26 @@ func (c *Conn) WriteUint64(data uint64) {
 	c.writeRawTimeout(dataB, defaultTimeout)
 }
 
+// Read a Uint8 from the conn.
+func (c *Conn) ReadUint8() uint8 {
+	if c.err != nil {
+		return 0
+	}
+	raw := c.readRawTimeout(1, defaultTimeout)
+	if c.err != nil {
+		return 0
+	}
+	return raw[0]
+}
+
+// Write a Uint8 to the conn.
+func (c *Conn) WriteUint8(data uint8) {
+	if c.err != nil {
+		return
+	}
+	c.writeRawTimeout([]byte{data}, defaultTimeout)
+}
+
 // Read a bool from the conn.
 func (c *Conn) ReadBool() bool {
 	if c.err != nil {
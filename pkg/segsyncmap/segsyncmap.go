@@ -0,0 +1,431 @@
+package segsyncmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/levilutz/basiccoin/pkg/lru"
+)
+
+type comparableStringer interface {
+	comparable
+	fmt.Stringer
+}
+
+const (
+	// Start a new segment file once the active one reaches this size.
+	DefaultMaxSegmentSize = 128 * 1024 * 1024
+	// Fsync the active segment after this many unsynced records.
+	DefaultSyncEvery = 256
+	// Bytes in a record header: key length, value length, then crc32 of key and value.
+	headerSize = 12
+	// Value length marking a record as a deletion of its key.
+	tombstoneLen = 0xffffffff
+)
+
+// Where a record's value lives on disk.
+type recordLoc struct {
+	segment int
+	offset  int64
+	length  uint32
+}
+
+// A sync map backed by segmented, append-only flat files.
+// Each record is appended as [key len][val len][crc32][key][val], and an in-memory index of each
+// key's location is rebuilt by scanning record headers on startup.
+// Only one goroutine should store at a time, though reads may be concurrent.
+// Deletions are appended as tombstone records, and their space is never reclaimed.
+type SegSyncMap[K comparableStringer, V fmt.Stringer] struct {
+	basePath       string
+	parseFunc      func(raw string) (v V, err error)
+	maxSegmentSize int64
+	syncEvery      int
+	mu             sync.RWMutex
+	index          map[string]recordLoc
+	segments       []*os.File
+	activeSize     int64
+	unsynced       int
+	cache          *lru.Cache[K, V]
+	quarantined    []string
+}
+
+// Create a new segmented sync map, loading the index of any existing segments.
+// Every loaded entry is cached in memory.
+func NewSegSyncMap[K comparableStringer, V fmt.Stringer](
+	basePath string,
+	parseFunc func(raw string) (v V, err error),
+) *SegSyncMap[K, V] {
+	return NewSegSyncMapWithBudget[K, V](basePath, parseFunc, 0)
+}
+
+// Create a new segmented sync map, caching up to maxBytes of serialized entries in memory.
+// A non-positive budget caches every loaded entry.
+func NewSegSyncMapWithBudget[K comparableStringer, V fmt.Stringer](
+	basePath string,
+	parseFunc func(raw string) (v V, err error),
+	maxBytes int64,
+) *SegSyncMap[K, V] {
+	if err := os.MkdirAll(basePath, 0750); err != nil {
+		panic(fmt.Sprintf("failed to make SegSyncMap dir: %s", err))
+	}
+	ssm := &SegSyncMap[K, V]{
+		basePath:       basePath,
+		parseFunc:      parseFunc,
+		maxSegmentSize: DefaultMaxSegmentSize,
+		syncEvery:      DefaultSyncEvery,
+		index:          make(map[string]recordLoc),
+		segments:       make([]*os.File, 0),
+		cache:          lru.NewCache[K, V](maxBytes),
+		quarantined:    make([]string, 0),
+	}
+	if err := ssm.loadSegments(); err != nil {
+		panic(fmt.Sprintf("failed to load SegSyncMap segments: %s", err))
+	}
+	return ssm
+}
+
+// Set the size at which new segments are started, and how many records to store per fsync.
+func (ssm *SegSyncMap[K, V]) SetLimits(maxSegmentSize int64, syncEvery int) {
+	ssm.mu.Lock()
+	defer ssm.mu.Unlock()
+	ssm.maxSegmentSize = maxSegmentSize
+	ssm.syncEvery = syncEvery
+}
+
+// Check whether the given key exists in the map.
+func (ssm *SegSyncMap[K, V]) Has(key K) bool {
+	ssm.mu.RLock()
+	defer ssm.mu.RUnlock()
+	_, ok := ssm.index[key.String()]
+	return ok
+}
+
+// Retrieve the given key from the map, panics if it doesn't exist or can't be read.
+func (ssm *SegSyncMap[K, V]) Get(key K) V {
+	if val, ok := ssm.cache.Get(key); ok {
+		return val
+	}
+	ssm.mu.RLock()
+	loc, ok := ssm.index[key.String()]
+	var seg *os.File
+	if ok {
+		seg = ssm.segments[loc.segment]
+	}
+	ssm.mu.RUnlock()
+	if !ok {
+		panic(fmt.Sprintf("attempted to load unknown key: %s", key))
+	}
+	raw := make([]byte, loc.length)
+	if _, err := seg.ReadAt(raw, loc.offset); err != nil {
+		panic(fmt.Sprintf("failed to read key %s: %s", key, err))
+	}
+	val, err := ssm.parseFunc(string(raw))
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse key %s: %s", key, err))
+	}
+	ssm.cache.Add(key, val, int64(loc.length))
+	return val
+}
+
+// Store the given key to the map, appending it to the active segment.
+// Keys already present are left unchanged.
+func (ssm *SegSyncMap[K, V]) Store(key K, val V) {
+	ssm.mu.Lock()
+	defer ssm.mu.Unlock()
+	keyS := key.String()
+	if _, ok := ssm.index[keyS]; ok {
+		return
+	}
+	loc, err := ssm.appendRecord([]byte(keyS), []byte(val.String()), false)
+	if err != nil {
+		fmt.Printf("failed to store key %s: %s\n", keyS, err)
+		return
+	}
+	ssm.index[keyS] = loc
+	ssm.cache.Add(key, val, int64(loc.length))
+	ssm.unsynced++
+	if ssm.unsynced >= ssm.syncEvery {
+		if err := ssm.syncActive(); err != nil {
+			fmt.Printf("failed to sync segment: %s\n", err)
+		}
+	}
+}
+
+// Delete the given key from the map, appending a tombstone to the active segment.
+func (ssm *SegSyncMap[K, V]) Delete(key K) {
+	ssm.mu.Lock()
+	defer ssm.mu.Unlock()
+	keyS := key.String()
+	if _, ok := ssm.index[keyS]; !ok {
+		return
+	}
+	if _, err := ssm.appendRecord([]byte(keyS), nil, true); err != nil {
+		fmt.Printf("failed to delete key %s: %s\n", keyS, err)
+		return
+	}
+	delete(ssm.index, keyS)
+	ssm.cache.Remove(key)
+	ssm.unsynced++
+}
+
+// Walk every indexed record in key order, passing its key, its raw serialized value, and any
+// error reading it, without parsing or caching it. Stops if fn returns false.
+func (ssm *SegSyncMap[K, V]) IterateRaw(fn func(key string, raw string, err error) bool) error {
+	return ssm.IterateRawAfter("", fn)
+}
+
+// Walk the indexed records like IterateRaw, but only those with keys after the given key, so a
+// walk can be resumed after the last key it saw.
+func (ssm *SegSyncMap[K, V]) IterateRawAfter(
+	after string, fn func(key string, raw string, err error) bool,
+) error {
+	ssm.mu.RLock()
+	keys := make([]string, 0, len(ssm.index))
+	for key := range ssm.index {
+		if key > after {
+			keys = append(keys, key)
+		}
+	}
+	ssm.mu.RUnlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		ssm.mu.RLock()
+		loc, ok := ssm.index[key]
+		var seg *os.File
+		if ok {
+			seg = ssm.segments[loc.segment]
+		}
+		ssm.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		raw := make([]byte, loc.length)
+		_, err := seg.ReadAt(raw, loc.offset)
+		if !fn(key, string(raw), err) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Keep the given key in memory once loaded, regardless of the cache budget.
+func (ssm *SegSyncMap[K, V]) Pin(key K) {
+	ssm.cache.Pin(key)
+}
+
+// Allow the given key to be evicted from memory again.
+func (ssm *SegSyncMap[K, V]) Unpin(key K) {
+	ssm.cache.Unpin(key)
+}
+
+// Get the in-memory cache's stats.
+func (ssm *SegSyncMap[K, V]) CacheStats() lru.Stats {
+	return ssm.cache.Stats()
+}
+
+// Fsync any records not yet synced to disk.
+func (ssm *SegSyncMap[K, V]) Sync() error {
+	ssm.mu.Lock()
+	defer ssm.mu.Unlock()
+	return ssm.syncActive()
+}
+
+// Sync and close every segment. The map must not be used afterwards.
+func (ssm *SegSyncMap[K, V]) Close() error {
+	ssm.mu.Lock()
+	defer ssm.mu.Unlock()
+	if err := ssm.syncActive(); err != nil {
+		return err
+	}
+	for _, seg := range ssm.segments {
+		if err := seg.Close(); err != nil {
+			return err
+		}
+	}
+	ssm.segments = nil
+	return nil
+}
+
+// Append a record to the active segment (starting a new one if needed), return its location.
+// A tombstone record has no value, and marks its key as deleted.
+// Caller must hold the write lock.
+func (ssm *SegSyncMap[K, V]) appendRecord(
+	key []byte, val []byte, tombstone bool,
+) (recordLoc, error) {
+	recordSize := int64(headerSize + len(key) + len(val))
+	if len(ssm.segments) == 0 ||
+		(ssm.activeSize > 0 && ssm.activeSize+recordSize > ssm.maxSegmentSize) {
+		if err := ssm.startSegment(); err != nil {
+			return recordLoc{}, err
+		}
+	}
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(key)))
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(val)))
+	if tombstone {
+		binary.BigEndian.PutUint32(record[4:8], tombstoneLen)
+	}
+	copy(record[headerSize:], key)
+	copy(record[headerSize+len(key):], val)
+	binary.BigEndian.PutUint32(record[8:12], crc32.ChecksumIEEE(record[headerSize:]))
+	active := len(ssm.segments) - 1
+	if _, err := ssm.segments[active].WriteAt(record, ssm.activeSize); err != nil {
+		return recordLoc{}, err
+	}
+	loc := recordLoc{
+		segment: active,
+		offset:  ssm.activeSize + int64(headerSize+len(key)),
+		length:  uint32(len(val)),
+	}
+	ssm.activeSize += recordSize
+	return loc, nil
+}
+
+// Sync the current active segment, then open a new empty one.
+// Caller must hold the write lock.
+func (ssm *SegSyncMap[K, V]) startSegment() error {
+	if err := ssm.syncActive(); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(
+		ssm.segmentPath(len(ssm.segments)), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666,
+	)
+	if err != nil {
+		return err
+	}
+	ssm.segments = append(ssm.segments, f)
+	ssm.activeSize = 0
+	return nil
+}
+
+// Fsync the active segment if it has unsynced records.
+// Caller must hold the write lock.
+func (ssm *SegSyncMap[K, V]) syncActive() error {
+	if ssm.unsynced == 0 || len(ssm.segments) == 0 {
+		return nil
+	}
+	if err := ssm.segments[len(ssm.segments)-1].Sync(); err != nil {
+		return err
+	}
+	ssm.unsynced = 0
+	return nil
+}
+
+// Open each existing segment in order and index its records.
+// A partially written or corrupt record at the end of the last segment is truncated away.
+func (ssm *SegSyncMap[K, V]) loadSegments() error {
+	paths, err := filepath.Glob(filepath.Join(ssm.basePath, "seg-*.dat"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	for i, path := range paths {
+		if path != ssm.segmentPath(i) {
+			return fmt.Errorf("missing segment before %s", path)
+		}
+		f, err := os.OpenFile(path, os.O_RDWR, 0666)
+		if err != nil {
+			return err
+		}
+		ssm.segments = append(ssm.segments, f)
+		size, err := ssm.indexSegment(i)
+		if err != nil {
+			return fmt.Errorf("failed to index %s: %s", path, err)
+		}
+		ssm.activeSize = size
+	}
+	if len(ssm.segments) > 0 {
+		if err := ssm.segments[len(ssm.segments)-1].Truncate(ssm.activeSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Index every intact record in the given segment, return the end offset of the last one.
+// Anything after the first torn or corrupt record is copied to the quarantine dir.
+func (ssm *SegSyncMap[K, V]) indexSegment(segment int) (int64, error) {
+	f := ssm.segments[segment]
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	fileSize := stat.Size()
+	r := bufio.NewReader(io.NewSectionReader(f, 0, fileSize))
+	header := make([]byte, headerSize)
+	offset := int64(0)
+	for offset < fileSize {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		keyLen := int64(binary.BigEndian.Uint32(header[0:4]))
+		valLen := binary.BigEndian.Uint32(header[4:8])
+		bodyLen := keyLen + int64(valLen)
+		if valLen == tombstoneLen {
+			bodyLen = keyLen
+		}
+		end := offset + headerSize + bodyLen
+		if end > fileSize {
+			break
+		}
+		body := make([]byte, bodyLen)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return 0, err
+		}
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[8:12]) {
+			break
+		}
+		if valLen == tombstoneLen {
+			delete(ssm.index, string(body))
+		} else {
+			ssm.index[string(body[:keyLen])] = recordLoc{
+				segment: segment,
+				offset:  offset + headerSize + keyLen,
+				length:  valLen,
+			}
+		}
+		offset = end
+	}
+	if offset < fileSize {
+		if err := ssm.quarantineTail(segment, offset, fileSize); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// Copy the bytes of a segment from the given offset to the quarantine dir.
+func (ssm *SegSyncMap[K, V]) quarantineTail(segment int, offset int64, fileSize int64) error {
+	quarantineDir := ssm.basePath + ".quarantine"
+	if err := os.MkdirAll(quarantineDir, 0750); err != nil {
+		return err
+	}
+	tail := make([]byte, fileSize-offset)
+	if _, err := ssm.segments[segment].ReadAt(tail, offset); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("seg-%06d-%d.dat", segment, offset)
+	if err := os.WriteFile(filepath.Join(quarantineDir, name), tail, 0666); err != nil {
+		return err
+	}
+	fmt.Printf("quarantined %d corrupt bytes from %s\n", len(tail), ssm.segmentPath(segment))
+	ssm.quarantined = append(ssm.quarantined, name)
+	return nil
+}
+
+// Get the names of anything quarantined when loading the segments.
+// Corrupt records are detected and quarantined on open, so this does no further work.
+func (ssm *SegSyncMap[K, V]) Recover() ([]string, error) {
+	return ssm.quarantined, nil
+}
+
+func (ssm *SegSyncMap[K, V]) segmentPath(segment int) string {
+	return filepath.Join(ssm.basePath, fmt.Sprintf("seg-%06d.dat", segment))
+}
@@ -0,0 +1,80 @@
+package segsyncmap_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/levilutz/basiccoin/pkg/segsyncmap"
+	"github.com/levilutz/basiccoin/pkg/util"
+)
+
+type strKey string
+
+func (k strKey) String() string { return string(k) }
+
+type strVal string
+
+func (v strVal) String() string { return string(v) }
+
+func parseStrVal(raw string) (strVal, error) { return strVal(raw), nil }
+
+// Test storing across several segments, reloading, and recovering a torn final record.
+func TestSegSyncMapReload(t *testing.T) {
+	dir := t.TempDir()
+	ssm := NewSegSyncMap[strKey, strVal](dir, parseStrVal)
+	ssm.SetLimits(64, 3)
+	for i := 0; i < 20; i++ {
+		ssm.Store(strKey(fmt.Sprint("key", i)), strVal(fmt.Sprint("value", i)))
+	}
+	ssm.Store("key3", "ignored")
+	util.Assert(t, ssm.Get("key3") == "value3", "existing key overwritten")
+	util.AssertNoErr(t, ssm.Close())
+	segs, err := filepath.Glob(filepath.Join(dir, "seg-*.dat"))
+	util.AssertNoErr(t, err)
+	util.Assert(t, len(segs) > 1, "expected multiple segments, got %d", len(segs))
+
+	// Simulate a crash mid-append
+	last := segs[len(segs)-1]
+	f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0666)
+	util.AssertNoErr(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 4, 0, 0, 0, 9, 'k'})
+	util.AssertNoErr(t, err)
+	util.AssertNoErr(t, f.Close())
+
+	ssm = NewSegSyncMap[strKey, strVal](dir, parseStrVal)
+	for i := 0; i < 20; i++ {
+		key := strKey(fmt.Sprint("key", i))
+		util.Assert(t, ssm.Has(key), "missing %s", key)
+		util.Assert(t, ssm.Get(key) == strVal(fmt.Sprint("value", i)), "wrong %s", key)
+	}
+	util.Assert(t, !ssm.Has("k"), "torn record indexed")
+	ssm.Store("new", "after recovery")
+	util.AssertNoErr(t, ssm.Close())
+	ssm = NewSegSyncMap[strKey, strVal](dir, parseStrVal)
+	util.Assert(t, ssm.Get("new") == "after recovery", "record after recovery lost")
+	util.Assert(t, ssm.Get("key19") == "value19", "record before recovery lost")
+}
+
+// Test deleted keys stay deleted across a reload, and can be stored again.
+func TestSegSyncMapDelete(t *testing.T) {
+	dir := t.TempDir()
+	ssm := NewSegSyncMap[strKey, strVal](dir, parseStrVal)
+	ssm.Store("a", "1")
+	ssm.Store("b", "2")
+	ssm.Store("c", "3")
+	ssm.Delete("b")
+	ssm.Delete("missing")
+	util.Assert(t, !ssm.Has("b"), "deleted key still present")
+	ssm.Store("c2", "4")
+	ssm.Delete("c")
+	ssm.Store("c", "5")
+	util.AssertNoErr(t, ssm.Close())
+
+	ssm = NewSegSyncMap[strKey, strVal](dir, parseStrVal)
+	util.Assert(t, ssm.Get("a") == "1", "kept key lost")
+	util.Assert(t, !ssm.Has("b"), "deleted key restored on reload")
+	util.Assert(t, ssm.Get("c") == "5", "re-stored key wrong: %s", ssm.Get("c"))
+	util.Assert(t, ssm.Get("c2") == "4", "key after tombstone lost")
+}
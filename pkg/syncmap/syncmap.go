@@ -6,7 +6,6 @@ import (
 )
 
 // Generic allowing better type checking of sync.Map.
-// This map intentionally does not support deletions.
 type SyncMap[K comparable, V any] struct {
 	m sync.Map
 }
@@ -35,3 +34,8 @@ func (sm *SyncMap[K, V]) Get(key K) V {
 func (sm *SyncMap[K, V]) Store(key K, value V) {
 	sm.m.Store(key, value)
 }
+
+// Delete the given key from the map, if it exists.
+func (sm *SyncMap[K, V]) Delete(key K) {
+	sm.m.Delete(key)
+}
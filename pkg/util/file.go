@@ -0,0 +1,80 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Prefix of temp files written by WriteFileAtomic, which may be left behind by a crash.
+const TempFilePrefix = ".tmp-"
+
+// Write a file such that a crash leaves either the old or the new contents, never a mix.
+// Data is written to a temp file in the same dir, synced, then renamed over the target.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := writeFileRenamed(path, data, perm, true); err != nil {
+		return err
+	}
+	// Sync the dir so the rename itself is durable, where dirs can be synced
+	SyncPaths([]string{filepath.Dir(path)})
+	return nil
+}
+
+// Write a file via a temp file renamed over the target like WriteFileAtomic, but without
+// syncing, so many can be written then synced together by SyncPaths. Until then a crash may
+// leave the target missing, empty or truncated, so its contents must be checksummed.
+func WriteFileRenamed(path string, data []byte, perm os.FileMode) error {
+	return writeFileRenamed(path, data, perm, false)
+}
+
+// Fsync the given files or dirs, skipping any that no longer exist.
+func SyncPaths(paths []string) error {
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write data to a temp file beside path, optionally syncing it, then rename it over path.
+func writeFileRenamed(path string, data []byte, perm os.FileMode, sync bool) error {
+	f, err := os.CreateTemp(filepath.Dir(path), TempFilePrefix+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}